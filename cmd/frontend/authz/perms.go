@@ -96,6 +96,15 @@ type UserPermissions struct {
 	Type      PermType
 	IDs       *roaring.Bitmap
 	UpdatedAt time.Time
+	Metadata  *SyncMetadata // Optional, describes the sync that wrote these permissions.
+}
+
+// SyncMetadata describes the sync that wrote a set of permissions, so that slow syncs
+// can be correlated with the jobs and providers that performed them.
+type SyncMetadata struct {
+	Job           string        `json:"job,omitempty"`           // Name of the syncer job.
+	Provider      string        `json:"provider,omitempty"`      // ID of the authz provider fetched from.
+	FetchDuration time.Duration `json:"fetchDuration,omitempty"` // Time taken to fetch from the provider.
 }
 
 // Expired returns true if these UserPermissions have elapsed the given ttl.
@@ -136,6 +145,14 @@ func (p *UserPermissions) TracingFields() []otlog.Field {
 		)
 	}
 
+	if p.Metadata != nil {
+		fs = append(fs,
+			otlog.String("UserPermissions.Metadata.Job", p.Metadata.Job),
+			otlog.String("UserPermissions.Metadata.Provider", p.Metadata.Provider),
+			otlog.String("UserPermissions.Metadata.FetchDuration", p.Metadata.FetchDuration.String()),
+		)
+	}
+
 	return fs
 }
 
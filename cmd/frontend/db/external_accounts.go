@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"sync"
 
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/keegancsmith/sqlf"
@@ -30,6 +31,31 @@ func (err userExternalAccountNotFoundError) NotFound() bool {
 // userExternalAccounts provides access to the `user_external_accounts` table.
 type userExternalAccounts struct{}
 
+// externalAccountAssociatedHooks are the functions registered by OnExternalAccountAssociated.
+var externalAccountAssociatedHooks struct {
+	sync.RWMutex
+	fns []func(userID int32, spec extsvc.ExternalAccountSpec)
+}
+
+// OnExternalAccountAssociated registers fn to be called whenever a new external account has been
+// associated with a user by AssociateUserAndSave or CreateUserAndSave, after the change is
+// committed. It is meant to invalidate caches of the users of external accounts, and is only called
+// for changes made by the current process.
+func OnExternalAccountAssociated(fn func(userID int32, spec extsvc.ExternalAccountSpec)) {
+	externalAccountAssociatedHooks.Lock()
+	defer externalAccountAssociatedHooks.Unlock()
+	externalAccountAssociatedHooks.fns = append(externalAccountAssociatedHooks.fns, fn)
+}
+
+// externalAccountAssociated calls the functions registered by OnExternalAccountAssociated.
+func externalAccountAssociated(userID int32, spec extsvc.ExternalAccountSpec) {
+	externalAccountAssociatedHooks.RLock()
+	defer externalAccountAssociatedHooks.RUnlock()
+	for _, fn := range externalAccountAssociatedHooks.fns {
+		fn(userID, spec)
+	}
+}
+
 // Get gets information about the user external account.
 func (s *userExternalAccounts) Get(ctx context.Context, id int32) (*extsvc.ExternalAccount, error) {
 	if Mocks.ExternalAccounts.Get != nil {
@@ -79,6 +105,7 @@ func (s *userExternalAccounts) AssociateUserAndSave(ctx context.Context, userID
 	if err != nil {
 		return err
 	}
+	var inserted bool
 	defer func() {
 		if err != nil {
 			rollErr := tx.Rollback()
@@ -88,6 +115,9 @@ func (s *userExternalAccounts) AssociateUserAndSave(ctx context.Context, userID
 			return
 		}
 		err = tx.Commit()
+		if err == nil && inserted {
+			externalAccountAssociated(userID, spec)
+		}
 	}()
 
 	// Find whether the account exists and, if so, which user ID the account is associated with.
@@ -110,6 +140,7 @@ WHERE service_type=$1 AND service_id=$2 AND client_id=$3 AND account_id=$4 AND d
 
 	if !exists {
 		// Create the external account (it doesn't yet exist).
+		inserted = true
 		return s.insert(ctx, tx, userID, spec, data)
 	}
 
@@ -155,6 +186,9 @@ func (s *userExternalAccounts) CreateUserAndSave(ctx context.Context, newUser Ne
 			return
 		}
 		err = tx.Commit()
+		if err == nil {
+			externalAccountAssociated(createdUserID, spec)
+		}
 	}()
 
 	createdUser, err := Users.create(ctx, tx, newUser)
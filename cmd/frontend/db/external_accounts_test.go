@@ -115,6 +115,45 @@ func TestExternalAccounts_CreateUserAndSave(t *testing.T) {
 	}
 }
 
+func TestExternalAccounts_OnExternalAccountAssociated(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+	dbtesting.SetupGlobalTestDB(t)
+	ctx := context.Background()
+
+	var associated []extsvc.ExternalAccountSpec
+	OnExternalAccountAssociated(func(userID int32, spec extsvc.ExternalAccountSpec) {
+		associated = append(associated, spec)
+	})
+
+	spec := extsvc.ExternalAccountSpec{
+		ServiceType: "xa",
+		ServiceID:   "xb",
+		ClientID:    "xc",
+		AccountID:   "xd",
+	}
+	userID, err := ExternalAccounts.CreateUserAndSave(ctx, NewUser{Username: "u"}, spec, extsvc.ExternalAccountData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Saving an account that is already associated is not a new association.
+	if err := ExternalAccounts.AssociateUserAndSave(ctx, userID, spec, extsvc.ExternalAccountData{}); err != nil {
+		t.Fatal(err)
+	}
+
+	spec2 := spec
+	spec2.AccountID = "xe"
+	if err := ExternalAccounts.AssociateUserAndSave(ctx, userID, spec2, extsvc.ExternalAccountData{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []extsvc.ExternalAccountSpec{spec, spec2}; !reflect.DeepEqual(associated, want) {
+		t.Errorf("got %+v, want %+v", associated, want)
+	}
+}
+
 func simplifyExternalAccount(account *extsvc.ExternalAccount) {
 	account.CreatedAt = time.Time{}
 	account.UpdatedAt = time.Time{}
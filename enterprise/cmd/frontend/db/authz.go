@@ -135,7 +135,7 @@ func (s *authzStore) RevokeUserPermissions(ctx context.Context, args *db.RevokeU
 		ServiceID:   args.ServiceID,
 		AccountIDs:  append([]string{args.Username}, args.VerifiedEmails...),
 	}
-	if err := txs.DeleteAllUserPendingPermissions(ctx, accounts); err != nil {
+	if _, err := txs.DeleteAllUserPendingPermissions(ctx, accounts); err != nil {
 		return err
 	}
 	return nil
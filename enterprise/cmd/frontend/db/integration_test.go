@@ -24,19 +24,62 @@ func TestIntegration_PermsStore(t *testing.T) {
 		test func(*testing.T)
 	}{
 		{"PermsStore/LoadUserPermissions", testPermsStore_LoadUserPermissions(db)},
+		{"PermsStore/LoadUserPermissionsFiltered", testPermsStore_LoadUserPermissionsFiltered(db)},
+		{"PermsStore/LoadUserPermissionsWithRepos", testPermsStore_LoadUserPermissionsWithRepos(db)},
+		{"PermsStore/UserPermissionsMetadata", testPermsStore_UserPermissionsMetadata(db)},
 		{"PermsStore/LoadRepoPermissions", testPermsStore_LoadRepoPermissions(db)},
+		{"PermsStore/LoadRepoPermissionsWithReplica", testPermsStore_LoadRepoPermissionsWithReplica(db)},
+		{"PermsStore/LoadRepoPermissionsWithAddedAt", testPermsStore_LoadRepoPermissionsWithAddedAt(db)},
+		{"PermsStore/LoadRepoPermissionsWithPendingCount", testPermsStore_LoadRepoPermissionsWithPendingCount(db)},
+		{"PermsStore/LoadRepoPermissionsWithPending", testPermsStore_LoadRepoPermissionsWithPending(db)},
+		{"PermsStore/QueriesUseIndexes", testPermsStore_QueriesUseIndexes(db)},
+		{"PermsStore/UserPermissionsExist", testPermsStore_UserPermissionsExist(db)},
+		{"PermsStore/UserHasAnyPermission", testPermsStore_UserHasAnyPermission(db)},
+		{"PermsStore/BatchTouchUserPermissions", testPermsStore_BatchTouchUserPermissions(db)},
 		{"PermsStore/SetUserPermissions", testPermsStore_SetUserPermissions(db)},
+		{"PermsStore/SetUserPermissionsWithExpiry", testPermsStore_SetUserPermissionsWithExpiry(db)},
+		{"PermsStore/SetUserPermissionsWithStrategy", testPermsStore_SetUserPermissionsWithStrategy(db)},
+		{"PermsStore/SetUserPermissionsBatch", testPermsStore_SetUserPermissionsBatch(db)},
 		{"PermsStore/SetRepoPermissions", testPermsStore_SetRepoPermissions(db)},
+		{"PermsStore/SetRepoPermissionsWithSequence", testPermsStore_SetRepoPermissionsWithSequence(db)},
+		{"PermsStore/SetPermissionsOutOfRange", testPermsStore_SetPermissionsOutOfRange(db)},
+		{"PermsStore/SetRepoPermissionsInBatches", testPermsStore_SetRepoPermissionsInBatches(db)},
+		{"PermsStore/RepoPermissionsQueue", testPermsStore_RepoPermissionsQueue(db)},
+		{"PermsStore/SetRepoPermissionsByProvider", testPermsStore_SetRepoPermissionsByProvider(db)},
+		{"PermsStore/SetRepoPermissionsCanonicalBlobs", testPermsStore_SetRepoPermissionsCanonicalBlobs(db)},
+		{"PermsStore/WithClock", testPermsStore_WithClock(db)},
+		{"PermsStore/WithNotifications", testPermsStore_WithNotifications(db)},
+		{"PermsStore/WithRepoPermsDispatcher", testPermsStore_WithRepoPermsDispatcher(db)},
+		{"PermsStore/WithRemovalGuard", testPermsStore_WithRemovalGuard(db)},
+		{"PermsStore/WithGrantGuard", testPermsStore_WithGrantGuard(db)},
+		{"PermsStore/RepoPermsFanoutMetrics", testPermsStore_RepoPermsFanoutMetrics(db)},
+		{"PermsStore/RepoPermissionsDiff", testPermsStore_RepoPermissionsDiff(db)},
+		{"PermsStore/LoadUserPermissionsHistory", testPermsStore_LoadUserPermissionsHistory(db)},
 		{"PermsStore/LoadUserPendingPermissions", testPermsStore_LoadUserPendingPermissions(db)},
+		{"PermsStore/LoadUserPendingPermissionsBatch", testPermsStore_LoadUserPendingPermissionsBatch(db)},
 		{"PermsStore/SetRepoPendingPermissions", testPermsStore_SetRepoPendingPermissions(db)},
 		{"PermsStore/ListPendingUsers", testPermsStore_ListPendingUsers(db)},
+		{"PermsStore/CountPendingUsers", testPermsStore_CountPendingUsers(db)},
 		{"PermsStore/GrantPendingPermissions", testPermsStore_GrantPendingPermissions(db)},
+		{"PermsStore/GrantResolvedPendingPermissions", testPermsStore_GrantResolvedPendingPermissions(db)},
+		{"PermsStore/ReconcilePendingForNewUser", testPermsStore_ReconcilePendingForNewUser(db)},
 		{"PermsStore/DeleteAllUserPermissions", testPermsStore_DeleteAllUserPermissions(db)},
+		{"PermsStore/DeleteAllUserPermissionsBatch", testPermsStore_DeleteAllUserPermissionsBatch(db)},
 		{"PermsStore/DeleteAllUserPendingPermissions", testPermsStore_DeleteAllUserPendingPermissions(db)},
+		{"PermsStore/DeleteAllUserPermissionsAndPending", testPermsStore_DeleteAllUserPermissionsAndPending(db)},
+		{"PermsStore/ExportPermissions", testPermsStore_ExportPermissions(db)},
+		{"PermsStore/ImportPermissions", testPermsStore_ImportPermissions(db)},
+		{"PermsStore/ImportRepoPermissions", testPermsStore_ImportRepoPermissions(db)},
 		{"PermsStore/DatabaseDeadlocks", testPermsStore_DatabaseDeadlocks(db)},
+		{"PermsStore/SetRepoPendingPermissionsSharedBindID", testPermsStore_SetRepoPendingPermissionsSharedBindID(db)},
 
 		{"PermsStore/ListExternalAccounts", testPermsStore_ListExternalAccounts(db)},
 		{"PermsStore/GetUserIDsByExternalAccounts", testPermsStore_GetUserIDsByExternalAccounts(db)},
+		{"PermsStore/GetExternalAccountsByAccountIDs", testPermsStore_GetExternalAccountsByAccountIDs(db)},
+		{"PermsStore/GetUserIDsByExternalAccountsCache", testPermsStore_GetUserIDsByExternalAccountsCache(db)},
+		{"PermsStore/GetUserIDsByExternalAccountsSourcegraph", testPermsStore_GetUserIDsByExternalAccountsSourcegraph(db)},
+		{"PermsStore/GetUserIDsByExternalAccountsBatch", testPermsStore_GetUserIDsByExternalAccountsBatch(db)},
+		{"PermsStore/PruneOrphanExternalAccounts", testPermsStore_PruneOrphanExternalAccounts(db)},
 	} {
 		t.Run(tc.name, tc.test)
 	}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/db"
+	"github.com/sourcegraph/sourcegraph/internal/extsvc"
+)
+
+// WithExternalAccountsCache returns a copy of the PermsStore that caches the user IDs resolved by
+// GetUserIDsByExternalAccounts for up to ttl, keeping at most size external accounts. This avoids
+// resolving the same external accounts over and over, e.g. during a large sync. Only resolved
+// accounts are cached, so that an account associated with a user after a miss is resolved by the
+// next call, and bind IDs of the "sourcegraph" service are never cached.
+//
+// A cached account is invalidated when a new external account with the same key is associated with
+// a user by this process (see db.OnExternalAccountAssociated), and PruneOrphanExternalAccounts
+// empties the cache when it deletes any account. Other changes, e.g. by other processes, are only
+// observed once the entry expires. The cache is shared by all copies of the returned PermsStore,
+// including transactions. A size less than 1 is treated as 1, because the cache must be bounded.
+//
+// Every call registers a new cache to be invalidated, thus it should only be called on startup.
+func (s *PermsStore) WithExternalAccountsCache(size int, ttl time.Duration) *PermsStore {
+	if size < 1 {
+		size = 1
+	}
+	c := s.clone()
+	c.accounts = &externalAccountsCache{
+		ttl:   ttl,
+		cache: lru.New(size),
+	}
+	db.OnExternalAccountAssociated(c.accounts.associated)
+	return c
+}
+
+// externalAccountsCache is a size-bounded cache of user IDs by external account, with expiring
+// entries. It is safe for concurrent use.
+type externalAccountsCache struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	cache *lru.Cache // ExternalAccountKey -> cachedUserID
+}
+
+type cachedUserID struct {
+	userID    int32
+	expiresAt time.Time
+}
+
+// get returns the cached user ID of the external account, unless it is absent or expired at now.
+func (c *externalAccountsCache) get(key ExternalAccountKey, now time.Time) (int32, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.cache.Get(key)
+	if !ok {
+		return 0, false
+	}
+	entry := v.(cachedUserID)
+	if !now.Before(entry.expiresAt) {
+		c.cache.Remove(key)
+		return 0, false
+	}
+	return entry.userID, true
+}
+
+// add caches the user ID of the external account as of now, evicting the least recently used
+// account if the cache is full.
+func (c *externalAccountsCache) add(key ExternalAccountKey, userID int32, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cache.Add(key, cachedUserID{userID: userID, expiresAt: now.Add(c.ttl)})
+}
+
+// associated invalidates the cached user ID of the external account of spec, which has just been
+// associated with a user.
+func (c *externalAccountsCache) associated(_ int32, spec extsvc.ExternalAccountSpec) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cache.Remove(ExternalAccountKey{ServiceType: spec.ServiceType, ServiceID: spec.ServiceID, AccountID: spec.AccountID})
+}
+
+// purge removes all cached external accounts.
+func (c *externalAccountsCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cache.Clear()
+}
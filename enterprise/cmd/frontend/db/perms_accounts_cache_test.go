@@ -0,0 +1,274 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/keegancsmith/sqlf"
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/internal/db/dbutil"
+	"github.com/sourcegraph/sourcegraph/internal/extsvc"
+)
+
+// countingDB is a dbutil.DB that counts the queries it runs.
+type countingDB struct {
+	dbutil.DB
+	count int32
+}
+
+func (db *countingDB) QueryContext(ctx context.Context, q string, args ...interface{}) (*sql.Rows, error) {
+	atomic.AddInt32(&db.count, 1)
+	return db.DB.QueryContext(ctx, q, args...)
+}
+
+func (db *countingDB) queries() int {
+	return int(atomic.LoadInt32(&db.count))
+}
+
+func TestExternalAccountsCache(t *testing.T) {
+	now := time.Unix(1577836800, 0)
+	c := (&PermsStore{}).WithExternalAccountsCache(2, time.Minute).accounts
+
+	key := func(accountID string) ExternalAccountKey {
+		return ExternalAccountKey{ServiceType: "gitlab", ServiceID: "https://gitlab.com/", AccountID: accountID}
+	}
+	get := func(accountID string, now time.Time) int32 {
+		userID, ok := c.get(key(accountID), now)
+		if !ok {
+			return -1
+		}
+		return userID
+	}
+
+	c.add(key("alice"), 1, now)
+	c.add(key("bob"), 2, now)
+	equal(t, "alice", int32(1), get("alice", now))
+	equal(t, "bob", int32(2), get("bob", now.Add(59*time.Second)))
+
+	// Entries expire after the TTL.
+	equal(t, "expired alice", int32(-1), get("alice", now.Add(time.Minute)))
+
+	// The least recently used entry is evicted when the cache is full.
+	c.add(key("alice"), 1, now)
+	c.add(key("cindy"), 3, now)
+	equal(t, "evicted bob", int32(-1), get("bob", now))
+	equal(t, "alice", int32(1), get("alice", now))
+	equal(t, "cindy", int32(3), get("cindy", now))
+
+	// Keys of other code hosts are distinct.
+	_, ok := c.get(ExternalAccountKey{ServiceType: "github", ServiceID: "https://github.com/", AccountID: "alice"}, now)
+	equal(t, "github alice", false, ok)
+
+	// Associating an account invalidates it.
+	c.associated(3, extsvc.ExternalAccountSpec{ServiceType: "gitlab", ServiceID: "https://gitlab.com/", AccountID: "cindy"})
+	equal(t, "associated cindy", int32(-1), get("cindy", now))
+	equal(t, "alice", int32(1), get("alice", now))
+
+	c.purge()
+	equal(t, "purged alice", int32(-1), get("alice", now))
+}
+
+// fakeAccountsConnector is a driver.Connector of a fake database whose only table is the external
+// accounts in userIDs (account ID -> user ID). Every query is taken as the query of
+// GetUserIDsByExternalAccounts, whose arguments after the service type and ID are account IDs.
+type fakeAccountsConnector struct {
+	userIDs map[string]int32
+}
+
+func (c *fakeAccountsConnector) Connect(context.Context) (driver.Conn, error) {
+	return c, nil
+}
+
+func (c *fakeAccountsConnector) Driver() driver.Driver {
+	return nil
+}
+
+func (c *fakeAccountsConnector) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *fakeAccountsConnector) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *fakeAccountsConnector) Close() error {
+	return nil
+}
+
+func (c *fakeAccountsConnector) QueryContext(_ context.Context, _ string, args []driver.NamedValue) (driver.Rows, error) {
+	rows := &fakeAccountsRows{}
+	for _, arg := range args[2:] {
+		accountID := arg.Value.(string)
+		if userID, ok := c.userIDs[accountID]; ok {
+			rows.values = append(rows.values, []driver.Value{int64(userID), accountID})
+		}
+	}
+	return rows, nil
+}
+
+// fakeAccountsRows are the user_id and account_id columns of the rows of a fakeAccountsConnector.
+type fakeAccountsRows struct {
+	values [][]driver.Value
+}
+
+func (r *fakeAccountsRows) Columns() []string {
+	return []string{"user_id", "account_id"}
+}
+
+func (r *fakeAccountsRows) Close() error {
+	return nil
+}
+
+func (r *fakeAccountsRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func TestPermsStore_GetUserIDsByExternalAccountsCache(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeAccountsConnector{userIDs: map[string]int32{"alice_gitlab": 1, "bob_gitlab": 2}}
+	db := sql.OpenDB(fake)
+	defer db.Close()
+
+	tc := NewTestClock(clock())
+	counter := &countingDB{DB: db}
+	s := NewPermsStore(counter, clock).WithClock(tc).WithExternalAccountsCache(10, time.Minute)
+
+	resolve := func(t *testing.T, accountIDs ...string) map[string]int32 {
+		t.Helper()
+		userIDs, err := s.GetUserIDsByExternalAccounts(ctx, &extsvc.ExternalAccounts{
+			ServiceType: "gitlab",
+			ServiceID:   "https://gitlab.com/",
+			AccountIDs:  accountIDs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return userIDs
+	}
+
+	equal(t, "userIDs", map[string]int32{"alice_gitlab": 1}, resolve(t, "alice_gitlab"))
+	equal(t, "queries", 1, counter.queries())
+
+	// A cache hit skips the second query.
+	equal(t, "userIDs", map[string]int32{"alice_gitlab": 1}, resolve(t, "alice_gitlab"))
+	equal(t, "queries", 1, counter.queries())
+
+	// Only missing accounts are queried.
+	equal(t, "userIDs", map[string]int32{"alice_gitlab": 1, "bob_gitlab": 2}, resolve(t, "alice_gitlab", "bob_gitlab"))
+	equal(t, "queries", 2, counter.queries())
+
+	// An account associated with another user is queried again.
+	fake.userIDs["bob_gitlab"] = 3
+	s.accounts.associated(3, extsvc.ExternalAccountSpec{ServiceType: "gitlab", ServiceID: "https://gitlab.com/", AccountID: "bob_gitlab"})
+	equal(t, "userIDs", map[string]int32{"alice_gitlab": 1, "bob_gitlab": 3}, resolve(t, "alice_gitlab", "bob_gitlab"))
+	equal(t, "queries", 3, counter.queries())
+
+	// Expired accounts are queried again.
+	tc.Advance(time.Minute)
+	equal(t, "userIDs", map[string]int32{"alice_gitlab": 1}, resolve(t, "alice_gitlab"))
+	equal(t, "queries", 4, counter.queries())
+}
+
+func testPermsStore_GetUserIDsByExternalAccountsCache(db *sql.DB) func(t *testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+		tc := NewTestClock(clock())
+		counter := &countingDB{DB: db}
+		s := NewPermsStore(counter, clock).WithClock(tc).WithExternalAccountsCache(10, time.Minute)
+		defer cleanupUsersTable(t, NewPermsStore(db, clock))
+
+		extSQL := `
+INSERT INTO user_external_accounts(user_id, service_type, service_id, account_id, client_id, created_at, updated_at)
+	VALUES(%s, %s, %s, %s, %s, %s, %s)
+`
+		exec := func(t *testing.T, qs ...*sqlf.Query) {
+			t.Helper()
+			for _, q := range qs {
+				if _, err := db.ExecContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		exec(t,
+			sqlf.Sprintf(`INSERT INTO users(username) VALUES('alice')`), // ID=1
+			sqlf.Sprintf(`INSERT INTO users(username) VALUES('bob')`),   // ID=2
+			sqlf.Sprintf(extSQL, 1, "gitlab", "https://gitlab.com/", "alice_gitlab", "alice_gitlab_client_id", clock(), clock()),
+			sqlf.Sprintf(extSQL, 2, "gitlab", "https://gitlab.com/", "bob_gitlab", "bob_gitlab_client_id", clock(), clock()),
+		)
+
+		resolve := func(t *testing.T, accountIDs ...string) map[string]int32 {
+			t.Helper()
+			userIDs, err := s.GetUserIDsByExternalAccounts(ctx, &extsvc.ExternalAccounts{
+				ServiceType: "gitlab",
+				ServiceID:   "https://gitlab.com/",
+				AccountIDs:  accountIDs,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return userIDs
+		}
+
+		equal(t, "userIDs", map[string]int32{"alice_gitlab": 1}, resolve(t, "alice_gitlab"))
+		equal(t, "queries", 1, counter.queries())
+
+		// A cache hit avoids a second query.
+		equal(t, "userIDs", map[string]int32{"alice_gitlab": 1}, resolve(t, "alice_gitlab"))
+		equal(t, "queries", 1, counter.queries())
+
+		// Only missing accounts are queried, and unresolved accounts are not cached.
+		equal(t, "userIDs", map[string]int32{"alice_gitlab": 1, "bob_gitlab": 2}, resolve(t, "alice_gitlab", "bob_gitlab", "cindy_gitlab"))
+		equal(t, "queries", 2, counter.queries())
+
+		// A new external account is resolved by the next call.
+		exec(t,
+			sqlf.Sprintf(`INSERT INTO users(username) VALUES('cindy')`), // ID=3
+			sqlf.Sprintf(extSQL, 3, "gitlab", "https://gitlab.com/", "cindy_gitlab", "cindy_gitlab_client_id", clock(), clock()),
+		)
+		equal(t, "userIDs", map[string]int32{"alice_gitlab": 1, "bob_gitlab": 2, "cindy_gitlab": 3}, resolve(t, "alice_gitlab", "bob_gitlab", "cindy_gitlab"))
+		equal(t, "queries", 3, counter.queries())
+		equal(t, "userIDs", map[string]int32{"cindy_gitlab": 3}, resolve(t, "cindy_gitlab"))
+		equal(t, "queries", 3, counter.queries())
+
+		// Expired accounts are queried again.
+		tc.Advance(time.Minute)
+		equal(t, "userIDs", map[string]int32{"alice_gitlab": 1}, resolve(t, "alice_gitlab"))
+		equal(t, "queries", 4, counter.queries())
+
+		// Pruning the account of a hard-deleted user empties the cache. The foreign key
+		// constraint on user_id is bypassed to delete the user.
+		equal(t, "userIDs", map[string]int32{"bob_gitlab": 2}, resolve(t, "bob_gitlab"))
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, q := range []string{`SET LOCAL session_replication_role = replica`, `DELETE FROM users WHERE id = 2`} {
+			if _, err = tx.ExecContext(ctx, q); err != nil {
+				_ = tx.Rollback()
+				t.Fatal(err)
+			}
+		}
+		if err = tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		count, err := s.PruneOrphanExternalAccounts(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "count", 1, count)
+
+		queries := counter.queries()
+		equal(t, "userIDs", map[string]int32{}, resolve(t, "bob_gitlab"))
+		equal(t, "queries", queries+1, counter.queries())
+	}
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/keegancsmith/sqlf"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+)
+
+// BatchMode defines how SetUserPermissionsBatch handles an entry that fails to be set.
+type BatchMode int
+
+const (
+	// BatchAllOrNothing aborts the batch at the first failed entry, and none of the entries are set.
+	BatchAllOrNothing BatchMode = iota
+	// BatchBestEffort sets all entries that don't fail, and reports failed entries with a *BatchError.
+	BatchBestEffort
+)
+
+// BatchError is returned by SetUserPermissionsBatch in BatchBestEffort mode when some of the
+// entries fail to be set.
+type BatchError struct {
+	Errors map[int]error // Index of the failed entry in the batch -> error
+}
+
+func (e *BatchError) Error() string {
+	indexes := make([]int, 0, len(e.Errors))
+	for i := range e.Errors {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	msgs := make([]string, len(indexes))
+	for i, idx := range indexes {
+		msgs[i] = fmt.Sprintf("entry %d: %v", idx, e.Errors[idx])
+	}
+	return fmt.Sprintf("%d entries failed to be set: %s", len(indexes), strings.Join(msgs, "; "))
+}
+
+// SetUserPermissionsBatch performs a full update for each entry of ps with the same semantics as
+// SetUserPermissions, within a single transaction.
+//
+// In BatchAllOrNothing mode, the first failed entry aborts the batch and its error is returned.
+// In BatchBestEffort mode, the changes of a failed entry are rolled back without affecting other
+// entries, the successful entries are committed, and a *BatchError is returned for the failed ones.
+//
+// This method starts its own transaction if the caller hasn't started one already. Note that a
+// caller that has started a transaction must not roll it back on *BatchError for the successful
+// entries to be committed.
+func (s *PermsStore) SetUserPermissionsBatch(ctx context.Context, ps []*authz.UserPermissions, mode BatchMode) (err error) {
+	ctx, save := s.observe(ctx, "SetUserPermissionsBatch", "")
+	defer func() { save(&err, otlog.Int("ps.count", len(ps)), otlog.Int("mode", int(mode))) }()
+
+	if s.inTx() {
+		return s.setUserPermissionsBatch(ctx, ps, mode)
+	}
+
+	txs, err := s.Transact(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = txs.setUserPermissionsBatch(ctx, ps, mode)
+	if _, ok := err.(*BatchError); ok {
+		// Commit the successful entries.
+		var txErr error
+		txs.Done(&txErr)
+		return err
+	}
+	txs.Done(&err)
+	return err
+}
+
+// setUserPermissionsBatch implements SetUserPermissionsBatch, it must be called within a transaction.
+func (s *PermsStore) setUserPermissionsBatch(ctx context.Context, ps []*authz.UserPermissions, mode BatchMode) error {
+	batchErr := &BatchError{Errors: make(map[int]error)}
+	for i, p := range ps {
+		if mode == BatchAllOrNothing {
+			if err := s.setUserPermissionsBatchEntry(ctx, p); err != nil {
+				return errors.Wrapf(err, "entry %d", i)
+			}
+			continue
+		}
+
+		if err := s.execute(ctx, sqlf.Sprintf("SAVEPOINT set_user_permissions_batch_entry")); err != nil {
+			return errors.Wrap(err, "create savepoint")
+		}
+		pending := len(s.pending)
+		if err := s.setUserPermissionsBatchEntry(ctx, p); err != nil {
+			batchErr.Errors[i] = err
+			// Changes of a rolled back entry must not be notified.
+			s.pending = s.pending[:pending]
+			if err = s.execute(ctx, sqlf.Sprintf("ROLLBACK TO SAVEPOINT set_user_permissions_batch_entry")); err != nil {
+				return errors.Wrap(err, "rollback to savepoint")
+			}
+			continue
+		}
+		if err := s.execute(ctx, sqlf.Sprintf("RELEASE SAVEPOINT set_user_permissions_batch_entry")); err != nil {
+			return errors.Wrap(err, "release savepoint")
+		}
+	}
+
+	if len(batchErr.Errors) > 0 {
+		return batchErr
+	}
+	return nil
+}
+
+// setUserPermissionsBatchEntry validates and sets a single entry of SetUserPermissionsBatch.
+func (s *PermsStore) setUserPermissionsBatchEntry(ctx context.Context, p *authz.UserPermissions) error {
+	_, hasExpiries, err := s.setUserPermissions(ctx, p)
+	if err != nil || !hasExpiries {
+		return err
+	}
+	return s.setUserPermissionsExpiries(ctx, p, nil)
+}
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+)
+
+func testPermsStore_SetUserPermissionsBatch(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+
+		newBatch := func() []*authz.UserPermissions {
+			return []*authz.UserPermissions{
+				{
+					UserID: 1,
+					Perm:   authz.Read,
+					Type:   authz.PermRepos,
+					IDs:    toBitmap(1, 2),
+				}, {
+					UserID: 2,
+					Perm:   authz.Read,
+					Type:   authz.PermRepos,
+					IDs:    toBitmap(1, math.MaxInt32+1),
+				}, {
+					UserID: 3,
+					Perm:   authz.Read,
+					Type:   authz.PermRepos,
+					IDs:    toBitmap(2),
+				},
+			}
+		}
+		check := func(t *testing.T, s *PermsStore, expectUserPerms, expectRepoPerms map[int32][]uint32) {
+			t.Helper()
+			err := checkRegularPermsTable(s, `SELECT user_id, object_ids FROM user_permissions`, expectUserPerms)
+			if err != nil {
+				t.Fatal("user_permissions:", err)
+			}
+			err = checkRegularPermsTable(s, `SELECT repo_id, user_ids FROM repo_permissions`, expectRepoPerms)
+			if err != nil {
+				t.Fatal("repo_permissions:", err)
+			}
+		}
+
+		t.Run("all or nothing", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupPermsTables(t, s)
+
+			err := s.SetUserPermissionsBatch(ctx, newBatch(), BatchAllOrNothing)
+			if err == nil {
+				t.Fatal("expected an error but got nil")
+			} else if _, ok := err.(*BatchError); ok {
+				t.Fatalf("expected a non-batch error but got %v", err)
+			}
+			check(t, s, map[int32][]uint32{}, map[int32][]uint32{})
+		})
+
+		t.Run("best effort", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupPermsTables(t, s)
+
+			err := s.SetUserPermissionsBatch(ctx, newBatch(), BatchBestEffort)
+			batchErr, ok := err.(*BatchError)
+			if !ok {
+				t.Fatalf("expected a *BatchError but got %v", err)
+			}
+			if len(batchErr.Errors) != 1 || batchErr.Errors[1] == nil {
+				t.Fatalf("expected entry 1 to fail but got %v", batchErr)
+			}
+			check(t, s,
+				map[int32][]uint32{1: {1, 2}, 3: {2}},
+				map[int32][]uint32{1: {1}, 2: {1, 3}},
+			)
+		})
+	}
+}
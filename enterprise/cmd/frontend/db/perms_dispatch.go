@@ -0,0 +1,57 @@
+package db
+
+import (
+	"github.com/RoaringBitmap/roaring"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// RepoPermsChange describes a change of the user IDs that have permissions to a repository.
+type RepoPermsChange struct {
+	RepoID  int32
+	Added   *roaring.Bitmap // User IDs that have been granted permissions to the repository.
+	Removed *roaring.Bitmap // User IDs that no longer have permissions to the repository.
+}
+
+// RepoPermsDispatcher receives changes of repository permissions from a PermsStore, e.g. to send
+// them to an external system as webhooks.
+type RepoPermsDispatcher interface {
+	// DispatchRepoPermsChange is called once for every change after the transaction that made it
+	// commits. It is called synchronously by the committing caller, so an implementation that
+	// talks to external systems should bound its own time or hand the change off.
+	DispatchRepoPermsChange(c RepoPermsChange) error
+}
+
+// WithRepoPermsDispatcher returns a copy of the PermsStore that passes a RepoPermsChange to d
+// whenever SetRepoPermissions or SetRepoPermissionsInBatches actually changes the permissions of
+// a repository. Changes are dispatched only after the transaction that made them commits, and
+// an error returned by d is logged without affecting the committed change.
+func (s *PermsStore) WithRepoPermsDispatcher(d RepoPermsDispatcher) *PermsStore {
+	c := s.clone()
+	c.dispatcher = d
+	return c
+}
+
+// recordRepoChange records a change of permissions of the repository to be dispatched when the
+// transaction of this PermsStore commits. Changes are not recorded when no dispatcher is set,
+// and empty changes are never recorded.
+func (s *PermsStore) recordRepoChange(repoID int32, added, removed *roaring.Bitmap) {
+	if s.dispatcher == nil || (added.IsEmpty() && removed.IsEmpty()) {
+		return
+	}
+
+	s.pendingRepos = append(s.pendingRepos, RepoPermsChange{
+		RepoID:  repoID,
+		Added:   added,
+		Removed: removed,
+	})
+}
+
+// dispatchRepoChanges dispatches all recorded changes, logging those that fail.
+func (s *PermsStore) dispatchRepoChanges() {
+	for _, c := range s.pendingRepos {
+		if err := s.dispatcher.DispatchRepoPermsChange(c); err != nil {
+			log15.Error("Failed to dispatch repo permissions change", "repoID", c.RepoID, "err", err)
+		}
+	}
+	s.pendingRepos = nil
+}
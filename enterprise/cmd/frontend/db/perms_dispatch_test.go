@@ -0,0 +1,99 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+)
+
+// fakeRepoPermsDispatcher records the changes it receives and fails with err.
+type fakeRepoPermsDispatcher struct {
+	changes []RepoPermsChange
+	err     error
+}
+
+func (d *fakeRepoPermsDispatcher) DispatchRepoPermsChange(c RepoPermsChange) error {
+	d.changes = append(d.changes, c)
+	return d.err
+}
+
+func testPermsStore_WithRepoPermsDispatcher(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+		d := &fakeRepoPermsDispatcher{}
+		s := NewPermsStore(db, clock).WithRepoPermsDispatcher(d)
+		defer cleanupPermsTables(t, s)
+
+		type change struct {
+			RepoID  int32
+			Added   []uint32
+			Removed []uint32
+		}
+		receive := func() []change {
+			var changes []change
+			for _, c := range d.changes {
+				changes = append(changes, change{
+					RepoID:  c.RepoID,
+					Added:   append([]uint32{}, bitmapToArray(c.Added)...),
+					Removed: append([]uint32{}, bitmapToArray(c.Removed)...),
+				})
+			}
+			d.changes = nil
+			return changes
+		}
+		setRepoPermissions := func(t *testing.T, s *PermsStore, ids ...uint32) {
+			t.Helper()
+			if err := s.SetRepoPermissions(ctx, &authz.RepoPermissions{
+				RepoID:  1,
+				Perm:    authz.Read,
+				UserIDs: toBitmap(ids...),
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		setRepoPermissions(t, s, 1, 2)
+		equal(t, "changes", []change{{RepoID: 1, Added: []uint32{1, 2}, Removed: []uint32{}}}, receive())
+
+		// Unchanged permissions are not dispatched.
+		setRepoPermissions(t, s, 1, 2)
+		equal(t, "changes", 0, len(receive()))
+
+		setRepoPermissions(t, s, 2, 3)
+		equal(t, "changes", []change{{RepoID: 1, Added: []uint32{3}, Removed: []uint32{1}}}, receive())
+
+		// Changes of a transaction are dispatched only after it commits.
+		txs, err := s.Transact(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setRepoPermissions(t, txs, 3, 4)
+		equal(t, "changes before commit", 0, len(receive()))
+		txs.Done(nil)
+		equal(t, "changes", []change{{RepoID: 1, Added: []uint32{4}, Removed: []uint32{2}}}, receive())
+
+		// Changes of a transaction that is rolled back are never dispatched.
+		txs, err = s.Transact(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setRepoPermissions(t, txs, 5)
+		rollback := errors.New("rollback")
+		txs.Done(&rollback)
+		equal(t, "changes", 0, len(receive()))
+
+		// A failing dispatcher does not affect the committed change.
+		d.err = errors.New("webhook unavailable")
+		setRepoPermissions(t, s, 4, 5)
+		equal(t, "changes", []change{{RepoID: 1, Added: []uint32{5}, Removed: []uint32{3}}}, receive())
+
+		p := &authz.RepoPermissions{RepoID: 1, Perm: authz.Read}
+		if err := s.LoadRepoPermissions(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "UserIDs", []uint32{4, 5}, bitmapToArray(p.UserIDs))
+	}
+}
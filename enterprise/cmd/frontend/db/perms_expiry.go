@@ -0,0 +1,331 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/keegancsmith/sqlf"
+	"github.com/lib/pq"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+)
+
+// SetUserPermissionsWithExpiry is like SetUserPermissions, but the grants of object IDs found
+// in expiries are only effective until the corresponding time. Object IDs in p that are not
+// found in expiries never expire. Every key of expiries must be an object ID in p.
+//
+// Expired object IDs are excluded from LoadUserPermissions and LoadRepoPermissions right away,
+// and removed from the tables by DeleteExpiredPermissions. Granting an object ID again, e.g. by
+// SetRepoPermissions or GrantPendingPermissions, deletes its expiry.
+func (s *PermsStore) SetUserPermissionsWithExpiry(ctx context.Context, p *authz.UserPermissions, expiries map[int32]time.Time) (err error) {
+	ctx, save := s.observe(ctx, "SetUserPermissionsWithExpiry", "")
+	defer func() { save(&err, append(p.TracingFields(), otlog.Int("expiries.count", len(expiries)))...) }()
+
+	for id := range expiries {
+		if p.IDs == nil || !p.IDs.Contains(uint32(id)) {
+			return errors.Errorf("expiry set for object ID %d which is not granted", id)
+		}
+	}
+
+	// Open a transaction for update consistency.
+	txs, err := s.Transact(ctx)
+	if err != nil {
+		return err
+	}
+	defer txs.Done(&err)
+
+	if _, _, err = txs.setUserPermissions(ctx, p); err != nil {
+		return err
+	}
+	return txs.setUserPermissionsExpiries(ctx, p, expiries)
+}
+
+// setUserPermissionsExpiries replaces all expiries of the user permissions p with given expiries.
+func (s *PermsStore) setUserPermissionsExpiries(ctx context.Context, p *authz.UserPermissions, expiries map[int32]time.Time) error {
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_expiry.go:PermsStore.setUserPermissionsExpiries
+DELETE FROM user_permissions_expiries
+WHERE user_id = %s
+AND permission = %s
+AND object_type = %s
+`, p.UserID, p.Perm.String(), p.Type)
+	if err := s.execute(ctx, q); err != nil {
+		return errors.Wrap(err, "execute delete user permissions expiries query")
+	}
+
+	if len(expiries) == 0 {
+		return nil
+	}
+
+	items := make([]*sqlf.Query, 0, len(expiries))
+	for id, expiredAt := range expiries {
+		items = append(items, sqlf.Sprintf("(%s, %s, %s, %s, %s)",
+			p.UserID,
+			p.Perm.String(),
+			p.Type,
+			id,
+			expiredAt.UTC(),
+		))
+	}
+	q = sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_expiry.go:PermsStore.setUserPermissionsExpiries
+INSERT INTO user_permissions_expiries
+  (user_id, permission, object_type, object_id, expired_at)
+VALUES
+  %s
+`, sqlf.Join(items, ","))
+	if err := s.execute(ctx, q); err != nil {
+		return errors.Wrap(err, "execute insert user permissions expiries query")
+	}
+	return nil
+}
+
+// deleteUserPermissionsExpiries deletes the expiries of given object IDs of the user permissions p,
+// so that they never expire if they are granted.
+func (s *PermsStore) deleteUserPermissionsExpiries(ctx context.Context, p *authz.UserPermissions, ids *roaring.Bitmap) error {
+	if ids.IsEmpty() {
+		return nil
+	}
+
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_expiry.go:PermsStore.deleteUserPermissionsExpiries
+DELETE FROM user_permissions_expiries
+WHERE user_id = %s
+AND permission = %s
+AND object_type = %s
+AND object_id = ANY(%s::integer[])
+`, p.UserID, p.Perm.String(), p.Type, pq.Array(bitmapToInt64s(ids)))
+	if err := s.execute(ctx, q); err != nil {
+		return errors.Wrap(err, "execute delete user permissions expiries query")
+	}
+	return nil
+}
+
+// deleteUserPermissionsExpiriesBatch deletes the expiries of all object IDs of the user permissions
+// ps, so that none of their object IDs expire.
+func (s *PermsStore) deleteUserPermissionsExpiriesBatch(ctx context.Context, ps []*authz.UserPermissions) error {
+	if len(ps) == 0 {
+		return nil
+	}
+
+	userIDs := make([]int64, len(ps))
+	perms := make([]string, len(ps))
+	types := make([]string, len(ps))
+	for i, p := range ps {
+		userIDs[i] = int64(p.UserID)
+		perms[i] = p.Perm.String()
+		types[i] = string(p.Type)
+	}
+
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_expiry.go:PermsStore.deleteUserPermissionsExpiriesBatch
+DELETE FROM user_permissions_expiries AS e
+USING unnest(%s::integer[], %s::text[], %s::text[]) AS k(user_id, permission, object_type)
+WHERE e.user_id = k.user_id
+AND e.permission = k.permission
+AND e.object_type = k.object_type
+`, pq.Array(userIDs), pq.Array(perms), pq.Array(types))
+	if err := s.execute(ctx, q); err != nil {
+		return errors.Wrap(err, "execute delete user permissions expiries batch query")
+	}
+	return nil
+}
+
+// deleteRepoPermissionsExpiries deletes the expiries of all users of the repository permissions p,
+// so that the users granted by p never expire.
+func (s *PermsStore) deleteRepoPermissionsExpiries(ctx context.Context, p *authz.RepoPermissions) error {
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_expiry.go:PermsStore.deleteRepoPermissionsExpiries
+DELETE FROM user_permissions_expiries
+WHERE object_id = %s
+AND permission = %s
+AND object_type = %s
+`, p.RepoID, p.Perm.String(), authz.PermRepos)
+	if err := s.execute(ctx, q); err != nil {
+		return errors.Wrap(err, "execute delete repo permissions expiries query")
+	}
+	return nil
+}
+
+// deleteAllPermissionsExpiries deletes all rows of the "user_permissions_expiries" table.
+func (s *PermsStore) deleteAllPermissionsExpiries(ctx context.Context) error {
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_expiry.go:PermsStore.deleteAllPermissionsExpiries
+DELETE FROM user_permissions_expiries
+`)
+	if err := s.execute(ctx, q); err != nil {
+		return errors.Wrap(err, "execute delete all permissions expiries query")
+	}
+	return nil
+}
+
+// expiredObjectIDsColumn returns a column of the object IDs of a row of the "user_permissions"
+// table whose grants have expired at now but are not yet removed by DeleteExpiredPermissions, so
+// that they are excluded in the same query that loads the row.
+func expiredObjectIDsColumn(now time.Time) *sqlf.Query {
+	return sqlf.Sprintf(`ARRAY(
+  SELECT e.object_id FROM user_permissions_expiries AS e
+  WHERE e.user_id = user_permissions.user_id
+  AND e.permission = user_permissions.permission
+  AND e.object_type = user_permissions.object_type
+  AND e.expired_at <= %s
+)`, now.UTC())
+}
+
+// hasExpiriesColumn returns a column of a row of the "user_permissions" table that is true when
+// any of its object IDs have expiries, whether or not they have expired.
+func hasExpiriesColumn() *sqlf.Query {
+	return sqlf.Sprintf(`EXISTS (
+  SELECT 1 FROM user_permissions_expiries AS e
+  WHERE e.user_id = user_permissions.user_id
+  AND e.permission = user_permissions.permission
+  AND e.object_type = user_permissions.object_type
+)`)
+}
+
+// expiredUserIDsColumn is like expiredObjectIDsColumn, but returns a column of the user IDs of a
+// row of the "repo_permissions" table.
+func expiredUserIDsColumn(now time.Time) *sqlf.Query {
+	return sqlf.Sprintf(`ARRAY(
+  SELECT e.user_id FROM user_permissions_expiries AS e
+  WHERE e.object_id = repo_permissions.repo_id
+  AND e.permission = repo_permissions.permission
+  AND e.object_type = %s
+  AND e.expired_at <= %s
+)`, authz.PermRepos, now.UTC())
+}
+
+// removeExpiredIDs removes the IDs scanned from a column of expiredObjectIDsColumn or
+// expiredUserIDsColumn from ids.
+func removeExpiredIDs(ids *roaring.Bitmap, expired []int64) {
+	for _, id := range expired {
+		ids.Remove(uint32(id))
+	}
+}
+
+// loadIDs runs the query and returns the scanned values of a single integer column as a bitmap.
+func (s *PermsStore) loadIDs(ctx context.Context, q *sqlf.Query) (ids *roaring.Bitmap, err error) {
+	ctx, save := s.observe(ctx, "loadIDs", "")
+	defer func() {
+		save(&err,
+			otlog.String("Query.Query", q.Query(sqlf.PostgresBindVar)),
+			otlog.Object("Query.Args", q.Args()),
+		)
+	}()
+
+	var rows *sql.Rows
+	rows, err = s.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids = roaring.NewBitmap()
+	for rows.Next() {
+		var id uint32
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids.Add(id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// DeleteExpiredPermissions removes all expired grants from the "user_permissions" and "repo_permissions"
+// tables, along with their expiries.
+//
+// This method starts its own transaction for update consistency if the caller hasn't started one already.
+func (s *PermsStore) DeleteExpiredPermissions(ctx context.Context) (err error) {
+	ctx, save := s.observe(ctx, "DeleteExpiredPermissions", "")
+	defer func() { save(&err) }()
+
+	var txs *PermsStore
+	if s.inTx() {
+		txs = s
+	} else {
+		txs, err = s.Transact(ctx)
+		if err != nil {
+			return err
+		}
+		defer txs.Done(&err)
+	}
+
+	now := txs.clock.Now().UTC()
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_expiry.go:PermsStore.DeleteExpiredPermissions
+SELECT user_id, permission, object_type, object_id
+FROM user_permissions_expiries
+WHERE expired_at <= %s
+ORDER BY user_id
+FOR UPDATE
+`, now)
+	rows, err := txs.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return err
+	}
+
+	type userPermsKey struct {
+		userID int32
+		perm   string
+		typ    authz.PermType
+	}
+	var keys []userPermsKey
+	expired := make(map[userPermsKey]*roaring.Bitmap)
+	for rows.Next() {
+		var key userPermsKey
+		var objectID uint32
+		if err = rows.Scan(&key.userID, &key.perm, &key.typ, &objectID); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		if expired[key] == nil {
+			keys = append(keys, key)
+			expired[key] = roaring.NewBitmap()
+		}
+		expired[key].Add(objectID)
+	}
+	if err = rows.Close(); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		perm, err := parsePerms(key.perm)
+		if err != nil {
+			return err
+		}
+
+		p := &authz.UserPermissions{
+			UserID: key.userID,
+			Perm:   perm,
+			Type:   key.typ,
+		}
+		vals, err := txs.load(ctx, loadUserPermissionsQuery(p, "FOR UPDATE"))
+		if err == authz.ErrPermsNotFound {
+			continue
+		} else if err != nil {
+			return errors.Wrap(err, "load user permissions")
+		}
+
+		p.IDs = roaring.AndNot(vals.ids, expired[key])
+		if _, _, err = txs.setUserPermissions(ctx, p); err != nil {
+			return err
+		}
+	}
+
+	q = sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_expiry.go:PermsStore.DeleteExpiredPermissions
+DELETE FROM user_permissions_expiries
+WHERE expired_at <= %s
+`, now)
+	if err = txs.execute(ctx, q); err != nil {
+		return errors.Wrap(err, "execute delete expired user permissions expiries query")
+	}
+	return nil
+}
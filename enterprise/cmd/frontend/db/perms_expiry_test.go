@@ -0,0 +1,251 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/keegancsmith/sqlf"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+	"github.com/sourcegraph/sourcegraph/internal/extsvc"
+)
+
+func testPermsStore_SetUserPermissionsWithExpiry(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+
+		loadUserIDs := func(t *testing.T, s *PermsStore, userID int32) []uint32 {
+			t.Helper()
+			up := &authz.UserPermissions{
+				UserID: userID,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+			}
+			if err := s.LoadUserPermissions(ctx, up); err != nil {
+				t.Fatal(err)
+			}
+			return bitmapToArray(up.IDs)
+		}
+		loadRepoIDs := func(t *testing.T, s *PermsStore, repoID int32) []uint32 {
+			t.Helper()
+			rp := &authz.RepoPermissions{
+				RepoID: repoID,
+				Perm:   authz.Read,
+			}
+			if err := s.LoadRepoPermissions(ctx, rp); err != nil {
+				t.Fatal(err)
+			}
+			return bitmapToArray(rp.UserIDs)
+		}
+
+		t.Run("expiry for object ID not granted", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupPermsTables(t, s)
+
+			err := s.SetUserPermissionsWithExpiry(ctx, &authz.UserPermissions{
+				UserID: 1,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+				IDs:    toBitmap(1),
+			}, map[int32]time.Time{2: clock().Add(time.Hour)})
+			if err == nil {
+				t.Fatal("expected an error but got nil")
+			}
+		})
+
+		t.Run("expired grants are excluded and deleted", func(t *testing.T) {
+			tc := NewTestClock(clock())
+			s := NewPermsStore(db, clock).WithClock(tc)
+			defer cleanupPermsTables(t, s)
+
+			if err := s.SetUserPermissionsWithExpiry(ctx, &authz.UserPermissions{
+				UserID: 1,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+				IDs:    toBitmap(1, 2),
+			}, map[int32]time.Time{2: tc.Now().Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "user IDs", []uint32{1, 2}, loadUserIDs(t, s, 1))
+			equal(t, "repo 2 user IDs", []uint32{1}, loadRepoIDs(t, s, 2))
+
+			tc.Advance(2 * time.Hour)
+			equal(t, "user IDs", []uint32{1}, loadUserIDs(t, s, 1))
+			equal(t, "repo 1 user IDs", []uint32{1}, loadRepoIDs(t, s, 1))
+			equal(t, "repo 2 user IDs", 0, len(loadRepoIDs(t, s, 2)))
+
+			if err := s.DeleteExpiredPermissions(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			err := checkRegularPermsTable(s, `SELECT user_id, object_ids FROM user_permissions`, map[int32][]uint32{
+				1: {1},
+			})
+			if err != nil {
+				t.Fatal("user_permissions:", err)
+			}
+			err = checkRegularPermsTable(s, `SELECT repo_id, user_ids FROM repo_permissions`, map[int32][]uint32{
+				1: {1},
+				2: {},
+			})
+			if err != nil {
+				t.Fatal("repo_permissions:", err)
+			}
+
+			ids, err := s.loadIDs(ctx, sqlf.Sprintf(`SELECT object_id FROM user_permissions_expiries`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "expiries", 0, len(bitmapToArray(ids)))
+		})
+
+		t.Run("set without expiry clears expiries", func(t *testing.T) {
+			tc := NewTestClock(clock())
+			s := NewPermsStore(db, clock).WithClock(tc)
+			defer cleanupPermsTables(t, s)
+
+			p := &authz.UserPermissions{
+				UserID: 1,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+				IDs:    toBitmap(1, 2),
+			}
+			if err := s.SetUserPermissionsWithExpiry(ctx, p, map[int32]time.Time{2: tc.Now().Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.SetUserPermissions(ctx, p); err != nil {
+				t.Fatal(err)
+			}
+
+			tc.Advance(2 * time.Hour)
+			equal(t, "user IDs", []uint32{1, 2}, loadUserIDs(t, s, 1))
+		})
+
+		t.Run("expiries are only deleted when they exist", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupPermsTables(t, s)
+
+			hasExpiries := func(t *testing.T, p *authz.UserPermissions) bool {
+				t.Helper()
+				var has bool
+				if _, err := s.load(ctx, loadUserPermissionsForUpdateQuery(p), &has); err != nil {
+					t.Fatal(err)
+				}
+				return has
+			}
+
+			p := &authz.UserPermissions{
+				UserID: 1,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+				IDs:    toBitmap(1, 2),
+			}
+			if err := s.SetUserPermissionsWithExpiry(ctx, p, map[int32]time.Time{2: clock().Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "has expiries", true, hasExpiries(t, p))
+
+			if err := s.SetUserPermissions(ctx, p); err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "has expiries", false, hasExpiries(t, p))
+		})
+
+		t.Run("set repo permissions clears expiries", func(t *testing.T) {
+			tc := NewTestClock(clock())
+			s := NewPermsStore(db, clock).WithClock(tc)
+			defer cleanupPermsTables(t, s)
+
+			if err := s.SetUserPermissionsWithExpiry(ctx, &authz.UserPermissions{
+				UserID: 1,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+				IDs:    toBitmap(1, 2),
+			}, map[int32]time.Time{2: tc.Now().Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+
+			// The grant has expired but is not yet cleaned up when the repository is granted again.
+			tc.Advance(2 * time.Hour)
+			if err := s.SetRepoPermissions(ctx, &authz.RepoPermissions{
+				RepoID:  2,
+				Perm:    authz.Read,
+				UserIDs: toBitmap(1),
+			}); err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "user IDs", []uint32{1, 2}, loadUserIDs(t, s, 1))
+			equal(t, "repo 2 user IDs", []uint32{1}, loadRepoIDs(t, s, 2))
+
+			if err := s.DeleteExpiredPermissions(ctx); err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "user IDs", []uint32{1, 2}, loadUserIDs(t, s, 1))
+		})
+
+		t.Run("grant pending permissions clears expiries", func(t *testing.T) {
+			tc := NewTestClock(clock())
+			s := NewPermsStore(db, clock).WithClock(tc)
+			defer cleanupPermsTables(t, s)
+
+			if err := s.SetUserPermissionsWithExpiry(ctx, &authz.UserPermissions{
+				UserID: 1,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+				IDs:    toBitmap(1, 2),
+			}, map[int32]time.Time{2: tc.Now().Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+			accounts := &extsvc.ExternalAccounts{
+				ServiceType: "sourcegraph",
+				ServiceID:   "https://sourcegraph.com/",
+				AccountIDs:  []string{"alice"},
+			}
+			if err := s.SetRepoPendingPermissions(ctx, accounts, &authz.RepoPermissions{
+				RepoID: 2,
+				Perm:   authz.Read,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.GrantPendingPermissions(ctx, 1, &authz.UserPendingPermissions{
+				ServiceType: "sourcegraph",
+				ServiceID:   "https://sourcegraph.com/",
+				BindID:      "alice",
+				Perm:        authz.Read,
+				Type:        authz.PermRepos,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			tc.Advance(2 * time.Hour)
+			equal(t, "user IDs", []uint32{1, 2}, loadUserIDs(t, s, 1))
+			equal(t, "repo 2 user IDs", []uint32{1}, loadRepoIDs(t, s, 2))
+		})
+
+		t.Run("delete all user permissions clears expiries", func(t *testing.T) {
+			tc := NewTestClock(clock())
+			s := NewPermsStore(db, clock).WithClock(tc)
+			defer cleanupPermsTables(t, s)
+
+			p := &authz.UserPermissions{
+				UserID: 1,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+				IDs:    toBitmap(1, 2),
+			}
+			if err := s.SetUserPermissionsWithExpiry(ctx, p, map[int32]time.Time{2: tc.Now().Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.DeleteAllUserPermissions(ctx, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			ids, err := s.loadIDs(ctx, sqlf.Sprintf(`SELECT object_id FROM user_permissions_expiries`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "expiries", 0, len(bitmapToArray(ids)))
+		})
+	}
+}
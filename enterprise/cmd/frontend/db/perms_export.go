@@ -0,0 +1,672 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/keegancsmith/sqlf"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+)
+
+// PermsFormat is the serialization format of exported permissions.
+type PermsFormat string
+
+// The list of supported permissions formats.
+const (
+	PermsFormatJSON PermsFormat = "json" // One JSON object per line.
+	PermsFormatCSV  PermsFormat = "csv"  // Comma-separated values with a header row.
+)
+
+// PermsRecord is a portable representation of a single row of either the
+// "user_permissions" or the "repo_permissions" table.
+type PermsRecord struct {
+	Table      string    `json:"table"`                 // Name of the table the row belongs to
+	ID         int32     `json:"id"`                    // The user_id or the repo_id
+	Permission string    `json:"permission"`            // The permission level, e.g. "read"
+	ObjectType string    `json:"object_type,omitempty"` // The object type, only set for "user_permissions"
+	IDs        []uint32  `json:"ids"`                   // The expanded bitmap of object IDs or user IDs
+	UpdatedAt  time.Time `json:"updated_at"`            // Last updated time of the row
+}
+
+var permsCSVHeader = []string{"table", "id", "permission", "object_type", "ids", "updated_at"}
+
+func (r *PermsRecord) csvRecord() []string {
+	ids := make([]string, len(r.IDs))
+	for i := range r.IDs {
+		ids[i] = strconv.FormatUint(uint64(r.IDs[i]), 10)
+	}
+	return []string{
+		r.Table,
+		strconv.FormatInt(int64(r.ID), 10),
+		r.Permission,
+		r.ObjectType,
+		strings.Join(ids, " "),
+		r.UpdatedAt.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+func parsePermsCSVRecord(fields []string) (*PermsRecord, error) {
+	if len(fields) != len(permsCSVHeader) {
+		return nil, errors.Errorf("want %d fields but got %d", len(permsCSVHeader), len(fields))
+	}
+
+	id, err := strconv.ParseInt(fields[1], 10, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse id")
+	}
+
+	var ids []uint32
+	for _, f := range strings.Fields(fields[4]) {
+		id, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse ids")
+		}
+		ids = append(ids, uint32(id))
+	}
+
+	updatedAt, err := time.Parse(time.RFC3339Nano, fields[5])
+	if err != nil {
+		return nil, errors.Wrap(err, "parse updated_at")
+	}
+
+	return &PermsRecord{
+		Table:      fields[0],
+		ID:         int32(id),
+		Permission: fields[2],
+		ObjectType: fields[3],
+		IDs:        ids,
+		UpdatedAt:  updatedAt,
+	}, nil
+}
+
+// newPermsRecordReader returns a function that reads the next record from r in given format
+// on every call. It returns io.EOF when there are no more records.
+func newPermsRecordReader(r io.Reader, format PermsFormat) (func() (*PermsRecord, error), error) {
+	switch format {
+	case PermsFormatJSON:
+		dec := json.NewDecoder(r)
+		return func() (*PermsRecord, error) {
+			var rec PermsRecord
+			if err := dec.Decode(&rec); err != nil {
+				return nil, err
+			}
+			return &rec, nil
+		}, nil
+
+	case PermsFormatCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = len(permsCSVHeader)
+		header, err := cr.Read()
+		if err != nil {
+			if err == io.EOF {
+				return func() (*PermsRecord, error) { return nil, io.EOF }, nil
+			}
+			return nil, errors.Wrap(err, "read header")
+		} else if strings.Join(header, ",") != strings.Join(permsCSVHeader, ",") {
+			return nil, errors.Errorf("unexpected header %q", header)
+		}
+		return func() (*PermsRecord, error) {
+			fields, err := cr.Read()
+			if err != nil {
+				return nil, err
+			}
+			return parsePermsCSVRecord(fields)
+		}, nil
+	}
+
+	return nil, errors.Errorf("unsupported permissions format %q", format)
+}
+
+// ExportPermissions writes every row of the "user_permissions" and "repo_permissions" tables to w
+// in given format, with bitmaps expanded to arrays of IDs. Rows are streamed one at a time from the
+// database to w, thus memory usage does not grow with the number of rows.
+func (s *PermsStore) ExportPermissions(ctx context.Context, w io.Writer, format PermsFormat) (err error) {
+	ctx, save := s.observe(ctx, "ExportPermissions", "")
+	defer func() { save(&err, otlog.String("format", string(format))) }()
+
+	var write func(*PermsRecord) error
+	switch format {
+	case PermsFormatJSON:
+		enc := json.NewEncoder(w)
+		write = func(r *PermsRecord) error { return enc.Encode(r) }
+
+	case PermsFormatCSV:
+		cw := csv.NewWriter(w)
+		defer func() {
+			cw.Flush()
+			if err == nil {
+				err = cw.Error()
+			}
+		}()
+		if err = cw.Write(permsCSVHeader); err != nil {
+			return err
+		}
+		write = func(r *PermsRecord) error { return cw.Write(r.csvRecord()) }
+
+	default:
+		return errors.Errorf("unsupported permissions format %q", format)
+	}
+
+	if err = s.exportPermissions(ctx, exportUserPermissionsQuery(), write); err != nil {
+		return errors.Wrap(err, "export user permissions")
+	}
+	if err = s.exportPermissions(ctx, exportRepoPermissionsQuery(), write); err != nil {
+		return errors.Wrap(err, "export repo permissions")
+	}
+	return nil
+}
+
+func exportUserPermissionsQuery() *sqlf.Query {
+	return sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_export.go:exportUserPermissionsQuery
+SELECT 'user_permissions', user_id, permission, object_type, object_ids, updated_at
+FROM user_permissions
+ORDER BY user_id, permission, object_type
+`)
+}
+
+func exportRepoPermissionsQuery() *sqlf.Query {
+	return sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_export.go:exportRepoPermissionsQuery
+SELECT 'repo_permissions', repo_id, permission, '', user_ids, updated_at
+FROM repo_permissions
+ORDER BY repo_id, permission
+`)
+}
+
+// exportPermissions runs the query and passes every scanned row to write as a PermsRecord.
+func (s *PermsStore) exportPermissions(ctx context.Context, q *sqlf.Query, write func(*PermsRecord) error) (err error) {
+	var rows *sql.Rows
+	rows, err = s.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rec PermsRecord
+		var ids []byte
+		if err = rows.Scan(&rec.Table, &rec.ID, &rec.Permission, &rec.ObjectType, &ids, &rec.UpdatedAt); err != nil {
+			return err
+		}
+
+		bm := roaring.NewBitmap()
+		if len(ids) > 0 {
+			if err = unmarshalBitmap(bm, ids); err != nil {
+				return err
+			}
+		}
+		rec.IDs = bm.ToArray()
+		rec.UpdatedAt = rec.UpdatedAt.UTC()
+
+		if err = write(&rec); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// permsImportBatchSize is the maximum number of rows upserted by a single statement
+// in ImportPermissions.
+const permsImportBatchSize = 1000
+
+// ErrPermsTablesNotEmpty is returned by ImportRepoPermissions when there are existing permissions.
+var ErrPermsTablesNotEmpty = errors.New("permissions tables must be empty to import permissions")
+
+// parsePerms returns the authz.Perms whose string representation is s.
+func parsePerms(s string) (authz.Perms, error) {
+	for _, p := range []authz.Perms{authz.Read, authz.Write, authz.Read | authz.Write} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return authz.None, errors.Errorf("unknown permission %q", s)
+}
+
+// repoPermsKey identifies a row of the "repo_permissions" table.
+type repoPermsKey struct {
+	repoID int32
+	perm   authz.Perms
+}
+
+// userPermsKey identifies a row of the "user_permissions" table.
+type userPermsKey struct {
+	userID int32
+	perm   authz.Perms
+	typ    authz.PermType
+}
+
+// ImportPermissions reads records written by ExportPermissions from r in given format, and upserts
+// them into the "user_permissions" and "repo_permissions" tables. Bitmaps are rebuilt from the arrays
+// of IDs, and records of the same row are merged into the union of their IDs with the latest update
+// time. Records of the "user_permissions" table are the source of truth: records of the
+// "repo_permissions" table must agree with the reverse mapping derived from them, otherwise nothing
+// is imported and an error is returned.
+//
+// Imported rows of the "user_permissions" table replace existing ones, and imported permissions
+// never expire. Rows of the "repo_permissions" table are updated with the users added and removed by
+// the import instead of being replaced, so that users who are not imported keep their access to
+// imported repositories.
+//
+// All rows are upserted in batches within a single transaction.
+func (s *PermsStore) ImportPermissions(ctx context.Context, r io.Reader, format PermsFormat) (err error) {
+	ctx, save := s.observe(ctx, "ImportPermissions", "")
+	defer func() { save(&err, otlog.String("format", string(format))) }()
+
+	next, err := newPermsRecordReader(r, format)
+	if err != nil {
+		return err
+	}
+
+	userPerms := make(map[userPermsKey]*authz.UserPermissions)
+	repoPerms := make(map[repoPermsKey]*authz.RepoPermissions)
+	for line := 1; ; line++ {
+		rec, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrapf(err, "read record %d", line)
+		}
+
+		perm, err := parsePerms(rec.Permission)
+		if err != nil {
+			return errors.Wrapf(err, "record %d", line)
+		}
+
+		ids := roaring.NewBitmap()
+		ids.AddMany(rec.IDs)
+		if !ids.IsEmpty() && ids.Maximum() > math.MaxInt32 {
+			return errors.Errorf("record %d: ID %d is out of range", line, ids.Maximum())
+		}
+
+		switch rec.Table {
+		case "user_permissions":
+			key := userPermsKey{userID: rec.ID, perm: perm, typ: authz.PermType(rec.ObjectType)}
+			if p := userPerms[key]; p != nil {
+				p.IDs.Or(ids)
+				if rec.UpdatedAt.After(p.UpdatedAt) {
+					p.UpdatedAt = rec.UpdatedAt
+				}
+				continue
+			}
+			userPerms[key] = &authz.UserPermissions{
+				UserID:    rec.ID,
+				Perm:      perm,
+				Type:      key.typ,
+				IDs:       ids,
+				UpdatedAt: rec.UpdatedAt,
+			}
+
+		case "repo_permissions":
+			key := repoPermsKey{repoID: rec.ID, perm: perm}
+			if p := repoPerms[key]; p != nil {
+				p.UserIDs.Or(ids)
+				if rec.UpdatedAt.After(p.UpdatedAt) {
+					p.UpdatedAt = rec.UpdatedAt
+				}
+				continue
+			}
+			repoPerms[key] = &authz.RepoPermissions{
+				RepoID:    rec.ID,
+				Perm:      perm,
+				UserIDs:   ids,
+				UpdatedAt: rec.UpdatedAt,
+			}
+
+		default:
+			return errors.Errorf("record %d: unknown table %q", line, rec.Table)
+		}
+	}
+
+	// Only permissions of repositories have a reverse mapping in the "repo_permissions" table.
+	reverse := make(map[repoPermsKey]*roaring.Bitmap)
+	for key, p := range userPerms {
+		if key.typ != authz.PermRepos {
+			continue
+		}
+		for _, repoID := range p.IDs.ToArray() {
+			key := repoPermsKey{repoID: int32(repoID), perm: p.Perm}
+			if reverse[key] == nil {
+				reverse[key] = roaring.NewBitmap()
+			}
+			reverse[key].Add(uint32(p.UserID))
+		}
+	}
+
+	// Validate both mappings agree with each other.
+	for key, userIDs := range reverse {
+		p := repoPerms[key]
+		if p == nil {
+			return errors.Errorf("missing permissions of repository %d for users %v", key.repoID, userIDs.ToArray())
+		} else if !p.UserIDs.Equals(userIDs) {
+			return errors.Errorf("permissions of repository %d do not agree with user permissions: want %v but got %v",
+				key.repoID, userIDs.ToArray(), p.UserIDs.ToArray())
+		}
+	}
+	for key, p := range repoPerms {
+		if reverse[key] == nil && !p.UserIDs.IsEmpty() {
+			return errors.Errorf("permissions of repository %d do not agree with user permissions: want [] but got %v",
+				key.repoID, p.UserIDs.ToArray())
+		}
+	}
+
+	ps := make([]*authz.UserPermissions, 0, len(userPerms))
+	for _, p := range userPerms {
+		ps = append(ps, p)
+	}
+	// Rows are upserted in the order of their keys, which keeps batches deterministic.
+	sort.Slice(ps, func(i, j int) bool {
+		if ps[i].UserID != ps[j].UserID {
+			return ps[i].UserID < ps[j].UserID
+		}
+		if ps[i].Perm != ps[j].Perm {
+			return ps[i].Perm < ps[j].Perm
+		}
+		return ps[i].Type < ps[j].Type
+	})
+
+	var txs *PermsStore
+	if s.inTx() {
+		txs = s
+	} else {
+		txs, err = s.Transact(ctx)
+		if err != nil {
+			return err
+		}
+		defer txs.Done(&err)
+	}
+
+	// Load the stored rows of imported users with a row-level lock, in order to compute the users
+	// added to and removed from each repository by replacing them.
+	added := make(map[repoPermsKey]*roaring.Bitmap)
+	removed := make(map[repoPermsKey]*roaring.Bitmap)
+	addTo := func(m map[repoPermsKey]*roaring.Bitmap, repoIDs *roaring.Bitmap, perm authz.Perms, userID int32) {
+		for _, repoID := range repoIDs.ToArray() {
+			key := repoPermsKey{repoID: int32(repoID), perm: perm}
+			if m[key] == nil {
+				m[key] = roaring.NewBitmap()
+			}
+			m[key].Add(uint32(userID))
+		}
+	}
+	for start := 0; start < len(ps); start += permsImportBatchSize {
+		end := start + permsImportBatchSize
+		if end > len(ps) {
+			end = len(ps)
+		}
+
+		for perm, userIDs := range importedUserIDs(ps[start:end]) {
+			loaded, err := txs.batchLoadIDs(ctx, loadUserPermissionsBatchQuery(userIDs, perm, authz.PermRepos, "FOR UPDATE"))
+			if err != nil {
+				return errors.Wrap(err, "batch load user permissions")
+			}
+			for _, p := range ps[start:end] {
+				if p.Perm != perm || p.Type != authz.PermRepos {
+					continue
+				}
+				oldIDs := loaded[p.UserID]
+				if oldIDs == nil {
+					oldIDs = roaring.NewBitmap()
+				}
+				addTo(added, roaring.AndNot(p.IDs, oldIDs), perm, p.UserID)
+				addTo(removed, roaring.AndNot(oldIDs, p.IDs), perm, p.UserID)
+			}
+		}
+
+		q, err := upsertUserPermissionsBatchQuery(ps[start:end]...)
+		if err != nil {
+			return err
+		} else if err = txs.execute(ctx, q); err != nil {
+			return errors.Wrap(err, "execute upsert user permissions batch query")
+		}
+		if err = txs.deleteUserPermissionsExpiriesBatch(ctx, ps[start:end]); err != nil {
+			return err
+		}
+	}
+
+	// Imported repositories are written even if their users do not change, so that their update
+	// time is the imported one.
+	keys := make([]repoPermsKey, 0, len(repoPerms))
+	for key := range repoPerms {
+		keys = append(keys, key)
+	}
+	for _, m := range []map[repoPermsKey]*roaring.Bitmap{added, removed} {
+		for key := range m {
+			if repoPerms[key] == nil {
+				repoPerms[key] = &authz.RepoPermissions{RepoID: key.repoID, Perm: key.perm}
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].repoID != keys[j].repoID {
+			return keys[i].repoID < keys[j].repoID
+		}
+		return keys[i].perm < keys[j].perm
+	})
+
+	updatedAt := txs.clock.Now()
+	for start := 0; start < len(keys); start += permsImportBatchSize {
+		end := start + permsImportBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		repoIDs := make(map[authz.Perms][]uint32)
+		for _, key := range keys[start:end] {
+			repoIDs[key.perm] = append(repoIDs[key.perm], uint32(key.repoID))
+		}
+		loaded := make(map[repoPermsKey]*roaring.Bitmap)
+		for perm, ids := range repoIDs {
+			vals, err := txs.batchLoadIDs(ctx, loadRepoPermissionsBatchQuery(ids, perm, "FOR UPDATE"))
+			if err != nil {
+				return errors.Wrap(err, "batch load repo permissions")
+			}
+			for repoID, userIDs := range vals {
+				loaded[repoPermsKey{repoID: repoID, perm: perm}] = userIDs
+			}
+		}
+
+		batch := make([]*authz.RepoPermissions, 0, end-start)
+		addedGrants := make(map[repoPermsKey]*roaring.Bitmap)
+		removedGrants := make(map[repoPermsKey]*roaring.Bitmap)
+		for _, key := range keys[start:end] {
+			userIDs := loaded[key]
+			if userIDs == nil {
+				userIDs = roaring.NewBitmap()
+			}
+			if removed[key] != nil {
+				userIDs.AndNot(removed[key])
+				removedGrants[key] = removed[key]
+			}
+			if added[key] != nil {
+				addedGrants[key] = roaring.AndNot(added[key], userIDs)
+				userIDs.Or(added[key])
+			}
+
+			p := repoPerms[key]
+			p.UserIDs = userIDs
+			if p.UpdatedAt.IsZero() {
+				p.UpdatedAt = updatedAt
+			}
+			batch = append(batch, p)
+		}
+
+		q, err := upsertRepoPermissionsBatchQuery(batch...)
+		if err != nil {
+			return err
+		} else if err = txs.execute(ctx, q); err != nil {
+			return errors.Wrap(err, "execute upsert repo permissions batch query")
+		}
+		if err = txs.recordPermissionsGrants(ctx, addedGrants, removedGrants, updatedAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importedUserIDs returns the IDs of users of permissions of repositories in ps, grouped by
+// permission.
+func importedUserIDs(ps []*authz.UserPermissions) map[authz.Perms][]uint32 {
+	userIDs := make(map[authz.Perms][]uint32)
+	for _, p := range ps {
+		if p.Type == authz.PermRepos {
+			userIDs[p.Perm] = append(userIDs[p.Perm], uint32(p.UserID))
+		}
+	}
+	return userIDs
+}
+
+// checkPermsTablesEmpty returns ErrPermsTablesNotEmpty if the "user_permissions" or the
+// "repo_permissions" table has any rows.
+func (s *PermsStore) checkPermsTablesEmpty(ctx context.Context) error {
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_export.go:PermsStore.checkPermsTablesEmpty
+SELECT EXISTS (SELECT FROM user_permissions) OR EXISTS (SELECT FROM repo_permissions)
+`)
+	rows, err := s.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return err
+	}
+	var exists bool
+	if rows.Next() {
+		err = rows.Scan(&exists)
+	}
+	if closeErr := rows.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	} else if exists {
+		return ErrPermsTablesNotEmpty
+	}
+	return nil
+}
+
+// ImportRepoPermissions performs the initial load of permissions of all repositories given by ps,
+// which is much faster than calling SetRepoPermissions for each of them. Rows of the
+// "user_permissions" table are rebuilt at once by inverting the mapping of repositories to users
+// in memory, instead of being updated incrementally for every repository, and rows of both tables
+// are inserted in batches of multi-row statements. Both tables must be empty before the import,
+// otherwise ErrPermsTablesNotEmpty is returned, and repositories may appear only once per permission.
+// Imported permissions never expire.
+//
+// It is not safe to call this method concurrently with any other method that updates permissions,
+// because their updates are not merged with the imported permissions. Changes are neither recorded
+// in the history nor notified.
+//
+// All rows are inserted within a single transaction.
+func (s *PermsStore) ImportRepoPermissions(ctx context.Context, ps []*authz.RepoPermissions) (err error) {
+	ctx, save := s.observe(ctx, "ImportRepoPermissions", "")
+	defer func() { save(&err, otlog.Int("count", len(ps))) }()
+
+	seen := make(map[repoPermsKey]bool, len(ps))
+	reverse := make(map[userPermsKey]*roaring.Bitmap)
+	for _, p := range ps {
+		key := repoPermsKey{repoID: p.RepoID, perm: p.Perm}
+		if seen[key] {
+			return errors.Errorf("duplicated repository %d", p.RepoID)
+		}
+		seen[key] = true
+
+		if p.UserIDs == nil {
+			p.UserIDs = roaring.NewBitmap()
+		} else if !p.UserIDs.IsEmpty() && p.UserIDs.Maximum() > math.MaxInt32 {
+			return errors.Errorf("user ID %d of repository %d is out of range", p.UserIDs.Maximum(), p.RepoID)
+		}
+
+		for _, id := range p.UserIDs.ToArray() {
+			key := userPermsKey{userID: int32(id), perm: p.Perm, typ: authz.PermRepos}
+			if reverse[key] == nil {
+				reverse[key] = roaring.NewBitmap()
+			}
+			reverse[key].Add(uint32(p.RepoID))
+		}
+	}
+
+	var txs *PermsStore
+	if s.inTx() {
+		txs = s
+	} else {
+		txs, err = s.Transact(ctx)
+		if err != nil {
+			return err
+		}
+		defer txs.Done(&err)
+	}
+
+	if err = txs.checkPermsTablesEmpty(ctx); err != nil {
+		return err
+	}
+	// Expiries left behind by deleted permissions must not apply to imported ones.
+	if err = txs.deleteAllPermissionsExpiries(ctx); err != nil {
+		return err
+	}
+
+	updatedAt := txs.clock.Now()
+	for start := 0; start < len(ps); start += permsImportBatchSize {
+		end := start + permsImportBatchSize
+		if end > len(ps) {
+			end = len(ps)
+		}
+
+		grants := make(map[repoPermsKey]*roaring.Bitmap, end-start)
+		for _, p := range ps[start:end] {
+			p.UpdatedAt = updatedAt
+			grants[repoPermsKey{repoID: p.RepoID, perm: p.Perm}] = p.UserIDs
+		}
+		q, err := upsertRepoPermissionsBatchQuery(ps[start:end]...)
+		if err != nil {
+			return err
+		} else if err = txs.execute(ctx, q); err != nil {
+			return errors.Wrap(err, "execute upsert repo permissions batch query")
+		}
+		if err = txs.recordPermissionsGrants(ctx, grants, nil, updatedAt); err != nil {
+			return err
+		}
+	}
+
+	userPerms := make([]*authz.UserPermissions, 0, len(reverse))
+	for key, ids := range reverse {
+		userPerms = append(userPerms, &authz.UserPermissions{
+			UserID:    key.userID,
+			Perm:      key.perm,
+			Type:      authz.PermRepos,
+			IDs:       ids,
+			UpdatedAt: updatedAt,
+		})
+	}
+	// Rows are inserted in the order of user IDs, which keeps batches deterministic.
+	sort.Slice(userPerms, func(i, j int) bool {
+		if userPerms[i].UserID != userPerms[j].UserID {
+			return userPerms[i].UserID < userPerms[j].UserID
+		}
+		return userPerms[i].Perm < userPerms[j].Perm
+	})
+
+	for start := 0; start < len(userPerms); start += permsImportBatchSize {
+		end := start + permsImportBatchSize
+		if end > len(userPerms) {
+			end = len(userPerms)
+		}
+
+		q, err := upsertUserPermissionsBatchQuery(userPerms[start:end]...)
+		if err != nil {
+			return err
+		} else if err = txs.execute(ctx, q); err != nil {
+			return errors.Wrap(err, "execute upsert user permissions batch query")
+		}
+	}
+	return nil
+}
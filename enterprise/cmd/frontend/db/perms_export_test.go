@@ -0,0 +1,385 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/keegancsmith/sqlf"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+	"github.com/sourcegraph/sourcegraph/internal/db/dbtest"
+)
+
+func testPermsStore_ExportPermissions(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		s := NewPermsStore(db, clock)
+		defer cleanupPermsTables(t, s)
+
+		ctx := context.Background()
+		for _, p := range []*authz.RepoPermissions{
+			{
+				RepoID:  1,
+				Perm:    authz.Read,
+				UserIDs: toBitmap(1, 2),
+			}, {
+				RepoID:  2,
+				Perm:    authz.Read,
+				UserIDs: toBitmap(2),
+			},
+		} {
+			if err := s.SetRepoPermissions(ctx, p); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		updatedAt := clock().UTC()
+		want := []*PermsRecord{
+			{Table: "user_permissions", ID: 1, Permission: "read", ObjectType: "repos", IDs: []uint32{1}, UpdatedAt: updatedAt},
+			{Table: "user_permissions", ID: 2, Permission: "read", ObjectType: "repos", IDs: []uint32{1, 2}, UpdatedAt: updatedAt},
+			{Table: "repo_permissions", ID: 1, Permission: "read", IDs: []uint32{1, 2}, UpdatedAt: updatedAt},
+			{Table: "repo_permissions", ID: 2, Permission: "read", IDs: []uint32{2}, UpdatedAt: updatedAt},
+		}
+
+		for _, format := range []PermsFormat{PermsFormatJSON, PermsFormatCSV} {
+			t.Run(string(format), func(t *testing.T) {
+				var buf bytes.Buffer
+				if err := s.ExportPermissions(ctx, &buf, format); err != nil {
+					t.Fatal(err)
+				}
+
+				next, err := newPermsRecordReader(&buf, format)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var have []*PermsRecord
+				for {
+					rec, err := next()
+					if err == io.EOF {
+						break
+					} else if err != nil {
+						t.Fatal(err)
+					}
+					have = append(have, rec)
+				}
+
+				if diff := cmp.Diff(want, have, cmpopts.EquateEmpty(), cmp.Comparer(func(a, b time.Time) bool {
+					return a.Equal(b)
+				})); diff != "" {
+					t.Fatal(diff)
+				}
+			})
+		}
+
+		t.Run("unsupported format", func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := s.ExportPermissions(ctx, &buf, "xml"); err == nil {
+				t.Fatal("expected an error but got nil")
+			}
+		})
+	}
+}
+
+func testPermsStore_ImportPermissions(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+		setup := func(t *testing.T, s *PermsStore) {
+			for _, p := range []*authz.RepoPermissions{
+				{
+					RepoID:  1,
+					Perm:    authz.Read,
+					UserIDs: toBitmap(1, 2),
+				}, {
+					RepoID:  2,
+					Perm:    authz.Read,
+					UserIDs: toBitmap(2, 3),
+				},
+			} {
+				if err := s.SetRepoPermissions(ctx, p); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		for _, format := range []PermsFormat{PermsFormatJSON, PermsFormatCSV} {
+			t.Run("round trip "+string(format), func(t *testing.T) {
+				s := NewPermsStore(db, clock)
+				defer cleanupPermsTables(t, s)
+				setup(t, s)
+
+				var exported bytes.Buffer
+				if err := s.ExportPermissions(ctx, &exported, format); err != nil {
+					t.Fatal(err)
+				}
+				want := exported.String()
+
+				cleanupPermsTables(t, s)
+				if err := s.ImportPermissions(ctx, &exported, format); err != nil {
+					t.Fatal(err)
+				}
+
+				var reexported bytes.Buffer
+				if err := s.ExportPermissions(ctx, &reexported, format); err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(want, reexported.String()); diff != "" {
+					t.Fatal(diff)
+				}
+			})
+		}
+
+		t.Run("tables not empty", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupPermsTables(t, s)
+			setup(t, s)
+
+			if err := s.SetUserPermissionsWithExpiry(ctx, &authz.UserPermissions{
+				UserID: 3,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+				IDs:    toBitmap(2),
+			}, map[int32]time.Time{2: clock().Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+
+			// User 2 loses access to repository 1 and gains access to repository 3, and user 4 is
+			// new, while user 1 is not imported and keeps access to repository 1.
+			dump := `{"table":"user_permissions","id":2,"permission":"read","object_type":"repos","ids":[2,3],"updated_at":"2020-01-01T00:00:00Z"}
+{"table":"user_permissions","id":3,"permission":"read","object_type":"repos","ids":[2],"updated_at":"2020-01-01T00:00:00Z"}
+{"table":"user_permissions","id":4,"permission":"read","object_type":"repos","ids":[1],"updated_at":"2020-01-01T00:00:00Z"}
+{"table":"repo_permissions","id":1,"permission":"read","ids":[4],"updated_at":"2020-01-01T00:00:00Z"}
+{"table":"repo_permissions","id":2,"permission":"read","ids":[2,3],"updated_at":"2020-01-01T00:00:00Z"}
+{"table":"repo_permissions","id":3,"permission":"read","ids":[2],"updated_at":"2020-01-01T00:00:00Z"}
+`
+			if err := s.ImportPermissions(ctx, bytes.NewBufferString(dump), PermsFormatJSON); err != nil {
+				t.Fatal(err)
+			}
+
+			err := checkRegularPermsTable(s, `SELECT user_id, object_ids FROM user_permissions`, map[int32][]uint32{
+				1: {1},
+				2: {2, 3},
+				3: {2},
+				4: {1},
+			})
+			if err != nil {
+				t.Fatal("user_permissions:", err)
+			}
+			err = checkRegularPermsTable(s, `SELECT repo_id, user_ids FROM repo_permissions`, map[int32][]uint32{
+				1: {1, 4},
+				2: {2, 3},
+				3: {2},
+			})
+			if err != nil {
+				t.Fatal("repo_permissions:", err)
+			}
+
+			// Imported permissions never expire.
+			ids, err := s.loadIDs(ctx, sqlf.Sprintf(`SELECT object_id FROM user_permissions_expiries`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "expiries", 0, len(bitmapToArray(ids)))
+		})
+
+		t.Run("duplicated records", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupPermsTables(t, s)
+
+			dump := `{"table":"user_permissions","id":1,"permission":"read","object_type":"repos","ids":[1],"updated_at":"2020-01-01T00:00:00Z"}
+{"table":"user_permissions","id":1,"permission":"read","object_type":"repos","ids":[2],"updated_at":"2020-01-02T00:00:00Z"}
+{"table":"repo_permissions","id":1,"permission":"read","ids":[1],"updated_at":"2020-01-01T00:00:00Z"}
+{"table":"repo_permissions","id":1,"permission":"read","ids":[1],"updated_at":"2020-01-01T00:00:00Z"}
+{"table":"repo_permissions","id":2,"permission":"read","ids":[1],"updated_at":"2020-01-01T00:00:00Z"}
+`
+			if err := s.ImportPermissions(ctx, bytes.NewBufferString(dump), PermsFormatJSON); err != nil {
+				t.Fatal(err)
+			}
+
+			p := &authz.UserPermissions{
+				UserID: 1,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+			}
+			if err := s.LoadUserPermissions(ctx, p); err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "IDs", []uint32{1, 2}, bitmapToArray(p.IDs))
+			equal(t, "UpdatedAt", time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), p.UpdatedAt.UTC())
+
+			err := checkRegularPermsTable(s, `SELECT repo_id, user_ids FROM repo_permissions`, map[int32][]uint32{
+				1: {1},
+				2: {1},
+			})
+			if err != nil {
+				t.Fatal("repo_permissions:", err)
+			}
+		})
+
+		t.Run("mappings disagree", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupPermsTables(t, s)
+
+			dump := `{"table":"user_permissions","id":1,"permission":"read","object_type":"repos","ids":[1],"updated_at":"2020-01-01T00:00:00Z"}
+{"table":"repo_permissions","id":1,"permission":"read","ids":[1,2],"updated_at":"2020-01-01T00:00:00Z"}
+`
+			if err := s.ImportPermissions(ctx, bytes.NewBufferString(dump), PermsFormatJSON); err == nil {
+				t.Fatal("expected an error but got nil")
+			}
+
+			err := s.LoadUserPermissions(ctx, &authz.UserPermissions{
+				UserID: 1,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+			})
+			if err != authz.ErrPermsNotFound {
+				t.Fatalf("err: want %q but got %v", authz.ErrPermsNotFound, err)
+			}
+		})
+	}
+}
+
+func testPermsStore_ImportRepoPermissions(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+		fixture := func() []*authz.RepoPermissions {
+			return []*authz.RepoPermissions{
+				{RepoID: 1, Perm: authz.Read, UserIDs: toBitmap(1, 2)},
+				{RepoID: 2, Perm: authz.Read, UserIDs: toBitmap(2, 3)},
+				{RepoID: 3, Perm: authz.Read},
+			}
+		}
+
+		t.Run("import", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupPermsTables(t, s)
+
+			if err := s.ImportRepoPermissions(ctx, fixture()); err != nil {
+				t.Fatal(err)
+			}
+
+			err := checkRegularPermsTable(s, `SELECT user_id, object_ids FROM user_permissions`, map[int32][]uint32{
+				1: {1},
+				2: {1, 2},
+				3: {2},
+			})
+			if err != nil {
+				t.Fatal("user_permissions:", err)
+			}
+
+			err = checkRegularPermsTable(s, `SELECT repo_id, user_ids FROM repo_permissions`, map[int32][]uint32{
+				1: {1, 2},
+				2: {2, 3},
+				3: {},
+			})
+			if err != nil {
+				t.Fatal("repo_permissions:", err)
+			}
+
+			// Imported permissions are updated like any other.
+			if err = s.SetRepoPermissions(ctx, &authz.RepoPermissions{
+				RepoID:  1,
+				Perm:    authz.Read,
+				UserIDs: toBitmap(3),
+			}); err != nil {
+				t.Fatal(err)
+			}
+			err = checkRegularPermsTable(s, `SELECT user_id, object_ids FROM user_permissions`, map[int32][]uint32{
+				1: {},
+				2: {2},
+				3: {1, 2},
+			})
+			if err != nil {
+				t.Fatal("user_permissions:", err)
+			}
+		})
+
+		t.Run("tables not empty", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupPermsTables(t, s)
+
+			if err := s.ImportRepoPermissions(ctx, fixture()); err != nil {
+				t.Fatal(err)
+			}
+			err := s.ImportRepoPermissions(ctx, fixture())
+			if err != ErrPermsTablesNotEmpty {
+				t.Fatalf("err: want %q but got %v", ErrPermsTablesNotEmpty, err)
+			}
+		})
+
+		t.Run("duplicated repository", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupPermsTables(t, s)
+
+			ps := append(fixture(), &authz.RepoPermissions{RepoID: 1, Perm: authz.Read, UserIDs: toBitmap(4)})
+			if err := s.ImportRepoPermissions(ctx, ps); err == nil {
+				t.Fatal("expected an error but got nil")
+			}
+
+			err := checkRegularPermsTable(s, `SELECT repo_id, user_ids FROM repo_permissions`, map[int32][]uint32{})
+			if err != nil {
+				t.Fatal("repo_permissions:", err)
+			}
+		})
+	}
+}
+
+func BenchmarkPermsStore_ImportRepoPermissions(b *testing.B) {
+	db, cleanup := dbtest.NewDB(b, *dsn)
+	defer cleanup()
+
+	// Every repository is readable by a tenth of all users, so that every user has
+	// permissions to a tenth of all repositories.
+	const numRepos, numUsers = 1000, 1000
+	fixture := func() []*authz.RepoPermissions {
+		ps := make([]*authz.RepoPermissions, 0, numRepos)
+		for i := 0; i < numRepos; i++ {
+			userIDs := roaring.NewBitmap()
+			for id := 1 + i%10; id <= numUsers; id += 10 {
+				userIDs.Add(uint32(id))
+			}
+			ps = append(ps, &authz.RepoPermissions{
+				RepoID:  int32(i + 1),
+				Perm:    authz.Read,
+				UserIDs: userIDs,
+			})
+		}
+		return ps
+	}
+
+	ctx := context.Background()
+	for _, name := range []string{"SetRepoPermissions", "ImportRepoPermissions"} {
+		b.Run(name, func(b *testing.B) {
+			s := NewPermsStore(db, clock)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				ps := fixture()
+				b.StartTimer()
+
+				if name == "ImportRepoPermissions" {
+					if err := s.ImportRepoPermissions(ctx, ps); err != nil {
+						b.Fatal(err)
+					}
+				} else {
+					for _, p := range ps {
+						if err := s.SetRepoPermissions(ctx, p); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+
+				b.StopTimer()
+				q := `TRUNCATE TABLE user_permissions, repo_permissions`
+				if err := s.execute(ctx, sqlf.Sprintf(q)); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/keegancsmith/sqlf"
+	"github.com/lib/pq"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+)
+
+// recordRepoPermissionsGrants records p.UpdatedAt as the time at which users in added were
+// added to the repository, and forgets the times of users in removed. A user added again
+// after being removed gets a new time. It must be called within a transaction.
+func (s *PermsStore) recordRepoPermissionsGrants(ctx context.Context, p *authz.RepoPermissions, added, removed *roaring.Bitmap) error {
+	if !added.IsEmpty() {
+		q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_grants.go:PermsStore.recordRepoPermissionsGrants
+INSERT INTO repo_permissions_grants
+  (repo_id, permission, user_id, added_at)
+SELECT %s, %s, unnest(%s::integer[]), %s
+ON CONFLICT ON CONSTRAINT
+  repo_permissions_grants_perm_user_unique
+DO UPDATE SET
+  added_at = excluded.added_at
+`, p.RepoID, p.Perm.String(), pq.Array(bitmapToInt64s(added)), p.UpdatedAt.UTC())
+		if err := s.execute(ctx, q); err != nil {
+			return errors.Wrap(err, "execute upsert repo permissions grants query")
+		}
+	}
+
+	if !removed.IsEmpty() {
+		q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_grants.go:PermsStore.recordRepoPermissionsGrants
+DELETE FROM repo_permissions_grants
+WHERE repo_id = %s
+AND permission = %s
+AND user_id = ANY(%s::integer[])
+`, p.RepoID, p.Perm.String(), pq.Array(bitmapToInt64s(removed)))
+		if err := s.execute(ctx, q); err != nil {
+			return errors.Wrap(err, "execute delete repo permissions grants query")
+		}
+	}
+
+	return nil
+}
+
+// recordPermissionsGrants is like recordRepoPermissionsGrants, but for the users added to and
+// removed from many repositories at once, keyed by repository and permission. Users in added
+// are recorded as added at addedAt. It must be called within a transaction.
+func (s *PermsStore) recordPermissionsGrants(ctx context.Context, added, removed map[repoPermsKey]*roaring.Bitmap, addedAt time.Time) error {
+	if repoIDs, perms, userIDs := flattenPermissionsGrants(added); len(repoIDs) > 0 {
+		q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_grants.go:PermsStore.recordPermissionsGrants
+INSERT INTO repo_permissions_grants
+  (repo_id, permission, user_id, added_at)
+SELECT k.repo_id, k.permission, k.user_id, %s
+FROM unnest(%s::integer[], %s::text[], %s::integer[]) AS k(repo_id, permission, user_id)
+ON CONFLICT ON CONSTRAINT
+  repo_permissions_grants_perm_user_unique
+DO UPDATE SET
+  added_at = excluded.added_at
+`, addedAt.UTC(), pq.Array(repoIDs), pq.Array(perms), pq.Array(userIDs))
+		if err := s.execute(ctx, q); err != nil {
+			return errors.Wrap(err, "execute upsert permissions grants query")
+		}
+	}
+
+	if repoIDs, perms, userIDs := flattenPermissionsGrants(removed); len(repoIDs) > 0 {
+		q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_grants.go:PermsStore.recordPermissionsGrants
+DELETE FROM repo_permissions_grants AS g
+USING unnest(%s::integer[], %s::text[], %s::integer[]) AS k(repo_id, permission, user_id)
+WHERE g.repo_id = k.repo_id
+AND g.permission = k.permission
+AND g.user_id = k.user_id
+`, pq.Array(repoIDs), pq.Array(perms), pq.Array(userIDs))
+		if err := s.execute(ctx, q); err != nil {
+			return errors.Wrap(err, "execute delete permissions grants query")
+		}
+	}
+
+	return nil
+}
+
+// flattenPermissionsGrants returns the repository, permission and user of every grant in m as
+// parallel slices usable with pq.Array.
+func flattenPermissionsGrants(m map[repoPermsKey]*roaring.Bitmap) (repoIDs []int64, perms []string, userIDs []int64) {
+	for key, ids := range m {
+		for _, id := range bitmapToInt64s(ids) {
+			repoIDs = append(repoIDs, int64(key.repoID))
+			perms = append(perms, key.perm.String())
+			userIDs = append(userIDs, id)
+		}
+	}
+	return repoIDs, perms, userIDs
+}
+
+// deleteUsersPermissionsGrants forgets the times at which given users were added to any
+// repository.
+func (s *PermsStore) deleteUsersPermissionsGrants(ctx context.Context, userIDs []int32) error {
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_grants.go:PermsStore.deleteUsersPermissionsGrants
+DELETE FROM repo_permissions_grants
+WHERE user_id = ANY(%s)
+`, pq.Array(userIDs))
+	if err := s.execute(ctx, q); err != nil {
+		return errors.Wrap(err, "execute delete users permissions grants query")
+	}
+	return nil
+}
+
+// bitmapToInt64s returns the IDs of bm as a slice usable with pq.Array.
+func bitmapToInt64s(bm *roaring.Bitmap) []int64 {
+	ids := make([]int64, 0, bm.GetCardinality())
+	it := bm.Iterator()
+	for it.HasNext() {
+		ids = append(ids, int64(it.Next()))
+	}
+	return ids
+}
+
+// LoadRepoPermissionsWithAddedAt is like LoadRepoPermissions, but also returns the time at
+// which each user in p.UserIDs was added to the repository, by any method that grants users
+// access to repositories, e.g. SetRepoPermissions, SetUserPermissions, GrantPendingPermissions
+// or the imports. The time of a user is kept across updates for as long as the user is not
+// removed. Users granted before times were recorded are absent from the returned map.
+func (s *PermsStore) LoadRepoPermissionsWithAddedAt(ctx context.Context, p *authz.RepoPermissions) (addedAt map[int32]time.Time, err error) {
+	ctx, save := s.observe(ctx, "LoadRepoPermissionsWithAddedAt", "")
+	defer func() { save(&err, append(p.TracingFields(), otlog.Int("addedAt.count", len(addedAt)))...) }()
+
+	r := s.reads()
+	if err = r.LoadRepoPermissions(ctx, p); err != nil {
+		return nil, err
+	}
+
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_grants.go:PermsStore.LoadRepoPermissionsWithAddedAt
+SELECT user_id, added_at
+FROM repo_permissions_grants
+WHERE repo_id = %s
+AND permission = %s
+`, p.RepoID, p.Perm.String())
+	rows, err := r.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	addedAt = make(map[int32]time.Time)
+	for rows.Next() {
+		var userID int32
+		var t time.Time
+		if err = rows.Scan(&userID, &t); err != nil {
+			return nil, err
+		}
+		// Users may have been removed from the repository by DeleteAllUserPermissions,
+		// which doesn't update the "repo_permissions" table nor forget their times.
+		if p.UserIDs.Contains(uint32(userID)) {
+			addedAt[userID] = t
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return addedAt, nil
+}
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/keegancsmith/sqlf"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+	"github.com/sourcegraph/sourcegraph/internal/extsvc"
+)
+
+func testPermsStore_LoadRepoPermissionsWithAddedAt(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+		start := clock().UTC()
+		tc := NewTestClock(start)
+		s := NewPermsStore(db, clock).WithClock(tc)
+		defer cleanupPermsTables(t, s)
+
+		for i, ids := range [][]uint32{{1, 2}, {2, 3}, {1, 2, 3}} {
+			if i > 0 {
+				tc.Advance(time.Hour)
+			}
+			if err := s.SetRepoPermissions(ctx, &authz.RepoPermissions{
+				RepoID:  1,
+				Perm:    authz.Read,
+				UserIDs: toBitmap(ids...),
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		loadAddedAt := func(t *testing.T) map[int32]time.Time {
+			t.Helper()
+			addedAt, err := s.LoadRepoPermissionsWithAddedAt(ctx, &authz.RepoPermissions{RepoID: 1, Perm: authz.Read})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for id, at := range addedAt {
+				addedAt[id] = at.UTC()
+			}
+			return addedAt
+		}
+
+		// User 2 keeps the time it was first added, and user 1 gets a new time
+		// after being removed and added again.
+		equal(t, "addedAt", map[int32]time.Time{
+			1: start.Add(2 * time.Hour),
+			2: start,
+			3: start.Add(time.Hour),
+		}, loadAddedAt(t))
+
+		// Users removed and added by SetUserPermissions are recorded as well.
+		setUserPermissions := func(t *testing.T, userID int32, ids ...uint32) {
+			t.Helper()
+			if err := s.SetUserPermissions(ctx, &authz.UserPermissions{
+				UserID: userID,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+				IDs:    toBitmap(ids...),
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		setUserPermissions(t, 3)
+		equal(t, "addedAt", map[int32]time.Time{
+			1: start.Add(2 * time.Hour),
+			2: start,
+		}, loadAddedAt(t))
+
+		tc.Advance(time.Hour)
+		setUserPermissions(t, 3, 1)
+		equal(t, "addedAt", map[int32]time.Time{
+			1: start.Add(2 * time.Hour),
+			2: start,
+			3: start.Add(3 * time.Hour),
+		}, loadAddedAt(t))
+
+		// Users granted by GrantPendingPermissions get a time, unless they were already members.
+		tc.Advance(time.Hour)
+		accounts := &extsvc.ExternalAccounts{
+			ServiceType: "sourcegraph",
+			ServiceID:   "https://sourcegraph.com/",
+			AccountIDs:  []string{"bob", "dave"},
+		}
+		if err := s.SetRepoPendingPermissions(ctx, accounts, &authz.RepoPermissions{
+			RepoID: 1,
+			Perm:   authz.Read,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		for userID, bindID := range map[int32]string{2: "bob", 4: "dave"} {
+			if err := s.GrantPendingPermissions(ctx, userID, &authz.UserPendingPermissions{
+				ServiceType: accounts.ServiceType,
+				ServiceID:   accounts.ServiceID,
+				BindID:      bindID,
+				Perm:        authz.Read,
+				Type:        authz.PermRepos,
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		equal(t, "addedAt", map[int32]time.Time{
+			1: start.Add(2 * time.Hour),
+			2: start,
+			3: start.Add(3 * time.Hour),
+			4: start.Add(4 * time.Hour),
+		}, loadAddedAt(t))
+
+		// Users deleted by DeleteAllUserPermissionsBatch are forgotten.
+		if err := s.DeleteAllUserPermissionsBatch(ctx, []int32{1, 4}); err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "addedAt", map[int32]time.Time{
+			2: start,
+			3: start.Add(3 * time.Hour),
+		}, loadAddedAt(t))
+		ids, err := s.loadIDs(ctx, sqlf.Sprintf(`SELECT user_id FROM repo_permissions_grants`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "recorded users", []uint32{2, 3}, bitmapToArray(ids))
+
+		_, err = s.LoadRepoPermissionsWithAddedAt(ctx, &authz.RepoPermissions{RepoID: 2, Perm: authz.Read})
+		if err != authz.ErrPermsNotFound {
+			t.Fatalf("err: want %q but got %v", authz.ErrPermsNotFound, err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// RemovalGuard bounds the number of users a single SetRepoPermissions may revoke access
+// from, to detect catastrophic changes such as an upstream ACL glitch that would
+// otherwise silently revoke permissions of everyone. A zero value for a limit means
+// removals are not bounded by it.
+type RemovalGuard struct {
+	MaxCount    int     // Maximum number of users removed.
+	MaxFraction float64 // Maximum fraction of the currently stored users removed, between 0 and 1.
+
+	// Confirm is called with the details of a change exceeding a limit before anything
+	// is written. The change is committed if it returns nil, and aborted with the returned
+	// error otherwise. When Confirm is nil, changes exceeding a limit are aborted with
+	// a *LargeRemovalError.
+	Confirm func(ctx context.Context, err *LargeRemovalError) error
+}
+
+// LargeRemovalError is returned by SetRepoPermissions when a change exceeds a limit of
+// the RemovalGuard of the PermsStore.
+type LargeRemovalError struct {
+	RepoID   int32
+	Perm     authz.Perms
+	Removed  *roaring.Bitmap // User IDs that would no longer have permissions.
+	Existing int             // Number of currently stored user IDs.
+}
+
+func (e *LargeRemovalError) Error() string {
+	return fmt.Sprintf("refusing to remove %d of %d users from %q permissions of repository %d",
+		e.Removed.GetCardinality(), e.Existing, e.Perm, e.RepoID)
+}
+
+// WithRemovalGuard returns a copy of the PermsStore that checks every change made by
+// SetRepoPermissions and SetRepoPermissionsInBatches against given guard.
+func (s *PermsStore) WithRemovalGuard(guard RemovalGuard) *PermsStore {
+	c := s.clone()
+	c.guard = &guard
+	return c
+}
+
+// checkRemoval returns an error if the removal of user IDs from the currently stored
+// oldIDs exceeds a limit of the RemovalGuard and is not confirmed.
+func (s *PermsStore) checkRemoval(ctx context.Context, p *authz.RepoPermissions, oldIDs, removed *roaring.Bitmap) error {
+	if s.guard == nil || removed.IsEmpty() {
+		return nil
+	}
+
+	count := int(removed.GetCardinality())
+	existing := int(oldIDs.GetCardinality())
+	exceeded := s.guard.MaxCount > 0 && count > s.guard.MaxCount
+	if s.guard.MaxFraction > 0 && float64(count)/float64(existing) > s.guard.MaxFraction {
+		exceeded = true
+	}
+	if !exceeded {
+		return nil
+	}
+
+	err := &LargeRemovalError{
+		RepoID:   p.RepoID,
+		Perm:     p.Perm,
+		Removed:  removed,
+		Existing: existing,
+	}
+	if s.guard.Confirm == nil {
+		return err
+	}
+	return s.guard.Confirm(ctx, err)
+}
+
+// GrantGuard bounds the number of object IDs a single SetUserPermissions may write for
+// a user, to detect runaway grants such as an upstream bug granting a user access to
+// every repository, which would be both suspicious and expensive to store. A zero
+// MaxIDs means grants are not bounded.
+type GrantGuard struct {
+	MaxIDs int // Maximum number of object IDs of a single user.
+
+	// Truncate makes changes exceeding MaxIDs keep only the MaxIDs smallest object IDs
+	// and log a warning, instead of being aborted with a *LargeGrantError.
+	Truncate bool
+}
+
+// LargeGrantError is returned by SetUserPermissions when a change exceeds the MaxIDs of
+// the GrantGuard of the PermsStore.
+type LargeGrantError struct {
+	UserID int32
+	Perm   authz.Perms
+	Type   authz.PermType
+	Count  int // Number of object IDs of the change.
+	Max    int // Maximum number of object IDs allowed.
+}
+
+func (e *LargeGrantError) Error() string {
+	return fmt.Sprintf("refusing to grant %d %s (maximum %d) to user %d with %q permissions",
+		e.Count, e.Type, e.Max, e.UserID, e.Perm)
+}
+
+// WithGrantGuard returns a copy of the PermsStore that checks every change made by
+// SetUserPermissions against given guard.
+func (s *PermsStore) WithGrantGuard(guard GrantGuard) *PermsStore {
+	c := s.clone()
+	c.grantGuard = &guard
+	return c
+}
+
+// checkGrant returns an error if the object IDs of p exceed the MaxIDs of the GrantGuard,
+// unless the guard truncates them, in which case p.IDs is replaced by the truncated set.
+func (s *PermsStore) checkGrant(p *authz.UserPermissions) error {
+	if s.grantGuard == nil || s.grantGuard.MaxIDs <= 0 || p.IDs == nil {
+		return nil
+	}
+
+	count := int(p.IDs.GetCardinality())
+	if count <= s.grantGuard.MaxIDs {
+		return nil
+	}
+
+	err := &LargeGrantError{
+		UserID: p.UserID,
+		Perm:   p.Perm,
+		Type:   p.Type,
+		Count:  count,
+		Max:    s.grantGuard.MaxIDs,
+	}
+	if !s.grantGuard.Truncate {
+		return err
+	}
+
+	first, selectErr := p.IDs.Select(uint32(s.grantGuard.MaxIDs))
+	if selectErr != nil {
+		return selectErr
+	}
+	ids := p.IDs.Clone()
+	ids.RemoveRange(uint64(first), math.MaxUint32+1)
+	p.IDs = ids
+
+	log15.Warn("Truncated user permissions", "userID", p.UserID, "perm", p.Perm, "type", p.Type, "count", count, "max", err.Max)
+	return nil
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+)
+
+func testPermsStore_WithRemovalGuard(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+
+		// setup grants 1000 users permissions to the repository.
+		setup := func(t *testing.T, s *PermsStore) {
+			t.Helper()
+			ids := roaring.NewBitmap()
+			ids.AddRange(1, 1001)
+			if err := s.SetRepoPermissions(ctx, &authz.RepoPermissions{
+				RepoID:  1,
+				Perm:    authz.Read,
+				UserIDs: ids,
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// set replaces the users of the repository by the first n users.
+		set := func(s *PermsStore, n uint64) error {
+			ids := roaring.NewBitmap()
+			ids.AddRange(1, n+1)
+			return s.SetRepoPermissions(ctx, &authz.RepoPermissions{
+				RepoID:  1,
+				Perm:    authz.Read,
+				UserIDs: ids,
+			})
+		}
+		count := func(t *testing.T, s *PermsStore) uint64 {
+			t.Helper()
+			p := &authz.RepoPermissions{RepoID: 1, Perm: authz.Read}
+			if err := s.LoadRepoPermissions(ctx, p); err != nil {
+				t.Fatal(err)
+			}
+			return p.UserIDs.GetCardinality()
+		}
+
+		t.Run("below thresholds", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupPermsTables(t, s)
+			setup(t, s)
+
+			s = s.WithRemovalGuard(RemovalGuard{MaxCount: 100, MaxFraction: 0.1})
+			if err := set(s, 900); err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "count", uint64(900), count(t, s))
+		})
+
+		t.Run("large removal is aborted", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupPermsTables(t, s)
+			setup(t, s)
+
+			for _, guard := range []RemovalGuard{{MaxCount: 500}, {MaxFraction: 0.5}} {
+				err := set(s.WithRemovalGuard(guard), 1)
+				var lre *LargeRemovalError
+				if !errors.As(err, &lre) {
+					t.Fatalf("%+v: want *LargeRemovalError but got %v", guard, err)
+				}
+				equal(t, "removed", uint64(999), lre.Removed.GetCardinality())
+				equal(t, "existing", 1000, lre.Existing)
+				equal(t, "count", uint64(1000), count(t, s))
+
+				// User permissions must not have been revoked either.
+				up := &authz.UserPermissions{UserID: 1000, Perm: authz.Read, Type: authz.PermRepos}
+				if err := s.LoadUserPermissions(ctx, up); err != nil {
+					t.Fatal(err)
+				}
+				equal(t, "user IDs", []uint32{1}, bitmapToArray(up.IDs))
+			}
+		})
+
+		t.Run("confirm", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupPermsTables(t, s)
+			setup(t, s)
+
+			errDenied := errors.New("denied")
+			var calls int
+			confirm := func(allow bool) func(context.Context, *LargeRemovalError) error {
+				return func(_ context.Context, err *LargeRemovalError) error {
+					calls++
+					if allow {
+						return nil
+					}
+					return errDenied
+				}
+			}
+
+			guard := RemovalGuard{MaxFraction: 0.5, Confirm: confirm(false)}
+			if err := set(s.WithRemovalGuard(guard), 1); err != errDenied {
+				t.Fatalf("want %v but got %v", errDenied, err)
+			}
+			equal(t, "count", uint64(1000), count(t, s))
+
+			guard.Confirm = confirm(true)
+			if err := set(s.WithRemovalGuard(guard), 1); err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "count", uint64(1), count(t, s))
+			equal(t, "calls", 2, calls)
+		})
+	}
+}
+
+func testPermsStore_WithGrantGuard(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+
+		// set grants the user permissions to the first n repositories.
+		set := func(s *PermsStore, n uint64) error {
+			ids := roaring.NewBitmap()
+			ids.AddRange(1, n+1)
+			return s.SetUserPermissions(ctx, &authz.UserPermissions{
+				UserID: 1,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+				IDs:    ids,
+			})
+		}
+		count := func(t *testing.T, s *PermsStore) uint64 {
+			t.Helper()
+			p := &authz.UserPermissions{UserID: 1, Perm: authz.Read, Type: authz.PermRepos}
+			if err := s.LoadUserPermissions(ctx, p); err != nil {
+				t.Fatal(err)
+			}
+			return p.IDs.GetCardinality()
+		}
+
+		t.Run("below threshold", func(t *testing.T) {
+			s := NewPermsStore(db, clock).WithGrantGuard(GrantGuard{MaxIDs: 100})
+			defer cleanupPermsTables(t, s)
+
+			if err := set(s, 100); err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "count", uint64(100), count(t, s))
+		})
+
+		t.Run("large grant is aborted", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupPermsTables(t, s)
+
+			if err := set(s, 10); err != nil {
+				t.Fatal(err)
+			}
+
+			err := set(s.WithGrantGuard(GrantGuard{MaxIDs: 100}), 101)
+			var lge *LargeGrantError
+			if !errors.As(err, &lge) {
+				t.Fatalf("want *LargeGrantError but got %v", err)
+			}
+			equal(t, "count", 101, lge.Count)
+			equal(t, "max", 100, lge.Max)
+
+			// Stored permissions must not have changed.
+			equal(t, "count", uint64(10), count(t, s))
+			rp := &authz.RepoPermissions{RepoID: 11, Perm: authz.Read}
+			if err := s.LoadRepoPermissions(ctx, rp); err != authz.ErrPermsNotFound {
+				t.Fatalf("want %v but got %v", authz.ErrPermsNotFound, err)
+			}
+		})
+
+		t.Run("large grant is truncated", func(t *testing.T) {
+			s := NewPermsStore(db, clock).WithGrantGuard(GrantGuard{MaxIDs: 100, Truncate: true})
+			defer cleanupPermsTables(t, s)
+
+			if err := set(s, 1000); err != nil {
+				t.Fatal(err)
+			}
+
+			p := &authz.UserPermissions{UserID: 1, Perm: authz.Read, Type: authz.PermRepos}
+			if err := s.LoadUserPermissions(ctx, p); err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "count", uint64(100), p.IDs.GetCardinality())
+			equal(t, "maximum", uint32(100), p.IDs.Maximum())
+
+			// Truncated object IDs are not granted on the repository side either.
+			rp := &authz.RepoPermissions{RepoID: 101, Perm: authz.Read}
+			if err := s.LoadRepoPermissions(ctx, rp); err != authz.ErrPermsNotFound {
+				t.Fatalf("want %v but got %v", authz.ErrPermsNotFound, err)
+			}
+		})
+	}
+}
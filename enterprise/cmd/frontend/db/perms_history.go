@@ -0,0 +1,293 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/keegancsmith/sqlf"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+)
+
+// PermsHistoryRetention bounds the number of changes of repository permissions retained for
+// auditing. A zero value for a limit means changes are not bounded by it.
+type PermsHistoryRetention struct {
+	MaxVersions int           // Maximum number of changes retained per repository and permission.
+	MaxAge      time.Duration // Maximum age of changes retained.
+}
+
+// RepoPermissionsChange is a recorded change of the user IDs that have permissions to a repository.
+type RepoPermissionsChange struct {
+	RepoID    int32
+	Perm      authz.Perms
+	Added     *roaring.Bitmap // User IDs that have been granted permissions.
+	Removed   *roaring.Bitmap // User IDs that no longer have permissions.
+	ChangedAt time.Time
+}
+
+// WithRepoPermissionsHistory returns a copy of the PermsStore that records every change made by
+// SetRepoPermissions, to be queried with RepoPermissionsDiff. Changes beyond the retention are
+// deleted whenever a new change of the same repository is recorded.
+func (s *PermsStore) WithRepoPermissionsHistory(retention PermsHistoryRetention) *PermsStore {
+	c := s.clone()
+	c.history = &retention
+	return c
+}
+
+// recordRepoPermissionsChange records a change of repository permissions if the history is
+// enabled, and deletes changes of the repository beyond the retention. It must be called
+// within a transaction.
+func (s *PermsStore) recordRepoPermissionsChange(ctx context.Context, p *authz.RepoPermissions, added, removed *roaring.Bitmap) error {
+	if s.history == nil {
+		return nil
+	}
+
+	addedIDs, err := marshalBitmap(added)
+	if err != nil {
+		return err
+	}
+	removedIDs, err := marshalBitmap(removed)
+	if err != nil {
+		return err
+	}
+
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_history.go:PermsStore.recordRepoPermissionsChange
+INSERT INTO repo_permissions_changes
+  (repo_id, permission, added_user_ids, removed_user_ids, changed_at)
+VALUES
+  (%s, %s, %s, %s, %s)
+`, p.RepoID, p.Perm.String(), addedIDs, removedIDs, p.UpdatedAt.UTC())
+	if err = s.execute(ctx, q); err != nil {
+		return errors.Wrap(err, "execute insert repo permissions change query")
+	}
+
+	if s.history.MaxAge > 0 {
+		q = sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_history.go:PermsStore.recordRepoPermissionsChange
+DELETE FROM repo_permissions_changes
+WHERE repo_id = %s
+AND permission = %s
+AND changed_at < %s
+`, p.RepoID, p.Perm.String(), p.UpdatedAt.Add(-s.history.MaxAge).UTC())
+		if err = s.execute(ctx, q); err != nil {
+			return errors.Wrap(err, "execute delete expired repo permissions changes query")
+		}
+	}
+
+	if s.history.MaxVersions > 0 {
+		q = sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_history.go:PermsStore.recordRepoPermissionsChange
+DELETE FROM repo_permissions_changes
+WHERE id IN (
+	SELECT id
+	FROM repo_permissions_changes
+	WHERE repo_id = %s
+	AND permission = %s
+	ORDER BY changed_at DESC, id DESC
+	OFFSET %s
+)
+`, p.RepoID, p.Perm.String(), s.history.MaxVersions)
+		if err = s.execute(ctx, q); err != nil {
+			return errors.Wrap(err, "execute delete excess repo permissions changes query")
+		}
+	}
+
+	return nil
+}
+
+// RepoPermissionsDiff returns the recorded changes of permissions of the repository made between
+// from and to (both inclusive), in the order they were made. Only changes made by a PermsStore
+// with the history enabled (see WithRepoPermissionsHistory) and still retained are returned.
+func (s *PermsStore) RepoPermissionsDiff(ctx context.Context, repoID int32, from, to time.Time) (_ []*RepoPermissionsChange, err error) {
+	ctx, save := s.observe(ctx, "RepoPermissionsDiff", "")
+	defer func() {
+		save(&err,
+			otlog.Int32("repoID", repoID),
+			otlog.String("from", from.String()),
+			otlog.String("to", to.String()),
+		)
+	}()
+
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_history.go:PermsStore.RepoPermissionsDiff
+SELECT permission, added_user_ids, removed_user_ids, changed_at
+FROM repo_permissions_changes
+WHERE repo_id = %s
+AND changed_at >= %s
+AND changed_at <= %s
+ORDER BY changed_at, id
+`, repoID, from.UTC(), to.UTC())
+	rows, err := s.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []*RepoPermissionsChange
+	for rows.Next() {
+		var perm string
+		var addedIDs, removedIDs []byte
+		c := &RepoPermissionsChange{
+			RepoID:  repoID,
+			Added:   roaring.NewBitmap(),
+			Removed: roaring.NewBitmap(),
+		}
+		if err = rows.Scan(&perm, &addedIDs, &removedIDs, &c.ChangedAt); err != nil {
+			return nil, err
+		}
+
+		if c.Perm, err = parsePerms(perm); err != nil {
+			return nil, err
+		}
+		if err = unmarshalBitmap(c.Added, addedIDs); err != nil {
+			return nil, err
+		}
+		if err = unmarshalBitmap(c.Removed, removedIDs); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// UserPermissionsSnapshot is a recorded state of the object IDs of user permissions prior to a change.
+type UserPermissionsSnapshot struct {
+	UserID     int32
+	Perm       authz.Perms
+	Type       authz.PermType
+	IDs        *roaring.Bitmap // Object IDs the user had permissions to before the change.
+	RecordedAt time.Time       // The time of the change.
+}
+
+// WithUserPermissionsHistory returns a copy of the PermsStore that records the object IDs of a
+// user before every change made by SetUserPermissions, to be queried with LoadUserPermissionsHistory.
+// Nothing is recorded for the first permissions set for a user. Snapshots beyond the retention are
+// deleted whenever a new snapshot of the same user is recorded.
+func (s *PermsStore) WithUserPermissionsHistory(retention PermsHistoryRetention) *PermsStore {
+	c := s.clone()
+	c.userHistory = &retention
+	return c
+}
+
+// recordUserPermissionsSnapshot records oldIDs as the object IDs of the user permissions p before
+// their change if the history is enabled, and deletes snapshots of the user beyond the retention.
+// It must be called within a transaction.
+func (s *PermsStore) recordUserPermissionsSnapshot(ctx context.Context, p *authz.UserPermissions, oldIDs *roaring.Bitmap) error {
+	if s.userHistory == nil {
+		return nil
+	}
+
+	ids, err := marshalBitmap(oldIDs)
+	if err != nil {
+		return err
+	}
+
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_history.go:PermsStore.recordUserPermissionsSnapshot
+INSERT INTO user_permissions_history
+  (user_id, permission, object_type, object_ids, recorded_at)
+VALUES
+  (%s, %s, %s, %s, %s)
+`, p.UserID, p.Perm.String(), p.Type, ids, p.UpdatedAt.UTC())
+	if err = s.execute(ctx, q); err != nil {
+		return errors.Wrap(err, "execute insert user permissions history query")
+	}
+
+	if s.userHistory.MaxAge > 0 {
+		q = sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_history.go:PermsStore.recordUserPermissionsSnapshot
+DELETE FROM user_permissions_history
+WHERE user_id = %s
+AND permission = %s
+AND object_type = %s
+AND recorded_at < %s
+`, p.UserID, p.Perm.String(), p.Type, p.UpdatedAt.Add(-s.userHistory.MaxAge).UTC())
+		if err = s.execute(ctx, q); err != nil {
+			return errors.Wrap(err, "execute delete expired user permissions history query")
+		}
+	}
+
+	if s.userHistory.MaxVersions > 0 {
+		q = sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_history.go:PermsStore.recordUserPermissionsSnapshot
+DELETE FROM user_permissions_history
+WHERE id IN (
+	SELECT id
+	FROM user_permissions_history
+	WHERE user_id = %s
+	AND permission = %s
+	AND object_type = %s
+	ORDER BY recorded_at DESC, id DESC
+	OFFSET %s
+)
+`, p.UserID, p.Perm.String(), p.Type, s.userHistory.MaxVersions)
+		if err = s.execute(ctx, q); err != nil {
+			return errors.Wrap(err, "execute delete excess user permissions history query")
+		}
+	}
+
+	return nil
+}
+
+// LoadUserPermissionsHistory returns at most limit recorded snapshots of the object IDs of the user,
+// most recent first, or all of them if limit is not positive. Only snapshots recorded by a PermsStore
+// with the history enabled (see WithUserPermissionsHistory) and still retained are returned.
+func (s *PermsStore) LoadUserPermissionsHistory(ctx context.Context, userID int32, limit int) (_ []*UserPermissionsSnapshot, err error) {
+	ctx, save := s.observe(ctx, "LoadUserPermissionsHistory", "")
+	defer func() { save(&err, otlog.Int32("userID", userID), otlog.Int("limit", limit)) }()
+
+	var limitClause *sqlf.Query
+	if limit > 0 {
+		limitClause = sqlf.Sprintf("LIMIT %s", limit)
+	} else {
+		limitClause = sqlf.Sprintf("")
+	}
+
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_history.go:PermsStore.LoadUserPermissionsHistory
+SELECT permission, object_type, object_ids, recorded_at
+FROM user_permissions_history
+WHERE user_id = %s
+ORDER BY recorded_at DESC, id DESC
+%s
+`, userID, limitClause)
+	rows, err := s.reads().db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var snapshots []*UserPermissionsSnapshot
+	for rows.Next() {
+		var perm, typ string
+		var ids []byte
+		snapshot := &UserPermissionsSnapshot{
+			UserID: userID,
+			IDs:    roaring.NewBitmap(),
+		}
+		if err = rows.Scan(&perm, &typ, &ids, &snapshot.RecordedAt); err != nil {
+			return nil, err
+		}
+
+		if snapshot.Perm, err = parsePerms(perm); err != nil {
+			return nil, err
+		}
+		snapshot.Type = authz.PermType(typ)
+		if err = unmarshalBitmap(snapshot.IDs, ids); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return snapshots, nil
+}
@@ -0,0 +1,221 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+)
+
+func testPermsStore_RepoPermissionsDiff(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+
+		type change struct {
+			Added     []uint32
+			Removed   []uint32
+			ChangedAt time.Time
+		}
+		// setVersions sets three versions of permissions of the repository an hour apart.
+		setVersions := func(t *testing.T, s *PermsStore, tc *TestClock) {
+			t.Helper()
+			for i, ids := range [][]uint32{{1, 2}, {2, 3}, {3}} {
+				if i > 0 {
+					tc.Advance(time.Hour)
+				}
+				if err := s.SetRepoPermissions(ctx, &authz.RepoPermissions{
+					RepoID:  1,
+					Perm:    authz.Read,
+					UserIDs: toBitmap(ids...),
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		diff := func(t *testing.T, s *PermsStore, from, to time.Time) []change {
+			t.Helper()
+			cs, err := s.RepoPermissionsDiff(ctx, 1, from, to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var changes []change
+			for _, c := range cs {
+				changes = append(changes, change{
+					Added:     append([]uint32{}, bitmapToArray(c.Added)...),
+					Removed:   append([]uint32{}, bitmapToArray(c.Removed)...),
+					ChangedAt: c.ChangedAt.UTC(),
+				})
+			}
+			return changes
+		}
+
+		t.Run("query window", func(t *testing.T) {
+			start := clock().UTC()
+			tc := NewTestClock(start)
+			s := NewPermsStore(db, clock).WithClock(tc).WithRepoPermissionsHistory(PermsHistoryRetention{})
+			defer cleanupPermsTables(t, s)
+
+			setVersions(t, s, tc)
+
+			// Unchanged permissions are not recorded.
+			tc.Advance(time.Hour)
+			if err := s.SetRepoPermissions(ctx, &authz.RepoPermissions{
+				RepoID:  1,
+				Perm:    authz.Read,
+				UserIDs: toBitmap(3),
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			equal(t, "changes", []change{
+				{Added: []uint32{3}, Removed: []uint32{1}, ChangedAt: start.Add(time.Hour)},
+				{Added: []uint32{}, Removed: []uint32{2}, ChangedAt: start.Add(2 * time.Hour)},
+			}, diff(t, s, start.Add(30*time.Minute), start.Add(3*time.Hour)))
+		})
+
+		t.Run("history disabled", func(t *testing.T) {
+			start := clock().UTC()
+			tc := NewTestClock(start)
+			s := NewPermsStore(db, clock).WithClock(tc)
+			defer cleanupPermsTables(t, s)
+
+			setVersions(t, s, tc)
+			equal(t, "changes", 0, len(diff(t, s, start, start.Add(3*time.Hour))))
+		})
+
+		t.Run("retain versions", func(t *testing.T) {
+			start := clock().UTC()
+			tc := NewTestClock(start)
+			s := NewPermsStore(db, clock).WithClock(tc).WithRepoPermissionsHistory(PermsHistoryRetention{MaxVersions: 2})
+			defer cleanupPermsTables(t, s)
+
+			setVersions(t, s, tc)
+			equal(t, "changes", []change{
+				{Added: []uint32{3}, Removed: []uint32{1}, ChangedAt: start.Add(time.Hour)},
+				{Added: []uint32{}, Removed: []uint32{2}, ChangedAt: start.Add(2 * time.Hour)},
+			}, diff(t, s, start, start.Add(3*time.Hour)))
+		})
+
+		t.Run("retain age", func(t *testing.T) {
+			start := clock().UTC()
+			tc := NewTestClock(start)
+			s := NewPermsStore(db, clock).WithClock(tc).WithRepoPermissionsHistory(PermsHistoryRetention{MaxAge: 30 * time.Minute})
+			defer cleanupPermsTables(t, s)
+
+			setVersions(t, s, tc)
+			equal(t, "changes", []change{
+				{Added: []uint32{}, Removed: []uint32{2}, ChangedAt: start.Add(2 * time.Hour)},
+			}, diff(t, s, start, start.Add(3*time.Hour)))
+		})
+	}
+}
+
+func testPermsStore_LoadUserPermissionsHistory(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+
+		type snapshot struct {
+			IDs        []uint32
+			RecordedAt time.Time
+		}
+		// setVersions sets four versions of permissions of the user an hour apart,
+		// where the third version is unchanged.
+		setVersions := func(t *testing.T, s *PermsStore, tc *TestClock) {
+			t.Helper()
+			for i, ids := range [][]uint32{{1, 2}, {2, 3}, {2, 3}, {4}} {
+				if i > 0 {
+					tc.Advance(time.Hour)
+				}
+				if err := s.SetUserPermissions(ctx, &authz.UserPermissions{
+					UserID: 1,
+					Perm:   authz.Read,
+					Type:   authz.PermRepos,
+					IDs:    toBitmap(ids...),
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		history := func(t *testing.T, s *PermsStore, limit int) []snapshot {
+			t.Helper()
+			ss, err := s.LoadUserPermissionsHistory(ctx, 1, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var snapshots []snapshot
+			for _, s := range ss {
+				snapshots = append(snapshots, snapshot{
+					IDs:        append([]uint32{}, bitmapToArray(s.IDs)...),
+					RecordedAt: s.RecordedAt.UTC(),
+				})
+			}
+			return snapshots
+		}
+
+		t.Run("accumulate", func(t *testing.T) {
+			start := clock().UTC()
+			tc := NewTestClock(start)
+			s := NewPermsStore(db, clock).WithClock(tc).WithUserPermissionsHistory(PermsHistoryRetention{})
+			defer cleanupPermsTables(t, s)
+
+			setVersions(t, s, tc)
+			equal(t, "snapshots", []snapshot{
+				{IDs: []uint32{2, 3}, RecordedAt: start.Add(3 * time.Hour)},
+				{IDs: []uint32{1, 2}, RecordedAt: start.Add(time.Hour)},
+			}, history(t, s, 0))
+			equal(t, "snapshots", []snapshot{
+				{IDs: []uint32{2, 3}, RecordedAt: start.Add(3 * time.Hour)},
+			}, history(t, s, 1))
+
+			// Removing all permissions records the last ones.
+			tc.Advance(time.Hour)
+			if err := s.SetUserPermissions(ctx, &authz.UserPermissions{
+				UserID: 1,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "snapshots", []snapshot{
+				{IDs: []uint32{4}, RecordedAt: start.Add(4 * time.Hour)},
+				{IDs: []uint32{2, 3}, RecordedAt: start.Add(3 * time.Hour)},
+			}, history(t, s, 2))
+		})
+
+		t.Run("history disabled", func(t *testing.T) {
+			start := clock().UTC()
+			tc := NewTestClock(start)
+			s := NewPermsStore(db, clock).WithClock(tc)
+			defer cleanupPermsTables(t, s)
+
+			setVersions(t, s, tc)
+			equal(t, "snapshots", 0, len(history(t, s, 0)))
+		})
+
+		t.Run("retain versions", func(t *testing.T) {
+			start := clock().UTC()
+			tc := NewTestClock(start)
+			s := NewPermsStore(db, clock).WithClock(tc).WithUserPermissionsHistory(PermsHistoryRetention{MaxVersions: 1})
+			defer cleanupPermsTables(t, s)
+
+			setVersions(t, s, tc)
+			equal(t, "snapshots", []snapshot{
+				{IDs: []uint32{2, 3}, RecordedAt: start.Add(3 * time.Hour)},
+			}, history(t, s, 0))
+		})
+
+		t.Run("retain age", func(t *testing.T) {
+			start := clock().UTC()
+			tc := NewTestClock(start)
+			s := NewPermsStore(db, clock).WithClock(tc).WithUserPermissionsHistory(PermsHistoryRetention{MaxAge: 90 * time.Minute})
+			defer cleanupPermsTables(t, s)
+
+			setVersions(t, s, tc)
+			equal(t, "snapshots", []snapshot{
+				{IDs: []uint32{2, 3}, RecordedAt: start.Add(3 * time.Hour)},
+			}, history(t, s, 0))
+		})
+	}
+}
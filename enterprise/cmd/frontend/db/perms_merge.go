@@ -0,0 +1,92 @@
+package db
+
+import (
+	"context"
+
+	"github.com/RoaringBitmap/roaring"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+)
+
+// PermsMergeStrategy is how SetUserPermissionsWithStrategy combines the object IDs of given user
+// permissions with the stored ones.
+type PermsMergeStrategy int
+
+const (
+	MergeReplace  PermsMergeStrategy = iota // Given object IDs replace stored ones, like SetUserPermissions.
+	MergeUnion                              // Given object IDs are added to stored ones.
+	MergeSubtract                           // Given object IDs are removed from stored ones.
+)
+
+func (s PermsMergeStrategy) String() string {
+	switch s {
+	case MergeReplace:
+		return "replace"
+	case MergeUnion:
+		return "union"
+	case MergeSubtract:
+		return "subtract"
+	}
+	return "unknown"
+}
+
+// SetUserPermissionsWithStrategy is like SetUserPermissions, but combines the object IDs in p
+// with the stored ones according to strategy, e.g. so that a user keeps access granted by
+// another provider with MergeUnion. The combination is computed within the transaction that
+// writes it, and p.IDs is set to the resulting object IDs. The "repo_permissions" table is
+// updated for every object ID added or removed by the combination.
+//
+// Object IDs in p never expire, while the expiries of other stored object IDs are kept unless
+// the strategy is MergeReplace.
+func (s *PermsStore) SetUserPermissionsWithStrategy(ctx context.Context, p *authz.UserPermissions, strategy PermsMergeStrategy) (err error) {
+	ctx, save := s.observe(ctx, "SetUserPermissionsWithStrategy", "")
+	defer func() { save(&err, append(p.TracingFields(), otlog.String("strategy", strategy.String()))...) }()
+
+	if strategy != MergeReplace && strategy != MergeUnion && strategy != MergeSubtract {
+		return errors.Errorf("unknown merge strategy %d", strategy)
+	}
+
+	// Open a transaction for update consistency.
+	txs, err := s.Transact(ctx)
+	if err != nil {
+		return err
+	}
+	defer txs.Done(&err)
+
+	given := p.IDs
+	if given == nil {
+		given = roaring.NewBitmap()
+	}
+
+	if strategy != MergeReplace {
+		var storedIDs *roaring.Bitmap
+		vals, err := txs.load(ctx, loadUserPermissionsQuery(p, "FOR UPDATE"))
+		if err == authz.ErrPermsNotFound {
+			storedIDs = roaring.NewBitmap()
+		} else if err != nil {
+			return errors.Wrap(err, "load user permissions")
+		} else {
+			storedIDs = vals.ids
+		}
+
+		if strategy == MergeUnion {
+			p.IDs = roaring.Or(storedIDs, given)
+		} else {
+			p.IDs = roaring.AndNot(storedIDs, given)
+		}
+	}
+
+	res, _, err := txs.setUserPermissions(ctx, p)
+	if err != nil {
+		return err
+	}
+	if err = txs.setUserPermissionsMetadata(ctx, p, res); err != nil {
+		return err
+	}
+
+	if strategy == MergeReplace {
+		return txs.setUserPermissionsExpiries(ctx, p, nil)
+	}
+	return txs.deleteUserPermissionsExpiries(ctx, p, given)
+}
@@ -0,0 +1,168 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+)
+
+func testPermsStore_SetUserPermissionsWithStrategy(db *sql.DB) func(*testing.T) {
+	tests := []struct {
+		name            string
+		strategy        PermsMergeStrategy
+		ids             []uint32
+		expectIDs       []uint32           // object_ids of user 1 after the update
+		expectUserPerms map[int32][]uint32 // user_id -> object_ids
+		expectRepoPerms map[int32][]uint32 // repo_id -> user_ids
+	}{
+		{
+			name:      "replace",
+			strategy:  MergeReplace,
+			ids:       []uint32{2, 3},
+			expectIDs: []uint32{2, 3},
+			expectUserPerms: map[int32][]uint32{
+				1: {2, 3},
+				2: {1, 2},
+			},
+			expectRepoPerms: map[int32][]uint32{
+				1: {2},
+				2: {1, 2},
+				3: {1},
+			},
+		},
+		{
+			name:      "union",
+			strategy:  MergeUnion,
+			ids:       []uint32{2, 3},
+			expectIDs: []uint32{1, 2, 3},
+			expectUserPerms: map[int32][]uint32{
+				1: {1, 2, 3},
+				2: {1, 2},
+			},
+			expectRepoPerms: map[int32][]uint32{
+				1: {1, 2},
+				2: {1, 2},
+				3: {1},
+			},
+		},
+		{
+			name:      "subtract",
+			strategy:  MergeSubtract,
+			ids:       []uint32{2, 3},
+			expectIDs: []uint32{1},
+			expectUserPerms: map[int32][]uint32{
+				1: {1},
+				2: {1, 2},
+			},
+			expectRepoPerms: map[int32][]uint32{
+				1: {1, 2},
+				2: {2},
+			},
+		},
+		{
+			name:      "union without changes",
+			strategy:  MergeUnion,
+			ids:       []uint32{},
+			expectIDs: []uint32{1, 2},
+			expectUserPerms: map[int32][]uint32{
+				1: {1, 2},
+				2: {1, 2},
+			},
+			expectRepoPerms: map[int32][]uint32{
+				1: {1, 2},
+				2: {1, 2},
+			},
+		},
+	}
+
+	return func(t *testing.T) {
+		ctx := context.Background()
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				s := NewPermsStore(db, clock)
+				defer cleanupPermsTables(t, s)
+
+				for _, userID := range []int32{1, 2} {
+					if err := s.SetUserPermissions(ctx, &authz.UserPermissions{
+						UserID: userID,
+						Perm:   authz.Read,
+						Type:   authz.PermRepos,
+						IDs:    toBitmap(1, 2),
+					}); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				p := &authz.UserPermissions{
+					UserID: 1,
+					Perm:   authz.Read,
+					Type:   authz.PermRepos,
+					IDs:    toBitmap(test.ids...),
+				}
+				if err := s.SetUserPermissionsWithStrategy(ctx, p, test.strategy); err != nil {
+					t.Fatal(err)
+				}
+				equal(t, "p.IDs", test.expectIDs, bitmapToArray(p.IDs))
+
+				err := checkRegularPermsTable(s, `SELECT user_id, object_ids FROM user_permissions`, test.expectUserPerms)
+				if err != nil {
+					t.Fatal("user_permissions:", err)
+				}
+
+				err = checkRegularPermsTable(s, `SELECT repo_id, user_ids FROM repo_permissions`, test.expectRepoPerms)
+				if err != nil {
+					t.Fatal("repo_permissions:", err)
+				}
+			})
+		}
+
+		t.Run("expiries", func(t *testing.T) {
+			tc := NewTestClock(clock())
+			s := NewPermsStore(db, clock).WithClock(tc)
+			defer cleanupPermsTables(t, s)
+
+			expiredAt := tc.Now().Add(time.Hour)
+			if err := s.SetUserPermissionsWithExpiry(ctx, &authz.UserPermissions{
+				UserID: 1,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+				IDs:    toBitmap(1, 2, 3),
+			}, map[int32]time.Time{2: expiredAt, 3: expiredAt}); err != nil {
+				t.Fatal(err)
+			}
+
+			// Object IDs in the union no longer expire, others keep their expiries.
+			if err := s.SetUserPermissionsWithStrategy(ctx, &authz.UserPermissions{
+				UserID: 1,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+				IDs:    toBitmap(3, 4),
+			}, MergeUnion); err != nil {
+				t.Fatal(err)
+			}
+
+			tc.Advance(2 * time.Hour)
+			up := &authz.UserPermissions{UserID: 1, Perm: authz.Read, Type: authz.PermRepos}
+			if err := s.LoadUserPermissions(ctx, up); err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "IDs", []uint32{1, 3, 4}, bitmapToArray(up.IDs))
+		})
+
+		t.Run("unknown strategy", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			err := s.SetUserPermissionsWithStrategy(ctx, &authz.UserPermissions{
+				UserID: 1,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+			}, PermsMergeStrategy(42))
+			if err == nil || err.Error() != "unknown merge strategy 42" {
+				t.Fatalf("want unknown merge strategy error but got %v", err)
+			}
+		})
+	}
+}
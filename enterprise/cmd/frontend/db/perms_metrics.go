@@ -0,0 +1,37 @@
+package db
+
+import (
+	"github.com/RoaringBitmap/roaring"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	repoPermsFanout = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "src",
+		Subsystem: "perms_store",
+		Name:      "repo_permissions_fanout",
+		Help:      "Number of user permissions rows updated by a single change of repository permissions",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+	}, []string{"op"})
+
+	repoPermsFanoutTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "src",
+		Subsystem: "perms_store",
+		Name:      "repo_permissions_fanout_total",
+		Help:      "Total number of user permissions rows updated by changes of repository permissions",
+	}, []string{"op"})
+)
+
+// observeRepoPermsFanout records the number of user permissions rows updated by a change of
+// repository permissions, separately for users added to and removed from the repository.
+func observeRepoPermsFanout(added, removed *roaring.Bitmap) {
+	for _, c := range []struct {
+		op  string
+		ids *roaring.Bitmap
+	}{{"add", added}, {"remove", removed}} {
+		n := float64(c.ids.GetCardinality())
+		repoPermsFanout.WithLabelValues(c.op).Observe(n)
+		repoPermsFanoutTotal.WithLabelValues(c.op).Add(n)
+	}
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+)
+
+// fanoutTotals returns the current values of the fan-out counter for added and removed users.
+func fanoutTotals() (added, removed float64) {
+	return testutil.ToFloat64(repoPermsFanoutTotal.WithLabelValues("add")),
+		testutil.ToFloat64(repoPermsFanoutTotal.WithLabelValues("remove"))
+}
+
+func TestObserveRepoPermsFanout(t *testing.T) {
+	added, removed := fanoutTotals()
+	observeRepoPermsFanout(roaring.BitmapOf(1, 2, 3), roaring.BitmapOf(4))
+
+	gotAdded, gotRemoved := fanoutTotals()
+	equal(t, "added", float64(3), gotAdded-added)
+	equal(t, "removed", float64(1), gotRemoved-removed)
+}
+
+func testPermsStore_RepoPermsFanoutMetrics(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+		s := NewPermsStore(db, clock)
+		defer cleanupPermsTables(t, s)
+
+		set := func(t *testing.T, ids *roaring.Bitmap) (added, removed float64) {
+			t.Helper()
+			beforeAdded, beforeRemoved := fanoutTotals()
+			if err := s.SetRepoPermissions(ctx, &authz.RepoPermissions{
+				RepoID:  1,
+				Perm:    authz.Read,
+				UserIDs: ids,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			afterAdded, afterRemoved := fanoutTotals()
+			return afterAdded - beforeAdded, afterRemoved - beforeRemoved
+		}
+
+		added, removed := set(t, roaring.BitmapOf(1, 2, 3))
+		equal(t, "added", float64(3), added)
+		equal(t, "removed", float64(0), removed)
+
+		added, removed = set(t, roaring.BitmapOf(2, 3, 4, 5))
+		equal(t, "added", float64(2), added)
+		equal(t, "removed", float64(1), removed)
+
+		// Unchanged permissions update no rows.
+		added, removed = set(t, roaring.BitmapOf(2, 3, 4, 5))
+		equal(t, "added", float64(0), added)
+		equal(t, "removed", float64(0), removed)
+
+		// Failed changes are not recorded.
+		beforeAdded, beforeRemoved := fanoutTotals()
+		err := s.WithRemovalGuard(RemovalGuard{MaxCount: 1}).SetRepoPermissions(ctx, &authz.RepoPermissions{
+			RepoID:  1,
+			Perm:    authz.Read,
+			UserIDs: roaring.BitmapOf(6),
+		})
+		if _, ok := err.(*LargeRemovalError); !ok {
+			t.Fatalf("want *LargeRemovalError but got %v", err)
+		}
+		afterAdded, afterRemoved := fanoutTotals()
+		equal(t, "added", beforeAdded, afterAdded)
+		equal(t, "removed", beforeRemoved, afterRemoved)
+	}
+}
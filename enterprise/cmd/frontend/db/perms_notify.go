@@ -0,0 +1,59 @@
+package db
+
+import (
+	"github.com/RoaringBitmap/roaring"
+)
+
+// PermsChange describes a change of the object IDs that a user has permissions to.
+type PermsChange struct {
+	UserID  int32
+	Added   *roaring.Bitmap // Object IDs the user has been granted permissions to.
+	Removed *roaring.Bitmap // Object IDs the user no longer has permissions to.
+}
+
+// WithNotifications returns a copy of the PermsStore that sends a PermsChange to ch whenever
+// SetUserPermissions or GrantPendingPermissions actually changes the permissions of a user.
+// Changes are sent only after the transaction that made them commits. Sending never blocks,
+// therefore changes are dropped when ch is not ready to receive, and a consumer that cannot
+// keep up should use a buffered channel.
+func (s *PermsStore) WithNotifications(ch chan<- PermsChange) *PermsStore {
+	c := s.clone()
+	c.notify = ch
+	return c
+}
+
+// recordChange records a change of permissions of the user to be notified when the transaction
+// of this PermsStore commits. Changes are not recorded when notifications are disabled, and
+// empty changes are never recorded.
+func (s *PermsStore) recordChange(userID int32, added, removed *roaring.Bitmap) {
+	if s.notify == nil {
+		return
+	}
+
+	if added == nil {
+		added = roaring.NewBitmap()
+	}
+	if removed == nil {
+		removed = roaring.NewBitmap()
+	}
+	if added.IsEmpty() && removed.IsEmpty() {
+		return
+	}
+
+	s.pending = append(s.pending, PermsChange{
+		UserID:  userID,
+		Added:   added,
+		Removed: removed,
+	})
+}
+
+// flushChanges sends all recorded changes without blocking.
+func (s *PermsStore) flushChanges() {
+	for _, c := range s.pending {
+		select {
+		case s.notify <- c:
+		default:
+		}
+	}
+	s.pending = nil
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+	"github.com/sourcegraph/sourcegraph/internal/extsvc"
+)
+
+func testPermsStore_WithNotifications(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+		ch := make(chan PermsChange, 10)
+		s := NewPermsStore(db, clock).WithNotifications(ch)
+		defer cleanupPermsTables(t, s)
+
+		type change struct {
+			UserID  int32
+			Added   []uint32
+			Removed []uint32
+		}
+		receive := func(t *testing.T) []change {
+			t.Helper()
+			var changes []change
+			for len(ch) > 0 {
+				c := <-ch
+				changes = append(changes, change{
+					UserID:  c.UserID,
+					Added:   append([]uint32{}, bitmapToArray(c.Added)...),
+					Removed: append([]uint32{}, bitmapToArray(c.Removed)...),
+				})
+			}
+			return changes
+		}
+		setUserPermissions := func(t *testing.T, ids ...uint32) {
+			t.Helper()
+			if err := s.SetUserPermissions(ctx, &authz.UserPermissions{
+				UserID: 1,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+				IDs:    toBitmap(ids...),
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		setUserPermissions(t, 1, 2)
+		equal(t, "changes", []change{{UserID: 1, Added: []uint32{1, 2}, Removed: []uint32{}}}, receive(t))
+
+		// Unchanged permissions are not notified.
+		setUserPermissions(t, 1, 2)
+		equal(t, "changes", 0, len(receive(t)))
+
+		setUserPermissions(t, 2, 3)
+		equal(t, "changes", []change{{UserID: 1, Added: []uint32{3}, Removed: []uint32{1}}}, receive(t))
+
+		accounts := &extsvc.ExternalAccounts{
+			ServiceType: "sourcegraph",
+			ServiceID:   "https://sourcegraph.com/",
+			AccountIDs:  []string{"alice"},
+		}
+		if err := s.SetRepoPendingPermissions(ctx, accounts, &authz.RepoPermissions{
+			RepoID: 3,
+			Perm:   authz.Read,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SetRepoPendingPermissions(ctx, accounts, &authz.RepoPermissions{
+			RepoID: 4,
+			Perm:   authz.Read,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.GrantPendingPermissions(ctx, 1, &authz.UserPendingPermissions{
+			ServiceType: "sourcegraph",
+			ServiceID:   "https://sourcegraph.com/",
+			BindID:      "alice",
+			Perm:        authz.Read,
+			Type:        authz.PermRepos,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "changes", []change{{UserID: 1, Added: []uint32{4}, Removed: []uint32{}}}, receive(t))
+	}
+}
@@ -0,0 +1,169 @@
+package db
+
+import (
+	"context"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/keegancsmith/sqlf"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+)
+
+// SetRepoPermissionsByProvider performs a full update of the user IDs that are granted access
+// to the repository by given provider (e.g. a code host), then sets the union of user IDs across
+// all providers of the repository with the same semantics as SetRepoPermissions. Therefore, a user
+// that no longer has access granted by one provider keeps access if another provider still grants it.
+//
+// Callers should not mix this method with SetRepoPermissions for the same repository, because the
+// latter is not aware of providers and its changes are overwritten by the next call to this method.
+//
+// This method starts its own transaction for update consistency if the caller hasn't started one already.
+//
+// Example input:
+// &RepoPermissions{
+//     RepoID: 1,
+//     Perm: authz.Read,
+//     UserIDs: bitmap{1, 2},
+// }
+//
+// Table states for input with provider "github" when provider "gitlab" has granted bitmap{2, 3}:
+//  "repo_permissions_providers":
+//   repo_id | permission | provider |   user_ids   | updated_at
+//  ---------+------------+----------+--------------+------------
+//         1 |       read |   github | bitmap{1, 2} | <DateTime>
+//         1 |       read |   gitlab | bitmap{2, 3} | <DateTime>
+//
+//  "repo_permissions":
+//   repo_id | permission |    user_ids     | updated_at
+//  ---------+------------+-----------------+------------
+//         1 |       read | bitmap{1, 2, 3} | <DateTime>
+func (s *PermsStore) SetRepoPermissionsByProvider(ctx context.Context, provider string, p *authz.RepoPermissions) (err error) {
+	ctx, save := s.observe(ctx, "SetRepoPermissionsByProvider", "")
+	defer func() { save(&err, append(p.TracingFields(), otlog.String("provider", provider))...) }()
+
+	var txs *PermsStore
+	if s.inTx() {
+		txs = s
+	} else {
+		txs, err = s.Transact(ctx)
+		if err != nil {
+			return err
+		}
+		defer txs.Done(&err)
+	}
+
+	if p.UserIDs == nil {
+		p.UserIDs = roaring.NewBitmap()
+	}
+	updatedAt := txs.clock.Now()
+
+	// Make sure the row of the repository exists and lock it, so that concurrent updates by
+	// different providers for the same repository are serialized. This keeps the same lock
+	// order as SetRepoPermissions (i.e. repo -> user) to prevent deadlocks.
+	if err = txs.execute(ctx, insertRepoPermissionsStubQuery(p, updatedAt)); err != nil {
+		return errors.Wrap(err, "execute insert repo permissions stub query")
+	}
+	if _, err = txs.load(ctx, loadRepoPermissionsQuery(p, "FOR UPDATE")); err != nil {
+		return errors.Wrap(err, "load repo permissions")
+	}
+
+	q, err := upsertRepoPermissionsProviderQuery(provider, p, updatedAt)
+	if err != nil {
+		return err
+	} else if err = txs.execute(ctx, q); err != nil {
+		return errors.Wrap(err, "execute upsert repo permissions provider query")
+	}
+
+	union, err := txs.loadRepoPermissionsProvidersUnion(ctx, p)
+	if err != nil {
+		return errors.Wrap(err, "load repo permissions providers")
+	}
+
+	rp := &authz.RepoPermissions{
+		RepoID:  p.RepoID,
+		Perm:    p.Perm,
+		UserIDs: union,
+	}
+	if err = txs.setRepoPermissions(ctx, rp, 0); err != nil {
+		return err
+	}
+
+	p.UpdatedAt = updatedAt
+	return nil
+}
+
+func insertRepoPermissionsStubQuery(p *authz.RepoPermissions, updatedAt interface{}) *sqlf.Query {
+	const format = `
+-- source: enterprise/cmd/frontend/db/perms_providers.go:insertRepoPermissionsStubQuery
+INSERT INTO repo_permissions
+  (repo_id, permission, user_ids, updated_at)
+VALUES
+  (%s, %s, %s, %s)
+ON CONFLICT ON CONSTRAINT
+  repo_permissions_perm_unique
+DO NOTHING
+`
+	return sqlf.Sprintf(format, p.RepoID, p.Perm.String(), []byte{}, updatedAt)
+}
+
+func upsertRepoPermissionsProviderQuery(provider string, p *authz.RepoPermissions, updatedAt interface{}) (*sqlf.Query, error) {
+	const format = `
+-- source: enterprise/cmd/frontend/db/perms_providers.go:upsertRepoPermissionsProviderQuery
+INSERT INTO repo_permissions_providers
+  (repo_id, permission, provider, user_ids, updated_at)
+VALUES
+  (%s, %s, %s, %s, %s)
+ON CONFLICT ON CONSTRAINT
+  repo_permissions_providers_perm_provider_unique
+DO UPDATE SET
+  user_ids = excluded.user_ids,
+  updated_at = excluded.updated_at
+`
+
+	ids, err := marshalBitmap(p.UserIDs)
+	if err != nil {
+		return nil, err
+	}
+	return sqlf.Sprintf(format, p.RepoID, p.Perm.String(), provider, ids, updatedAt), nil
+}
+
+// loadRepoPermissionsProvidersUnion returns the union of user IDs granted by all providers of the repository.
+func (s *PermsStore) loadRepoPermissionsProvidersUnion(ctx context.Context, p *authz.RepoPermissions) (*roaring.Bitmap, error) {
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_providers.go:PermsStore.loadRepoPermissionsProvidersUnion
+SELECT user_ids
+FROM repo_permissions_providers
+WHERE repo_id = %s
+AND permission = %s
+`, p.RepoID, p.Perm.String())
+
+	rows, err := s.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	union := roaring.NewBitmap()
+	for rows.Next() {
+		var ids []byte
+		if err = rows.Scan(&ids); err != nil {
+			return nil, err
+		}
+
+		if len(ids) == 0 {
+			continue
+		}
+
+		bm := roaring.NewBitmap()
+		if err = unmarshalBitmap(bm, ids); err != nil {
+			return nil, err
+		}
+		union.Or(bm)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return union, nil
+}
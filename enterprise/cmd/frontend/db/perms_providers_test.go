@@ -0,0 +1,61 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+)
+
+func testPermsStore_SetRepoPermissionsByProvider(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+		s := NewPermsStore(db, clock)
+		defer cleanupPermsTables(t, s)
+
+		set := func(t *testing.T, provider string, userIDs ...uint32) {
+			t.Helper()
+			if err := s.SetRepoPermissionsByProvider(ctx, provider, &authz.RepoPermissions{
+				RepoID:  1,
+				Perm:    authz.Read,
+				UserIDs: toBitmap(userIDs...),
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		check := func(t *testing.T, expectUserPerms, expectRepoPerms map[int32][]uint32) {
+			t.Helper()
+			err := checkRegularPermsTable(s, `SELECT user_id, object_ids FROM user_permissions`, expectUserPerms)
+			if err != nil {
+				t.Fatal("user_permissions:", err)
+			}
+			err = checkRegularPermsTable(s, `SELECT repo_id, user_ids FROM repo_permissions`, expectRepoPerms)
+			if err != nil {
+				t.Fatal("repo_permissions:", err)
+			}
+		}
+
+		// User 2 has accounts on both providers.
+		set(t, "github", 1, 2)
+		set(t, "gitlab", 2, 3)
+		check(t,
+			map[int32][]uint32{1: {1}, 2: {1}, 3: {1}},
+			map[int32][]uint32{1: {1, 2, 3}},
+		)
+
+		// Revoked by one provider, but still granted by the other.
+		set(t, "github", 1)
+		check(t,
+			map[int32][]uint32{1: {1}, 2: {1}, 3: {1}},
+			map[int32][]uint32{1: {1, 2, 3}},
+		)
+
+		// Revoked by both providers.
+		set(t, "gitlab", 3)
+		check(t,
+			map[int32][]uint32{1: {1}, 2: {}, 3: {1}},
+			map[int32][]uint32{1: {1, 3}},
+		)
+	}
+}
@@ -0,0 +1,347 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/hashicorp/go-multierror"
+	"github.com/lib/pq"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// PermsQueue is a durable first-in-first-out queue of changes of repository permissions that
+// could not be written to the database. Implementations must be safe for concurrent use.
+type PermsQueue interface {
+	// Push appends p to the queue, and returns only once p is durably stored.
+	Push(p *authz.RepoPermissions) error
+	// Peek returns the oldest change in the queue, or nil if the queue is empty.
+	Peek() (*authz.RepoPermissions, error)
+	// Pop removes the oldest change from the queue.
+	Pop() error
+}
+
+// WithWriteAheadQueue returns a copy of the PermsStore that pushes a change made by
+// SetRepoPermissions outside of a transaction to queue when the database is unavailable,
+// instead of returning an error. The change is then applied by FlushRepoPermissionsQueue
+// once the database recovers, and is not visible to the Load* methods until then.
+//
+// Queued changes are replayed with last-writer-wins semantics: a queued change is discarded
+// if the stored permissions of the repository were updated after the change was queued.
+func (s *PermsStore) WithWriteAheadQueue(queue PermsQueue) *PermsStore {
+	c := s.clone()
+	c.queue = queue
+	return c
+}
+
+// enqueueRepoPermissions pushes p to the queue, with p.UpdatedAt set to the current time
+// to order it against changes written directly to the database.
+func (s *PermsStore) enqueueRepoPermissions(p *authz.RepoPermissions) error {
+	if p.UserIDs == nil {
+		p.UserIDs = roaring.NewBitmap()
+	}
+	p.UpdatedAt = s.clock.Now()
+	if err := s.queue.Push(p); err != nil {
+		return errors.Wrap(err, "push repo permissions to queue")
+	}
+	return nil
+}
+
+// FlushRepoPermissionsQueue applies the changes in the queue of the PermsStore (see
+// WithWriteAheadQueue) in the order they were queued, and returns the number of changes
+// removed from the queue. Flushing stops at the first change that cannot be applied because
+// the database is unavailable, which is kept to be retried by the next flush. Changes that
+// fail for any other reason, e.g. a *LargeRemovalError, are removed from the queue and
+// their errors are returned once all other changes are flushed.
+func (s *PermsStore) FlushRepoPermissionsQueue(ctx context.Context) (flushed int, err error) {
+	ctx, save := s.observe(ctx, "FlushRepoPermissionsQueue", "")
+	defer func() { save(&err, otlog.Int("flushed", flushed)) }()
+
+	if s.queue == nil {
+		return 0, nil
+	}
+
+	var errs *multierror.Error
+	for {
+		p, err := s.queue.Peek()
+		if err != nil {
+			return flushed, errors.Wrap(err, "peek repo permissions queue")
+		} else if p == nil {
+			return flushed, errs.ErrorOrNil()
+		}
+
+		if err = s.replayRepoPermissions(ctx, p); err != nil {
+			if isDatabaseUnavailable(err) {
+				return flushed, err
+			}
+			errs = multierror.Append(errs, errors.Wrapf(err, "discard queued permissions of repository %d", p.RepoID))
+		}
+
+		if err = s.queue.Pop(); err != nil {
+			return flushed, errors.Wrap(err, "pop repo permissions queue")
+		}
+		flushed++
+	}
+}
+
+// replayRepoPermissions applies the queued change p unless the stored permissions of the
+// repository were updated after p was queued. The stored permissions are updated as of the
+// time p was queued, thus replaying a change that has already been applied is a no-op.
+func (s *PermsStore) replayRepoPermissions(ctx context.Context, p *authz.RepoPermissions) (err error) {
+	txs, err := s.Transact(ctx)
+	if err != nil {
+		return err
+	}
+	defer txs.Done(&err)
+
+	vals, err := txs.load(ctx, loadRepoPermissionsQuery(p, "FOR UPDATE"))
+	if err == nil && vals.updatedAt.After(p.UpdatedAt) {
+		return nil
+	} else if err != nil && err != authz.ErrPermsNotFound {
+		return errors.Wrap(err, "load repo permissions")
+	}
+
+	// Stamp the change with the time it was queued, so that it does not supersede later
+	// queued changes of the repository.
+	queuedAt := p.UpdatedAt
+	return txs.WithClock(clockFunc(func() time.Time { return queuedAt })).setRepoPermissions(ctx, p, 0)
+}
+
+// RunRepoPermissionsQueueFlusher calls FlushRepoPermissionsQueue every interval until ctx is
+// done. This method is blocking and should be called as a goroutine.
+func (s *PermsStore) RunRepoPermissionsQueueFlusher(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		flushed, err := s.FlushRepoPermissionsQueue(ctx)
+		if err != nil {
+			log15.Error("Failed to flush repo permissions queue", "flushed", flushed, "err", err)
+		} else if flushed > 0 {
+			log15.Info("Flushed repo permissions queue", "flushed", flushed)
+		}
+	}
+}
+
+// isDatabaseUnavailable returns true if err indicates that the database could not be
+// reached or refused the connection, as opposed to rejecting a statement.
+func isDatabaseUnavailable(err error) bool {
+	switch e := errors.Cause(err).(type) {
+	case *pq.Error:
+		// Class 08 is "Connection Exception", 57P01 to 57P03 are shutdowns and startups.
+		return e.Code.Class() == "08" || e.Code == "57P01" || e.Code == "57P02" || e.Code == "57P03"
+	case net.Error:
+		return true
+	}
+	return errors.Cause(err) == driver.ErrBadConn
+}
+
+// FilePermsQueue is a PermsQueue that stores every change as a file in a local directory,
+// thus survives restarts of the process.
+type FilePermsQueue struct {
+	dir string
+
+	mu   sync.Mutex
+	next uint64 // Sequence number of the next pushed change.
+}
+
+// queuedRepoPermissions is the serialized form of a change stored by FilePermsQueue.
+type queuedRepoPermissions struct {
+	RepoID    int32       `json:"repoID"`
+	Perm      authz.Perms `json:"perm"`
+	UserIDs   []byte      `json:"userIDs"`
+	UpdatedAt time.Time   `json:"updatedAt"`
+}
+
+const (
+	queueFileExt    = ".json"
+	badQueueFileExt = ".bad" // Appended to the names of files that cannot be decoded.
+)
+
+// NewFilePermsQueue returns a FilePermsQueue storing changes in dir, which is created if it
+// does not exist. Changes already stored in dir are kept in the queue.
+func NewFilePermsQueue(dir string) (*FilePermsQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	q := &FilePermsQueue{dir: dir}
+	seqs, err := q.list()
+	if err != nil {
+		return nil, err
+	}
+	if len(seqs) > 0 {
+		q.next = seqs[len(seqs)-1] + 1
+	}
+	return q, nil
+}
+
+// list returns the sequence numbers of stored changes in ascending order.
+func (q *FilePermsQueue) list() ([]uint64, error) {
+	infos, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seqs := make([]uint64, 0, len(infos))
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasSuffix(name, queueFileExt) {
+			continue // Skip temporary files of interrupted pushes and files moved aside by Peek.
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, queueFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+func (q *FilePermsQueue) path(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, queueFileExt))
+}
+
+// Push implements PermsQueue. The change is written to a temporary file which is synced and
+// then renamed, so that a crash never leaves a partially written change in the queue.
+func (q *FilePermsQueue) Push(p *authz.RepoPermissions) error {
+	ids, err := marshalBitmap(p.UserIDs)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(&queuedRepoPermissions{
+		RepoID:    p.RepoID,
+		Perm:      p.Perm,
+		UserIDs:   ids,
+		UpdatedAt: p.UpdatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	f, err := ioutil.TempFile(q.dir, "push-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(f.Name(), q.path(q.next)); err != nil {
+		return err
+	}
+	q.next++
+	return syncDir(q.dir)
+}
+
+// Peek implements PermsQueue. A stored change that cannot be decoded, e.g. because its file was
+// corrupted, is moved aside by appending badQueueFileExt to the name of its file, so that it no
+// longer blocks the changes queued after it.
+func (q *FilePermsQueue) Peek() (*authz.RepoPermissions, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	seqs, err := q.list()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, seq := range seqs {
+		path := q.path(seq)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := decodeQueuedRepoPermissions(data)
+		if err == nil {
+			return p, nil
+		}
+
+		log15.Error("Moving aside undecodable repo permissions queue file", "path", path, "err", err)
+		if err = os.Rename(path, path+badQueueFileExt); err != nil {
+			return nil, err
+		}
+		if err = syncDir(q.dir); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// decodeQueuedRepoPermissions decodes a change stored by FilePermsQueue.Push.
+func decodeQueuedRepoPermissions(data []byte) (*authz.RepoPermissions, error) {
+	var v queuedRepoPermissions
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, errors.Wrap(err, "unmarshal")
+	}
+
+	p := &authz.RepoPermissions{
+		RepoID:    v.RepoID,
+		Perm:      v.Perm,
+		UserIDs:   roaring.NewBitmap(),
+		UpdatedAt: v.UpdatedAt,
+	}
+	if err := unmarshalBitmap(p.UserIDs, v.UserIDs); err != nil {
+		return nil, errors.Wrap(err, "unmarshal user IDs")
+	}
+	return p, nil
+}
+
+// Pop implements PermsQueue.
+func (q *FilePermsQueue) Pop() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	seqs, err := q.list()
+	if err != nil || len(seqs) == 0 {
+		return err
+	}
+	if err = os.Remove(q.path(seqs[0])); err != nil {
+		return err
+	}
+	return syncDir(q.dir)
+}
+
+// syncDir commits the creation, renaming and removal of files in dir to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,252 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+)
+
+func TestFilePermsQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "perms-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := NewFilePermsQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p, err := q.Peek(); err != nil {
+		t.Fatal(err)
+	} else if p != nil {
+		t.Fatalf("want empty queue but got %+v", p)
+	}
+
+	now := time.Unix(1577836800, 0).UTC()
+	for _, id := range []int32{1, 2} {
+		if err = q.Push(&authz.RepoPermissions{
+			RepoID:    id,
+			Perm:      authz.Read,
+			UserIDs:   toBitmap(uint32(id), 3),
+			UpdatedAt: now,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Changes survive reopening the queue, and new changes are appended after them.
+	q, err = NewFilePermsQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Push(&authz.RepoPermissions{RepoID: 3, Perm: authz.Read, UserIDs: toBitmap(), UpdatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []struct {
+		repoID  int32
+		userIDs []uint32
+	}{
+		{1, []uint32{1, 3}},
+		{2, []uint32{2, 3}},
+		{3, []uint32{}},
+	} {
+		p, err := q.Peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "repoID", want.repoID, p.RepoID)
+		equal(t, "perm", authz.Read, p.Perm)
+		equal(t, "userIDs", want.userIDs, bitmapToArray(p.UserIDs))
+		equal(t, "updatedAt", now, p.UpdatedAt.UTC())
+		if err = q.Pop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if p, err := q.Peek(); err != nil {
+		t.Fatal(err)
+	} else if p != nil {
+		t.Fatalf("want empty queue but got %+v", p)
+	}
+}
+
+func TestFilePermsQueue_Corrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "perms-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := NewFilePermsQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1577836800, 0).UTC()
+	for _, id := range []int32{1, 2} {
+		if err = q.Push(&authz.RepoPermissions{
+			RepoID:    id,
+			Perm:      authz.Read,
+			UserIDs:   toBitmap(uint32(id)),
+			UpdatedAt: now,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Corrupt the head of the queue, as if its file was truncated.
+	if err = ioutil.WriteFile(q.path(0), []byte(`{"repoID":1,`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := q.Peek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	equal(t, "repoID", int32(2), p.RepoID)
+	equal(t, "userIDs", []uint32{2}, bitmapToArray(p.UserIDs))
+
+	if _, err = os.Stat(q.path(0) + badQueueFileExt); err != nil {
+		t.Fatalf("want corrupted change moved aside: %v", err)
+	}
+
+	if err = q.Pop(); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := q.Peek(); err != nil {
+		t.Fatal(err)
+	} else if p != nil {
+		t.Fatalf("want empty queue but got %+v", p)
+	}
+}
+
+func testPermsStore_RepoPermissionsQueue(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+		dir, err := ioutil.TempDir("", "perms-queue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		q, err := NewFilePermsQueue(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Nothing listens on port 1, which makes every connection attempt fail.
+		downDB, err := sql.Open("postgres", "postgres://127.0.0.1:1/?sslmode=disable&connect_timeout=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer downDB.Close()
+
+		tc := NewTestClock(clock().UTC())
+		down := NewPermsStore(downDB, clock).WithClock(tc).WithWriteAheadQueue(q)
+		s := NewPermsStore(db, clock).WithClock(tc).WithWriteAheadQueue(q)
+		defer cleanupPermsTables(t, s)
+
+		loadUserIDs := func(t *testing.T, repoID int32) []uint32 {
+			t.Helper()
+			p := &authz.RepoPermissions{RepoID: repoID, Perm: authz.Read}
+			if err := s.LoadRepoPermissions(ctx, p); err == authz.ErrPermsNotFound {
+				return nil
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			return bitmapToArray(p.UserIDs)
+		}
+
+		// The change is queued while the database is down.
+		if err = down.SetRepoPermissions(ctx, &authz.RepoPermissions{
+			RepoID:  1,
+			Perm:    authz.Read,
+			UserIDs: toBitmap(1, 2),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "userIDs", []uint32(nil), loadUserIDs(t, 1))
+
+		// Flushing keeps the change queued as long as the database is down.
+		flushed, err := down.FlushRepoPermissionsQueue(ctx)
+		if !isDatabaseUnavailable(err) {
+			t.Fatalf("want database unavailable error but got %v", err)
+		}
+		equal(t, "flushed", 0, flushed)
+
+		// Without a queue, the change fails.
+		err = NewPermsStore(downDB, clock).SetRepoPermissions(ctx, &authz.RepoPermissions{RepoID: 1, Perm: authz.Read})
+		if !isDatabaseUnavailable(err) {
+			t.Fatalf("want database unavailable error but got %v", err)
+		}
+
+		// The background flusher applies the change once the database recovers.
+		flusherCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			s.RunRepoPermissionsQueueFlusher(flusherCtx, 10*time.Millisecond)
+			close(done)
+		}()
+		for deadline := time.Now().Add(10 * time.Second); len(loadUserIDs(t, 1)) == 0; {
+			if time.Now().After(deadline) {
+				t.Fatal("queued change did not land in the database")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+		<-done
+		equal(t, "userIDs", []uint32{1, 2}, loadUserIDs(t, 1))
+
+		p, err := q.Peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "queued", (*authz.RepoPermissions)(nil), p)
+
+		// A queued change is discarded when the repository was updated after it was queued.
+		if err = down.SetRepoPermissions(ctx, &authz.RepoPermissions{
+			RepoID:  1,
+			Perm:    authz.Read,
+			UserIDs: toBitmap(3),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		tc.Advance(time.Minute)
+		if err = s.SetRepoPermissions(ctx, &authz.RepoPermissions{
+			RepoID:  1,
+			Perm:    authz.Read,
+			UserIDs: toBitmap(4),
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// A queued change of another repository is still applied, in order.
+		for _, ids := range [][]uint32{{5}, {6}} {
+			tc.Advance(time.Minute)
+			if err = down.SetRepoPermissions(ctx, &authz.RepoPermissions{
+				RepoID:  2,
+				Perm:    authz.Read,
+				UserIDs: toBitmap(ids...),
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tc.Advance(time.Minute)
+		flushed, err = s.FlushRepoPermissionsQueue(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "flushed", 3, flushed)
+		equal(t, "userIDs", []uint32{4}, loadUserIDs(t, 1))
+		equal(t, "userIDs", []uint32{6}, loadUserIDs(t, 2))
+	}
+}
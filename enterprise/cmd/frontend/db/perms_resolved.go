@@ -0,0 +1,202 @@
+package db
+
+import (
+	"context"
+
+	"github.com/keegancsmith/sqlf"
+	"github.com/lib/pq"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+	"github.com/sourcegraph/sourcegraph/internal/extsvc"
+)
+
+// SetRepoPendingPermissionsWithUserIDs is like SetRepoPendingPermissions, but also records the
+// users that some of the account IDs are already known to belong to, as given by userIDs, which
+// maps account IDs in accounts to user IDs. GrantResolvedPendingPermissions then grants the
+// pending permissions of such account IDs to their users without knowing their bind IDs.
+//
+// Bind IDs remain the key of pending permissions: the user of an account ID is recorded in addition
+// to its bind ID, and is kept by later calls to SetRepoPendingPermissions until it is recorded
+// again with a different user, or GrantResolvedPendingPermissions finds that the account no longer
+// belongs to the user. GrantPendingPermissions still grants pending permissions of a bind
+// ID regardless of any user recorded for it, and both grants remove them once granted.
+//
+// 🚨 SECURITY: Like GrantPendingPermissions, it is caller's responsibility to ensure the legitimate
+// relation between the account IDs and the user IDs found in userIDs.
+func (s *PermsStore) SetRepoPendingPermissionsWithUserIDs(ctx context.Context, accounts *extsvc.ExternalAccounts, userIDs map[string]int32, p *authz.RepoPermissions) (err error) {
+	ctx, save := s.observe(ctx, "SetRepoPendingPermissionsWithUserIDs", "")
+	defer func() {
+		save(&err, append(append(p.TracingFields(), accounts.TracingFields()...), otlog.Int("userIDs", len(userIDs)))...)
+	}()
+
+	accountIDs := make(map[string]bool, len(accounts.AccountIDs))
+	for _, id := range accounts.AccountIDs {
+		accountIDs[id] = true
+	}
+	for id := range userIDs {
+		if !accountIDs[id] {
+			return errors.Errorf("account ID %q of user %d is not in accounts", id, userIDs[id])
+		}
+	}
+
+	var txs *PermsStore
+	if s.inTx() {
+		txs = s
+	} else {
+		txs, err = s.Transact(ctx)
+		if err != nil {
+			return err
+		}
+		defer txs.Done(&err)
+	}
+
+	if err = txs.SetRepoPendingPermissions(ctx, accounts, p); err != nil {
+		return err
+	}
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	items := make([]*sqlf.Query, 0, len(userIDs))
+	for id, userID := range userIDs {
+		items = append(items, sqlf.Sprintf("(%s, %s::integer)", id, userID))
+	}
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_resolved.go:PermsStore.SetRepoPendingPermissionsWithUserIDs
+UPDATE user_pending_permissions AS p
+SET user_id = v.user_id
+FROM (VALUES %s) AS v(bind_id, user_id)
+WHERE p.service_type = %s
+AND p.service_id = %s
+AND p.permission = %s
+AND p.object_type = %s
+AND p.bind_id = v.bind_id
+`, sqlf.Join(items, ","), accounts.ServiceType, accounts.ServiceID, p.Perm.String(), authz.PermRepos)
+	if err = txs.execute(ctx, q); err != nil {
+		return errors.Wrap(err, "execute update user pending permissions user IDs query")
+	}
+	return nil
+}
+
+// GrantResolvedPendingPermissions grants the pending permissions of all bind IDs recorded to belong
+// to the user by SetRepoPendingPermissionsWithUserIDs, as GrantPendingPermissions does for each of
+// them, and returns the number of bind IDs granted.
+//
+// The accounts may have been unlinked from the user, or the user deleted, since they were recorded.
+// Every bind ID is therefore checked to still belong to the user at the time of the grant, as
+// GetUserIDsByExternalAccounts would resolve it, and the user of a bind ID that does not is cleared
+// instead of being granted, which leaves its pending permissions to be granted by bind ID.
+//
+// This method starts its own transaction for update consistency if the caller hasn't started one already.
+func (s *PermsStore) GrantResolvedPendingPermissions(ctx context.Context, userID int32, perm authz.Perms) (granted int, err error) {
+	ctx, save := s.observe(ctx, "GrantResolvedPendingPermissions", "")
+	defer func() {
+		save(&err,
+			otlog.Int32("userID", userID),
+			otlog.String("perm", perm.String()),
+			otlog.Int("granted", granted),
+		)
+	}()
+
+	var txs *PermsStore
+	if s.inTx() {
+		txs = s
+	} else {
+		txs, err = s.Transact(ctx)
+		if err != nil {
+			return 0, err
+		}
+		defer txs.Done(&err)
+	}
+
+	q := loadResolvedPendingPermissionsQuery(userID, perm)
+	rows, err := txs.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return 0, err
+	}
+
+	var pending []*authz.UserPendingPermissions
+	var stale []int64
+	for rows.Next() {
+		p := &authz.UserPendingPermissions{Perm: perm, Type: authz.PermRepos}
+		var resolved bool
+		if err = rows.Scan(&p.ID, &p.ServiceType, &p.ServiceID, &p.BindID, &resolved); err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+		if resolved {
+			pending = append(pending, p)
+		} else {
+			stale = append(stale, int64(p.ID))
+		}
+	}
+	if err = rows.Close(); err != nil {
+		return 0, err
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(stale) > 0 {
+		q = sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_resolved.go:PermsStore.GrantResolvedPendingPermissions
+UPDATE user_pending_permissions
+SET user_id = NULL
+WHERE id = ANY(%s::integer[])
+`, pq.Array(stale))
+		if err = txs.execute(ctx, q); err != nil {
+			return 0, errors.Wrap(err, "execute clear stale user pending permissions user IDs query")
+		}
+	}
+
+	for _, p := range pending {
+		if err = txs.GrantPendingPermissions(ctx, userID, p); err != nil {
+			return 0, errors.Wrapf(err, "grant pending permissions of bind ID %q", p.BindID)
+		}
+	}
+	return len(pending), nil
+}
+
+// loadResolvedPendingPermissionsQuery returns the query of the pending permissions recorded to
+// belong to the user, along with whether their bind IDs still belong to the user: bind IDs of the
+// "sourcegraph" service must be the username or a verified email address of the user, as matched by
+// getUserIDsByBindIDsQuery, and other bind IDs an external account linked to the user. Either way the
+// user must not be deleted. Rows are locked for the grant.
+func loadResolvedPendingPermissionsQuery(userID int32, perm authz.Perms) *sqlf.Query {
+	return sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_resolved.go:loadResolvedPendingPermissionsQuery
+SELECT p.id, p.service_type, p.service_id, p.bind_id, EXISTS (
+  SELECT 1
+  FROM users AS u
+  WHERE u.id = p.user_id
+  AND u.deleted_at IS NULL
+  AND CASE WHEN p.service_type = %s THEN
+    u.username = p.bind_id::citext
+    OR EXISTS (
+      SELECT 1
+      FROM user_emails AS e
+      WHERE e.user_id = u.id
+      AND e.email = p.bind_id::citext
+      AND e.verified_at IS NOT NULL
+    )
+  ELSE
+    EXISTS (
+      SELECT 1
+      FROM user_external_accounts AS e
+      WHERE e.user_id = u.id
+      AND e.service_type = p.service_type
+      AND e.service_id = p.service_id
+      AND e.account_id = p.bind_id
+      AND e.deleted_at IS NULL
+    )
+  END
+)
+FROM user_pending_permissions AS p
+WHERE p.user_id = %s
+AND p.permission = %s
+AND p.object_type = %s
+ORDER BY p.id
+FOR UPDATE OF p
+`, sourcegraphServiceType, userID, perm.String(), authz.PermRepos)
+}
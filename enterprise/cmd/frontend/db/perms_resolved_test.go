@@ -0,0 +1,170 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/keegancsmith/sqlf"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+	"github.com/sourcegraph/sourcegraph/internal/extsvc"
+)
+
+func testPermsStore_GrantResolvedPendingPermissions(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+
+		accounts := func(accountIDs ...string) *extsvc.ExternalAccounts {
+			return &extsvc.ExternalAccounts{
+				ServiceType: "sourcegraph",
+				ServiceID:   "https://sourcegraph.com/",
+				AccountIDs:  accountIDs,
+			}
+		}
+		setupUsers := func(t *testing.T, s *PermsStore) {
+			qs := []*sqlf.Query{
+				sqlf.Sprintf(`INSERT INTO users(username) VALUES('alice')`), // ID=1
+				sqlf.Sprintf(`INSERT INTO users(username) VALUES('bob')`),   // ID=2
+				sqlf.Sprintf(`
+INSERT INTO user_external_accounts(user_id, service_type, service_id, account_id, client_id, created_at, updated_at)
+	VALUES(%s, %s, %s, %s, %s, %s, %s)
+`, 2, "gitlab", "https://gitlab.com/", "bob_gitlab", "bob_gitlab_client_id", clock(), clock()),
+			}
+			for _, q := range qs {
+				if err := s.execute(ctx, q); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		t.Run("grant resolved", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupUsersTable(t, s)
+			defer cleanupPermsTables(t, s)
+			setupUsers(t, s)
+
+			// Only alice is known to be user 1.
+			if err := s.SetRepoPendingPermissionsWithUserIDs(ctx, accounts("alice", "bob"), map[string]int32{"alice": 1}, &authz.RepoPermissions{
+				RepoID: 1,
+				Perm:   authz.Read,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			// The user of alice is kept by an update that doesn't know it.
+			if err := s.SetRepoPendingPermissions(ctx, accounts("alice"), &authz.RepoPermissions{
+				RepoID: 2,
+				Perm:   authz.Read,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			granted, err := s.GrantResolvedPendingPermissions(ctx, 2, authz.Read)
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "granted to unknown user", 0, granted)
+
+			granted, err = s.GrantResolvedPendingPermissions(ctx, 1, authz.Read)
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "granted", 1, granted)
+
+			err = checkRegularPermsTable(s, `SELECT user_id, object_ids FROM user_permissions`, map[int32][]uint32{
+				1: {1, 2},
+			})
+			if err != nil {
+				t.Fatal("user_permissions:", err)
+			}
+			err = checkRegularPermsTable(s, `SELECT repo_id, user_ids FROM repo_permissions`, map[int32][]uint32{
+				1: {1},
+				2: {1},
+			})
+			if err != nil {
+				t.Fatal("repo_permissions:", err)
+			}
+
+			// The unresolved account is still pending and granted by its bind ID.
+			bindIDs, err := s.ListPendingUsers(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "bindIDs", []string{"bob"}, bindIDs)
+
+			granted, err = s.GrantResolvedPendingPermissions(ctx, 1, authz.Read)
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "granted again", 0, granted)
+
+			// Users of account IDs that are not given are rejected.
+			err = s.SetRepoPendingPermissionsWithUserIDs(ctx, accounts("bob"), map[string]int32{"cindy": 3}, &authz.RepoPermissions{
+				RepoID: 1,
+				Perm:   authz.Read,
+			})
+			if err == nil || err.Error() != `account ID "cindy" of user 3 is not in accounts` {
+				t.Fatalf("want account ID error but got %v", err)
+			}
+		})
+
+		t.Run("unlinked account", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupUsersTable(t, s)
+			defer cleanupPermsTables(t, s)
+			setupUsers(t, s)
+
+			gitlab := &extsvc.ExternalAccounts{
+				ServiceType: "gitlab",
+				ServiceID:   "https://gitlab.com/",
+				AccountIDs:  []string{"bob_gitlab"},
+			}
+			if err := s.SetRepoPendingPermissionsWithUserIDs(ctx, gitlab, map[string]int32{"bob_gitlab": 2}, &authz.RepoPermissions{
+				RepoID: 1,
+				Perm:   authz.Read,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			// Unlinking soft deletes the external account.
+			if err := s.execute(ctx, sqlf.Sprintf(`UPDATE user_external_accounts SET deleted_at = NOW() WHERE account_id = 'bob_gitlab'`)); err != nil {
+				t.Fatal(err)
+			}
+
+			granted, err := s.GrantResolvedPendingPermissions(ctx, 2, authz.Read)
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "granted", 0, granted)
+
+			err = s.LoadUserPermissions(ctx, &authz.UserPermissions{
+				UserID: 2,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+			})
+			if err != authz.ErrPermsNotFound {
+				t.Fatalf("err: want %q but got %v", authz.ErrPermsNotFound, err)
+			}
+
+			// The stale user is cleared, while the permissions are still pending by bind ID.
+			ids, err := s.loadIDs(ctx, sqlf.Sprintf(`SELECT id FROM user_pending_permissions WHERE user_id IS NOT NULL`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "resolved rows", 0, len(bitmapToArray(ids)))
+
+			bindIDs, err := s.ListPendingUsers(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "bindIDs", []string{"bob_gitlab"}, bindIDs)
+
+			// The unlinked account is no longer resolved to the user either.
+			userIDs, err := s.GetUserIDsByExternalAccounts(ctx, gitlab)
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "userIDs", map[string]int32{}, userIDs)
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/keegancsmith/sqlf"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+)
+
+// SetRepoPermissionsWithSequence is like SetRepoPermissions, but only applies the write if
+// sequence is greater than the sequence of the last write applied to the repository by this
+// method. It returns false without changing any state if the write is ignored, which makes
+// retries of writes safe: a retry of a write that has already been applied, or that is older
+// than a write applied meanwhile, is ignored instead of overwriting newer permissions. Callers
+// should derive sequence from a monotonic source, e.g. the time a sync started.
+//
+// Writes by SetRepoPermissions and other methods do not change the sequence of the repository,
+// thus they are neither ignored by nor taken into account by this method.
+//
+// This method starts its own transaction for update consistency if the caller hasn't started one already.
+func (s *PermsStore) SetRepoPermissionsWithSequence(ctx context.Context, p *authz.RepoPermissions, sequence int64) (applied bool, err error) {
+	ctx, save := s.observe(ctx, "SetRepoPermissionsWithSequence", "")
+	defer func() {
+		save(&err, append(p.TracingFields(), otlog.Int64("sequence", sequence), otlog.Bool("applied", applied))...)
+	}()
+
+	var txs *PermsStore
+	if s.inTx() {
+		txs = s
+	} else {
+		txs, err = s.Transact(ctx)
+		if err != nil {
+			return false, err
+		}
+		defer txs.Done(&err)
+	}
+
+	// Make sure the row of the repository exists and lock it, so that concurrent writes for the
+	// same repository are serialized. This keeps the same lock order as SetRepoPermissions (i.e.
+	// repo -> user) to prevent deadlocks.
+	if err = txs.execute(ctx, insertRepoPermissionsStubQuery(p, txs.clock.Now())); err != nil {
+		return false, errors.Wrap(err, "execute insert repo permissions stub query")
+	}
+
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_sequence.go:PermsStore.SetRepoPermissionsWithSequence
+SELECT sequence
+FROM repo_permissions
+WHERE repo_id = %s
+AND permission = %s
+FOR UPDATE
+`, p.RepoID, p.Perm.String())
+	last, err := txs.loadSequence(ctx, q)
+	if err != nil {
+		return false, errors.Wrap(err, "load repo permissions sequence")
+	}
+	if last.Valid && sequence <= last.Int64 {
+		return false, nil
+	}
+
+	if err = txs.setRepoPermissions(ctx, p, 0); err != nil {
+		return false, err
+	}
+
+	q = sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_sequence.go:PermsStore.SetRepoPermissionsWithSequence
+UPDATE repo_permissions
+SET sequence = %s
+WHERE repo_id = %s
+AND permission = %s
+`, sequence, p.RepoID, p.Perm.String())
+	if err = txs.execute(ctx, q); err != nil {
+		return false, errors.Wrap(err, "execute update repo permissions sequence query")
+	}
+	return true, nil
+}
+
+// loadSequence runs q, which returns the sequence of a single row of the "repo_permissions" table.
+func (s *PermsStore) loadSequence(ctx context.Context, q *sqlf.Query) (sql.NullInt64, error) {
+	var sequence sql.NullInt64
+	rows, err := s.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return sequence, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return sequence, err
+		}
+		return sequence, authz.ErrPermsNotFound
+	}
+	if err = rows.Scan(&sequence); err != nil {
+		return sequence, err
+	}
+	return sequence, rows.Close()
+}
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+)
+
+func testPermsStore_SetRepoPermissionsWithSequence(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		s := NewPermsStore(db, clock)
+		defer cleanupPermsTables(t, s)
+
+		ctx := context.Background()
+
+		set := func(t *testing.T, sequence int64, userIDs ...uint32) bool {
+			t.Helper()
+			applied, err := s.SetRepoPermissionsWithSequence(ctx, &authz.RepoPermissions{
+				RepoID:  1,
+				Perm:    authz.Read,
+				UserIDs: toBitmap(userIDs...),
+			}, sequence)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return applied
+		}
+		check := func(t *testing.T, userIDs []uint32, repoIDs map[int32][]uint32) {
+			t.Helper()
+			err := checkRegularPermsTable(s, `SELECT repo_id, user_ids FROM repo_permissions`, map[int32][]uint32{
+				1: userIDs,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = checkRegularPermsTable(s, `SELECT user_id, object_ids FROM user_permissions`, repoIDs)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		equal(t, "applied", true, set(t, 2, 1, 2))
+		check(t, []uint32{1, 2}, map[int32][]uint32{1: {1}, 2: {1}})
+
+		// An out-of-order write older than the last applied one is ignored.
+		equal(t, "applied", false, set(t, 1, 3))
+		check(t, []uint32{1, 2}, map[int32][]uint32{1: {1}, 2: {1}})
+
+		// A retry of the last applied write is ignored.
+		equal(t, "applied", false, set(t, 2, 1, 2))
+		check(t, []uint32{1, 2}, map[int32][]uint32{1: {1}, 2: {1}})
+
+		// A newer write is applied.
+		equal(t, "applied", true, set(t, 4, 2, 3))
+		check(t, []uint32{2, 3}, map[int32][]uint32{1: {}, 2: {1}, 3: {1}})
+
+		// Retries of writes older than the newer write are ignored, even if they
+		// are newer than writes applied before.
+		equal(t, "applied", false, set(t, 3, 1))
+		check(t, []uint32{2, 3}, map[int32][]uint32{1: {}, 2: {1}, 3: {1}})
+
+		// Writes without sequence neither change nor take into account the sequence.
+		if err := s.SetRepoPermissions(ctx, &authz.RepoPermissions{
+			RepoID:  1,
+			Perm:    authz.Read,
+			UserIDs: toBitmap(1),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		check(t, []uint32{1}, map[int32][]uint32{1: {1}, 2: {}, 3: {}})
+		equal(t, "applied", false, set(t, 4, 2))
+		equal(t, "applied", true, set(t, 5, 2))
+		check(t, []uint32{2}, map[int32][]uint32{1: {}, 2: {1}, 3: {}})
+	}
+}
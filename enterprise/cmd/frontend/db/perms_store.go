@@ -3,14 +3,21 @@ package db
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"math"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/RoaringBitmap/roaring"
 	"github.com/keegancsmith/sqlf"
+	"github.com/lib/pq"
 	otlog "github.com/opentracing/opentracing-go/log"
 	"github.com/pkg/errors"
 	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/types"
+	"github.com/sourcegraph/sourcegraph/enterprise/cmd/frontend/internal/authz/permsbitmap"
 	"github.com/sourcegraph/sourcegraph/internal/db/dbutil"
 	"github.com/sourcegraph/sourcegraph/internal/extsvc"
 	"github.com/sourcegraph/sourcegraph/internal/trace"
@@ -22,16 +29,164 @@ var ErrPermsUpdatedAtNotSet = errors.New("permissions UpdatedAt timestamp must b
 // It is concurrency-safe and maintains data consistency over the 'user_permissions',
 // 'repo_permissions', 'user_pending_permissions', and 'repo_pending_permissions' tables.
 type PermsStore struct {
-	db    dbutil.DB
-	clock func() time.Time
+	db     dbutil.DB
+	clock  Clock
+	notify chan<- PermsChange
+
+	// replica serves the Load* methods outside of transactions, which read from db when
+	// it is nil.
+	replica dbutil.DB
+
+	// history is the retention policy of changes of repository permissions, changes are
+	// not recorded when it is nil.
+	history *PermsHistoryRetention
+
+	// userHistory is the retention policy of prior object IDs of user permissions, prior
+	// object IDs are not recorded when it is nil.
+	userHistory *PermsHistoryRetention
+
+	// guard bounds the number of users removed by a single change of repository
+	// permissions, changes are not checked when it is nil.
+	guard *RemovalGuard
+
+	// grantGuard bounds the number of object IDs written by a single change of user
+	// permissions, changes are not checked when it is nil.
+	grantGuard *GrantGuard
+
+	// queue holds changes made by SetRepoPermissions while the database is unavailable,
+	// such changes fail when it is nil.
+	queue PermsQueue
+
+	// accounts caches user IDs resolved by GetUserIDsByExternalAccounts, nothing is cached
+	// when it is nil.
+	accounts *externalAccountsCache
+
+	// dispatcher receives changes of repository permissions, which are not recorded when it
+	// is nil.
+	dispatcher RepoPermsDispatcher
+
+	// isolation is the isolation level of transactions started by this PermsStore.
+	isolation sql.IsolationLevel
+
+	// pending holds changes of user permissions made within the transaction of this
+	// PermsStore, which are sent to notify after the transaction commits.
+	pending []PermsChange
+
+	// pendingRepos holds changes of repository permissions made within the transaction of
+	// this PermsStore, which are passed to dispatcher after the transaction commits.
+	pendingRepos []RepoPermsChange
 }
 
 // NewPermsStore returns a new PermsStore with given parameters.
 func NewPermsStore(db dbutil.DB, clock func() time.Time) *PermsStore {
 	return &PermsStore{
 		db:    db,
-		clock: clock,
+		clock: clockFunc(clock),
+	}
+}
+
+// WithClock returns a copy of the PermsStore that reads the current time from given clock.
+func (s *PermsStore) WithClock(clock Clock) *PermsStore {
+	c := s.clone()
+	c.clock = clock
+	return c
+}
+
+// WithIsolationLevel returns a copy of the PermsStore that starts transactions with given
+// isolation level. The default is sql.LevelDefault, which is READ COMMITTED in PostgreSQL.
+// Multi-statement writes only rely on row-level locks for consistency, which are sufficient
+// under READ COMMITTED. Stricter levels may fail concurrent writes with a serialization
+// error instead of waiting for locks, and such writes must be retried by the caller.
+func (s *PermsStore) WithIsolationLevel(level sql.IsolationLevel) *PermsStore {
+	c := s.clone()
+	c.isolation = level
+	return c
+}
+
+// WithReplica returns a copy of the PermsStore that serves the Load* methods from replica,
+// a read-only handle of a database replicated from the primary database of the PermsStore.
+// Reads within a transaction always use the primary database. Because of replication lag,
+// permissions written by the caller may not be visible on replica immediately, so callers
+// that need to read their own writes should use WithPrimaryReads.
+func (s *PermsStore) WithReplica(replica dbutil.DB) *PermsStore {
+	c := s.clone()
+	c.replica = replica
+	return c
+}
+
+// WithPrimaryReads returns a copy of the PermsStore that serves the Load* methods from the
+// primary database even if a replica is set, so that it observes all previously committed
+// writes, e.g. right after SetRepoPermissions.
+func (s *PermsStore) WithPrimaryReads() *PermsStore {
+	c := s.clone()
+	c.replica = nil
+	return c
+}
+
+// reads returns the PermsStore that serves the Load* methods, which reads from the replica
+// if one is set and the PermsStore is not in a transaction.
+func (s *PermsStore) reads() *PermsStore {
+	if s.replica == nil || s.inTx() {
+		return s
 	}
+	c := s.clone()
+	c.db = s.replica
+	c.replica = nil
+	return c
+}
+
+// clone returns a copy of the PermsStore without changes pending notification or dispatch.
+func (s *PermsStore) clone() *PermsStore {
+	return &PermsStore{
+		db:          s.db,
+		clock:       s.clock,
+		notify:      s.notify,
+		replica:     s.replica,
+		history:     s.history,
+		userHistory: s.userHistory,
+		guard:       s.guard,
+		grantGuard:  s.grantGuard,
+		queue:       s.queue,
+		accounts:    s.accounts,
+		dispatcher:  s.dispatcher,
+		isolation:   s.isolation,
+	}
+}
+
+// Clock is the source of the current time for a PermsStore.
+type Clock interface {
+	Now() time.Time
+}
+
+// clockFunc adapts a plain function to the Clock interface.
+type clockFunc func() time.Time
+
+func (f clockFunc) Now() time.Time { return f() }
+
+// TestClock is a Clock whose time only changes when advanced explicitly,
+// which allows tests to control time deterministically per PermsStore.
+type TestClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewTestClock returns a new TestClock set to given time.
+func NewTestClock(now time.Time) *TestClock {
+	return &TestClock{now: now}
+}
+
+// Now returns the current time of the clock.
+func (c *TestClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *TestClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
 }
 
 // LoadUserPermissions loads stored user permissions into p. An ErrPermsNotFound is returned
@@ -44,15 +199,47 @@ func (s *PermsStore) LoadUserPermissions(ctx context.Context, p *authz.UserPermi
 	ctx, save := s.observe(ctx, "LoadUserPermissions", "")
 	defer func() { save(&err, p.TracingFields()...) }()
 
-	vals, err := s.load(ctx, loadUserPermissionsQuery(p, ""))
+	var metadata []byte
+	var expired []int64
+	vals, err := s.reads().load(ctx, loadUserPermissionsWithMetadataQuery(p, s.clock.Now()), &metadata, pq.Array(&expired))
 	if err != nil {
 		return err
 	}
+
+	// Exclude object IDs whose grants have expired but not yet been cleaned up.
+	removeExpiredIDs(vals.ids, expired)
+
 	p.IDs = vals.ids
 	p.UpdatedAt = vals.updatedAt
+	p.Metadata = nil
+	if len(metadata) > 0 {
+		p.Metadata = &authz.SyncMetadata{}
+		if err = json.Unmarshal(metadata, p.Metadata); err != nil {
+			return errors.Wrap(err, "unmarshal sync metadata")
+		}
+	}
 	return nil
 }
 
+func loadUserPermissionsWithMetadataQuery(p *authz.UserPermissions, now time.Time) *sqlf.Query {
+	const format = `
+-- source: enterprise/cmd/frontend/db/perms_store.go:loadUserPermissionsWithMetadataQuery
+SELECT user_id, object_ids, updated_at, sync_metadata, %s
+FROM user_permissions
+WHERE user_id = %s
+AND permission = %s
+AND object_type = %s
+`
+
+	return sqlf.Sprintf(
+		format,
+		expiredObjectIDsColumn(now),
+		p.UserID,
+		p.Perm.String(),
+		p.Type,
+	)
+}
+
 func loadUserPermissionsQuery(p *authz.UserPermissions, lock string) *sqlf.Query {
 	const format = `
 -- source: enterprise/cmd/frontend/db/perms_store.go:loadUserPermissionsQuery
@@ -71,6 +258,240 @@ AND object_type = %s
 	)
 }
 
+// loadUserPermissionsForUpdateQuery is like loadUserPermissionsQuery with a "FOR UPDATE" lock, but
+// also returns whether any object IDs of the user have expiries, so that callers can skip deleting
+// expiries that don't exist.
+func loadUserPermissionsForUpdateQuery(p *authz.UserPermissions) *sqlf.Query {
+	const format = `
+-- source: enterprise/cmd/frontend/db/perms_store.go:loadUserPermissionsForUpdateQuery
+SELECT user_id, object_ids, updated_at, %s
+FROM user_permissions
+WHERE user_id = %s
+AND permission = %s
+AND object_type = %s
+FOR UPDATE
+`
+
+	return sqlf.Sprintf(
+		format,
+		hasExpiriesColumn(),
+		p.UserID,
+		p.Perm.String(),
+		p.Type,
+	)
+}
+
+// LoadUserPermissionsFiltered returns the IDs of repositories in candidates that the user of p
+// has permissions to, e.g. for a page of search results. The row of the user in the
+// "user_permissions" table is authoritative, so the result is the intersection of candidates
+// with its object IDs, and never includes repositories from stale rows of the "repo_permissions"
+// table. Like LoadUserPermissions, object IDs whose grants have expired are excluded. The result
+// is empty when the user has no permissions, and only the "repos" type is supported.
+func (s *PermsStore) LoadUserPermissionsFiltered(ctx context.Context, p *authz.UserPermissions, candidates *roaring.Bitmap) (ids *roaring.Bitmap, err error) {
+	if candidates == nil {
+		candidates = roaring.NewBitmap()
+	}
+
+	ctx, save := s.observe(ctx, "LoadUserPermissionsFiltered", "")
+	defer func() {
+		fields := append(p.TracingFields(), otlog.Uint64("candidates", candidates.GetCardinality()))
+		if ids != nil {
+			fields = append(fields, otlog.Uint64("ids", ids.GetCardinality()))
+		}
+		save(&err, fields...)
+	}()
+
+	if p.Type != authz.PermRepos {
+		return nil, errors.Errorf("unsupported permission type %q", p.Type)
+	}
+
+	ids = roaring.NewBitmap()
+	if candidates.IsEmpty() {
+		return ids, nil
+	}
+
+	var expired []int64
+	vals, err := s.reads().load(ctx, loadUnexpiredUserPermissionsQuery(p, s.clock.Now()), pq.Array(&expired))
+	if err == authz.ErrPermsNotFound {
+		return ids, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "load user permissions")
+	}
+	ids = roaring.And(candidates, vals.ids)
+
+	// Exclude object IDs whose grants have expired but not yet been cleaned up.
+	removeExpiredIDs(ids, expired)
+	return ids, nil
+}
+
+func loadUnexpiredUserPermissionsQuery(p *authz.UserPermissions, now time.Time) *sqlf.Query {
+	const format = `
+-- source: enterprise/cmd/frontend/db/perms_store.go:loadUnexpiredUserPermissionsQuery
+SELECT user_id, object_ids, updated_at, %s
+FROM user_permissions
+WHERE user_id = %s
+AND permission = %s
+AND object_type = %s
+`
+
+	return sqlf.Sprintf(
+		format,
+		expiredObjectIDsColumn(now),
+		p.UserID,
+		p.Perm.String(),
+		p.Type,
+	)
+}
+
+// LoadUserPermissionsWithRepos is like LoadUserPermissions, but also returns a page of the
+// repositories in p.IDs with their names, ordered by ID. The page is the window of at most limit
+// IDs of p.IDs after the first offset IDs, and a limit of zero or less is the window of all IDs
+// after offset. Only the IDs of the window are queried, which is cheaper for users with access
+// to many repositories, thus deleted repositories in the window are skipped rather than
+// replaced, and a page may have fewer than limit repositories even if it is not the last one.
+func (s *PermsStore) LoadUserPermissionsWithRepos(ctx context.Context, p *authz.UserPermissions, limit, offset int) (repos []*types.Repo, err error) {
+	ctx, save := s.observe(ctx, "LoadUserPermissionsWithRepos", "")
+	defer func() {
+		save(&err, append(p.TracingFields(),
+			otlog.Int("limit", limit),
+			otlog.Int("offset", offset),
+			otlog.Int("repos.count", len(repos)),
+		)...)
+	}()
+
+	r := s.reads()
+	if err = r.LoadUserPermissions(ctx, p); err != nil {
+		return nil, err
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	if uint64(offset) >= p.IDs.GetCardinality() {
+		return []*types.Repo{}, nil
+	}
+
+	// Take the window of IDs from the bitmap rather than from the query.
+	first, err := p.IDs.Select(uint32(offset))
+	if err != nil {
+		return nil, errors.Wrap(err, "select first ID of page")
+	}
+	it := p.IDs.Iterator()
+	it.AdvanceIfNeeded(first)
+	var ids []int64
+	for it.HasNext() && (limit <= 0 || len(ids) < limit) {
+		ids = append(ids, int64(it.Next()))
+	}
+
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_store.go:PermsStore.LoadUserPermissionsWithRepos
+SELECT id, name
+FROM repo
+WHERE id = ANY(%s)
+AND deleted_at IS NULL
+ORDER BY id
+`, pq.Array(ids))
+	rows, err := r.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	repos = []*types.Repo{}
+	for rows.Next() {
+		var repo types.Repo
+		if err = rows.Scan(&repo.ID, &repo.Name); err != nil {
+			return nil, err
+		}
+		repos = append(repos, &repo)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return repos, nil
+}
+
+// UserPermissionsExist returns true if a row of user permissions exists for given user,
+// permission and type, without loading its object IDs. It distinguishes users whose
+// permissions have never been synced (false) from users whose permissions have been synced
+// but are empty (true).
+func (s *PermsStore) UserPermissionsExist(ctx context.Context, userID int32, perm authz.Perms, typ authz.PermType) (exists bool, err error) {
+	ctx, save := s.observe(ctx, "UserPermissionsExist", "")
+	defer func() {
+		save(&err,
+			otlog.Int32("userID", userID),
+			otlog.String("perm", perm.String()),
+			otlog.String("type", string(typ)),
+			otlog.Bool("exists", exists),
+		)
+	}()
+
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_store.go:PermsStore.UserPermissionsExist
+SELECT EXISTS (
+  SELECT 1
+  FROM user_permissions
+  WHERE user_id = %s
+  AND permission = %s
+  AND object_type = %s
+)
+`, userID, perm.String(), typ)
+
+	rows, err := s.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		if err = rows.Scan(&exists); err != nil {
+			return false, err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+// UserHasAnyPermission returns true if a row of user permissions exists for given user with any
+// permission and type, without loading its object IDs, i.e. if the user is subject to permissions
+// enforcement at all.
+func (s *PermsStore) UserHasAnyPermission(ctx context.Context, userID int32) (exists bool, err error) {
+	ctx, save := s.observe(ctx, "UserHasAnyPermission", "")
+	defer func() {
+		save(&err,
+			otlog.Int32("userID", userID),
+			otlog.Bool("exists", exists),
+		)
+	}()
+
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_store.go:PermsStore.UserHasAnyPermission
+SELECT EXISTS (
+  SELECT 1
+  FROM user_permissions
+  WHERE user_id = %s
+)
+`, userID)
+
+	rows, err := s.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		if err = rows.Scan(&exists); err != nil {
+			return false, err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
 // LoadRepoPermissions loads stored repository permissions into p. An ErrPermsNotFound is
 // returned when there are no valid permissions available.
 func (s *PermsStore) LoadRepoPermissions(ctx context.Context, p *authz.RepoPermissions) (err error) {
@@ -81,15 +502,37 @@ func (s *PermsStore) LoadRepoPermissions(ctx context.Context, p *authz.RepoPermi
 	ctx, save := s.observe(ctx, "LoadRepoPermissions", "")
 	defer func() { save(&err, p.TracingFields()...) }()
 
-	vals, err := s.load(ctx, loadRepoPermissionsQuery(p, ""))
+	var expired []int64
+	vals, err := s.reads().load(ctx, loadUnexpiredRepoPermissionsQuery(p, s.clock.Now()), pq.Array(&expired))
 	if err != nil {
 		return err
 	}
+
+	// Exclude user IDs whose grants have expired but not yet been cleaned up.
+	removeExpiredIDs(vals.ids, expired)
+
 	p.UserIDs = vals.ids
 	p.UpdatedAt = vals.updatedAt
 	return nil
 }
 
+func loadUnexpiredRepoPermissionsQuery(p *authz.RepoPermissions, now time.Time) *sqlf.Query {
+	const format = `
+-- source: enterprise/cmd/frontend/db/perms_store.go:loadUnexpiredRepoPermissionsQuery
+SELECT repo_id, user_ids, updated_at, %s
+FROM repo_permissions
+WHERE repo_id = %s
+AND permission = %s
+`
+
+	return sqlf.Sprintf(
+		format,
+		expiredUserIDsColumn(now),
+		p.RepoID,
+		p.Perm.String(),
+	)
+}
+
 func loadRepoPermissionsQuery(p *authz.RepoPermissions, lock string) *sqlf.Query {
 	const format = `
 -- source: enterprise/cmd/frontend/db/perms_store.go:loadRepoPermissionsQuery
@@ -106,6 +549,98 @@ AND permission = %s
 	)
 }
 
+// LoadRepoPermissionsWithPendingCount is like LoadRepoPermissions, but also returns the number of
+// users that have pending permissions to the repository (i.e. bind IDs not yet associated with a
+// user). Unlike LoadRepoPermissions, repositories without stored permissions are not an error, and
+// p.UserIDs is set to an empty bitmap instead.
+func (s *PermsStore) LoadRepoPermissionsWithPendingCount(ctx context.Context, p *authz.RepoPermissions) (pendingCount int, err error) {
+	ctx, save := s.observe(ctx, "LoadRepoPermissionsWithPendingCount", "")
+	defer func() { save(&err, append(p.TracingFields(), otlog.Int("pendingCount", pendingCount))...) }()
+
+	bindIDSet, err := s.loadRepoPermissionsWithPending(ctx, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(bindIDSet), nil
+}
+
+// LoadRepoPermissionsWithPending returns the IDs of users that have the given permission to the
+// repository along with the bind IDs that have pending permissions to it, sorted, i.e. both the
+// real and the pending members of the repository. Like LoadRepoPermissionsWithPendingCount,
+// repositories without stored permissions are not an error, and an empty bitmap is returned.
+func (s *PermsStore) LoadRepoPermissionsWithPending(ctx context.Context, repoID int32, perm authz.Perms) (userIDs *roaring.Bitmap, bindIDs []string, err error) {
+	ctx, save := s.observe(ctx, "LoadRepoPermissionsWithPending", "")
+	defer func() {
+		save(&err,
+			otlog.Int32("repoID", repoID),
+			otlog.String("perm", perm.String()),
+			otlog.Int("bindIDs", len(bindIDs)),
+		)
+	}()
+
+	p := &authz.RepoPermissions{RepoID: repoID, Perm: perm}
+	bindIDSet, err := s.loadRepoPermissionsWithPending(ctx, p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bindIDs = make([]string, 0, len(bindIDSet))
+	for _, bindID := range bindIDSet {
+		bindIDs = append(bindIDs, bindID)
+	}
+	sort.Strings(bindIDs)
+	return p.UserIDs, bindIDs, nil
+}
+
+// loadRepoPermissionsWithPending loads stored repository permissions into p, or an empty bitmap
+// when there are none, and returns the bind IDs that have pending permissions to the repository,
+// keyed by the IDs of their rows in the "user_pending_permissions" table. Unless s is within a
+// transaction, both are read from the same snapshot of the database (see readTransact), so that a
+// bind ID being granted concurrently is either a real or a pending member, never both or neither.
+func (s *PermsStore) loadRepoPermissionsWithPending(ctx context.Context, p *authz.RepoPermissions) (bindIDSet map[int32]string, err error) {
+	var r *PermsStore
+	if s.inTx() {
+		r = s
+	} else {
+		if r, err = s.readTransact(ctx); err != nil {
+			return nil, err
+		}
+		defer r.Done(&err)
+	}
+
+	err = r.LoadRepoPermissions(ctx, p)
+	if err == authz.ErrPermsNotFound {
+		p.UserIDs = roaring.NewBitmap()
+		p.UpdatedAt = time.Time{}
+	} else if err != nil {
+		return nil, err
+	}
+	return r.loadRepoPendingBindIDs(ctx, p)
+}
+
+// loadRepoPendingBindIDs returns the bind IDs that have pending permissions to the repository of
+// p, keyed by the IDs of their rows in the "user_pending_permissions" table.
+func (s *PermsStore) loadRepoPendingBindIDs(ctx context.Context, p *authz.RepoPermissions) (map[int32]string, error) {
+	vals, err := s.load(ctx, loadRepoPendingPermissionsQuery(p, ""))
+	if err == authz.ErrPermsNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "load repo pending permissions")
+	}
+
+	// IDs of pending permissions that have been granted are not removed from the row of the
+	// repository, so only IDs that still exist are returned.
+	ids := vals.ids.ToArray()
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	bindIDSet, _, err := s.batchLoadUserPendingPermissions(ctx, loadUserPendingPermissionsByIDBatchQuery(ids, p.Perm, authz.PermRepos, ""))
+	if err != nil {
+		return nil, errors.Wrap(err, "batch load user pending permissions")
+	}
+	return bindIDSet, nil
+}
+
 // SetUserPermissions performs a full update for p, new object IDs found in p will be upserted
 // and object IDs no longer in p will be removed. This method updates both `user_permissions`
 // and `repo_permissions` tables.
@@ -133,25 +668,94 @@ func (s *PermsStore) SetUserPermissions(ctx context.Context, p *authz.UserPermis
 	ctx, save := s.observe(ctx, "SetUserPermissions", "")
 	defer func() { save(&err, p.TracingFields()...) }()
 
+	_, err = s.setUserPermissionsWithResult(ctx, p)
+	return err
+}
+
+// SetUserPermissionsResult describes the changes made by SetUserPermissionsWithResult.
+type SetUserPermissionsResult struct {
+	Added   int // The number of object IDs added to the user.
+	Removed int // The number of object IDs removed from the user.
+	Total   int // The number of object IDs of the user after the update.
+}
+
+// SetUserPermissionsWithResult is like SetUserPermissions, but also returns the number of object IDs
+// added and removed, as computed against the stored object IDs within the transaction, and the number
+// of object IDs of the user after the update. The result is nil if the error is not.
+func (s *PermsStore) SetUserPermissionsWithResult(ctx context.Context, p *authz.UserPermissions) (res *SetUserPermissionsResult, err error) {
+	ctx, save := s.observe(ctx, "SetUserPermissionsWithResult", "")
+	defer func() {
+		fields := p.TracingFields()
+		if res != nil {
+			fields = append(fields,
+				otlog.Int("added", res.Added),
+				otlog.Int("removed", res.Removed),
+				otlog.Int("total", res.Total),
+			)
+		}
+		save(&err, fields...)
+	}()
+
+	return s.setUserPermissionsWithResult(ctx, p)
+}
+
+func (s *PermsStore) setUserPermissionsWithResult(ctx context.Context, p *authz.UserPermissions) (res *SetUserPermissionsResult, err error) {
 	// Open a transaction for update consistency.
 	txs, err := s.Transact(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer txs.Done(&err)
 
+	var hasExpiries bool
+	if res, hasExpiries, err = txs.setUserPermissions(ctx, p); err != nil {
+		return nil, err
+	}
+	if err = txs.setUserPermissionsMetadata(ctx, p, res); err != nil {
+		return nil, err
+	}
+
+	// All object IDs set by this method never expire.
+	if hasExpiries {
+		if err = txs.setUserPermissionsExpiries(ctx, p, nil); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// setUserPermissions implements SetUserPermissions, it must be called within a transaction. It
+// returns the changes made to the object IDs of the user and whether any of the stored object IDs
+// have expiries, checks the object IDs against the GrantGuard, and rejects object IDs that do not
+// fit into the int32 columns of object IDs. Expiries are left unchanged. The sync metadata is
+// written along with the object IDs, thus it is only replaced when the object IDs have changed.
+//
+// The row of the user is written by a single upsert statement. It is still loaded with a row-level
+// lock beforehand, because the stored object IDs are needed to compute the rows to be updated in the
+// "repo_permissions" table, and concurrent updates of the same user must not interleave.
+func (s *PermsStore) setUserPermissions(ctx context.Context, p *authz.UserPermissions) (res *SetUserPermissionsResult, hasExpiries bool, err error) {
+	// Object IDs are stored as int32 in the "repo_permissions" table.
+	if p.IDs != nil && !p.IDs.IsEmpty() && p.IDs.Maximum() > math.MaxInt32 {
+		return nil, false, errors.Errorf("object ID %d of user %d is out of range", p.IDs.Maximum(), p.UserID)
+	}
+
+	if err = s.checkGrant(p); err != nil {
+		return nil, false, err
+	}
+
 	// Retrieve currently stored object IDs of this user.
 	var oldIDs *roaring.Bitmap
-	vals, err := txs.load(ctx, loadUserPermissionsQuery(p, "FOR UPDATE"))
+	vals, err := s.load(ctx, loadUserPermissionsForUpdateQuery(p), &hasExpiries)
 	if err != nil {
 		if err == authz.ErrPermsNotFound {
 			oldIDs = roaring.NewBitmap()
 		} else {
-			return errors.Wrap(err, "load user permissions")
+			return nil, false, errors.Wrap(err, "load user permissions")
 		}
 	} else {
 		oldIDs = vals.ids
 	}
+	stored := vals != nil
 
 	if p.IDs == nil {
 		p.IDs = roaring.NewBitmap()
@@ -160,24 +764,31 @@ func (s *PermsStore) SetUserPermissions(ctx context.Context, p *authz.UserPermis
 	// Compute differences between the old and new sets.
 	added := roaring.AndNot(p.IDs, oldIDs)
 	removed := roaring.AndNot(oldIDs, p.IDs)
+	res = &SetUserPermissionsResult{
+		Added:   int(added.GetCardinality()),
+		Removed: int(removed.GetCardinality()),
+		Total:   int(p.IDs.GetCardinality()),
+	}
 
 	// Load stored object IDs of both added and removed.
 	changedIDs := roaring.Or(added, removed).ToArray()
 
 	// In case there is nothing to add or remove.
 	if len(changedIDs) == 0 {
-		return nil
+		return res, hasExpiries, nil
 	}
 
 	q := loadRepoPermissionsBatchQuery(changedIDs, p.Perm, "FOR UPDATE")
-	loadedIDs, err := txs.batchLoadIDs(ctx, q)
+	loadedIDs, err := s.batchLoadIDs(ctx, q)
 	if err != nil {
-		return errors.Wrap(err, "batch load repo permissions")
+		return nil, false, errors.Wrap(err, "batch load repo permissions")
 	}
 
 	// We have two sets of IDs that one needs to add, and the other needs to remove.
-	updatedAt := txs.clock()
+	updatedAt := s.clock.Now()
 	updatedPerms := make([]*authz.RepoPermissions, 0, len(changedIDs))
+	addedGrants := make(map[repoPermsKey]*roaring.Bitmap)
+	removedGrants := make(map[repoPermsKey]*roaring.Bitmap)
 	for _, id := range changedIDs {
 		repoID := int32(id)
 		userIDs := loadedIDs[repoID]
@@ -185,11 +796,15 @@ func (s *PermsStore) SetUserPermissions(ctx context.Context, p *authz.UserPermis
 			userIDs = roaring.NewBitmap()
 		}
 
+		key := repoPermsKey{repoID: repoID, perm: p.Perm}
 		switch {
 		case added.Contains(id):
-			userIDs.Add(uint32(p.UserID))
+			if userIDs.CheckedAdd(uint32(p.UserID)) {
+				addedGrants[key] = roaring.BitmapOf(uint32(p.UserID))
+			}
 		case removed.Contains(id):
 			userIDs.Remove(uint32(p.UserID))
+			removedGrants[key] = roaring.BitmapOf(uint32(p.UserID))
 		}
 
 		updatedPerms = append(updatedPerms, &authz.RepoPermissions{
@@ -201,26 +816,116 @@ func (s *PermsStore) SetUserPermissions(ctx context.Context, p *authz.UserPermis
 	}
 
 	if q, err = upsertRepoPermissionsBatchQuery(updatedPerms...); err != nil {
-		return err
-	} else if err = txs.execute(ctx, q); err != nil {
-		return errors.Wrap(err, "execute upsert repo permissions batch query")
+		return nil, false, err
+	} else if err = s.execute(ctx, q); err != nil {
+		return nil, false, errors.Wrap(err, "execute upsert repo permissions batch query")
+	}
+	if err = s.recordPermissionsGrants(ctx, addedGrants, removedGrants, updatedAt); err != nil {
+		return nil, false, err
 	}
 
 	p.UpdatedAt = updatedAt
-	if q, err = upsertUserPermissionsBatchQuery(p); err != nil {
+	if q, err = upsertUserPermissionsWithMetadataQuery(p); err != nil {
+		return nil, false, err
+	} else if err = s.execute(ctx, q); err != nil {
+		return nil, false, errors.Wrap(err, "execute upsert user permissions with metadata query")
+	}
+
+	if stored {
+		if err = s.recordUserPermissionsSnapshot(ctx, p, oldIDs); err != nil {
+			return nil, false, err
+		}
+	}
+
+	s.recordChange(p.UserID, added, removed)
+	return res, hasExpiries, nil
+}
+
+// setUserPermissionsMetadata stores p.Metadata in the row of the user, replacing the metadata
+// of any previous sync, when setUserPermissions has not written it along with the object IDs,
+// i.e. when res has no changes. In that case, the metadata is kept when p.Metadata is nil, as
+// it still describes the sync that wrote the current permissions.
+func (s *PermsStore) setUserPermissionsMetadata(ctx context.Context, p *authz.UserPermissions, res *SetUserPermissionsResult) error {
+	if res.Added > 0 || res.Removed > 0 || p.Metadata == nil {
+		return nil
+	}
+
+	metadata, err := marshalSyncMetadata(p.Metadata)
+	if err != nil {
 		return err
-	} else if err = txs.execute(ctx, q); err != nil {
-		return errors.Wrap(err, "execute upsert user permissions batch query")
 	}
 
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_store.go:PermsStore.setUserPermissionsMetadata
+UPDATE user_permissions
+SET sync_metadata = %s::jsonb
+WHERE user_id = %s
+AND permission = %s
+AND object_type = %s
+`, metadata, p.UserID, p.Perm.String(), p.Type)
+	if err := s.execute(ctx, q); err != nil {
+		return errors.Wrap(err, "execute update user permissions metadata query")
+	}
 	return nil
 }
 
+// marshalSyncMetadata returns the value of the "sync_metadata" column for m, which is NULL
+// when m is nil.
+func marshalSyncMetadata(m *authz.SyncMetadata) (interface{}, error) {
+	if m == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// BatchTouchUserPermissions sets the updated_at of the rows of given users in the "user_permissions"
+// table to the current time without changing their object IDs, e.g. when a sync confirms that the
+// permissions of many users are unchanged. It returns the number of rows updated, which is less than
+// the number of given users when some of them have no row.
+func (s *PermsStore) BatchTouchUserPermissions(ctx context.Context, userIDs []int32, perm authz.Perms, typ authz.PermType) (touched int, err error) {
+	ctx, save := s.observe(ctx, "BatchTouchUserPermissions", "")
+	defer func() {
+		save(&err,
+			otlog.Int("userIDs", len(userIDs)),
+			otlog.String("perm", perm.String()),
+			otlog.String("type", string(typ)),
+			otlog.Int("touched", touched),
+		)
+	}()
+
+	if len(userIDs) == 0 {
+		return 0, nil
+	}
+
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_store.go:PermsStore.BatchTouchUserPermissions
+UPDATE user_permissions
+SET updated_at = %s
+WHERE user_id = ANY(%s)
+AND permission = %s
+AND object_type = %s
+RETURNING user_id
+`, s.clock.Now().UTC(), pq.Array(userIDs), perm.String(), typ)
+
+	ids, err := s.loadIDs(ctx, q)
+	if err != nil {
+		return 0, errors.Wrap(err, "execute touch user permissions query")
+	}
+	return int(ids.GetCardinality()), nil
+}
+
 // SetRepoPermissions performs a full update for p, new user IDs found in p will be upserted
 // and user IDs no longer in p will be removed. This method updates both `user_permissions`
-// and `repo_permissions` tables.
+// and `repo_permissions` tables. User IDs found in p never expire, i.e. their expiries set by
+// SetUserPermissionsWithExpiry are deleted.
 //
 // This method starts its own transaction for update consistency if the caller hasn't started one already.
+// When the database is unavailable, the update is queued instead if the PermsStore has a write-ahead
+// queue (see WithWriteAheadQueue) and the caller hasn't started a transaction.
 //
 // Example input:
 // &RepoPermissions{
@@ -248,6 +953,40 @@ func (s *PermsStore) SetRepoPermissions(ctx context.Context, p *authz.RepoPermis
 	ctx, save := s.observe(ctx, "SetRepoPermissions", "")
 	defer func() { save(&err, p.TracingFields()...) }()
 
+	err = s.setRepoPermissions(ctx, p, 0)
+	if err != nil && s.queue != nil && !s.inTx() && isDatabaseUnavailable(err) {
+		return s.enqueueRepoPermissions(p)
+	}
+	return err
+}
+
+// SetRepoPermissionsInBatches is like SetRepoPermissions but updates rows of the
+// `user_permissions` table in batches of at most batchSize user IDs per statement.
+// It is intended for repositories that are readable by a very large number of users,
+// where a single statement would otherwise be too large to build and send. Only the
+// size of statements is bounded: all batches run in the same transaction as the update
+// of the `repo_permissions` row, so that the final state is presented atomically, thus
+// the rows locked by every batch stay locked until the transaction commits.
+func (s *PermsStore) SetRepoPermissionsInBatches(ctx context.Context, p *authz.RepoPermissions, batchSize int) (err error) {
+	ctx, save := s.observe(ctx, "SetRepoPermissionsInBatches", "")
+	defer func() { save(&err, append(p.TracingFields(), otlog.Int("batchSize", batchSize))...) }()
+
+	if batchSize <= 0 {
+		return errors.Errorf("batch size must be positive but got %d", batchSize)
+	}
+	return s.setRepoPermissions(ctx, p, batchSize)
+}
+
+// setRepoPermissions implements SetRepoPermissions. Rows of the `user_permissions` table are
+// loaded and upserted in batches of batchSize user IDs, or all at once when batchSize is 0. User
+// IDs that do not fit into the int32 columns of user IDs are rejected. The number of rows updated
+// for added and removed users of every successful change is recorded in the fan-out metrics.
+func (s *PermsStore) setRepoPermissions(ctx context.Context, p *authz.RepoPermissions, batchSize int) (err error) {
+	// User IDs are stored as int32 in the "user_permissions" table.
+	if p.UserIDs != nil && !p.UserIDs.IsEmpty() && p.UserIDs.Maximum() > math.MaxInt32 {
+		return errors.Errorf("user ID %d of repository %d is out of range", p.UserIDs.Maximum(), p.RepoID)
+	}
+
 	var txs *PermsStore
 	if s.inTx() {
 		txs = s
@@ -279,6 +1018,21 @@ func (s *PermsStore) SetRepoPermissions(ctx context.Context, p *authz.RepoPermis
 	// Compute differences between the old and new sets.
 	added := roaring.AndNot(p.UserIDs, oldIDs)
 	removed := roaring.AndNot(oldIDs, p.UserIDs)
+	defer func() {
+		if err == nil {
+			observeRepoPermsFanout(added, removed)
+		}
+	}()
+
+	if err = txs.checkRemoval(ctx, p, oldIDs, removed); err != nil {
+		return err
+	}
+
+	// Users granted by p never expire, including those whose grants had expired but were not yet
+	// cleaned up, and users removed by p have nothing left to expire.
+	if err = txs.deleteRepoPermissionsExpiries(ctx, p); err != nil {
+		return err
+	}
 
 	// Load stored user IDs of both added and removed.
 	changedIDs := roaring.Or(added, removed).ToArray()
@@ -288,51 +1042,72 @@ func (s *PermsStore) SetRepoPermissions(ctx context.Context, p *authz.RepoPermis
 		return nil
 	}
 
-	q := loadUserPermissionsBatchQuery(changedIDs, p.Perm, authz.PermRepos, "FOR UPDATE")
-	loadedIDs, err := txs.batchLoadIDs(ctx, q)
-	if err != nil {
-		return errors.Wrap(err, "batch load user permissions")
+	if batchSize <= 0 {
+		batchSize = len(changedIDs)
 	}
 
-	// We have two sets of IDs that one needs to add, and the other needs to remove.
-	updatedAt := txs.clock()
-	updatedPerms := make([]*authz.UserPermissions, 0, len(changedIDs))
-	for _, id := range changedIDs {
-		userID := int32(id)
-		repoIDs := loadedIDs[userID]
-		if repoIDs == nil {
-			repoIDs = roaring.NewBitmap()
+	updatedAt := txs.clock.Now()
+	for start := 0; start < len(changedIDs); start += batchSize {
+		end := start + batchSize
+		if end > len(changedIDs) {
+			end = len(changedIDs)
 		}
+		batchIDs := changedIDs[start:end]
 
-		switch {
-		case added.Contains(id):
-			repoIDs.Add(uint32(p.RepoID))
-		case removed.Contains(id):
-			repoIDs.Remove(uint32(p.RepoID))
+		q := loadUserPermissionsBatchQuery(batchIDs, p.Perm, authz.PermRepos, "FOR UPDATE")
+		loadedIDs, err := txs.batchLoadIDs(ctx, q)
+		if err != nil {
+			return errors.Wrap(err, "batch load user permissions")
 		}
 
-		updatedPerms = append(updatedPerms, &authz.UserPermissions{
-			UserID:    userID,
-			Perm:      p.Perm,
-			Type:      authz.PermRepos,
-			IDs:       repoIDs,
-			UpdatedAt: updatedAt,
-		})
-	}
+		// We have two sets of IDs that one needs to add, and the other needs to remove.
+		updatedPerms := make([]*authz.UserPermissions, 0, len(batchIDs))
+		for _, id := range batchIDs {
+			userID := int32(id)
+			repoIDs := loadedIDs[userID]
+			if repoIDs == nil {
+				repoIDs = roaring.NewBitmap()
+			}
+
+			switch {
+			case added.Contains(id):
+				repoIDs.Add(uint32(p.RepoID))
+			case removed.Contains(id):
+				repoIDs.Remove(uint32(p.RepoID))
+			}
+
+			updatedPerms = append(updatedPerms, &authz.UserPermissions{
+				UserID:    userID,
+				Perm:      p.Perm,
+				Type:      authz.PermRepos,
+				IDs:       repoIDs,
+				UpdatedAt: updatedAt,
+			})
+		}
 
-	if q, err = upsertUserPermissionsBatchQuery(updatedPerms...); err != nil {
-		return err
-	} else if err = txs.execute(ctx, q); err != nil {
-		return errors.Wrap(err, "execute upsert user permissions batch query")
+		if q, err = upsertUserPermissionsBatchQuery(updatedPerms...); err != nil {
+			return err
+		} else if err = txs.execute(ctx, q); err != nil {
+			return errors.Wrap(err, "execute upsert user permissions batch query")
+		}
 	}
 
 	p.UpdatedAt = updatedAt
-	if q, err = upsertRepoPermissionsBatchQuery(p); err != nil {
+	q, err := upsertRepoPermissionsBatchQuery(p)
+	if err != nil {
 		return err
 	} else if err = txs.execute(ctx, q); err != nil {
 		return errors.Wrap(err, "execute upsert repo permissions batch query")
 	}
 
+	if err = txs.recordRepoPermissionsGrants(ctx, p, added, removed); err != nil {
+		return err
+	}
+	if err = txs.recordRepoPermissionsChange(ctx, p, added, removed); err != nil {
+		return err
+	}
+
+	txs.recordRepoChange(p.RepoID, added, removed)
 	return nil
 }
 
@@ -379,8 +1154,7 @@ DO UPDATE SET
 
 	items := make([]*sqlf.Query, len(ps))
 	for i := range ps {
-		ps[i].IDs.RunOptimize()
-		ids, err := ps[i].IDs.ToBytes()
+		ids, err := marshalBitmap(ps[i].IDs)
 		if err != nil {
 			return nil, err
 		}
@@ -404,6 +1178,49 @@ DO UPDATE SET
 	), nil
 }
 
+// upsertUserPermissionsWithMetadataQuery is like upsertUserPermissionsBatchQuery for a single row,
+// but also replaces its sync metadata with p.Metadata, which is cleared when p.Metadata is nil,
+// because it would otherwise describe a sync that didn't write the current permissions.
+func upsertUserPermissionsWithMetadataQuery(p *authz.UserPermissions) (*sqlf.Query, error) {
+	const format = `
+-- source: enterprise/cmd/frontend/db/perms_store.go:upsertUserPermissionsWithMetadataQuery
+INSERT INTO user_permissions
+  (user_id, permission, object_type, object_ids, updated_at, sync_metadata)
+VALUES
+  (%s, %s, %s, %s, %s, %s::jsonb)
+ON CONFLICT ON CONSTRAINT
+  user_permissions_perm_object_unique
+DO UPDATE SET
+  object_ids = excluded.object_ids,
+  updated_at = excluded.updated_at,
+  sync_metadata = excluded.sync_metadata
+`
+
+	ids, err := marshalBitmap(p.IDs)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.UpdatedAt.IsZero() {
+		return nil, ErrPermsUpdatedAtNotSet
+	}
+
+	metadata, err := marshalSyncMetadata(p.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return sqlf.Sprintf(
+		format,
+		p.UserID,
+		p.Perm.String(),
+		p.Type,
+		ids,
+		p.UpdatedAt.UTC(),
+		metadata,
+	), nil
+}
+
 // LoadUserPendingPermissions returns pending permissions found by given parameters.
 // An ErrPermsNotFound is returned when there are no pending permissions available.
 func (s *PermsStore) LoadUserPendingPermissions(ctx context.Context, p *authz.UserPendingPermissions) (err error) {
@@ -414,7 +1231,7 @@ func (s *PermsStore) LoadUserPendingPermissions(ctx context.Context, p *authz.Us
 	ctx, save := s.observe(ctx, "LoadUserPendingPermissions", "")
 	defer func() { save(&err, p.TracingFields()...) }()
 
-	vals, err := s.load(ctx, loadUserPendingPermissionsQuery(p, ""))
+	vals, err := s.reads().load(ctx, loadUserPendingPermissionsQuery(p, ""))
 	if err != nil {
 		return err
 	}
@@ -424,6 +1241,80 @@ func (s *PermsStore) LoadUserPendingPermissions(ctx context.Context, p *authz.Us
 	return nil
 }
 
+// LoadUserPendingPermissionsBatch is like LoadUserPendingPermissions, but loads pending permissions
+// of all ups in a single query. Elements of ups without pending permissions available are left with
+// empty IDs instead of returning an ErrPermsNotFound.
+func (s *PermsStore) LoadUserPendingPermissionsBatch(ctx context.Context, ups []*authz.UserPendingPermissions) (err error) {
+	ctx, save := s.observe(ctx, "LoadUserPendingPermissionsBatch", "")
+	defer func() { save(&err, otlog.Int("ups.count", len(ups))) }()
+
+	type pendingPermsKey struct {
+		serviceType string
+		serviceID   string
+		perm        string
+		typ         string
+		bindID      string
+	}
+
+	byKey := make(map[pendingPermsKey][]*authz.UserPendingPermissions, len(ups))
+	items := make([]*sqlf.Query, 0, len(ups))
+	for _, p := range ups {
+		p.ID = 0
+		p.IDs = roaring.NewBitmap()
+		p.UpdatedAt = time.Time{}
+
+		key := pendingPermsKey{p.ServiceType, p.ServiceID, p.Perm.String(), string(p.Type), p.BindID}
+		if byKey[key] == nil {
+			items = append(items, sqlf.Sprintf("(%s, %s, %s, %s, %s)", key.serviceType, key.serviceID, key.perm, key.typ, key.bindID))
+		}
+		byKey[key] = append(byKey[key], p)
+	}
+	if len(items) == 0 {
+		return nil
+	}
+
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_store.go:PermsStore.LoadUserPendingPermissionsBatch
+SELECT p.service_type, p.service_id, p.permission, p.object_type, p.bind_id, p.id, p.object_ids, p.updated_at
+FROM user_pending_permissions AS p
+JOIN (VALUES %s) AS v(service_type, service_id, permission, object_type, bind_id)
+ON p.service_type = v.service_type
+AND p.service_id = v.service_id
+AND p.permission = v.permission
+AND p.object_type = v.object_type
+AND p.bind_id = v.bind_id
+`, sqlf.Join(items, ","))
+	rows, err := s.reads().db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key pendingPermsKey
+		var id int32
+		var ids []byte
+		var updatedAt time.Time
+		if err = rows.Scan(&key.serviceType, &key.serviceID, &key.perm, &key.typ, &key.bindID, &id, &ids, &updatedAt); err != nil {
+			return err
+		}
+
+		bm := roaring.NewBitmap()
+		if len(ids) > 0 {
+			if err = unmarshalBitmap(bm, ids); err != nil {
+				return err
+			}
+		}
+
+		for _, p := range byKey[key] {
+			p.ID = id
+			p.IDs = bm.Clone()
+			p.UpdatedAt = updatedAt
+		}
+	}
+	return rows.Err()
+}
+
 func loadUserPendingPermissionsQuery(p *authz.UserPendingPermissions, lock string) *sqlf.Query {
 	const format = `
 -- source: enterprise/cmd/frontend/db/perms_store.go:loadUserPendingPermissionsQuery
@@ -449,9 +1340,18 @@ AND bind_id = %s
 // found will be upserted and account IDs no longer in AccountIDs will be removed.
 //
 // This method updates both `user_pending_permissions` and `repo_pending_permissions` tables.
+// Duplicate account IDs are ignored. Account IDs are opaque identifiers of code hosts, therefore
+// they are compared as-is and IDs that differ only in case are distinct.
 //
 // This method starts its own transaction for update consistency if the caller hasn't started one already.
 //
+// Concurrent calls for repositories that share bind IDs read, modify and write the same rows
+// of the "user_pending_permissions" table. Updates are not lost under the default READ COMMITTED
+// isolation level (see WithIsolationLevel) because every row is locked before it is read:
+// the upsert of stub rows locks the rows of all given bind IDs, and the rows of the repository
+// and of removed bind IDs are loaded with "FOR UPDATE". A statement that waits for a lock reads
+// the row as committed by the transaction that held it.
+//
 // Example input:
 //  &ExternalAccounts{
 //      ServiceType: "sourcegraph",
@@ -482,13 +1382,45 @@ func (s *PermsStore) SetRepoPendingPermissions(ctx context.Context, accounts *ex
 	ctx, save := s.observe(ctx, "SetRepoPendingPermissions", "")
 	defer func() { save(&err, append(p.TracingFields(), accounts.TracingFields()...)...) }()
 
+	_, err = s.setRepoPendingPermissions(ctx, accounts, p)
+	return err
+}
+
+// SetRepoPendingPermissionsResult describes the changes made by SetRepoPendingPermissionsWithResult.
+type SetRepoPendingPermissionsResult struct {
+	AddedBindIDs   []string // The bind IDs granted pending permissions to the repository, sorted.
+	RemovedBindIDs []string // The bind IDs no longer having pending permissions to the repository, sorted.
+}
+
+// SetRepoPendingPermissionsWithResult is like SetRepoPendingPermissions, but also returns the bind IDs
+// added and removed, as computed against the stored bind IDs of the repository within the transaction.
+// The result is nil if the error is not.
+func (s *PermsStore) SetRepoPendingPermissionsWithResult(ctx context.Context, accounts *extsvc.ExternalAccounts, p *authz.RepoPermissions) (res *SetRepoPendingPermissionsResult, err error) {
+	ctx, save := s.observe(ctx, "SetRepoPendingPermissionsWithResult", "")
+	defer func() {
+		fields := append(p.TracingFields(), accounts.TracingFields()...)
+		if res != nil {
+			fields = append(fields,
+				otlog.Int("added", len(res.AddedBindIDs)),
+				otlog.Int("removed", len(res.RemovedBindIDs)),
+			)
+		}
+		save(&err, fields...)
+	}()
+
+	return s.setRepoPendingPermissions(ctx, accounts, p)
+}
+
+// setRepoPendingPermissions implements SetRepoPendingPermissions, and returns the changes made to
+// the bind IDs of the repository.
+func (s *PermsStore) setRepoPendingPermissions(ctx context.Context, accounts *extsvc.ExternalAccounts, p *authz.RepoPermissions) (res *SetRepoPendingPermissionsResult, err error) {
 	var txs *PermsStore
 	if s.inTx() {
 		txs = s
 	} else {
 		txs, err = s.Transact(ctx)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		defer txs.Done(&err)
 	}
@@ -496,22 +1428,23 @@ func (s *PermsStore) SetRepoPendingPermissions(ctx context.Context, accounts *ex
 	var q *sqlf.Query
 
 	p.UserIDs = roaring.NewBitmap()
+	accounts = dedupeAccountIDs(accounts)
 
 	// Insert rows for bindIDs without one in the "user_pending_permissions" table.
 	// The insert does not store any permissions data but uses auto-increment key to generate unique ID.
 	// This help guarantees rows of all bindIDs exist when getting user IDs in next load query.
-	updatedAt := txs.clock()
+	updatedAt := txs.clock.Now()
 	p.UpdatedAt = updatedAt
 	if len(accounts.AccountIDs) > 0 {
 		// NOTE: Row-level locking is not needed here because we're creating stub rows and not modifying permissions.
 		q, err = insertUserPendingPermissionsBatchQuery(accounts, p)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		ids, err := txs.loadUserPendingPermissionsIDs(ctx, q)
 		if err != nil {
-			return errors.Wrap(err, "load user pending permissions IDs")
+			return nil, errors.Wrap(err, "load user pending permissions IDs")
 		}
 
 		// Make up p.UserIDs from the result set.
@@ -521,7 +1454,7 @@ func (s *PermsStore) SetRepoPendingPermissions(ctx context.Context, accounts *ex
 	// Retrieve currently stored user IDs of this repository.
 	vals, err := txs.load(ctx, loadRepoPendingPermissionsQuery(p, "FOR UPDATE"))
 	if err != nil && err != authz.ErrPermsNotFound {
-		return errors.Wrap(err, "load repo pending permissions")
+		return nil, errors.Wrap(err, "load repo pending permissions")
 	}
 	oldIDs := roaring.NewBitmap()
 	if vals != nil && vals.ids != nil {
@@ -536,14 +1469,15 @@ func (s *PermsStore) SetRepoPendingPermissions(ctx context.Context, accounts *ex
 	changedIDs := roaring.Or(added, removed).ToArray()
 
 	// In case there is nothing to add or remove.
+	res = &SetRepoPendingPermissionsResult{}
 	if len(changedIDs) == 0 {
-		return nil
+		return res, nil
 	}
 
 	q = loadUserPendingPermissionsByIDBatchQuery(changedIDs, p.Perm, authz.PermRepos, "FOR UPDATE")
 	bindIDSet, loadedIDs, err := txs.batchLoadUserPendingPermissions(ctx, q)
 	if err != nil {
-		return errors.Wrap(err, "batch load user pending permissions")
+		return nil, errors.Wrap(err, "batch load user pending permissions")
 	}
 
 	updatedPerms := make([]*authz.UserPendingPermissions, 0, len(bindIDSet))
@@ -557,8 +1491,10 @@ func (s *PermsStore) SetRepoPendingPermissions(ctx context.Context, accounts *ex
 		switch {
 		case added.Contains(id):
 			repoIDs.Add(uint32(p.RepoID))
+			res.AddedBindIDs = append(res.AddedBindIDs, bindIDSet[userID])
 		case removed.Contains(id):
 			repoIDs.Remove(uint32(p.RepoID))
+			res.RemovedBindIDs = append(res.RemovedBindIDs, bindIDSet[userID])
 		}
 
 		updatedPerms = append(updatedPerms, &authz.UserPendingPermissions{
@@ -573,18 +1509,20 @@ func (s *PermsStore) SetRepoPendingPermissions(ctx context.Context, accounts *ex
 	}
 
 	if q, err = upsertUserPendingPermissionsBatchQuery(updatedPerms...); err != nil {
-		return err
+		return nil, err
 	} else if err = txs.execute(ctx, q); err != nil {
-		return errors.Wrap(err, "execute upsert user pending permissions batch query")
+		return nil, errors.Wrap(err, "execute upsert user pending permissions batch query")
 	}
 
 	if q, err = upsertRepoPendingPermissionsBatchQuery(p); err != nil {
-		return err
+		return nil, err
 	} else if err = txs.execute(ctx, q); err != nil {
-		return errors.Wrap(err, "execute upsert repo pending permissions batch query")
+		return nil, errors.Wrap(err, "execute upsert repo pending permissions batch query")
 	}
 
-	return nil
+	sort.Strings(res.AddedBindIDs)
+	sort.Strings(res.RemovedBindIDs)
+	return res, nil
 }
 
 func (s *PermsStore) loadUserPendingPermissionsIDs(ctx context.Context, q *sqlf.Query) (ids []uint32, err error) {
@@ -653,7 +1591,7 @@ func (s *PermsStore) batchLoadUserPendingPermissions(ctx context.Context, q *sql
 		}
 
 		bm := roaring.NewBitmap()
-		if err = bm.UnmarshalBinary(ids); err != nil {
+		if err = unmarshalBitmap(bm, ids); err != nil {
 			return nil, nil, err
 		}
 		loaded[id] = bm
@@ -665,6 +1603,29 @@ func (s *PermsStore) batchLoadUserPendingPermissions(ctx context.Context, q *sql
 	return bindIDSet, loaded, nil
 }
 
+// dedupeAccountIDs returns accounts if it has no duplicate account IDs, or otherwise a copy of
+// accounts with only the first occurrence of each account ID.
+func dedupeAccountIDs(accounts *extsvc.ExternalAccounts) *extsvc.ExternalAccounts {
+	seen := make(map[string]bool, len(accounts.AccountIDs))
+	accountIDs := make([]string, 0, len(accounts.AccountIDs))
+	for _, id := range accounts.AccountIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		accountIDs = append(accountIDs, id)
+	}
+	if len(accountIDs) == len(accounts.AccountIDs) {
+		return accounts
+	}
+
+	return &extsvc.ExternalAccounts{
+		ServiceType: accounts.ServiceType,
+		ServiceID:   accounts.ServiceID,
+		AccountIDs:  accountIDs,
+	}
+}
+
 func insertUserPendingPermissionsBatchQuery(
 	accounts *extsvc.ExternalAccounts,
 	p *authz.RepoPermissions,
@@ -758,8 +1719,7 @@ DO UPDATE SET
 
 	items := make([]*sqlf.Query, len(ps))
 	for i := range ps {
-		ps[i].IDs.RunOptimize()
-		ids, err := ps[i].IDs.ToBytes()
+		ids, err := marshalBitmap(ps[i].IDs)
 		if err != nil {
 			return nil, err
 		}
@@ -801,8 +1761,7 @@ DO UPDATE SET
 
 	items := make([]*sqlf.Query, len(ps))
 	for i := range ps {
-		ps[i].UserIDs.RunOptimize()
-		ids, err := ps[i].UserIDs.ToBytes()
+		ids, err := marshalBitmap(ps[i].UserIDs)
 		if err != nil {
 			return nil, err
 		}
@@ -880,8 +1839,9 @@ func (s *PermsStore) GrantPendingPermissions(ctx context.Context, userID int32,
 		return errors.Wrap(err, "batch load repo permissions")
 	}
 
-	updatedAt := txs.clock()
+	updatedAt := txs.clock.Now()
 	updatedPerms := make([]*authz.RepoPermissions, 0, len(ids))
+	addedGrants := make(map[repoPermsKey]*roaring.Bitmap)
 	for i := range ids {
 		repoID := int32(ids[i])
 		oldIDs := loadedIDs[repoID]
@@ -889,7 +1849,10 @@ func (s *PermsStore) GrantPendingPermissions(ctx context.Context, userID int32,
 			oldIDs = roaring.NewBitmap()
 		}
 
-		oldIDs.Add(uint32(userID))
+		// Only repositories the user had no access to yet are new grants.
+		if oldIDs.CheckedAdd(uint32(userID)) {
+			addedGrants[repoPermsKey{repoID: repoID, perm: p.Perm}] = roaring.BitmapOf(uint32(userID))
+		}
 		updatedPerms = append(updatedPerms, &authz.RepoPermissions{
 			RepoID:    repoID,
 			Perm:      p.Perm,
@@ -903,6 +1866,9 @@ func (s *PermsStore) GrantPendingPermissions(ctx context.Context, userID int32,
 	} else if err = txs.execute(ctx, q); err != nil {
 		return errors.Wrap(err, "execute upsert repo permissions batch query")
 	}
+	if err = txs.recordPermissionsGrants(ctx, addedGrants, nil, updatedAt); err != nil {
+		return err
+	}
 
 	// Load existing user permissions to be merged if any. Since we're doing union of permissions,
 	// whatever we have already in the "repo_permissions" table is all valid thus we don't
@@ -924,12 +1890,18 @@ func (s *PermsStore) GrantPendingPermissions(ctx context.Context, userID int32,
 	}
 	up.IDs = roaring.Or(oldIDs, p.IDs)
 
-	up.UpdatedAt = txs.clock()
+	up.UpdatedAt = txs.clock.Now()
 	if q, err = upsertUserPermissionsBatchQuery(up); err != nil {
 		return err
 	} else if err = txs.execute(ctx, q); err != nil {
 		return errors.Wrap(err, "execute upsert user permissions query")
 	}
+	txs.recordChange(userID, roaring.AndNot(p.IDs, oldIDs), nil)
+
+	// Pending permissions never expire, thus neither do the object IDs they grant again.
+	if err = txs.deleteUserPermissionsExpiries(ctx, up, p.IDs); err != nil {
+		return err
+	}
 
 	// NOTE: Practically, we don't need to clean up "repo_pending_permissions" table because the value of "id" column
 	// that is associated with this user will be invalidated automatically by deleting this row. Thus, we are able to
@@ -941,6 +1913,63 @@ func (s *PermsStore) GrantPendingPermissions(ctx context.Context, userID int32,
 	return nil
 }
 
+// ReconcilePendingForNewUser grants the pending permissions of all bind IDs in accounts to the
+// user in a single transaction, as GrantPendingPermissions does for a single bind ID, and returns
+// the IDs of repositories granted. Account IDs that are associated with a different user through
+// an external account are skipped.
+//
+// This method starts its own transaction for update consistency if the caller hasn't started one already.
+//
+// 🚨 SECURITY: Like GrantPendingPermissions, it is caller's responsibility to ensure the legitimate
+// relation between the given user ID and the account IDs found in accounts.
+func (s *PermsStore) ReconcilePendingForNewUser(ctx context.Context, userID int32, accounts *extsvc.ExternalAccounts, perm authz.Perms) (repoIDs *roaring.Bitmap, err error) {
+	ctx, save := s.observe(ctx, "ReconcilePendingForNewUser", "")
+	defer func() { save(&err, append(accounts.TracingFields(), otlog.Int32("userID", userID))...) }()
+
+	var txs *PermsStore
+	if s.inTx() {
+		txs = s
+	} else {
+		txs, err = s.Transact(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer txs.Done(&err)
+	}
+
+	repoIDs = roaring.NewBitmap()
+	accounts = dedupeAccountIDs(accounts)
+	if len(accounts.AccountIDs) == 0 {
+		return repoIDs, nil
+	}
+
+	userIDs, err := txs.GetUserIDsByExternalAccounts(ctx, accounts)
+	if err != nil {
+		return nil, errors.Wrap(err, "get user IDs by external accounts")
+	}
+
+	for _, bindID := range accounts.AccountIDs {
+		if id, ok := userIDs[bindID]; ok && id != userID {
+			continue
+		}
+
+		p := &authz.UserPendingPermissions{
+			ServiceType: accounts.ServiceType,
+			ServiceID:   accounts.ServiceID,
+			BindID:      bindID,
+			Perm:        perm,
+			Type:        authz.PermRepos,
+		}
+		if err = txs.GrantPendingPermissions(ctx, userID, p); err != nil {
+			return nil, errors.Wrap(err, "grant pending permissions")
+		}
+		if p.IDs != nil {
+			repoIDs.Or(p.IDs)
+		}
+	}
+	return repoIDs, nil
+}
+
 func loadRepoPermissionsBatchQuery(repoIDs []uint32, perm authz.Perms, lock string) *sqlf.Query {
 	const format = `
 -- source: enterprise/cmd/frontend/db/perms_store.go:loadRepoPermissionsBatchQuery
@@ -977,110 +2006,419 @@ DO UPDATE SET
 
 	items := make([]*sqlf.Query, len(ps))
 	for i := range ps {
-		ps[i].UserIDs.RunOptimize()
-		ids, err := ps[i].UserIDs.ToBytes()
+		ids, err := marshalBitmap(ps[i].UserIDs)
 		if err != nil {
 			return nil, err
 		}
 
-		if ps[i].UpdatedAt.IsZero() {
-			return nil, ErrPermsUpdatedAtNotSet
+		if ps[i].UpdatedAt.IsZero() {
+			return nil, ErrPermsUpdatedAtNotSet
+		}
+
+		items[i] = sqlf.Sprintf("(%s, %s, %s, %s)",
+			ps[i].RepoID,
+			ps[i].Perm.String(),
+			ids,
+			ps[i].UpdatedAt.UTC(),
+		)
+	}
+
+	return sqlf.Sprintf(
+		format,
+		sqlf.Join(items, ","),
+	), nil
+}
+
+func deleteUserPendingPermissionsQuery(p *authz.UserPendingPermissions) *sqlf.Query {
+	const format = `
+-- source: enterprise/cmd/frontend/db/perms_store.go:deleteUserPendingPermissionsQuery
+DELETE FROM user_pending_permissions
+WHERE permission = %s
+AND object_type = %s
+AND bind_id = %s
+`
+
+	return sqlf.Sprintf(
+		format,
+		p.Perm.String(),
+		p.Type,
+		p.BindID,
+	)
+}
+
+// ListPendingUsers returns a list of bind IDs who have pending permissions.
+func (s *PermsStore) ListPendingUsers(ctx context.Context) (bindIDs []string, err error) {
+	if Mocks.Perms.ListPendingUsers != nil {
+		return Mocks.Perms.ListPendingUsers(ctx)
+	}
+
+	ctx, save := s.observe(ctx, "ListPendingUsers", "")
+	defer save(&err)
+
+	q := sqlf.Sprintf(`SELECT bind_id, object_ids FROM user_pending_permissions`)
+
+	var rows *sql.Rows
+	rows, err = s.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bindID string
+		var ids []byte
+		if err = rows.Scan(&bindID, &ids); err != nil {
+			return nil, err
+		}
+
+		if len(ids) == 0 {
+			continue
+		}
+
+		bm := roaring.NewBitmap()
+		if err = unmarshalBitmap(bm, ids); err != nil {
+			return nil, err
+		} else if bm.GetCardinality() == 0 {
+			continue
+		}
+
+		bindIDs = append(bindIDs, bindID)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return bindIDs, nil
+}
+
+// CountPendingUsers returns the number of rows in the "user_pending_permissions" table with
+// non-empty object IDs, which is the number of bind IDs returned by ListPendingUsers. Rows are
+// counted by the database without reading their object IDs, see countPendingUsersQuery.
+func (s *PermsStore) CountPendingUsers(ctx context.Context) (count int, err error) {
+	ctx, save := s.observe(ctx, "CountPendingUsers", "")
+	defer func() { save(&err, otlog.Int("count", count)) }()
+
+	q, err := countPendingUsersQuery()
+	if err != nil {
+		return 0, err
+	}
+	rows, err := s.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		if err = rows.Scan(&count); err != nil {
+			return 0, err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// countPendingUsersQuery returns the query counting rows of the "user_pending_permissions" table
+// with non-empty object IDs. Because marshalBitmap writes canonical bitmaps, and only bitmaps
+// above permsbitmap.CompressThreshold are compressed, every empty bitmap is stored as the same
+// bytes, which are compared with instead of unmarshalling each row.
+func countPendingUsersQuery() (*sqlf.Query, error) {
+	empty, err := marshalBitmap(roaring.NewBitmap())
+	if err != nil {
+		return nil, err
+	}
+
+	return sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_store.go:countPendingUsersQuery
+SELECT COUNT(*) FROM user_pending_permissions
+WHERE octet_length(object_ids) > 0
+AND object_ids <> %s
+`, empty), nil
+}
+
+// CountPendingUsersForRepo returns the number of distinct bind IDs that have pending permissions
+// of any kind to the repository, i.e. users that will be granted access once they are created.
+// Like LoadRepoPermissionsWithPendingCount, only pending permissions that still exist are counted.
+func (s *PermsStore) CountPendingUsersForRepo(ctx context.Context, repoID int32) (count int, err error) {
+	ctx, save := s.observe(ctx, "CountPendingUsersForRepo", "")
+	defer func() { save(&err, otlog.Int32("repoID", repoID), otlog.Int("count", count)) }()
+
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_store.go:PermsStore.CountPendingUsersForRepo
+SELECT user_ids FROM repo_pending_permissions
+WHERE repo_id = %s
+`, repoID)
+	rows, err := s.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	ids := roaring.NewBitmap()
+	for rows.Next() {
+		var userIDs []byte
+		if err = rows.Scan(&userIDs); err != nil {
+			return 0, err
+		}
+
+		bm := roaring.NewBitmap()
+		if err = unmarshalBitmap(bm, userIDs); err != nil {
+			return 0, err
+		}
+		ids.Or(bm)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	if ids.IsEmpty() {
+		return 0, nil
+	}
+
+	q = sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_store.go:PermsStore.CountPendingUsersForRepo
+SELECT COUNT(DISTINCT bind_id) FROM user_pending_permissions
+WHERE id = ANY(%s)
+`, pq.Array(bitmapToInt64s(ids)))
+	rows, err = s.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		if err = rows.Scan(&count); err != nil {
+			return 0, err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// DeleteAllUserPermissions deletes all rows with given user ID from the "user_permissions" table,
+// which effectively removes access to all repositories for the user. Expiries of the user are
+// deleted along with them, so that they do not apply to permissions granted again later.
+func (s *PermsStore) DeleteAllUserPermissions(ctx context.Context, userID int32) (err error) {
+	ctx, save := s.observe(ctx, "DeleteAllUserPermissions", "")
+	defer func() { save(&err, otlog.Int32("userID", userID)) }()
+
+	// NOTE: Practically, we don't need to clean up "repo_permissions" table because the value of "id" column
+	// that is associated with this user will be invalidated automatically by deleting this row.
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_store.go:PermsStore.DeleteAllUserPermissions
+WITH expiries AS (
+  DELETE FROM user_permissions_expiries WHERE user_id = %s
+)
+DELETE FROM user_permissions WHERE user_id = %s
+`, userID, userID)
+	if err = s.execute(ctx, q); err != nil {
+		return errors.Wrap(err, "execute delete user permissions query")
+	}
+
+	return nil
+}
+
+// deleteUserPermissionsBatchSize is the maximum number of rows of the "repo_permissions" table
+// updated by a single statement of DeleteAllUserPermissionsBatch.
+const deleteUserPermissionsBatchSize = 1000
+
+// DeleteAllUserPermissionsBatch deletes all rows of given users from the "user_permissions" table
+// like DeleteAllUserPermissions, and also removes the users from the rows of all repositories they
+// had permissions to in the "repo_permissions" table, so that both tables stay consistent. Rows of
+// repositories are updated in batches of at most deleteUserPermissionsBatchSize rows per statement,
+// and each affected row is updated once regardless of the number of given users it contains.
+//
+// This method starts its own transaction for update consistency if the caller hasn't started one already.
+func (s *PermsStore) DeleteAllUserPermissionsBatch(ctx context.Context, userIDs []int32) (err error) {
+	ctx, save := s.observe(ctx, "DeleteAllUserPermissionsBatch", "")
+	defer func() { save(&err, otlog.Int("userIDs", len(userIDs))) }()
+
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	var txs *PermsStore
+	if s.inTx() {
+		txs = s
+	} else {
+		txs, err = s.Transact(ctx)
+		if err != nil {
+			return err
+		}
+		defer txs.Done(&err)
+	}
+
+	// NOTE: It is critical to always acquire row-level locks in the same order as SetRepoPermissions
+	// (i.e. repo -> user) to prevent deadlocks. Therefore, the repositories of the users are loaded
+	// without locks first, and their rows are locked before the rows of the users are deleted.
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_store.go:PermsStore.DeleteAllUserPermissionsBatch
+SELECT user_id, permission, object_ids
+FROM user_permissions
+WHERE user_id = ANY(%s)
+AND object_type = %s
+`, pq.Array(userIDs), authz.PermRepos)
+	removals, err := txs.loadUserPermissionsRemovals(ctx, q)
+	if err != nil {
+		return errors.Wrap(err, "load user permissions")
+	}
+	loaded := make(map[authz.Perms]map[int32]*roaring.Bitmap, len(removals))
+	for perm, repos := range removals {
+		if loaded[perm], err = txs.batchLoadRepoPermissions(ctx, perm, repos, nil); err != nil {
+			return err
 		}
-
-		items[i] = sqlf.Sprintf("(%s, %s, %s, %s)",
-			ps[i].RepoID,
-			ps[i].Perm.String(),
-			ids,
-			ps[i].UpdatedAt.UTC(),
-		)
 	}
 
-	return sqlf.Sprintf(
-		format,
-		sqlf.Join(items, ","),
-	), nil
-}
-
-func deleteUserPendingPermissionsQuery(p *authz.UserPendingPermissions) *sqlf.Query {
-	const format = `
--- source: enterprise/cmd/frontend/db/perms_store.go:deleteUserPendingPermissionsQuery
-DELETE FROM user_pending_permissions
-WHERE permission = %s
+	q = sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_store.go:PermsStore.DeleteAllUserPermissionsBatch
+DELETE FROM user_permissions
+WHERE user_id = ANY(%s)
 AND object_type = %s
-AND bind_id = %s
-`
+RETURNING user_id, permission, object_ids
+`, pq.Array(userIDs), authz.PermRepos)
+	if removals, err = txs.loadUserPermissionsRemovals(ctx, q); err != nil {
+		return errors.Wrap(err, "execute delete user permissions query")
+	}
 
-	return sqlf.Sprintf(
-		format,
-		p.Perm.String(),
-		p.Type,
-		p.BindID,
-	)
-}
+	updatedAt := txs.clock.Now()
+	for perm, repos := range removals {
+		// Repositories granted after the first load are locked now, which is rare.
+		if loaded[perm], err = txs.batchLoadRepoPermissions(ctx, perm, repos, loaded[perm]); err != nil {
+			return err
+		}
 
-// ListPendingUsers returns a list of bind IDs who have pending permissions.
-func (s *PermsStore) ListPendingUsers(ctx context.Context) (bindIDs []string, err error) {
-	if Mocks.Perms.ListPendingUsers != nil {
-		return Mocks.Perms.ListPendingUsers(ctx)
+		repoIDs := make([]int32, 0, len(repos))
+		for repoID := range repos {
+			repoIDs = append(repoIDs, repoID)
+		}
+		sort.Slice(repoIDs, func(i, j int) bool { return repoIDs[i] < repoIDs[j] })
+
+		updatedPerms := make([]*authz.RepoPermissions, 0, deleteUserPermissionsBatchSize)
+		for i, repoID := range repoIDs {
+			userIDs := loaded[perm][repoID]
+			if userIDs == nil {
+				userIDs = roaring.NewBitmap()
+			}
+			updatedPerms = append(updatedPerms, &authz.RepoPermissions{
+				RepoID:    repoID,
+				Perm:      perm,
+				UserIDs:   roaring.AndNot(userIDs, repos[repoID]),
+				UpdatedAt: updatedAt,
+			})
+			if len(updatedPerms) < deleteUserPermissionsBatchSize && i < len(repoIDs)-1 {
+				continue
+			}
+
+			if q, err = upsertRepoPermissionsBatchQuery(updatedPerms...); err != nil {
+				return err
+			} else if err = txs.execute(ctx, q); err != nil {
+				return errors.Wrap(err, "execute upsert repo permissions batch query")
+			}
+			updatedPerms = updatedPerms[:0]
+		}
 	}
 
-	ctx, save := s.observe(ctx, "ListPendingUsers", "")
-	defer save(&err)
-
-	q := sqlf.Sprintf(`SELECT bind_id, object_ids FROM user_pending_permissions`)
+	q = sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_store.go:PermsStore.DeleteAllUserPermissionsBatch
+DELETE FROM user_permissions_expiries
+WHERE user_id = ANY(%s)
+AND object_type = %s
+`, pq.Array(userIDs), authz.PermRepos)
+	if err = txs.execute(ctx, q); err != nil {
+		return errors.Wrap(err, "execute delete user permissions expiries query")
+	}
+	return txs.deleteUsersPermissionsGrants(ctx, userIDs)
+}
 
-	var rows *sql.Rows
-	rows, err = s.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+// loadUserPermissionsRemovals runs q, which returns the user_id, permission and object_ids
+// columns of rows of the "user_permissions" table, and returns the users of every repository
+// by permission.
+func (s *PermsStore) loadUserPermissionsRemovals(ctx context.Context, q *sqlf.Query) (map[authz.Perms]map[int32]*roaring.Bitmap, error) {
+	rows, err := s.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	removals := make(map[authz.Perms]map[int32]*roaring.Bitmap)
 	for rows.Next() {
-		var bindID string
+		var userID int32
+		var perm string
 		var ids []byte
-		if err = rows.Scan(&bindID, &ids); err != nil {
+		if err = rows.Scan(&userID, &perm, &ids); err != nil {
 			return nil, err
 		}
 
-		if len(ids) == 0 {
-			continue
+		p, err := parsePerms(perm)
+		if err != nil {
+			return nil, err
 		}
-
 		bm := roaring.NewBitmap()
-		if err = bm.UnmarshalBinary(ids); err != nil {
-			return nil, err
-		} else if bm.GetCardinality() == 0 {
-			continue
+		if len(ids) > 0 {
+			if err = unmarshalBitmap(bm, ids); err != nil {
+				return nil, err
+			}
 		}
 
-		bindIDs = append(bindIDs, bindID)
-	}
-	if err = rows.Err(); err != nil {
-		return nil, err
+		if removals[p] == nil {
+			removals[p] = make(map[int32]*roaring.Bitmap)
+		}
+		for _, id := range bm.ToArray() {
+			repoID := int32(id)
+			if removals[p][repoID] == nil {
+				removals[p][repoID] = roaring.NewBitmap()
+			}
+			removals[p][repoID].Add(uint32(userID))
+		}
 	}
-
-	return bindIDs, nil
+	return removals, rows.Err()
 }
 
-// DeleteAllUserPermissions deletes all rows with given user ID from the "user_permissions" table,
-// which effectively removes access to all repositories for the user.
-func (s *PermsStore) DeleteAllUserPermissions(ctx context.Context, userID int32) (err error) {
-	ctx, save := s.observe(ctx, "DeleteAllUserPermissions", "")
-	defer func() { save(&err, otlog.Int32("userID", userID)) }()
+// batchLoadRepoPermissions loads and locks the rows of the "repo_permissions" table of given
+// repositories that are not in loaded yet, in batches of deleteUserPermissionsBatchSize rows,
+// and returns loaded with the user IDs of these rows added.
+func (s *PermsStore) batchLoadRepoPermissions(ctx context.Context, perm authz.Perms, repos map[int32]*roaring.Bitmap, loaded map[int32]*roaring.Bitmap) (map[int32]*roaring.Bitmap, error) {
+	if loaded == nil {
+		loaded = make(map[int32]*roaring.Bitmap, len(repos))
+	}
 
-	// NOTE: Practically, we don't need to clean up "repo_permissions" table because the value of "id" column
-	// that is associated with this user will be invalidated automatically by deleting this row.
-	if err = s.execute(ctx, sqlf.Sprintf(`DELETE FROM user_permissions WHERE user_id = %s`, userID)); err != nil {
-		return errors.Wrap(err, "execute delete user permissions query")
+	ids := roaring.NewBitmap()
+	for repoID := range repos {
+		if _, ok := loaded[repoID]; !ok {
+			ids.Add(uint32(repoID))
+		}
 	}
 
-	return nil
+	repoIDs := ids.ToArray()
+	for start := 0; start < len(repoIDs); start += deleteUserPermissionsBatchSize {
+		end := start + deleteUserPermissionsBatchSize
+		if end > len(repoIDs) {
+			end = len(repoIDs)
+		}
+
+		batch, err := s.batchLoadIDs(ctx, loadRepoPermissionsBatchQuery(repoIDs[start:end], perm, "FOR UPDATE"))
+		if err != nil {
+			return nil, errors.Wrap(err, "batch load repo permissions")
+		}
+		for _, id := range repoIDs[start:end] {
+			userIDs := batch[int32(id)]
+			if userIDs == nil {
+				userIDs = roaring.NewBitmap()
+			}
+			loaded[int32(id)] = userIDs
+		}
+	}
+	return loaded, nil
 }
 
 // DeleteAllUserPendingPermissions deletes all rows with given bind IDs from the "user_pending_permissions" table.
 // It accepts list of bind IDs because a user has multiple bind IDs, e.g. username and email addresses.
-func (s *PermsStore) DeleteAllUserPendingPermissions(ctx context.Context, accounts *extsvc.ExternalAccounts) (err error) {
+// It returns the union of repository IDs that were pending for any of the deleted bind IDs, so callers
+// are able to invalidate data associated with those repositories.
+func (s *PermsStore) DeleteAllUserPendingPermissions(ctx context.Context, accounts *extsvc.ExternalAccounts) (repoIDs *roaring.Bitmap, err error) {
 	ctx, save := s.observe(ctx, "DeleteAllUserPendingPermissions", "")
 	defer func() { save(&err, accounts.TracingFields()...) }()
 
@@ -1095,13 +2433,79 @@ func (s *PermsStore) DeleteAllUserPendingPermissions(ctx context.Context, accoun
 DELETE FROM user_pending_permissions
 WHERE service_type = %s
 AND service_id = %s
-AND bind_id IN (%s)`,
+AND bind_id IN (%s)
+RETURNING object_ids`,
 		accounts.ServiceType, accounts.ServiceID, sqlf.Join(items, ","))
-	if err = s.execute(ctx, q); err != nil {
-		return errors.Wrap(err, "execute delete user pending permissions query")
+
+	rows, err := s.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return nil, errors.Wrap(err, "execute delete user pending permissions query")
 	}
+	defer rows.Close()
 
-	return nil
+	repoIDs = roaring.NewBitmap()
+	for rows.Next() {
+		var ids []byte
+		if err = rows.Scan(&ids); err != nil {
+			return nil, err
+		}
+
+		if len(ids) == 0 {
+			continue
+		}
+
+		bm := roaring.NewBitmap()
+		if err = unmarshalBitmap(bm, ids); err != nil {
+			return nil, err
+		}
+		repoIDs.Or(bm)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return repoIDs, nil
+}
+
+// DeleteAllUserPermissionsAndPending deletes all permissions of the user like DeleteAllUserPermissions,
+// and all pending permissions of the bind IDs in accounts like DeleteAllUserPendingPermissions, in a
+// single transaction. It is intended for deleting a user, so that pending permissions of the user's
+// bind IDs cannot be granted again when an account with the same bind ID is created. It returns the
+// union of repository IDs that were pending for any of the deleted bind IDs.
+//
+// This method starts its own transaction for update consistency if the caller hasn't started one already.
+func (s *PermsStore) DeleteAllUserPermissionsAndPending(ctx context.Context, userID int32, accounts []*extsvc.ExternalAccounts) (repoIDs *roaring.Bitmap, err error) {
+	ctx, save := s.observe(ctx, "DeleteAllUserPermissionsAndPending", "")
+	defer func() { save(&err, otlog.Int32("userID", userID), otlog.Int("accounts", len(accounts))) }()
+
+	var txs *PermsStore
+	if s.inTx() {
+		txs = s
+	} else {
+		txs, err = s.Transact(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer txs.Done(&err)
+	}
+
+	if err = txs.DeleteAllUserPermissions(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	repoIDs = roaring.NewBitmap()
+	for _, a := range accounts {
+		if len(a.AccountIDs) == 0 {
+			continue
+		}
+
+		ids, err := txs.DeleteAllUserPendingPermissions(ctx, a)
+		if err != nil {
+			return nil, err
+		}
+		repoIDs.Or(ids)
+	}
+	return repoIDs, nil
 }
 
 func (s *PermsStore) execute(ctx context.Context, q *sqlf.Query) (err error) {
@@ -1116,6 +2520,17 @@ func (s *PermsStore) execute(ctx context.Context, q *sqlf.Query) (err error) {
 	return rows.Close()
 }
 
+// marshalBitmap serializes bm for the permissions tables, see permsbitmap.Marshal.
+func marshalBitmap(bm *roaring.Bitmap) ([]byte, error) {
+	return permsbitmap.Marshal(bm)
+}
+
+// unmarshalBitmap deserializes data read from the permissions tables into bm, see
+// permsbitmap.Unmarshal.
+func unmarshalBitmap(bm *roaring.Bitmap, data []byte) error {
+	return permsbitmap.Unmarshal(bm, data)
+}
+
 // permsLoadValues contains return values of (*PermsStore).load method.
 type permsLoadValues struct {
 	id        int32           // An integer ID
@@ -1125,8 +2540,8 @@ type permsLoadValues struct {
 
 // load is a generic method that scans three values from one database table row, these values must have
 // types and be scanned in the order of int32, []byte and time.Time. In addition, it unmarshalles the
-// []byte into a *roaring.Bitmap.
-func (s *PermsStore) load(ctx context.Context, q *sqlf.Query) (*permsLoadValues, error) {
+// []byte into a *roaring.Bitmap. Values of any further columns are scanned into extra.
+func (s *PermsStore) load(ctx context.Context, q *sqlf.Query, extra ...interface{}) (*permsLoadValues, error) {
 	var err error
 	ctx, save := s.observe(ctx, "load", "")
 	defer func() {
@@ -1154,7 +2569,7 @@ func (s *PermsStore) load(ctx context.Context, q *sqlf.Query) (*permsLoadValues,
 	var id int32
 	var ids []byte
 	var updatedAt time.Time
-	if err = rows.Scan(&id, &ids, &updatedAt); err != nil {
+	if err = rows.Scan(append([]interface{}{&id, &ids, &updatedAt}, extra...)...); err != nil {
 		return nil, err
 	}
 
@@ -1169,7 +2584,7 @@ func (s *PermsStore) load(ctx context.Context, q *sqlf.Query) (*permsLoadValues,
 	}
 	if len(ids) == 0 {
 		return vals, nil
-	} else if err = vals.ids.UnmarshalBinary(ids); err != nil {
+	} else if err = unmarshalBitmap(vals.ids, ids); err != nil {
 		return nil, err
 	}
 
@@ -1207,7 +2622,7 @@ func (s *PermsStore) batchLoadIDs(ctx context.Context, q *sqlf.Query) (map[int32
 		}
 
 		bm := roaring.NewBitmap()
-		if err = bm.UnmarshalBinary(ids); err != nil {
+		if err = unmarshalBitmap(bm, ids); err != nil {
 			return nil, err
 		}
 		loaded[objID] = bm
@@ -1234,6 +2649,12 @@ FROM user_external_accounts
 WHERE user_id = %d
 ORDER BY id ASC
 `, userID)
+	return s.loadExternalAccounts(ctx, q)
+}
+
+// loadExternalAccounts runs q, which returns the columns of rows of the "user_external_accounts"
+// table in the order selected by ListExternalAccounts, and returns the external accounts.
+func (s *PermsStore) loadExternalAccounts(ctx context.Context, q *sqlf.Query) (accounts []*extsvc.ExternalAccount, err error) {
 	rows, err := s.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
 	if err != nil {
 		return nil, err
@@ -1259,17 +2680,47 @@ ORDER BY id ASC
 	return accounts, nil
 }
 
+// sourcegraphServiceType is the service type of the bind IDs of pending permissions that are
+// usernames or email addresses of Sourcegraph users rather than accounts of a code host.
+const sourcegraphServiceType = "sourcegraph"
+
 // GetUserIDsByExternalAccounts returns all user IDs matched by given external account specs.
 // The returned set has mapping relation as "account ID -> user ID". The number of results
 // could be less than the candidate list due to some users are not associated with any external
-// account.
+// account, or their accounts have been unlinked (i.e. soft deleted). Account IDs of the built-in
+// "sourcegraph" service are not external accounts, but bind IDs as granted by the authz store, and
+// are resolved to the users with the same username or the same verified email address instead.
+// Deleted users are never matched by them.
 func (s *PermsStore) GetUserIDsByExternalAccounts(ctx context.Context, accounts *extsvc.ExternalAccounts) (_ map[string]int32, err error) {
 	ctx, save := s.observe(ctx, "ListUsersByExternalAccounts", "")
 	defer func() { save(&err, accounts.TracingFields()...) }()
 
-	items := make([]*sqlf.Query, len(accounts.AccountIDs))
-	for i := range accounts.AccountIDs {
-		items[i] = sqlf.Sprintf("%s", accounts.AccountIDs[i])
+	// Bind IDs are usernames and email addresses rather than external accounts, thus never cached.
+	if accounts.ServiceType == sourcegraphServiceType {
+		return s.getUserIDsByBindIDs(ctx, accounts.AccountIDs)
+	}
+
+	userIDs := make(map[string]int32)
+	accountIDs := accounts.AccountIDs
+	now := s.clock.Now()
+	if s.accounts != nil {
+		accountIDs = make([]string, 0, len(accounts.AccountIDs))
+		for _, accountID := range accounts.AccountIDs {
+			key := ExternalAccountKey{ServiceType: accounts.ServiceType, ServiceID: accounts.ServiceID, AccountID: accountID}
+			if userID, ok := s.accounts.get(key, now); ok {
+				userIDs[accountID] = userID
+			} else {
+				accountIDs = append(accountIDs, accountID)
+			}
+		}
+		if len(accountIDs) == 0 {
+			return userIDs, nil
+		}
+	}
+
+	items := make([]*sqlf.Query, len(accountIDs))
+	for i := range accountIDs {
+		items[i] = sqlf.Sprintf("%s", accountIDs[i])
 	}
 
 	q := sqlf.Sprintf(`
@@ -1279,6 +2730,7 @@ FROM user_external_accounts
 WHERE service_type = %s
 AND service_id = %s
 AND account_id IN (%s)
+AND deleted_at IS NULL
 `, accounts.ServiceType, accounts.ServiceID, sqlf.Join(items, ","))
 	rows, err := s.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
 	if err != nil {
@@ -1286,7 +2738,6 @@ AND account_id IN (%s)
 	}
 	defer rows.Close()
 
-	userIDs := make(map[string]int32)
 	for rows.Next() {
 		var userID int32
 		var accountID string
@@ -1294,6 +2745,165 @@ AND account_id IN (%s)
 			return nil, err
 		}
 		userIDs[accountID] = userID
+		if s.accounts != nil {
+			key := ExternalAccountKey{ServiceType: accounts.ServiceType, ServiceID: accounts.ServiceID, AccountID: accountID}
+			s.accounts.add(key, userID, now)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return userIDs, nil
+}
+
+// getUserIDsByBindIDsQuery returns the query of the user IDs and bind IDs of the existing users
+// whose username or verified email address is one of bindIDs. Like the authz store, which only
+// grants pending permissions of verified email addresses, unverified ones are never matched.
+// Usernames and email addresses are case-insensitive, but the bind IDs are returned as given.
+func getUserIDsByBindIDsQuery(bindIDs []string) *sqlf.Query {
+	return sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_store.go:getUserIDsByBindIDsQuery
+SELECT u.id, b.bind_id
+FROM unnest(%s::text[]) AS b(bind_id)
+JOIN users AS u ON u.username = b.bind_id::citext
+WHERE u.deleted_at IS NULL
+UNION ALL
+SELECT u.id, b.bind_id
+FROM unnest(%s::text[]) AS b(bind_id)
+JOIN user_emails AS e ON e.email = b.bind_id::citext
+JOIN users AS u ON u.id = e.user_id
+WHERE e.verified_at IS NOT NULL
+AND u.deleted_at IS NULL
+`, pq.Array(bindIDs), pq.Array(bindIDs))
+}
+
+// getUserIDsByBindIDs returns the user IDs of the users matched by bindIDs of the "sourcegraph"
+// service, see getUserIDsByBindIDsQuery. The returned set has mapping relation as
+// "bind ID -> user ID".
+func (s *PermsStore) getUserIDsByBindIDs(ctx context.Context, bindIDs []string) (map[string]int32, error) {
+	q := getUserIDsByBindIDsQuery(bindIDs)
+	rows, err := s.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	userIDs := make(map[string]int32)
+	for rows.Next() {
+		var userID int32
+		var bindID string
+		if err := rows.Scan(&userID, &bindID); err != nil {
+			return nil, err
+		}
+		userIDs[bindID] = userID
+	}
+	return userIDs, rows.Err()
+}
+
+// GetExternalAccountsByAccountIDs is like GetUserIDsByExternalAccounts, but returns the full records
+// of the external accounts as returned by ListExternalAccounts, including the user IDs they are
+// associated with. The returned set has mapping relation as "account ID -> external account".
+// The cache of external accounts (see WithExternalAccountsCache) is neither used nor populated,
+// because it only holds user IDs.
+func (s *PermsStore) GetExternalAccountsByAccountIDs(ctx context.Context, accounts *extsvc.ExternalAccounts) (_ map[string]*extsvc.ExternalAccount, err error) {
+	ctx, save := s.observe(ctx, "GetExternalAccountsByAccountIDs", "")
+	defer func() { save(&err, accounts.TracingFields()...) }()
+
+	accts := make(map[string]*extsvc.ExternalAccount)
+	if len(accounts.AccountIDs) == 0 {
+		return accts, nil
+	}
+
+	items := make([]*sqlf.Query, len(accounts.AccountIDs))
+	for i := range accounts.AccountIDs {
+		items[i] = sqlf.Sprintf("%s", accounts.AccountIDs[i])
+	}
+
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_store.go:PermsStore.GetExternalAccountsByAccountIDs
+SELECT id, user_id,
+       service_type, service_id, client_id, account_id,
+       auth_data, account_data,
+       created_at, updated_at
+FROM user_external_accounts
+WHERE service_type = %s
+AND service_id = %s
+AND account_id IN (%s)
+ORDER BY id ASC
+`, accounts.ServiceType, accounts.ServiceID, sqlf.Join(items, ","))
+	loaded, err := s.loadExternalAccounts(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, acct := range loaded {
+		accts[acct.AccountID] = acct
+	}
+	return accts, nil
+}
+
+// ExternalAccountKey identifies an external account of a code host.
+type ExternalAccountKey struct {
+	ServiceType string
+	ServiceID   string
+	AccountID   string
+}
+
+// GetUserIDsByExternalAccountsBatch is like GetUserIDsByExternalAccounts, but resolves external
+// accounts of multiple code hosts in a single query. The returned set has mapping relation as
+// "external account -> user ID". Accounts that are not associated with any user, or that have
+// been unlinked, are skipped.
+func (s *PermsStore) GetUserIDsByExternalAccountsBatch(ctx context.Context, accounts []*extsvc.ExternalAccounts) (_ map[ExternalAccountKey]int32, err error) {
+	ctx, save := s.observe(ctx, "GetUserIDsByExternalAccountsBatch", "")
+	defer func() { save(&err, otlog.Int("accounts.count", len(accounts))) }()
+
+	userIDs := make(map[ExternalAccountKey]int32)
+	var items []*sqlf.Query
+	for _, accts := range accounts {
+		if accts.ServiceType == sourcegraphServiceType && len(accts.AccountIDs) > 0 {
+			// Bind IDs are not external accounts, see GetUserIDsByExternalAccounts.
+			ids, err := s.getUserIDsByBindIDs(ctx, accts.AccountIDs)
+			if err != nil {
+				return nil, err
+			}
+			for accountID, userID := range ids {
+				userIDs[ExternalAccountKey{ServiceType: accts.ServiceType, ServiceID: accts.ServiceID, AccountID: accountID}] = userID
+			}
+			continue
+		}
+		for _, accountID := range accts.AccountIDs {
+			items = append(items, sqlf.Sprintf("(%s, %s, %s)", accts.ServiceType, accts.ServiceID, accountID))
+		}
+	}
+
+	if len(items) == 0 {
+		return userIDs, nil
+	}
+
+	q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_store.go:PermsStore.GetUserIDsByExternalAccountsBatch
+SELECT e.user_id, e.service_type, e.service_id, e.account_id
+FROM user_external_accounts AS e
+JOIN (VALUES %s) AS v(service_type, service_id, account_id)
+ON e.service_type = v.service_type
+AND e.service_id = v.service_id
+AND e.account_id = v.account_id
+WHERE e.deleted_at IS NULL
+`, sqlf.Join(items, ","))
+	rows, err := s.db.QueryContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID int32
+		var key ExternalAccountKey
+		if err := rows.Scan(&userID, &key.ServiceType, &key.ServiceID, &key.AccountID); err != nil {
+			return nil, err
+		}
+		userIDs[key] = userID
 	}
 	if err = rows.Err(); err != nil {
 		return nil, err
@@ -1302,13 +2912,57 @@ AND account_id IN (%s)
 	return userIDs, nil
 }
 
+// pruneOrphanExternalAccountsBatchSize is the maximum number of rows deleted by a single
+// statement of PruneOrphanExternalAccounts.
+const pruneOrphanExternalAccountsBatchSize = 1000
+
+// PruneOrphanExternalAccounts deletes external accounts that are not associated with any existing
+// user, so that they can't be resolved to user IDs by GetUserIDsByExternalAccounts. It returns the
+// number of deleted external accounts. Rows are deleted in batches, and each batch is committed
+// separately if the caller hasn't started a transaction.
+func (s *PermsStore) PruneOrphanExternalAccounts(ctx context.Context) (count int, err error) {
+	ctx, save := s.observe(ctx, "PruneOrphanExternalAccounts", "")
+	defer func() { save(&err, otlog.Int("count", count)) }()
+
+	defer func() {
+		// Cached external accounts may have been deleted.
+		if count > 0 && s.accounts != nil {
+			s.accounts.purge()
+		}
+	}()
+
+	for {
+		q := sqlf.Sprintf(`
+-- source: enterprise/cmd/frontend/db/perms_store.go:PermsStore.PruneOrphanExternalAccounts
+DELETE FROM user_external_accounts
+WHERE id IN (
+	SELECT e.id
+	FROM user_external_accounts AS e
+	WHERE NOT EXISTS (SELECT 1 FROM users AS u WHERE u.id = e.user_id)
+	LIMIT %s
+)
+RETURNING id
+`, pruneOrphanExternalAccountsBatchSize)
+		ids, err := s.loadIDs(ctx, q)
+		if err != nil {
+			return count, errors.Wrap(err, "delete orphan external accounts")
+		}
+
+		n := int(ids.GetCardinality())
+		count += n
+		if n < pruneOrphanExternalAccountsBatchSize {
+			return count, nil
+		}
+	}
+}
+
 // tx begins a new transaction.
 func (s *PermsStore) tx(ctx context.Context) (*sql.Tx, error) {
 	switch t := s.db.(type) {
 	case *sql.Tx:
 		return t, nil
 	case *sql.DB:
-		tx, err := t.BeginTx(ctx, nil)
+		tx, err := t.BeginTx(ctx, &sql.TxOptions{Isolation: s.isolation})
 		if err != nil {
 			return nil, err
 		}
@@ -1328,7 +2982,28 @@ func (s *PermsStore) Transact(ctx context.Context) (*PermsStore, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewPermsStore(tx, s.clock), nil
+	c := s.clone()
+	c.db = tx
+	return c, nil
+}
+
+// readTransact begins a new read-only transaction on the database serving the Load* methods (see
+// WithReplica) and makes a new PermsStore over it. The transaction is REPEATABLE READ, so that all
+// of its statements read from the same snapshot of the database, which a hot standby replica
+// supports as well.
+func (s *PermsStore) readTransact(ctx context.Context) (*PermsStore, error) {
+	r := s.reads()
+	db, ok := r.db.(*sql.DB)
+	if !ok {
+		panic(fmt.Sprintf("can't open transaction with unknown implementation of dbutil.DB: %T", r.db))
+	}
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	c := r.clone()
+	c.db = tx
+	return c, nil
 }
 
 // inTx returns true if the current PermsStore wraps an underlying transaction.
@@ -1337,7 +3012,9 @@ func (s *PermsStore) inTx() bool {
 	return ok
 }
 
-// Done commits the transaction if error is nil. Otherwise, rolls back the transaction.
+// Done commits the transaction if error is nil. Otherwise, rolls back the transaction. Changes of
+// user and repository permissions made within the transaction are notified and dispatched only
+// after it commits.
 func (s *PermsStore) Done(err *error) {
 	if !s.inTx() {
 		return
@@ -1345,18 +3022,23 @@ func (s *PermsStore) Done(err *error) {
 
 	tx := s.db.(*sql.Tx)
 	if err == nil || *err == nil {
-		_ = tx.Commit()
+		if tx.Commit() == nil {
+			s.flushChanges()
+			s.dispatchRepoChanges()
+		}
 	} else {
 		_ = tx.Rollback()
 	}
+	s.pending = nil
+	s.pendingRepos = nil
 }
 
 func (s *PermsStore) observe(ctx context.Context, family, title string) (context.Context, func(*error, ...otlog.Field)) {
-	began := s.clock()
+	began := s.clock.Now()
 	tr, ctx := trace.New(ctx, "db.PermsStore."+family, title)
 
 	return ctx, func(err *error, fs ...otlog.Field) {
-		now := s.clock()
+		now := s.clock.Now()
 		took := now.Sub(began)
 
 		fs = append(fs, otlog.String("Duration", took.String()))
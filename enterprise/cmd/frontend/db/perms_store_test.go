@@ -1,9 +1,11 @@
 package db
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"fmt"
+	"math"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -14,7 +16,9 @@ import (
 	"github.com/gitchander/permutation"
 	"github.com/google/go-cmp/cmp"
 	"github.com/keegancsmith/sqlf"
+	"github.com/lib/pq"
 	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+	"github.com/sourcegraph/sourcegraph/internal/db/dbtest"
 	"github.com/sourcegraph/sourcegraph/internal/extsvc"
 	"golang.org/x/sync/errgroup"
 )
@@ -24,7 +28,7 @@ func cleanupPermsTables(t *testing.T, s *PermsStore) {
 		return
 	}
 
-	q := `TRUNCATE TABLE user_permissions, repo_permissions, user_pending_permissions, repo_pending_permissions;`
+	q := `TRUNCATE TABLE user_permissions, repo_permissions, user_pending_permissions, repo_pending_permissions, user_permissions_expiries, repo_permissions_providers, repo_permissions_changes, repo_permissions_grants, user_permissions_history;`
 	if err := s.execute(context.Background(), sqlf.Sprintf(q)); err != nil {
 		t.Fatal(err)
 	}
@@ -158,106 +162,800 @@ func testPermsStore_LoadUserPermissions(db *sql.DB) func(*testing.T) {
 	}
 }
 
+func testPermsStore_LoadUserPermissionsFiltered(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+		tc := NewTestClock(clock())
+		s := NewPermsStore(db, clock).WithClock(tc)
+		defer cleanupPermsTables(t, s)
+
+		if err := s.SetUserPermissionsWithExpiry(ctx, &authz.UserPermissions{
+			UserID: 1,
+			Perm:   authz.Read,
+			Type:   authz.PermRepos,
+			IDs:    toBitmap(1, 2, 3, 4),
+		}, map[int32]time.Time{3: tc.Now().Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SetUserPermissions(ctx, &authz.UserPermissions{
+			UserID: 2,
+			Perm:   authz.Read,
+			Type:   authz.PermRepos,
+			IDs:    toBitmap(5),
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		filter := func(t *testing.T, userID int32, candidates ...uint32) []uint32 {
+			t.Helper()
+			ids, err := s.LoadUserPermissionsFiltered(ctx, &authz.UserPermissions{
+				UserID: userID,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+			}, toBitmap(candidates...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return bitmapToArray(ids)
+		}
+
+		equal(t, "overlapping", []uint32{2, 3}, filter(t, 1, 2, 3, 5, 6))
+		equal(t, "subset", []uint32{1, 4}, filter(t, 1, 1, 4))
+		equal(t, "disjoint", []uint32{}, filter(t, 1, 5, 6))
+		equal(t, "no candidates", []uint32{}, filter(t, 1))
+		equal(t, "other user", []uint32{5}, filter(t, 2, 2, 3, 5))
+		equal(t, "no permissions", []uint32{}, filter(t, 3, 1, 2, 3))
+
+		tc.Advance(2 * time.Hour)
+		equal(t, "expired", []uint32{2}, filter(t, 1, 2, 3))
+
+		// Revoked permissions leave the user in the "repo_permissions" table, which must not
+		// grant access.
+		if err := s.DeleteAllUserPermissions(ctx, 2); err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "revoked", []uint32{}, filter(t, 2, 2, 3, 5))
+	}
+}
+
+func testPermsStore_LoadUserPermissionsWithRepos(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		s := NewPermsStore(db, clock)
+		defer cleanupPermsTables(t, s)
+		defer cleanupReposTable(t, s)
+
+		ctx := context.Background()
+
+		qs := []*sqlf.Query{
+			sqlf.Sprintf(`INSERT INTO repo(id, name) VALUES(1, 'github.com/a/one')`),
+			sqlf.Sprintf(`INSERT INTO repo(id, name) VALUES(2, 'github.com/a/two')`),
+			sqlf.Sprintf(`INSERT INTO repo(id, name, deleted_at) VALUES(3, 'github.com/a/three', NOW())`),
+			sqlf.Sprintf(`INSERT INTO repo(id, name) VALUES(4, 'github.com/a/four')`),
+			sqlf.Sprintf(`INSERT INTO repo(id, name) VALUES(6, 'github.com/a/six')`),
+		}
+		for _, q := range qs {
+			if err := s.execute(ctx, q); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Repository 5 doesn't exist and repository 3 is deleted.
+		if err := s.SetUserPermissions(ctx, &authz.UserPermissions{
+			UserID: 1,
+			Perm:   authz.Read,
+			Type:   authz.PermRepos,
+			IDs:    toBitmap(1, 2, 3, 4, 5),
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		type repo struct {
+			ID   int32
+			Name string
+		}
+		load := func(t *testing.T, limit, offset int) []repo {
+			t.Helper()
+			up := &authz.UserPermissions{
+				UserID: 1,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+			}
+			rs, err := s.LoadUserPermissionsWithRepos(ctx, up, limit, offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "IDs", []uint32{1, 2, 3, 4, 5}, bitmapToArray(up.IDs))
+
+			repos := []repo{}
+			for _, r := range rs {
+				repos = append(repos, repo{ID: int32(r.ID), Name: string(r.Name)})
+			}
+			return repos
+		}
+
+		// Pages are windows of IDs, which skip the deleted repository 3 and the missing repository 5.
+		equal(t, "first page", []repo{{1, "github.com/a/one"}, {2, "github.com/a/two"}}, load(t, 2, 0))
+		equal(t, "second page", []repo{{4, "github.com/a/four"}}, load(t, 2, 2))
+		equal(t, "third page", []repo{}, load(t, 2, 4))
+		equal(t, "past the end", []repo{}, load(t, 2, 5))
+		equal(t, "offset of IDs", []repo{{2, "github.com/a/two"}}, load(t, 2, 1))
+		equal(t, "no limit", []repo{{1, "github.com/a/one"}, {2, "github.com/a/two"}, {4, "github.com/a/four"}}, load(t, 0, 0))
+		equal(t, "no limit after offset", []repo{{4, "github.com/a/four"}}, load(t, 0, 2))
+
+		_, err := s.LoadUserPermissionsWithRepos(ctx, &authz.UserPermissions{
+			UserID: 2,
+			Perm:   authz.Read,
+			Type:   authz.PermRepos,
+		}, 2, 0)
+		if err != authz.ErrPermsNotFound {
+			t.Fatalf("err: want %q but got %v", authz.ErrPermsNotFound, err)
+		}
+	}
+}
+
+func testPermsStore_UserPermissionsMetadata(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		s := NewPermsStore(db, clock)
+		defer cleanupPermsTables(t, s)
+
+		ctx := context.Background()
+		load := func(t *testing.T) *authz.SyncMetadata {
+			t.Helper()
+			up := &authz.UserPermissions{
+				UserID: 1,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+			}
+			if err := s.LoadUserPermissions(ctx, up); err != nil {
+				t.Fatal(err)
+			}
+			return up.Metadata
+		}
+
+		metadata := &authz.SyncMetadata{
+			Job:           "PermsSyncer.syncUserPerms",
+			Provider:      "https://gitlab.com/",
+			FetchDuration: 3 * time.Second,
+		}
+		if err := s.SetUserPermissions(ctx, &authz.UserPermissions{
+			UserID:   1,
+			Perm:     authz.Read,
+			Type:     authz.PermRepos,
+			IDs:      toBitmap(1, 2),
+			Metadata: metadata,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "metadata", metadata, load(t))
+
+		// Metadata is kept if the object IDs are unchanged and none is provided.
+		if err := s.SetUserPermissions(ctx, &authz.UserPermissions{
+			UserID: 1,
+			Perm:   authz.Read,
+			Type:   authz.PermRepos,
+			IDs:    toBitmap(1, 2),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "metadata", metadata, load(t))
+
+		// Metadata is replaced even if the object IDs are unchanged.
+		metadata = &authz.SyncMetadata{
+			Job:           "PermsSyncer.syncUserPerms",
+			Provider:      "https://gitlab.com/",
+			FetchDuration: 5 * time.Second,
+		}
+		if err := s.SetUserPermissions(ctx, &authz.UserPermissions{
+			UserID:   1,
+			Perm:     authz.Read,
+			Type:     authz.PermRepos,
+			IDs:      toBitmap(1, 2),
+			Metadata: metadata,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "metadata", metadata, load(t))
+
+		// Metadata is cleared by callers that change the object IDs without providing any.
+		if err := s.SetUserPermissions(ctx, &authz.UserPermissions{
+			UserID: 1,
+			Perm:   authz.Read,
+			Type:   authz.PermRepos,
+			IDs:    toBitmap(1),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "metadata", (*authz.SyncMetadata)(nil), load(t))
+	}
+}
+
 func testPermsStore_LoadRepoPermissions(db *sql.DB) func(*testing.T) {
 	return func(t *testing.T) {
-		t.Run("no matching", func(t *testing.T) {
-			s := NewPermsStore(db, time.Now)
+		t.Run("no matching", func(t *testing.T) {
+			s := NewPermsStore(db, time.Now)
+			defer cleanupPermsTables(t, s)
+
+			rp := &authz.RepoPermissions{
+				RepoID:  1,
+				Perm:    authz.Read,
+				UserIDs: toBitmap(2),
+			}
+			if err := s.SetRepoPermissions(context.Background(), rp); err != nil {
+				t.Fatal(err)
+			}
+
+			rp = &authz.RepoPermissions{
+				RepoID: 2,
+				Perm:   authz.Read,
+			}
+			err := s.LoadRepoPermissions(context.Background(), rp)
+			if err != authz.ErrPermsNotFound {
+				t.Fatalf("err: want %q but got %q", authz.ErrPermsNotFound, err)
+			}
+			equal(t, "rp.UserIDs", 0, len(bitmapToArray(rp.UserIDs)))
+		})
+
+		t.Run("found matching", func(t *testing.T) {
+			s := NewPermsStore(db, time.Now)
+			defer cleanupPermsTables(t, s)
+
+			rp := &authz.RepoPermissions{
+				RepoID:  1,
+				Perm:    authz.Read,
+				UserIDs: toBitmap(2),
+			}
+			if err := s.SetRepoPermissions(context.Background(), rp); err != nil {
+				t.Fatal(err)
+			}
+
+			rp = &authz.RepoPermissions{
+				RepoID: 1,
+				Perm:   authz.Read,
+			}
+			if err := s.LoadRepoPermissions(context.Background(), rp); err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "rp.UserIDs", []uint32{2}, bitmapToArray(rp.UserIDs))
+		})
+	}
+}
+
+func TestMarshalBitmap(t *testing.T) {
+	// The same set of IDs built in different ways.
+	ascending := roaring.NewBitmap()
+	for i := uint32(0); i < 5000; i += 2 {
+		ascending.Add(i)
+	}
+	descending := roaring.NewBitmap()
+	for i := uint32(4998); ; i -= 2 {
+		descending.Add(i)
+		if i == 0 {
+			break
+		}
+	}
+	removed := roaring.NewBitmap()
+	removed.AddRange(0, 70000)
+	for i := uint32(1); i < 70000; i += 2 {
+		removed.Remove(i)
+	}
+	removed.RemoveRange(5000, 70000)
+
+	want, err := marshalBitmap(ascending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, bm := range map[string]*roaring.Bitmap{"descending": descending, "removed": removed} {
+		have, err := marshalBitmap(bm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		equal(t, name, want, have)
+	}
+}
+
+func testPermsStore_SetRepoPermissionsCanonicalBlobs(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		s := NewPermsStore(db, clock)
+		defer cleanupPermsTables(t, s)
+
+		ctx := context.Background()
+		ids := []uint32{3, 1000, 1, 70000, 2}
+		for i, repoID := range []int32{1, 2} {
+			userIDs := roaring.NewBitmap()
+			if i == 0 {
+				userIDs.AddMany(ids)
+			} else {
+				for j := len(ids) - 1; j >= 0; j-- {
+					userIDs.Add(ids[j])
+				}
+			}
+			if err := s.SetRepoPermissions(ctx, &authz.RepoPermissions{
+				RepoID:  repoID,
+				Perm:    authz.Read,
+				UserIDs: userIDs,
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		rows, err := s.db.QueryContext(ctx, `SELECT user_ids FROM repo_permissions ORDER BY repo_id`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var blobs [][]byte
+		for rows.Next() {
+			var blob []byte
+			if err = rows.Scan(&blob); err != nil {
+				t.Fatal(err)
+			}
+			blobs = append(blobs, blob)
+		}
+		if err = rows.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		equal(t, "number of blobs", 2, len(blobs))
+		equal(t, "blobs", blobs[0], blobs[1])
+	}
+}
+
+func checkRegularPermsTable(s *PermsStore, sql string, expects map[int32][]uint32) error {
+	rows, err := s.db.QueryContext(context.Background(), sql)
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var id int32
+		var ids []byte
+		if err = rows.Scan(&id, &ids); err != nil {
+			return err
+		}
+
+		bm := roaring.NewBitmap()
+		if err = unmarshalBitmap(bm, ids); err != nil {
+			return err
+		}
+
+		objIDs := bitmapToArray(bm)
+		if expects[id] == nil {
+			return fmt.Errorf("unexpected row in table: (id: %v) -> (ids: %v)", id, objIDs)
+		}
+
+		have := fmt.Sprintf("%v", objIDs)
+		want := fmt.Sprintf("%v", expects[id])
+		if have != want {
+			return fmt.Errorf("key %v: want %q but got %q", id, want, have)
+		}
+
+		delete(expects, id)
+	}
+
+	if err = rows.Close(); err != nil {
+		return err
+	}
+
+	if len(expects) > 0 {
+		return fmt.Errorf("missing rows from table: %v", expects)
+	}
+
+	return nil
+}
+
+func testPermsStore_UserPermissionsExist(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+		s := NewPermsStore(db, clock)
+		defer cleanupPermsTables(t, s)
+
+		exist := func(t *testing.T, userID int32) bool {
+			t.Helper()
+			exists, err := s.UserPermissionsExist(ctx, userID, authz.Read, authz.PermRepos)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return exists
+		}
+
+		equal(t, "never synced", false, exist(t, 1))
+
+		q, err := upsertUserPermissionsBatchQuery(&authz.UserPermissions{
+			UserID:    1,
+			Perm:      authz.Read,
+			Type:      authz.PermRepos,
+			IDs:       roaring.NewBitmap(),
+			UpdatedAt: clock(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.execute(ctx, q); err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "synced but empty", true, exist(t, 1))
+
+		if err = s.SetUserPermissions(ctx, &authz.UserPermissions{
+			UserID: 2,
+			Perm:   authz.Read,
+			Type:   authz.PermRepos,
+			IDs:    toBitmap(1),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "synced", true, exist(t, 2))
+
+		// The row of a different permission does not count.
+		exists, err := s.UserPermissionsExist(ctx, 2, authz.Write, authz.PermRepos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "other permission", false, exists)
+	}
+}
+
+func testPermsStore_UserHasAnyPermission(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+		s := NewPermsStore(db, clock)
+		defer cleanupPermsTables(t, s)
+
+		hasAny := func(t *testing.T, userID int32) bool {
+			t.Helper()
+			exists, err := s.UserHasAnyPermission(ctx, userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return exists
+		}
+
+		for _, p := range []*authz.UserPermissions{
+			{UserID: 1, Perm: authz.Read, Type: authz.PermRepos, IDs: toBitmap(1)},
+			{UserID: 2, Perm: authz.Write, Type: authz.PermRepos, IDs: toBitmap(1)},
+		} {
+			if err := s.SetUserPermissions(ctx, p); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		q, err := upsertUserPermissionsBatchQuery(&authz.UserPermissions{
+			UserID:    3,
+			Perm:      authz.Read,
+			Type:      authz.PermRepos,
+			IDs:       roaring.NewBitmap(),
+			UpdatedAt: clock(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.execute(ctx, q); err != nil {
+			t.Fatal(err)
+		}
+
+		equal(t, "read permission", true, hasAny(t, 1))
+		equal(t, "other permission", true, hasAny(t, 2))
+		equal(t, "synced but empty", true, hasAny(t, 3))
+		equal(t, "never synced", false, hasAny(t, 4))
+	}
+}
+
+func testPermsStore_BatchTouchUserPermissions(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+		tc := NewTestClock(clock())
+		s := NewPermsStore(db, clock).WithClock(tc)
+		defer cleanupPermsTables(t, s)
+
+		for _, userID := range []int32{1, 2, 3} {
+			if err := s.SetUserPermissions(ctx, &authz.UserPermissions{
+				UserID: userID,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+				IDs:    toBitmap(uint32(userID)),
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		created := tc.Now()
+
+		tc.Advance(time.Hour)
+		touched, err := s.BatchTouchUserPermissions(ctx, []int32{1, 2, 4}, authz.Read, authz.PermRepos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "touched", 2, touched)
+
+		for userID, want := range map[int32]time.Time{1: tc.Now(), 2: tc.Now(), 3: created} {
+			p := &authz.UserPermissions{UserID: userID, Perm: authz.Read, Type: authz.PermRepos}
+			if err := s.LoadUserPermissions(ctx, p); err != nil {
+				t.Fatal(err)
+			}
+			equal(t, fmt.Sprintf("user %d UpdatedAt", userID), want.UTC(), p.UpdatedAt.UTC())
+			equal(t, fmt.Sprintf("user %d IDs", userID), []uint32{uint32(userID)}, bitmapToArray(p.IDs))
+		}
+
+		// Rows of other permissions are not touched.
+		touched, err = s.BatchTouchUserPermissions(ctx, []int32{1}, authz.Write, authz.PermRepos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "touched other permission", 0, touched)
+	}
+}
+
+func testPermsStore_LoadRepoPermissionsWithReplica(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		s := NewPermsStore(db, time.Now)
+		defer cleanupPermsTables(t, s)
+
+		ctx := context.Background()
+
+		// A repeatable read transaction that takes its snapshot before the write
+		// behaves like a replica lagging behind the primary. It is rolled back
+		// before the tables are cleaned up, which would otherwise wait for it.
+		replica, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = replica.Rollback() }()
+		if _, err = replica.ExecContext(ctx, `SELECT 1 FROM repo_permissions`); err != nil {
+			t.Fatal(err)
+		}
+		s = s.WithReplica(replica)
+
+		if err = s.SetRepoPermissions(ctx, &authz.RepoPermissions{
+			RepoID:  1,
+			Perm:    authz.Read,
+			UserIDs: toBitmap(2),
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		rp := &authz.RepoPermissions{RepoID: 1, Perm: authz.Read}
+		if err = s.LoadRepoPermissions(ctx, rp); err != authz.ErrPermsNotFound {
+			t.Fatalf("err: want %q but got %v", authz.ErrPermsNotFound, err)
+		}
+
+		rp = &authz.RepoPermissions{RepoID: 1, Perm: authz.Read}
+		if err = s.WithPrimaryReads().LoadRepoPermissions(ctx, rp); err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "rp.UserIDs", []uint32{2}, bitmapToArray(rp.UserIDs))
+
+		// Reads within a transaction never use the replica.
+		txs, err := s.Transact(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer txs.Done(&err)
+
+		rp = &authz.RepoPermissions{RepoID: 1, Perm: authz.Read}
+		if err = txs.LoadRepoPermissions(ctx, rp); err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "rp.UserIDs", []uint32{2}, bitmapToArray(rp.UserIDs))
+	}
+}
+
+func testPermsStore_LoadRepoPermissionsWithPendingCount(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+
+		t.Run("no permissions", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupPermsTables(t, s)
+
+			rp := &authz.RepoPermissions{
+				RepoID: 1,
+				Perm:   authz.Read,
+			}
+			pendingCount, err := s.LoadRepoPermissionsWithPendingCount(ctx, rp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "UserIDs", 0, len(bitmapToArray(rp.UserIDs)))
+			equal(t, "pendingCount", 0, pendingCount)
+		})
+
+		t.Run("restricted without pending users", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupPermsTables(t, s)
+
+			if err := s.SetRepoPermissions(ctx, &authz.RepoPermissions{
+				RepoID:  1,
+				Perm:    authz.Read,
+				UserIDs: toBitmap(2),
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			rp := &authz.RepoPermissions{
+				RepoID: 1,
+				Perm:   authz.Read,
+			}
+			pendingCount, err := s.LoadRepoPermissionsWithPendingCount(ctx, rp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "UserIDs", []uint32{2}, bitmapToArray(rp.UserIDs))
+			equal(t, "pendingCount", 0, pendingCount)
+		})
+
+		t.Run("pending users present", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupPermsTables(t, s)
+
+			if err := s.SetRepoPermissions(ctx, &authz.RepoPermissions{
+				RepoID:  1,
+				Perm:    authz.Read,
+				UserIDs: toBitmap(2),
+			}); err != nil {
+				t.Fatal(err)
+			}
+			accounts := &extsvc.ExternalAccounts{
+				ServiceType: "sourcegraph",
+				ServiceID:   "https://sourcegraph.com/",
+				AccountIDs:  []string{"alice", "bob"},
+			}
+			if err := s.SetRepoPendingPermissions(ctx, accounts, &authz.RepoPermissions{
+				RepoID: 1,
+				Perm:   authz.Read,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			rp := &authz.RepoPermissions{
+				RepoID: 1,
+				Perm:   authz.Read,
+			}
+			pendingCount, err := s.LoadRepoPermissionsWithPendingCount(ctx, rp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "UserIDs", []uint32{2}, bitmapToArray(rp.UserIDs))
+			equal(t, "pendingCount", 2, pendingCount)
+
+			// Granted pending permissions are no longer counted.
+			if err = s.GrantPendingPermissions(ctx, 1, &authz.UserPendingPermissions{
+				ServiceType: "sourcegraph",
+				ServiceID:   "https://sourcegraph.com/",
+				BindID:      "alice",
+				Perm:        authz.Read,
+				Type:        authz.PermRepos,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			pendingCount, err = s.LoadRepoPermissionsWithPendingCount(ctx, rp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "UserIDs", []uint32{1, 2}, bitmapToArray(rp.UserIDs))
+			equal(t, "pendingCount", 1, pendingCount)
+		})
+	}
+}
+
+func testPermsStore_LoadRepoPermissionsWithPending(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+
+		t.Run("no permissions", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
 			defer cleanupPermsTables(t, s)
 
-			rp := &authz.RepoPermissions{
+			userIDs, bindIDs, err := s.LoadRepoPermissionsWithPending(ctx, 1, authz.Read)
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "userIDs", 0, len(bitmapToArray(userIDs)))
+			equal(t, "bindIDs", 0, len(bindIDs))
+		})
+
+		t.Run("real and pending members", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupPermsTables(t, s)
+
+			if err := s.SetRepoPermissions(ctx, &authz.RepoPermissions{
 				RepoID:  1,
 				Perm:    authz.Read,
-				UserIDs: toBitmap(2),
+				UserIDs: toBitmap(2, 3),
+			}); err != nil {
+				t.Fatal(err)
 			}
-			if err := s.SetRepoPermissions(context.Background(), rp); err != nil {
+			accounts := &extsvc.ExternalAccounts{
+				ServiceType: "sourcegraph",
+				ServiceID:   "https://sourcegraph.com/",
+				AccountIDs:  []string{"bob", "alice"},
+			}
+			if err := s.SetRepoPendingPermissions(ctx, accounts, &authz.RepoPermissions{
+				RepoID: 1,
+				Perm:   authz.Read,
+			}); err != nil {
 				t.Fatal(err)
 			}
 
-			rp = &authz.RepoPermissions{
+			// Pending permissions of other repositories are not included.
+			if err := s.SetRepoPendingPermissions(ctx, &extsvc.ExternalAccounts{
+				ServiceType: "sourcegraph",
+				ServiceID:   "https://sourcegraph.com/",
+				AccountIDs:  []string{"cindy"},
+			}, &authz.RepoPermissions{
 				RepoID: 2,
 				Perm:   authz.Read,
+			}); err != nil {
+				t.Fatal(err)
 			}
-			err := s.LoadRepoPermissions(context.Background(), rp)
-			if err != authz.ErrPermsNotFound {
-				t.Fatalf("err: want %q but got %q", authz.ErrPermsNotFound, err)
+
+			userIDs, bindIDs, err := s.LoadRepoPermissionsWithPending(ctx, 1, authz.Read)
+			if err != nil {
+				t.Fatal(err)
 			}
-			equal(t, "rp.UserIDs", 0, len(bitmapToArray(rp.UserIDs)))
+			equal(t, "userIDs", []uint32{2, 3}, bitmapToArray(userIDs))
+			equal(t, "bindIDs", []string{"alice", "bob"}, bindIDs)
+
+			// Granted pending permissions move from the pending to the real members.
+			if err = s.GrantPendingPermissions(ctx, 1, &authz.UserPendingPermissions{
+				ServiceType: "sourcegraph",
+				ServiceID:   "https://sourcegraph.com/",
+				BindID:      "alice",
+				Perm:        authz.Read,
+				Type:        authz.PermRepos,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			userIDs, bindIDs, err = s.LoadRepoPermissionsWithPending(ctx, 1, authz.Read)
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "userIDs", []uint32{1, 2, 3}, bitmapToArray(userIDs))
+			equal(t, "bindIDs", []string{"bob"}, bindIDs)
 		})
 
-		t.Run("found matching", func(t *testing.T) {
-			s := NewPermsStore(db, time.Now)
+		t.Run("within a transaction", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
 			defer cleanupPermsTables(t, s)
 
-			rp := &authz.RepoPermissions{
+			txs, err := s.Transact(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer txs.Done(&err)
+
+			if err = txs.SetRepoPermissions(ctx, &authz.RepoPermissions{
 				RepoID:  1,
 				Perm:    authz.Read,
 				UserIDs: toBitmap(2),
-			}
-			if err := s.SetRepoPermissions(context.Background(), rp); err != nil {
+			}); err != nil {
 				t.Fatal(err)
 			}
-
-			rp = &authz.RepoPermissions{
+			if err = txs.SetRepoPendingPermissions(ctx, &extsvc.ExternalAccounts{
+				ServiceType: "sourcegraph",
+				ServiceID:   "https://sourcegraph.com/",
+				AccountIDs:  []string{"alice"},
+			}, &authz.RepoPermissions{
 				RepoID: 1,
 				Perm:   authz.Read,
+			}); err != nil {
+				t.Fatal(err)
 			}
-			if err := s.LoadRepoPermissions(context.Background(), rp); err != nil {
+
+			// Uncommitted writes of the transaction are visible.
+			userIDs, bindIDs, err := txs.LoadRepoPermissionsWithPending(ctx, 1, authz.Read)
+			if err != nil {
 				t.Fatal(err)
 			}
-			equal(t, "rp.UserIDs", []uint32{2}, bitmapToArray(rp.UserIDs))
+			equal(t, "userIDs", []uint32{2}, bitmapToArray(userIDs))
+			equal(t, "bindIDs", []string{"alice"}, bindIDs)
 		})
 	}
 }
 
-func checkRegularPermsTable(s *PermsStore, sql string, expects map[int32][]uint32) error {
-	rows, err := s.db.QueryContext(context.Background(), sql)
-	if err != nil {
-		return err
-	}
-
-	for rows.Next() {
-		var id int32
-		var ids []byte
-		if err = rows.Scan(&id, &ids); err != nil {
-			return err
-		}
-
-		bm := roaring.NewBitmap()
-		if err = bm.UnmarshalBinary(ids); err != nil {
-			return err
-		}
-
-		objIDs := bitmapToArray(bm)
-		if expects[id] == nil {
-			return fmt.Errorf("unexpected row in table: (id: %v) -> (ids: %v)", id, objIDs)
-		}
-
-		have := fmt.Sprintf("%v", objIDs)
-		want := fmt.Sprintf("%v", expects[id])
-		if have != want {
-			return fmt.Errorf("key %v: want %q but got %q", id, want, have)
-		}
-
-		delete(expects, id)
-	}
-
-	if err = rows.Close(); err != nil {
-		return err
-	}
-
-	if len(expects) > 0 {
-		return fmt.Errorf("missing rows from table: %v", expects)
-	}
-
-	return nil
-}
-
 func testPermsStore_SetUserPermissions(db *sql.DB) func(*testing.T) {
 	tests := []struct {
 		name            string
 		updates         []*authz.UserPermissions
-		expectUserPerms map[int32][]uint32 // user_id -> object_ids
-		expectRepoPerms map[int32][]uint32 // repo_id -> user_ids
+		expectUserPerms map[int32][]uint32         // user_id -> object_ids
+		expectRepoPerms map[int32][]uint32         // repo_id -> user_ids
+		expectResults   []SetUserPermissionsResult // The result of each update, summed over concurrent calls
 	}{
 		{
 			name: "empty",
@@ -267,6 +965,9 @@ func testPermsStore_SetUserPermissions(db *sql.DB) func(*testing.T) {
 					Perm:   authz.Read,
 				},
 			},
+			expectResults: []SetUserPermissionsResult{
+				{},
+			},
 		},
 		{
 			name: "add",
@@ -296,6 +997,11 @@ func testPermsStore_SetUserPermissions(db *sql.DB) func(*testing.T) {
 				3: {3},
 				4: {3},
 			},
+			expectResults: []SetUserPermissionsResult{
+				{Added: 1, Total: 1},
+				{Added: 2, Total: 2},
+				{Added: 2, Total: 2},
+			},
 		},
 		{
 			name: "add and update",
@@ -327,6 +1033,12 @@ func testPermsStore_SetUserPermissions(db *sql.DB) func(*testing.T) {
 				2: {1},
 				3: {1, 2},
 			},
+			expectResults: []SetUserPermissionsResult{
+				{Added: 1, Total: 1},
+				{Added: 2, Removed: 1, Total: 2},
+				{Added: 2, Total: 2},
+				{Added: 1, Removed: 1, Total: 2},
+			},
 		},
 		{
 			name: "add and clear",
@@ -349,6 +1061,10 @@ func testPermsStore_SetUserPermissions(db *sql.DB) func(*testing.T) {
 				2: {},
 				3: {},
 			},
+			expectResults: []SetUserPermissionsResult{
+				{Added: 3, Total: 3},
+				{Removed: 3, Total: 0},
+			},
 		},
 	}
 
@@ -358,8 +1074,12 @@ func testPermsStore_SetUserPermissions(db *sql.DB) func(*testing.T) {
 				s := NewPermsStore(db, clock)
 				defer cleanupPermsTables(t, s)
 
-				for _, p := range test.updates {
+				for i, p := range test.updates {
 					const numOps = 30
+					var (
+						mu  sync.Mutex
+						sum SetUserPermissionsResult
+					)
 					g, ctx := errgroup.WithContext(context.Background())
 					for i := 0; i < numOps; i++ {
 						g.Go(func() error {
@@ -371,12 +1091,24 @@ func testPermsStore_SetUserPermissions(db *sql.DB) func(*testing.T) {
 							if p.IDs != nil {
 								tmp.IDs = p.IDs.Clone()
 							}
-							return s.SetUserPermissions(ctx, tmp)
+							res, err := s.SetUserPermissionsWithResult(ctx, tmp)
+							if err != nil {
+								return err
+							}
+
+							// Concurrent calls are serialized, so only one of them makes changes.
+							mu.Lock()
+							defer mu.Unlock()
+							sum.Added += res.Added
+							sum.Removed += res.Removed
+							sum.Total = res.Total
+							return nil
 						})
 					}
 					if err := g.Wait(); err != nil {
 						t.Fatal(err)
 					}
+					equal(t, fmt.Sprintf("result of update %d", i), test.expectResults[i], sum)
 				}
 
 				err := checkRegularPermsTable(s, `SELECT user_id, object_ids FROM user_permissions`, test.expectUserPerms)
@@ -393,6 +1125,53 @@ func testPermsStore_SetUserPermissions(db *sql.DB) func(*testing.T) {
 	}
 }
 
+func testPermsStore_SetPermissionsOutOfRange(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+		s := NewPermsStore(db, clock)
+		defer cleanupPermsTables(t, s)
+
+		err := s.SetUserPermissions(ctx, &authz.UserPermissions{
+			UserID: 1,
+			Perm:   authz.Read,
+			Type:   authz.PermRepos,
+			IDs:    toBitmap(1, math.MaxInt32+1),
+		})
+		if err == nil || err.Error() != "object ID 2147483648 of user 1 is out of range" {
+			t.Fatalf("want out of range error but got %v", err)
+		}
+
+		err = s.SetRepoPermissions(ctx, &authz.RepoPermissions{
+			RepoID:  1,
+			Perm:    authz.Read,
+			UserIDs: toBitmap(1, math.MaxUint32),
+		})
+		if err == nil || err.Error() != "user ID 4294967295 of repository 1 is out of range" {
+			t.Fatalf("want out of range error but got %v", err)
+		}
+
+		// Nothing is written.
+		err = checkRegularPermsTable(s, `SELECT user_id, object_ids FROM user_permissions`, map[int32][]uint32{})
+		if err != nil {
+			t.Fatal("user_permissions:", err)
+		}
+		err = checkRegularPermsTable(s, `SELECT repo_id, user_ids FROM repo_permissions`, map[int32][]uint32{})
+		if err != nil {
+			t.Fatal("repo_permissions:", err)
+		}
+
+		// The largest int32 is in range.
+		if err = s.SetUserPermissions(ctx, &authz.UserPermissions{
+			UserID: 1,
+			Perm:   authz.Read,
+			Type:   authz.PermRepos,
+			IDs:    toBitmap(math.MaxInt32),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 func testPermsStore_SetRepoPermissions(db *sql.DB) func(*testing.T) {
 	tests := []struct {
 		name            string
@@ -480,58 +1259,380 @@ func testPermsStore_SetRepoPermissions(db *sql.DB) func(*testing.T) {
 				}, {
 					RepoID:  1,
 					Perm:    authz.Read,
-					UserIDs: toBitmap(),
-				},
-			},
-			expectUserPerms: map[int32][]uint32{
-				1: {},
-				2: {},
-				3: {},
-			},
-			expectRepoPerms: map[int32][]uint32{
-				1: {},
-			},
-		},
+					UserIDs: toBitmap(),
+				},
+			},
+			expectUserPerms: map[int32][]uint32{
+				1: {},
+				2: {},
+				3: {},
+			},
+			expectRepoPerms: map[int32][]uint32{
+				1: {},
+			},
+		},
+	}
+
+	return func(t *testing.T) {
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				s := NewPermsStore(db, clock)
+				defer cleanupPermsTables(t, s)
+
+				for _, p := range test.updates {
+					const numOps = 30
+					g, ctx := errgroup.WithContext(context.Background())
+					for i := 0; i < numOps; i++ {
+						g.Go(func() error {
+							tmp := &authz.RepoPermissions{
+								RepoID:    p.RepoID,
+								Perm:      p.Perm,
+								UpdatedAt: p.UpdatedAt,
+							}
+							if p.UserIDs != nil {
+								tmp.UserIDs = p.UserIDs.Clone()
+							}
+							return s.SetRepoPermissions(ctx, tmp)
+						})
+					}
+					if err := g.Wait(); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				err := checkRegularPermsTable(s, `SELECT user_id, object_ids FROM user_permissions`, test.expectUserPerms)
+				if err != nil {
+					t.Fatal("user_permissions:", err)
+				}
+
+				err = checkRegularPermsTable(s, `SELECT repo_id, user_ids FROM repo_permissions`, test.expectRepoPerms)
+				if err != nil {
+					t.Fatal("repo_permissions:", err)
+				}
+			})
+		}
+	}
+}
+
+func testPermsStore_SetRepoPermissionsInBatches(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		t.Run("invalid batch size", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupPermsTables(t, s)
+
+			err := s.SetRepoPermissionsInBatches(context.Background(), &authz.RepoPermissions{
+				RepoID:  1,
+				Perm:    authz.Read,
+				UserIDs: toBitmap(1),
+			}, 0)
+			if err == nil {
+				t.Fatal("expected an error but got nil")
+			}
+		})
+
+		t.Run("add and update", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupPermsTables(t, s)
+
+			ctx := context.Background()
+			for _, p := range []*authz.RepoPermissions{
+				{
+					RepoID:  1,
+					Perm:    authz.Read,
+					UserIDs: toBitmap(1, 2, 3, 4, 5),
+				}, {
+					RepoID:  1,
+					Perm:    authz.Read,
+					UserIDs: toBitmap(2, 4, 6),
+				}, {
+					RepoID:  2,
+					Perm:    authz.Read,
+					UserIDs: toBitmap(1, 6),
+				},
+			} {
+				if err := s.SetRepoPermissionsInBatches(ctx, p, 2); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := checkRegularPermsTable(s, `SELECT user_id, object_ids FROM user_permissions`, map[int32][]uint32{
+				1: {2},
+				2: {1},
+				3: {},
+				4: {1},
+				5: {},
+				6: {1, 2},
+			})
+			if err != nil {
+				t.Fatal("user_permissions:", err)
+			}
+
+			err = checkRegularPermsTable(s, `SELECT repo_id, user_ids FROM repo_permissions`, map[int32][]uint32{
+				1: {2, 4, 6},
+				2: {1, 6},
+			})
+			if err != nil {
+				t.Fatal("repo_permissions:", err)
+			}
+		})
+	}
+}
+
+// BenchmarkPermsStore_SetRepoPermissions compares the unbatched and batched write paths. Besides
+// the time of a call, it reports how long the row of a user in the first batch stays locked per
+// call, as observed by a concurrent probe (see probeUserPermissionsLock).
+func BenchmarkPermsStore_SetRepoPermissions(b *testing.B) {
+	db, cleanup := dbtest.NewDB(b, *dsn)
+	defer cleanup()
+
+	// NOTE: The unbatched write path puts every affected row into a single statement,
+	// so the number of users is kept below the Postgres limit of bind parameters.
+	const numUsers = 10000
+	userIDs := roaring.NewBitmap()
+	userIDs.AddRange(1, numUsers+1)
+
+	ctx := context.Background()
+	for _, batchSize := range []int{0, 100, 1000} {
+		b.Run(fmt.Sprintf("batchSize=%d", batchSize), func(b *testing.B) {
+			s := NewPermsStore(db, clock)
+
+			// The rows of users must exist to be locked, so every user has access to another
+			// repository beforehand.
+			b.StopTimer()
+			if err := s.SetRepoPermissions(ctx, &authz.RepoPermissions{
+				RepoID:  math.MaxInt32,
+				Perm:    authz.Read,
+				UserIDs: userIDs.Clone(),
+			}); err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+
+			var locked time.Duration
+			for i := 0; i < b.N; i++ {
+				p := &authz.RepoPermissions{
+					RepoID:  int32(i + 1),
+					Perm:    authz.Read,
+					UserIDs: userIDs.Clone(),
+				}
+
+				locked += probeUserPermissionsLock(ctx, b, db, 1, func() {
+					var err error
+					if batchSize == 0 {
+						err = s.SetRepoPermissions(ctx, p)
+					} else {
+						err = s.SetRepoPermissionsInBatches(ctx, p, batchSize)
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+				})
+			}
+			b.ReportMetric(float64(locked)/float64(time.Millisecond)/float64(b.N), "lock-ms/op")
+
+			b.StopTimer()
+			q := `TRUNCATE TABLE user_permissions, repo_permissions, repo_permissions_grants`
+			if err := s.execute(ctx, sqlf.Sprintf(q)); err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+		})
 	}
+}
 
-	return func(t *testing.T) {
-		for _, test := range tests {
-			t.Run(test.name, func(t *testing.T) {
-				s := NewPermsStore(db, clock)
-				defer cleanupPermsTables(t, s)
+// probeUserPermissionsLock runs f while repeatedly trying to lock the row of given user in the
+// "user_permissions" table without waiting, and returns for how long the row was found locked.
+func probeUserPermissionsLock(ctx context.Context, b *testing.B, db *sql.DB, userID int32, f func()) time.Duration {
+	done := make(chan struct{})
+	result := make(chan time.Duration)
+	go func() {
+		var locked time.Duration
+		last := time.Now()
+		for {
+			select {
+			case <-done:
+				result <- locked
+				return
+			default:
+			}
+
+			err := tryLockUserPermissions(ctx, db, userID)
+			now := time.Now()
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "55P03" { // lock_not_available
+				locked += now.Sub(last)
+			} else if err != nil {
+				b.Error(err)
+			}
+			last = now
+		}
+	}()
 
-				for _, p := range test.updates {
-					const numOps = 30
-					g, ctx := errgroup.WithContext(context.Background())
-					for i := 0; i < numOps; i++ {
-						g.Go(func() error {
-							tmp := &authz.RepoPermissions{
-								RepoID:    p.RepoID,
-								Perm:      p.Perm,
-								UpdatedAt: p.UpdatedAt,
-							}
-							if p.UserIDs != nil {
-								tmp.UserIDs = p.UserIDs.Clone()
-							}
-							return s.SetRepoPermissions(ctx, tmp)
-						})
+	f()
+	close(done)
+	return <-result
+}
+
+// tryLockUserPermissions locks the row of given user in the "user_permissions" table with NOWAIT
+// and releases it right away.
+func tryLockUserPermissions(ctx context.Context, db *sql.DB, userID int32) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	_, err = tx.ExecContext(ctx, `
+SELECT 1 FROM user_permissions
+WHERE user_id = $1
+AND permission = 'read'
+AND object_type = 'repos'
+FOR UPDATE NOWAIT
+`, userID)
+	return err
+}
+
+func BenchmarkPermsStore_SetUserPermissions(b *testing.B) {
+	db, cleanup := dbtest.NewDB(b, *dsn)
+	defer cleanup()
+
+	const numRepos = 100
+	ctx := context.Background()
+	for _, name := range []string{"distinct users", "same user"} {
+		b.Run(name, func(b *testing.B) {
+			s := NewPermsStore(db, clock)
+			var userID int32
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					id := int32(1)
+					if name == "distinct users" {
+						id = atomic.AddInt32(&userID, 1)
 					}
-					if err := g.Wait(); err != nil {
-						t.Fatal(err)
+
+					// Alternate between two sets of object IDs so that every call changes permissions.
+					ids := roaring.NewBitmap()
+					ids.AddRange(uint64(1+i%2), uint64(1+i%2+numRepos))
+					if err := s.SetUserPermissions(ctx, &authz.UserPermissions{
+						UserID: id,
+						Perm:   authz.Read,
+						Type:   authz.PermRepos,
+						IDs:    ids,
+					}); err != nil {
+						b.Fatal(err)
 					}
 				}
+			})
 
-				err := checkRegularPermsTable(s, `SELECT user_id, object_ids FROM user_permissions`, test.expectUserPerms)
-				if err != nil {
-					t.Fatal("user_permissions:", err)
-				}
+			b.StopTimer()
+			q := `TRUNCATE TABLE user_permissions, repo_permissions, user_permissions_expiries`
+			if err := s.execute(ctx, sqlf.Sprintf(q)); err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+		})
+	}
+}
 
-				err = checkRegularPermsTable(s, `SELECT repo_id, user_ids FROM repo_permissions`, test.expectRepoPerms)
-				if err != nil {
-					t.Fatal("repo_permissions:", err)
-				}
+func testPermsStore_WithClock(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		tc := NewTestClock(time.Unix(0, now).Truncate(time.Microsecond))
+		s := NewPermsStore(db, clock).WithClock(tc)
+		defer cleanupPermsTables(t, s)
+
+		ctx := context.Background()
+		loadUpdatedAt := func(userID int32) time.Time {
+			t.Helper()
+			up := &authz.UserPermissions{
+				UserID: userID,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+			}
+			if err := s.LoadUserPermissions(ctx, up); err != nil {
+				t.Fatal(err)
+			}
+			return up.UpdatedAt
+		}
+
+		if err := s.SetRepoPermissions(ctx, &authz.RepoPermissions{
+			RepoID:  1,
+			Perm:    authz.Read,
+			UserIDs: toBitmap(1, 2),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		first := tc.Now()
+		equal(t, "user 1 UpdatedAt", first.UnixNano(), loadUpdatedAt(1).UnixNano())
+		equal(t, "user 2 UpdatedAt", first.UnixNano(), loadUpdatedAt(2).UnixNano())
+
+		tc.Advance(time.Hour)
+		if err := s.SetRepoPermissions(ctx, &authz.RepoPermissions{
+			RepoID:  1,
+			Perm:    authz.Read,
+			UserIDs: toBitmap(2),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		second := tc.Now()
+		equal(t, "user 1 UpdatedAt", second.UnixNano(), loadUpdatedAt(1).UnixNano())
+		equal(t, "user 2 UpdatedAt", first.UnixNano(), loadUpdatedAt(2).UnixNano())
+
+		rp := &authz.RepoPermissions{
+			RepoID: 1,
+			Perm:   authz.Read,
+		}
+		if err := s.LoadRepoPermissions(ctx, rp); err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "repo UpdatedAt", second.UnixNano(), rp.UpdatedAt.UnixNano())
+	}
+}
+
+func testPermsStore_LoadUserPendingPermissionsBatch(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		s := NewPermsStore(db, clock)
+		defer cleanupPermsTables(t, s)
+
+		ctx := context.Background()
+
+		// The user has three verified emails, and only two of them have pending permissions.
+		accounts := &extsvc.ExternalAccounts{
+			ServiceType: "sourcegraph",
+			ServiceID:   "https://sourcegraph.com/",
+			AccountIDs:  []string{"alice@example.com", "alice@example.org"},
+		}
+		if err := s.SetRepoPendingPermissions(ctx, accounts, &authz.RepoPermissions{
+			RepoID: 1,
+			Perm:   authz.Read,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		accounts.AccountIDs = []string{"alice@example.org"}
+		if err := s.SetRepoPendingPermissions(ctx, accounts, &authz.RepoPermissions{
+			RepoID: 2,
+			Perm:   authz.Read,
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		var ups []*authz.UserPendingPermissions
+		for _, email := range []string{"alice@example.com", "alice@example.org", "alice@example.net"} {
+			ups = append(ups, &authz.UserPendingPermissions{
+				ServiceType: "sourcegraph",
+				ServiceID:   "https://sourcegraph.com/",
+				BindID:      email,
+				Perm:        authz.Read,
+				Type:        authz.PermRepos,
 			})
 		}
+		if err := s.LoadUserPendingPermissionsBatch(ctx, ups); err != nil {
+			t.Fatal(err)
+		}
+
+		equal(t, "ups[0].IDs", []uint32{1}, bitmapToArray(ups[0].IDs))
+		equal(t, "ups[0].UpdatedAt", now, ups[0].UpdatedAt.UnixNano())
+		equal(t, "ups[1].IDs", []uint32{1, 2}, bitmapToArray(ups[1].IDs))
+		equal(t, "ups[1].UpdatedAt", now, ups[1].UpdatedAt.UnixNano())
+		equal(t, "ups[2].IDs", 0, len(bitmapToArray(ups[2].IDs)))
+		equal(t, "ups[2].UpdatedAt", true, ups[2].UpdatedAt.IsZero())
 	}
 }
 
@@ -684,7 +1785,7 @@ func checkUserPendingPermsTable(ctx context.Context, s *PermsStore, expects map[
 		bindIDs[id] = bindID
 
 		bm := roaring.NewBitmap()
-		if err = bm.UnmarshalBinary(ids); err != nil {
+		if err = unmarshalBitmap(bm, ids); err != nil {
 			return nil, err
 		}
 
@@ -726,7 +1827,7 @@ func checkRepoPendingPermsTable(ctx context.Context, s *PermsStore, bindIDs map[
 		}
 
 		bm := roaring.NewBitmap()
-		if err = bm.UnmarshalBinary(ids); err != nil {
+		if err = unmarshalBitmap(bm, ids); err != nil {
 			return err
 		}
 
@@ -773,8 +1874,9 @@ func testPermsStore_SetRepoPendingPermissions(db *sql.DB) func(*testing.T) {
 	tests := []struct {
 		name                   string
 		updates                []update
-		expectUserPendingPerms map[string][]uint32 // bind_id -> object_ids
-		expectRepoPendingPerms map[int32][]string  // repo_id -> bind_ids
+		expectUserPendingPerms map[string][]uint32               // bind_id -> object_ids
+		expectRepoPendingPerms map[int32][]string                // repo_id -> bind_ids
+		expectResults          []SetRepoPendingPermissionsResult // The result of each update, merged over concurrent calls
 	}{
 		{
 			name: "empty",
@@ -791,6 +1893,7 @@ func testPermsStore_SetRepoPendingPermissions(db *sql.DB) func(*testing.T) {
 					},
 				},
 			},
+			expectResults: []SetRepoPendingPermissionsResult{{}},
 		},
 		{
 			name: "add",
@@ -838,6 +1941,38 @@ func testPermsStore_SetRepoPendingPermissions(db *sql.DB) func(*testing.T) {
 				2: {"alice", "bob"},
 				3: {"cindy", "david"},
 			},
+			expectResults: []SetRepoPendingPermissionsResult{
+				{AddedBindIDs: []string{"alice"}},
+				{AddedBindIDs: []string{"alice", "bob"}},
+				{AddedBindIDs: []string{"cindy", "david"}},
+			},
+		},
+		{
+			name: "add with duplicate account IDs",
+			updates: []update{
+				{
+					accounts: &extsvc.ExternalAccounts{
+						ServiceType: "sourcegraph",
+						ServiceID:   "https://sourcegraph.com/",
+						AccountIDs:  []string{"alice", "bob", "alice", "Alice"},
+					},
+					perm: &authz.RepoPermissions{
+						RepoID: 1,
+						Perm:   authz.Read,
+					},
+				},
+			},
+			expectUserPendingPerms: map[string][]uint32{
+				"alice": {1},
+				"bob":   {1},
+				"Alice": {1},
+			},
+			expectRepoPendingPerms: map[int32][]string{
+				1: {"alice", "bob", "Alice"},
+			},
+			expectResults: []SetRepoPendingPermissionsResult{
+				{AddedBindIDs: []string{"Alice", "alice", "bob"}},
+			},
 		},
 		{
 			name: "add and update",
@@ -894,6 +2029,12 @@ func testPermsStore_SetRepoPendingPermissions(db *sql.DB) func(*testing.T) {
 				1: {"bob", "cindy"},
 				2: {"cindy", "david"},
 			},
+			expectResults: []SetRepoPendingPermissionsResult{
+				{AddedBindIDs: []string{"alice", "bob"}},
+				{AddedBindIDs: []string{"cindy"}, RemovedBindIDs: []string{"alice"}},
+				{AddedBindIDs: []string{"alice", "bob"}},
+				{AddedBindIDs: []string{"cindy", "david"}, RemovedBindIDs: []string{"alice", "bob"}},
+			},
 		},
 		{
 			name: "add and clear",
@@ -928,6 +2069,10 @@ func testPermsStore_SetRepoPendingPermissions(db *sql.DB) func(*testing.T) {
 			expectRepoPendingPerms: map[int32][]string{
 				1: {},
 			},
+			expectResults: []SetRepoPendingPermissionsResult{
+				{AddedBindIDs: []string{"alice", "bob", "cindy"}},
+				{RemovedBindIDs: []string{"alice", "bob", "cindy"}},
+			},
 		},
 	}
 
@@ -939,8 +2084,12 @@ func testPermsStore_SetRepoPendingPermissions(db *sql.DB) func(*testing.T) {
 
 				ctx := context.Background()
 
-				for _, update := range test.updates {
+				for i, update := range test.updates {
 					const numOps = 30
+					var (
+						mu     sync.Mutex
+						merged SetRepoPendingPermissionsResult
+					)
 					g, ctx := errgroup.WithContext(ctx)
 					for i := 0; i < numOps; i++ {
 						g.Go(func() error {
@@ -952,12 +2101,25 @@ func testPermsStore_SetRepoPendingPermissions(db *sql.DB) func(*testing.T) {
 							if update.perm.UserIDs != nil {
 								tmp.UserIDs = update.perm.UserIDs.Clone()
 							}
-							return s.SetRepoPendingPermissions(ctx, update.accounts, tmp)
+							res, err := s.SetRepoPendingPermissionsWithResult(ctx, update.accounts, tmp)
+							if err != nil {
+								return err
+							}
+
+							// Concurrent calls are serialized, so only one of them makes changes.
+							mu.Lock()
+							defer mu.Unlock()
+							merged.AddedBindIDs = append(merged.AddedBindIDs, res.AddedBindIDs...)
+							merged.RemovedBindIDs = append(merged.RemovedBindIDs, res.RemovedBindIDs...)
+							return nil
 						})
 					}
 					if err := g.Wait(); err != nil {
 						t.Fatal(err)
 					}
+					sort.Strings(merged.AddedBindIDs)
+					sort.Strings(merged.RemovedBindIDs)
+					equal(t, fmt.Sprintf("result of update %d", i), test.expectResults[i], merged)
 				}
 
 				// Query and check rows in "user_pending_permissions" table.
@@ -982,30 +2144,134 @@ func testPermsStore_ListPendingUsers(db *sql.DB) func(*testing.T) {
 		perm     *authz.RepoPermissions
 	}
 	tests := []struct {
-		name               string
-		updates            []update
-		expectPendingUsers []string
+		name               string
+		updates            []update
+		expectPendingUsers []string
+	}{
+		{
+			name:               "no user with pending permissions",
+			expectPendingUsers: nil,
+		},
+		{
+			name: "has user with pending permissions",
+			updates: []update{
+				{
+					accounts: &extsvc.ExternalAccounts{
+						ServiceType: "sourcegraph",
+						ServiceID:   "https://sourcegraph.com/",
+						AccountIDs:  []string{"alice"},
+					},
+					perm: &authz.RepoPermissions{
+						RepoID: 1,
+						Perm:   authz.Read,
+					},
+				},
+			},
+			expectPendingUsers: []string{"alice"},
+		},
+		{
+			name: "has user but with empty object_ids",
+			updates: []update{
+				{
+					accounts: &extsvc.ExternalAccounts{
+						ServiceType: "sourcegraph",
+						ServiceID:   "https://sourcegraph.com/",
+						AccountIDs:  []string{"bob@example.com"},
+					},
+					perm: &authz.RepoPermissions{
+						RepoID: 1,
+						Perm:   authz.Read,
+					},
+				}, {
+					accounts: &extsvc.ExternalAccounts{
+						ServiceType: "sourcegraph",
+						ServiceID:   "https://sourcegraph.com/",
+						AccountIDs:  nil,
+					},
+					perm: &authz.RepoPermissions{
+						RepoID: 1,
+						Perm:   authz.Read,
+					},
+				},
+			},
+			expectPendingUsers: nil,
+		},
+	}
+	return func(t *testing.T) {
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				s := NewPermsStore(db, clock)
+				defer cleanupPermsTables(t, s)
+
+				ctx := context.Background()
+
+				for _, update := range test.updates {
+					tmp := &authz.RepoPermissions{
+						RepoID:    update.perm.RepoID,
+						Perm:      update.perm.Perm,
+						UpdatedAt: update.perm.UpdatedAt,
+					}
+					if update.perm.UserIDs != nil {
+						tmp.UserIDs = update.perm.UserIDs.Clone()
+					}
+					if err := s.SetRepoPendingPermissions(ctx, update.accounts, tmp); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				bindIDs, err := s.ListPendingUsers(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				equal(t, "bindIDs", test.expectPendingUsers, bindIDs)
+			})
+		}
+	}
+}
+
+func testPermsStore_CountPendingUsers(db *sql.DB) func(*testing.T) {
+	type update struct {
+		accounts *extsvc.ExternalAccounts
+		perm     *authz.RepoPermissions
+	}
+	tests := []struct {
+		name                string
+		updates             []update
+		expectCount         int
+		expectCountsForRepo map[int32]int
 	}{
 		{
-			name:               "no user with pending permissions",
-			expectPendingUsers: nil,
+			name:                "no user with pending permissions",
+			expectCount:         0,
+			expectCountsForRepo: map[int32]int{1: 0},
 		},
 		{
-			name: "has user with pending permissions",
+			name: "has users with pending permissions",
 			updates: []update{
 				{
 					accounts: &extsvc.ExternalAccounts{
 						ServiceType: "sourcegraph",
 						ServiceID:   "https://sourcegraph.com/",
-						AccountIDs:  []string{"alice"},
+						AccountIDs:  []string{"alice", "bob"},
 					},
 					perm: &authz.RepoPermissions{
 						RepoID: 1,
 						Perm:   authz.Read,
 					},
+				}, {
+					accounts: &extsvc.ExternalAccounts{
+						ServiceType: "sourcegraph",
+						ServiceID:   "https://sourcegraph.com/",
+						AccountIDs:  []string{"alice"},
+					},
+					perm: &authz.RepoPermissions{
+						RepoID: 2,
+						Perm:   authz.Read,
+					},
 				},
 			},
-			expectPendingUsers: []string{"alice"},
+			expectCount:         2,
+			expectCountsForRepo: map[int32]int{1: 2, 2: 1, 3: 0},
 		},
 		{
 			name: "has user but with empty object_ids",
@@ -1032,7 +2298,8 @@ func testPermsStore_ListPendingUsers(db *sql.DB) func(*testing.T) {
 					},
 				},
 			},
-			expectPendingUsers: nil,
+			expectCount:         0,
+			expectCountsForRepo: map[int32]int{1: 0},
 		},
 	}
 	return func(t *testing.T) {
@@ -1044,26 +2311,73 @@ func testPermsStore_ListPendingUsers(db *sql.DB) func(*testing.T) {
 				ctx := context.Background()
 
 				for _, update := range test.updates {
-					tmp := &authz.RepoPermissions{
-						RepoID:    update.perm.RepoID,
-						Perm:      update.perm.Perm,
-						UpdatedAt: update.perm.UpdatedAt,
-					}
-					if update.perm.UserIDs != nil {
-						tmp.UserIDs = update.perm.UserIDs.Clone()
-					}
-					if err := s.SetRepoPendingPermissions(ctx, update.accounts, tmp); err != nil {
+					if err := s.SetRepoPendingPermissions(ctx, update.accounts, update.perm); err != nil {
 						t.Fatal(err)
 					}
 				}
 
+				count, err := s.CountPendingUsers(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				equal(t, "count", test.expectCount, count)
+
 				bindIDs, err := s.ListPendingUsers(ctx)
 				if err != nil {
 					t.Fatal(err)
 				}
-				equal(t, "bindIDs", test.expectPendingUsers, bindIDs)
+				equal(t, "len(bindIDs)", len(bindIDs), count)
+
+				for repoID, expect := range test.expectCountsForRepo {
+					count, err := s.CountPendingUsersForRepo(ctx, repoID)
+					if err != nil {
+						t.Fatal(err)
+					}
+					equal(t, fmt.Sprintf("count for repo %d", repoID), expect, count)
+				}
 			})
 		}
+
+		t.Run("zero-length and large object_ids", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupPermsTables(t, s)
+
+			ctx := context.Background()
+
+			large := roaring.NewBitmap()
+			large.AddRange(1, 100000)
+			q, err := upsertUserPendingPermissionsBatchQuery(&authz.UserPendingPermissions{
+				ServiceType: "sourcegraph",
+				ServiceID:   "https://sourcegraph.com/",
+				BindID:      "alice",
+				Perm:        authz.Read,
+				Type:        authz.PermRepos,
+				IDs:         large,
+				UpdatedAt:   clock(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = s.execute(ctx, q); err != nil {
+				t.Fatal(err)
+			}
+
+			// Rows may have been written with zero-length object_ids by earlier versions.
+			if err = s.execute(ctx, sqlf.Sprintf(`
+INSERT INTO user_pending_permissions
+  (service_type, service_id, bind_id, permission, object_type, object_ids, updated_at)
+VALUES
+  ('sourcegraph', 'https://sourcegraph.com/', 'bob', 'read', 'repos', '', NOW())
+`)); err != nil {
+				t.Fatal(err)
+			}
+
+			count, err := s.CountPendingUsers(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "count", 1, count)
+		})
 	}
 }
 
@@ -1373,6 +2687,136 @@ func testPermsStore_GrantPendingPermissions(db *sql.DB) func(*testing.T) {
 	}
 }
 
+func testPermsStore_ReconcilePendingForNewUser(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+
+		t.Run("union matching pending permissions to same user with different emails", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupPermsTables(t, s)
+
+			for _, p := range []*authz.RepoPermissions{
+				{RepoID: 1, Perm: authz.Read, UserIDs: toBitmap(1)},
+				{RepoID: 2, Perm: authz.Read, UserIDs: toBitmap(1, 2)},
+			} {
+				if err := s.SetRepoPermissions(ctx, p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for repoID, email := range map[int32]string{1: "alice@example.com", 2: "alice2@example.com"} {
+				accounts := &extsvc.ExternalAccounts{
+					ServiceType: "sourcegraph",
+					ServiceID:   "https://sourcegraph.com/",
+					AccountIDs:  []string{email},
+				}
+				if err := s.SetRepoPendingPermissions(ctx, accounts, &authz.RepoPermissions{
+					RepoID: repoID,
+					Perm:   authz.Read,
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			repoIDs, err := s.ReconcilePendingForNewUser(ctx, 3, &extsvc.ExternalAccounts{
+				ServiceType: "sourcegraph",
+				ServiceID:   "https://sourcegraph.com/",
+				AccountIDs:  []string{"alice@example.com", "alice2@example.com", "alice3@example.com"},
+			}, authz.Read)
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "repoIDs", []uint32{1, 2}, bitmapToArray(repoIDs))
+
+			err = checkRegularPermsTable(s, `SELECT user_id, object_ids FROM user_permissions`, map[int32][]uint32{
+				1: {1, 2},
+				2: {2},
+				3: {1, 2},
+			})
+			if err != nil {
+				t.Fatal("user_permissions:", err)
+			}
+
+			err = checkRegularPermsTable(s, `SELECT repo_id, user_ids FROM repo_permissions`, map[int32][]uint32{
+				1: {1, 3},
+				2: {1, 2, 3},
+			})
+			if err != nil {
+				t.Fatal("repo_permissions:", err)
+			}
+
+			bindIDs, err := checkUserPendingPermsTable(ctx, s, map[string][]uint32{})
+			if err != nil {
+				t.Fatal("user_pending_permissions:", err)
+			}
+			err = checkRepoPendingPermsTable(ctx, s, bindIDs, map[int32][]string{
+				1: {},
+				2: {},
+			})
+			if err != nil {
+				t.Fatal("repo_pending_permissions:", err)
+			}
+		})
+
+		t.Run("skip accounts of other users", func(t *testing.T) {
+			s := NewPermsStore(db, clock)
+			defer cleanupUsersTable(t, s)
+			defer cleanupPermsTables(t, s)
+
+			qs := []*sqlf.Query{
+				sqlf.Sprintf(`INSERT INTO users(username) VALUES('alice')`), // ID=1
+				sqlf.Sprintf(`INSERT INTO users(username) VALUES('bob')`),   // ID=2
+				sqlf.Sprintf(`
+INSERT INTO user_external_accounts(user_id, service_type, service_id, account_id, client_id, created_at, updated_at)
+	VALUES(%s, %s, %s, %s, %s, %s, %s)
+`, 2, "gitlab", "https://gitlab.com/", "bob_gitlab", "bob_gitlab_client_id", clock(), clock()),
+			}
+			for _, q := range qs {
+				if err := s.execute(ctx, q); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			accounts := &extsvc.ExternalAccounts{
+				ServiceType: "gitlab",
+				ServiceID:   "https://gitlab.com/",
+				AccountIDs:  []string{"alice_gitlab", "bob_gitlab"},
+			}
+			if err := s.SetRepoPendingPermissions(ctx, accounts, &authz.RepoPermissions{
+				RepoID: 1,
+				Perm:   authz.Read,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			repoIDs, err := s.ReconcilePendingForNewUser(ctx, 1, accounts, authz.Read)
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "repoIDs", []uint32{1}, bitmapToArray(repoIDs))
+
+			// The pending permissions of "bob_gitlab" are not granted to alice.
+			up := &authz.UserPendingPermissions{
+				ServiceType: "gitlab",
+				ServiceID:   "https://gitlab.com/",
+				BindID:      "bob_gitlab",
+				Perm:        authz.Read,
+				Type:        authz.PermRepos,
+			}
+			if err := s.LoadUserPendingPermissions(ctx, up); err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "bob_gitlab IDs", []uint32{1}, bitmapToArray(up.IDs))
+
+			err = checkRegularPermsTable(s, `SELECT user_id, object_ids FROM user_permissions`, map[int32][]uint32{
+				1: {1},
+			})
+			if err != nil {
+				t.Fatal("user_permissions:", err)
+			}
+		})
+	}
+}
+
 func testPermsStore_DeleteAllUserPermissions(db *sql.DB) func(*testing.T) {
 	return func(t *testing.T) {
 		s := NewPermsStore(db, clock)
@@ -1425,6 +2869,57 @@ func testPermsStore_DeleteAllUserPermissions(db *sql.DB) func(*testing.T) {
 	}
 }
 
+func testPermsStore_DeleteAllUserPermissionsBatch(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		s := NewPermsStore(db, clock)
+		defer cleanupPermsTables(t, s)
+
+		ctx := context.Background()
+
+		// Set permissions for user 1, 2, 3 and 4
+		for repoID, userIDs := range map[int32][]uint32{
+			1: {1, 2, 3},
+			2: {1, 2, 4},
+			3: {2},
+			4: {3, 4},
+		} {
+			if err := s.SetRepoPermissions(ctx, &authz.RepoPermissions{
+				RepoID:  repoID,
+				Perm:    authz.Read,
+				UserIDs: toBitmap(userIDs...),
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Remove all permissions for the user=1 and user=2, and of user=5 without any permissions
+		if err := s.DeleteAllUserPermissionsBatch(ctx, []int32{1, 2, 5}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Check user=1 and user=2 should not have any permissions now, and user=3 and user=4
+		// should not be affected
+		err := checkRegularPermsTable(s, `SELECT user_id, object_ids FROM user_permissions`, map[int32][]uint32{
+			3: {1, 4},
+			4: {2, 4},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Check user=1 and user=2 should be removed from all repositories
+		err = checkRegularPermsTable(s, `SELECT repo_id, user_ids FROM repo_permissions`, map[int32][]uint32{
+			1: {3},
+			2: {4},
+			3: {},
+			4: {3, 4},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 func testPermsStore_DeleteAllUserPendingPermissions(db *sql.DB) func(*testing.T) {
 	return func(t *testing.T) {
 		s := NewPermsStore(db, clock)
@@ -1446,37 +2941,137 @@ func testPermsStore_DeleteAllUserPendingPermissions(db *sql.DB) func(*testing.T)
 			t.Fatal(err)
 		}
 
-		// Remove all pending permissions for alice
+		// Set pending permissions for alice only on another repository
 		accounts.AccountIDs = []string{"alice"}
-		if err := s.DeleteAllUserPendingPermissions(ctx, accounts); err != nil {
+		if err := s.SetRepoPendingPermissions(ctx, accounts, &authz.RepoPermissions{
+			RepoID: 2,
+			Perm:   authz.Read,
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Remove all pending permissions for alice
+		repoIDs, err := s.DeleteAllUserPendingPermissions(ctx, accounts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "repoIDs", []uint32{1, 2}, bitmapToArray(repoIDs))
+
+		// Check alice should not have any pending permissions now
+		err = s.LoadUserPendingPermissions(ctx, &authz.UserPendingPermissions{
+			ServiceType: "sourcegraph",
+			ServiceID:   "https://sourcegraph.com/",
+			BindID:      "alice",
+			Perm:        authz.Read,
+			Type:        authz.PermRepos,
+		})
+		if err != authz.ErrPermsNotFound {
+			t.Fatalf("err: want %q but got %v", authz.ErrPermsNotFound, err)
+		}
+
+		// Check bob shoud not be affected
+		p := &authz.UserPendingPermissions{
+			ServiceType: "sourcegraph",
+			ServiceID:   "https://sourcegraph.com/",
+			BindID:      "bob",
+			Perm:        authz.Read,
+			Type:        authz.PermRepos,
+		}
+		err = s.LoadUserPendingPermissions(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "p.IDs", []uint32{1}, bitmapToArray(p.IDs))
+	}
+}
+
+func testPermsStore_DeleteAllUserPermissionsAndPending(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		s := NewPermsStore(db, clock)
+		defer cleanupPermsTables(t, s)
+
+		ctx := context.Background()
+
+		// Set real permissions for users 1 and 2
+		if err := s.SetRepoPermissions(ctx, &authz.RepoPermissions{
+			RepoID:  1,
+			Perm:    authz.Read,
+			UserIDs: toBitmap(1, 2),
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Set pending permissions for bind IDs of user 1 on two code hosts, and for bob
+		emails := &extsvc.ExternalAccounts{
+			ServiceType: "sourcegraph",
+			ServiceID:   "https://sourcegraph.com/",
+			AccountIDs:  []string{"alice@example.com", "bob@example.com"},
+		}
+		gitlab := &extsvc.ExternalAccounts{
+			ServiceType: "gitlab",
+			ServiceID:   "https://gitlab.com/",
+			AccountIDs:  []string{"alice_gitlab"},
+		}
+		for repoID, accounts := range map[int32]*extsvc.ExternalAccounts{2: emails, 3: gitlab} {
+			if err := s.SetRepoPendingPermissions(ctx, accounts, &authz.RepoPermissions{
+				RepoID: repoID,
+				Perm:   authz.Read,
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		repoIDs, err := s.DeleteAllUserPermissionsAndPending(ctx, 1, []*extsvc.ExternalAccounts{
+			{
+				ServiceType: "sourcegraph",
+				ServiceID:   "https://sourcegraph.com/",
+				AccountIDs:  []string{"alice@example.com"},
+			},
+			gitlab,
+			{
+				ServiceType: "github",
+				ServiceID:   "https://github.com/",
+			},
+		})
+		if err != nil {
 			t.Fatal(err)
 		}
-
-		// Check alice should not have any pending permissions now
-		err := s.LoadUserPendingPermissions(ctx, &authz.UserPendingPermissions{
-			ServiceType: "sourcegraph",
-			ServiceID:   "https://sourcegraph.com/",
-			BindID:      "alice",
+		equal(t, "repoIDs", []uint32{2, 3}, bitmapToArray(repoIDs))
+
+		// Real permissions of user 1 are gone, those of user 2 remain
+		err = checkRegularPermsTable(s, `SELECT user_id, object_ids FROM user_permissions`, map[int32][]uint32{
+			2: {1},
+		})
+		if err != nil {
+			t.Fatal("user_permissions:", err)
+		}
+
+		// Pending permissions of user 1 are gone, those of bob remain
+		for bindID, want := range map[string]error{
+			"alice@example.com": authz.ErrPermsNotFound,
+			"bob@example.com":   nil,
+		} {
+			err := s.LoadUserPendingPermissions(ctx, &authz.UserPendingPermissions{
+				ServiceType: "sourcegraph",
+				ServiceID:   "https://sourcegraph.com/",
+				BindID:      bindID,
+				Perm:        authz.Read,
+				Type:        authz.PermRepos,
+			})
+			if err != want {
+				t.Fatalf("%s: want error %v but got %v", bindID, want, err)
+			}
+		}
+		err = s.LoadUserPendingPermissions(ctx, &authz.UserPendingPermissions{
+			ServiceType: "gitlab",
+			ServiceID:   "https://gitlab.com/",
+			BindID:      "alice_gitlab",
 			Perm:        authz.Read,
 			Type:        authz.PermRepos,
 		})
 		if err != authz.ErrPermsNotFound {
-			t.Fatalf("err: want %q but got %v", authz.ErrPermsNotFound, err)
-		}
-
-		// Check bob shoud not be affected
-		p := &authz.UserPendingPermissions{
-			ServiceType: "sourcegraph",
-			ServiceID:   "https://sourcegraph.com/",
-			BindID:      "bob",
-			Perm:        authz.Read,
-			Type:        authz.PermRepos,
-		}
-		err = s.LoadUserPendingPermissions(ctx, p)
-		if err != nil {
-			t.Fatal(err)
+			t.Fatalf("alice_gitlab: want error %v but got %v", authz.ErrPermsNotFound, err)
 		}
-		equal(t, "p.IDs", []uint32{1}, bitmapToArray(p.IDs))
 	}
 }
 
@@ -1574,6 +3169,63 @@ func testPermsStore_DatabaseDeadlocks(db *sql.DB) func(*testing.T) {
 	}
 }
 
+func testPermsStore_SetRepoPendingPermissionsSharedBindID(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		s := NewPermsStore(db, time.Now).WithIsolationLevel(sql.LevelReadCommitted)
+		defer cleanupPermsTables(t, s)
+
+		ctx := context.Background()
+
+		// setRepoPendingPermissions alternately adds and removes "alice" from the pending
+		// permissions of the repository, so every call rewrites the row of "alice".
+		setRepoPendingPermissions := func(repoID int32, add bool) error {
+			accounts := &extsvc.ExternalAccounts{
+				ServiceType: "sourcegraph",
+				ServiceID:   "https://sourcegraph.com/",
+			}
+			if add {
+				accounts.AccountIDs = []string{"alice"}
+			}
+			return s.SetRepoPendingPermissions(ctx, accounts, &authz.RepoPermissions{
+				RepoID: repoID,
+				Perm:   authz.Read,
+			})
+		}
+
+		const numOps = 50
+		var wg sync.WaitGroup
+		for _, repoID := range []int32{1, 2} {
+			wg.Add(1)
+			go func(repoID int32) {
+				defer wg.Done()
+				// The last operation adds "alice" because numOps is even.
+				for i := 1; i <= numOps; i++ {
+					if err := setRepoPendingPermissions(repoID, i%2 == 0); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}(repoID)
+		}
+		wg.Wait()
+		if t.Failed() {
+			return
+		}
+
+		up := &authz.UserPendingPermissions{
+			ServiceType: "sourcegraph",
+			ServiceID:   "https://sourcegraph.com/",
+			BindID:      "alice",
+			Perm:        authz.Read,
+			Type:        authz.PermRepos,
+		}
+		if err := s.LoadUserPendingPermissions(ctx, up); err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "IDs", []uint32{1, 2}, bitmapToArray(up.IDs))
+	}
+}
+
 func cleanupUsersTable(t *testing.T, s *PermsStore) {
 	if t.Failed() {
 		return
@@ -1585,6 +3237,17 @@ func cleanupUsersTable(t *testing.T, s *PermsStore) {
 	}
 }
 
+func cleanupReposTable(t *testing.T, s *PermsStore) {
+	if t.Failed() {
+		return
+	}
+
+	q := `TRUNCATE TABLE repo RESTART IDENTITY CASCADE;`
+	if err := s.execute(context.Background(), sqlf.Sprintf(q)); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func testPermsStore_ListExternalAccounts(db *sql.DB) func(*testing.T) {
 	return func(t *testing.T) {
 		s := NewPermsStore(db, time.Now)
@@ -1726,3 +3389,320 @@ INSERT INTO user_external_accounts(user_id, service_type, service_id, account_id
 		}
 	}
 }
+
+func testPermsStore_GetExternalAccountsByAccountIDs(db *sql.DB) func(t *testing.T) {
+	return func(t *testing.T) {
+		s := NewPermsStore(db, time.Now)
+		defer cleanupUsersTable(t, s)
+
+		ctx := context.Background()
+
+		// Set up test users and external accounts
+		extSQL := `
+INSERT INTO user_external_accounts(user_id, service_type, service_id, account_id, client_id, created_at, updated_at)
+	VALUES(%s, %s, %s, %s, %s, %s, %s)
+`
+		qs := []*sqlf.Query{
+			sqlf.Sprintf(`INSERT INTO users(username) VALUES('alice')`), // ID=1
+			sqlf.Sprintf(`INSERT INTO users(username) VALUES('bob')`),   // ID=2
+
+			sqlf.Sprintf(extSQL, 1, "gitlab", "https://gitlab.com/", "alice_gitlab", "alice_gitlab_client_id", clock(), clock()), // ID=1
+			sqlf.Sprintf(extSQL, 1, "github", "https://github.com/", "alice_github", "alice_github_client_id", clock(), clock()), // ID=2
+			sqlf.Sprintf(extSQL, 2, "gitlab", "https://gitlab.com/", "bob_gitlab", "bob_gitlab_client_id", clock(), clock()),     // ID=3
+		}
+		for _, q := range qs {
+			if err := s.execute(ctx, q); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		accounts, err := s.GetExternalAccountsByAccountIDs(ctx, &extsvc.ExternalAccounts{
+			ServiceType: "gitlab",
+			ServiceID:   "https://gitlab.com/",
+			AccountIDs:  []string{"alice_gitlab", "bob_gitlab", "alice_github", "david_gitlab"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expAccounts := map[string]*extsvc.ExternalAccount{
+			"alice_gitlab": {
+				ID:     1,
+				UserID: 1,
+				ExternalAccountSpec: extsvc.ExternalAccountSpec{
+					ServiceType: "gitlab",
+					ServiceID:   "https://gitlab.com/",
+					AccountID:   "alice_gitlab",
+					ClientID:    "alice_gitlab_client_id",
+				},
+				CreatedAt: clock(),
+				UpdatedAt: clock(),
+			},
+			"bob_gitlab": {
+				ID:     3,
+				UserID: 2,
+				ExternalAccountSpec: extsvc.ExternalAccountSpec{
+					ServiceType: "gitlab",
+					ServiceID:   "https://gitlab.com/",
+					AccountID:   "bob_gitlab",
+					ClientID:    "bob_gitlab_client_id",
+				},
+				CreatedAt: clock(),
+				UpdatedAt: clock(),
+			},
+		}
+		if diff := cmp.Diff(expAccounts, accounts); diff != "" {
+			t.Fatalf(diff)
+		}
+
+		// No account IDs resolve to no external accounts.
+		accounts, err = s.GetExternalAccountsByAccountIDs(ctx, &extsvc.ExternalAccounts{
+			ServiceType: "gitlab",
+			ServiceID:   "https://gitlab.com/",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "accounts", 0, len(accounts))
+	}
+}
+
+func testPermsStore_GetUserIDsByExternalAccountsSourcegraph(db *sql.DB) func(t *testing.T) {
+	return func(t *testing.T) {
+		s := NewPermsStore(db, time.Now)
+		defer cleanupUsersTable(t, s)
+
+		ctx := context.Background()
+
+		emailSQL := `INSERT INTO user_emails(user_id, email, verified_at) VALUES(%s, %s, %s)`
+		qs := []*sqlf.Query{
+			sqlf.Sprintf(`INSERT INTO users(username) VALUES('alice')`),                    // ID=1
+			sqlf.Sprintf(`INSERT INTO users(username) VALUES('bob')`),                      // ID=2
+			sqlf.Sprintf(`INSERT INTO users(username) VALUES('cindy')`),                    // ID=3
+			sqlf.Sprintf(`INSERT INTO users(username, deleted_at) VALUES('david', NOW())`), // ID=4
+			sqlf.Sprintf(`INSERT INTO users(username) VALUES('erin')`),                     // ID=5
+
+			sqlf.Sprintf(emailSQL, 2, "bob@example.com", clock()),
+			// Unverified email addresses and those of deleted users must not be matched.
+			sqlf.Sprintf(emailSQL, 3, "cindy@example.com", nil),
+			sqlf.Sprintf(emailSQL, 4, "david@example.com", clock()),
+
+			// An external account of another service with the same account ID must not be matched.
+			sqlf.Sprintf(`
+INSERT INTO user_external_accounts(user_id, service_type, service_id, account_id, client_id, created_at, updated_at)
+	VALUES(%s, %s, %s, %s, %s, %s, %s)
+`, 5, "gitlab", "https://gitlab.com/", "frank", "frank_gitlab_client_id", clock(), clock()),
+		}
+		for _, q := range qs {
+			if err := s.execute(ctx, q); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		userIDs, err := s.GetUserIDsByExternalAccounts(ctx, &extsvc.ExternalAccounts{
+			ServiceType: "sourcegraph",
+			ServiceID:   "https://sourcegraph.com/",
+			AccountIDs: []string{
+				"Alice", "bob@example.com", "bob", "cindy@example.com",
+				"david", "david@example.com", "frank", "erin@example.com",
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "userIDs", map[string]int32{
+			"Alice":           1,
+			"bob@example.com": 2,
+			"bob":             2,
+		}, userIDs)
+	}
+}
+
+func testPermsStore_PruneOrphanExternalAccounts(db *sql.DB) func(t *testing.T) {
+	return func(t *testing.T) {
+		s := NewPermsStore(db, time.Now)
+		defer cleanupUsersTable(t, s)
+
+		ctx := context.Background()
+
+		extSQL := `
+INSERT INTO user_external_accounts(user_id, service_type, service_id, account_id, client_id, created_at, updated_at)
+	VALUES(%s, %s, %s, %s, %s, %s, %s)
+`
+		qs := []*sqlf.Query{
+			sqlf.Sprintf(`INSERT INTO users(username) VALUES('alice')`), // ID=1
+
+			sqlf.Sprintf(extSQL, 1, "gitlab", "https://gitlab.com/", "alice_gitlab", "alice_gitlab_client_id", clock(), clock()), // ID=1
+		}
+		for _, q := range qs {
+			if err := s.execute(ctx, q); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The foreign key constraint on user_id prevents orphan rows from being created
+		// in the first place, so bypass it to simulate a hard-deleted user.
+		txs, err := s.Transact(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		qs = []*sqlf.Query{
+			sqlf.Sprintf(`SET LOCAL session_replication_role = replica`),
+			sqlf.Sprintf(extSQL, 2, "gitlab", "https://gitlab.com/", "bob_gitlab", "bob_gitlab_client_id", clock(), clock()), // ID=2
+		}
+		for _, q := range qs {
+			if err = txs.execute(ctx, q); err != nil {
+				break
+			}
+		}
+		txs.Done(&err)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		count, err := s.PruneOrphanExternalAccounts(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "count", 1, count)
+
+		userIDs, err := s.GetUserIDsByExternalAccounts(ctx, &extsvc.ExternalAccounts{
+			ServiceType: "gitlab",
+			ServiceID:   "https://gitlab.com/",
+			AccountIDs:  []string{"alice_gitlab", "bob_gitlab"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		equal(t, "userIDs", map[string]int32{"alice_gitlab": 1}, userIDs)
+	}
+}
+
+func testPermsStore_GetUserIDsByExternalAccountsBatch(db *sql.DB) func(t *testing.T) {
+	return func(t *testing.T) {
+		s := NewPermsStore(db, time.Now)
+		defer cleanupUsersTable(t, s)
+
+		ctx := context.Background()
+
+		// Set up test users and external accounts
+		extSQL := `
+INSERT INTO user_external_accounts(user_id, service_type, service_id, account_id, client_id, created_at, updated_at)
+	VALUES(%s, %s, %s, %s, %s, %s, %s)
+`
+		qs := []*sqlf.Query{
+			sqlf.Sprintf(`INSERT INTO users(username) VALUES('alice')`), // ID=1
+			sqlf.Sprintf(`INSERT INTO users(username) VALUES('bob')`),   // ID=2
+
+			sqlf.Sprintf(extSQL, 1, "gitlab", "https://gitlab.com/", "alice_gitlab", "alice_gitlab_client_id", clock(), clock()), // ID=1
+			sqlf.Sprintf(extSQL, 1, "github", "https://github.com/", "alice_github", "alice_github_client_id", clock(), clock()), // ID=2
+			sqlf.Sprintf(extSQL, 2, "github", "https://github.com/", "bob_github", "bob_github_client_id", clock(), clock()),     // ID=3
+		}
+		for _, q := range qs {
+			if err := s.execute(ctx, q); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		userIDs, err := s.GetUserIDsByExternalAccountsBatch(ctx, []*extsvc.ExternalAccounts{
+			{
+				ServiceType: "gitlab",
+				ServiceID:   "https://gitlab.com/",
+				AccountIDs:  []string{"alice_gitlab", "bob_github"},
+			}, {
+				ServiceType: "github",
+				ServiceID:   "https://github.com/",
+				AccountIDs:  []string{"alice_github", "bob_github", "david_github"},
+			}, {
+				ServiceType: "sourcegraph",
+				ServiceID:   "https://sourcegraph.com/",
+				AccountIDs:  []string{"bob", "david"},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expUserIDs := map[ExternalAccountKey]int32{
+			{ServiceType: "gitlab", ServiceID: "https://gitlab.com/", AccountID: "alice_gitlab"}:  1,
+			{ServiceType: "github", ServiceID: "https://github.com/", AccountID: "alice_github"}:  1,
+			{ServiceType: "github", ServiceID: "https://github.com/", AccountID: "bob_github"}:    2,
+			{ServiceType: "sourcegraph", ServiceID: "https://sourcegraph.com/", AccountID: "bob"}: 2,
+		}
+		equal(t, "userIDs", expUserIDs, userIDs)
+	}
+}
+
+func testPermsStore_QueriesUseIndexes(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		ctx := context.Background()
+		s := NewPermsStore(db, clock)
+		defer cleanupPermsTables(t, s)
+
+		// Store rows of several permissions, so that a query has to filter by permission.
+		expiredAt := clock().Add(time.Hour)
+		for _, perm := range []authz.Perms{authz.Read, authz.Write} {
+			for userID := int32(1); userID <= 10; userID++ {
+				if err := s.SetUserPermissionsWithExpiry(ctx, &authz.UserPermissions{
+					UserID: userID,
+					Perm:   perm,
+					Type:   authz.PermRepos,
+					IDs:    toBitmap(1, 2, 3),
+				}, map[int32]time.Time{1: expiredAt}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		up := &authz.UserPermissions{UserID: 1, Perm: authz.Write, Type: authz.PermRepos}
+		rp := &authz.RepoPermissions{RepoID: 1, Perm: authz.Write}
+		tests := []struct {
+			name  string
+			q     *sqlf.Query
+			index string
+		}{
+			{"loadUserPermissionsQuery", loadUserPermissionsQuery(up, ""), "user_permissions_perm_object_unique"},
+			{"loadUserPermissionsBatchQuery", loadUserPermissionsBatchQuery([]uint32{1, 2}, authz.Write, authz.PermRepos, ""), "user_permissions_perm_object_unique"},
+			{"loadRepoPermissionsQuery", loadRepoPermissionsQuery(rp, ""), "repo_permissions_perm_unique"},
+			{"loadRepoPermissionsBatchQuery", loadRepoPermissionsBatchQuery([]uint32{1, 2}, authz.Write, ""), "repo_permissions_perm_unique"},
+			{"loadUnexpiredUserPermissionsQuery", loadUnexpiredUserPermissionsQuery(up, clock()), "user_permissions_expiries_perm_object_unique"},
+			{"loadUnexpiredRepoPermissionsQuery", loadUnexpiredRepoPermissionsQuery(rp, clock()), "user_permissions_expiries_object_perm_idx"},
+			{"loadUserPermissionsForUpdateQuery", loadUserPermissionsForUpdateQuery(up), "user_permissions_expiries_perm_object_unique"},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				tx, err := db.BeginTx(ctx, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer func() { _ = tx.Rollback() }()
+
+				// Tables of a few rows are scanned sequentially regardless of indexes, unless
+				// the planner is told to avoid that wherever an index can be used instead.
+				if _, err = tx.ExecContext(ctx, `SET LOCAL enable_seqscan = off`); err != nil {
+					t.Fatal(err)
+				}
+				rows, err := tx.QueryContext(ctx, "EXPLAIN "+test.q.Query(sqlf.PostgresBindVar), test.q.Args()...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer rows.Close()
+
+				var plan bytes.Buffer
+				for rows.Next() {
+					var line string
+					if err = rows.Scan(&line); err != nil {
+						t.Fatal(err)
+					}
+					plan.WriteString(line + "\n")
+				}
+				if err = rows.Err(); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Contains(plan.Bytes(), []byte(test.index)) {
+					t.Fatalf("want plan using index %q but got:\n%s", test.index, plan.String())
+				}
+			})
+		}
+	}
+}
@@ -24,6 +24,7 @@ func TestIntegration(t *testing.T) {
 		test func(*testing.T)
 	}{
 		{"Store", testStore(db)},
+		{"Store/CompressedPermissions", testStoreCompressedPermissions(db)},
 		{"Provider/RepoPerms", testProviderRepoPerms(db)},
 	} {
 		t.Run(tc.name, tc.test)
@@ -13,6 +13,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/segmentio/fasthash/fnv1"
 	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+	"github.com/sourcegraph/sourcegraph/enterprise/cmd/frontend/internal/authz/permsbitmap"
 	"github.com/sourcegraph/sourcegraph/internal/db/dbutil"
 	"github.com/sourcegraph/sourcegraph/internal/extsvc"
 	"github.com/sourcegraph/sourcegraph/internal/trace"
@@ -240,7 +241,7 @@ func (s *store) load(ctx context.Context, p *authz.UserPermissions) (err error)
 		return nil
 	}
 
-	return p.IDs.UnmarshalBinary(ids)
+	return permsbitmap.Unmarshal(p.IDs, ids)
 }
 
 func loadRepoIDsQuery(c *extsvc.CodeHost, externalIDs []uint32) (*sqlf.Query, error) {
@@ -430,7 +431,7 @@ func (s *store) upsert(ctx context.Context, p *authz.UserPermissions) (err error
 }
 
 func (s *store) upsertQuery(p *authz.UserPermissions) (*sqlf.Query, error) {
-	ids, err := p.IDs.ToBytes()
+	ids, err := permsbitmap.Marshal(p.IDs)
 	if err != nil {
 		return nil, err
 	}
@@ -12,8 +12,10 @@ import (
 
 	"github.com/RoaringBitmap/roaring"
 	"github.com/google/go-cmp/cmp"
+	"github.com/keegancsmith/sqlf"
 	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
 	"github.com/sourcegraph/sourcegraph/cmd/repo-updater/repos"
+	"github.com/sourcegraph/sourcegraph/enterprise/cmd/frontend/internal/authz/permsbitmap"
 	"github.com/sourcegraph/sourcegraph/internal/api"
 	"github.com/sourcegraph/sourcegraph/internal/db/dbtest"
 	"github.com/sourcegraph/sourcegraph/internal/extsvc"
@@ -261,3 +263,47 @@ func testStore(db *sql.DB) func(*testing.T) {
 		}
 	}
 }
+
+func testStoreCompressedPermissions(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		old := permsbitmap.Compress
+		permsbitmap.Compress = true
+		defer func() { permsbitmap.Compress = old }()
+
+		ctx := context.Background()
+		s := newStore(db, time.Hour, DefaultHardTTL, clock)
+
+		// Enough IDs for the serialized bitmap to exceed permsbitmap.CompressThreshold.
+		ids := roaring.NewBitmap()
+		for i := uint32(0); i < 300000; i++ {
+			ids.Add(i * 7)
+		}
+		want := &authz.UserPermissions{
+			UserID:    43,
+			Perm:      authz.Read,
+			Type:      "repos",
+			IDs:       ids,
+			UpdatedAt: clock(),
+		}
+		if err := s.upsert(ctx, want); err != nil {
+			t.Fatal(err)
+		}
+
+		var data []byte
+		q := loadQuery(want)
+		if err := db.QueryRowContext(ctx, q.Query(sqlf.PostgresBindVar), q.Args()...).Scan(&data, new(time.Time)); err != nil {
+			t.Fatal(err)
+		}
+		if !permsbitmap.IsCompressed(data) {
+			t.Fatal("stored permissions are not compressed")
+		}
+
+		have := &authz.UserPermissions{UserID: 43, Perm: authz.Read, Type: "repos"}
+		if err := s.load(ctx, have); err != nil {
+			t.Fatal(err)
+		}
+		if !have.IDs.Equals(ids) {
+			t.Fatalf("loaded %d IDs, want %d", have.IDs.GetCardinality(), ids.GetCardinality())
+		}
+	}
+}
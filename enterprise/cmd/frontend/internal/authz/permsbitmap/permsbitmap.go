@@ -0,0 +1,76 @@
+// Package permsbitmap implements the serialization of the bitmaps of IDs stored in the
+// permissions tables, e.g. the "object_ids" column of the "user_permissions" table. Every
+// reader and writer of these columns must use it, so that they agree on the format.
+package permsbitmap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strconv"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/sourcegraph/sourcegraph/internal/env"
+)
+
+// Compress is true if Marshal compresses large bitmaps. It must only be enabled once every
+// running binary reads compressed bitmaps with Unmarshal, because earlier binaries fail to decode
+// them, e.g. during a rolling deploy.
+var Compress, _ = strconv.ParseBool(env.Get("PERMISSIONS_BITMAP_COMPRESSION", "false", "Compress permission bitmaps larger than 64 KiB when storing them. Only enable once all instances read compressed bitmaps."))
+
+// CompressThreshold is the size in bytes above which serialized bitmaps are compressed with
+// gzip before being stored, if Compress is true. Bitmaps of users with access to hundreds of
+// thousands of repositories take megabytes, which PostgreSQL would otherwise store out of line
+// uncompressed because the roaring format is rarely compressible enough for its own TOAST
+// compression. Compression roughly halves such blobs at the cost of a few milliseconds of
+// decompression per read (see BenchmarkUnmarshal), which is why small blobs are not compressed.
+const CompressThreshold = 64 * 1024
+
+// gzipMagic is the header of gzip data, which never begins a bitmap in the roaring format.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Marshal serializes bm in a canonical form, so that equal sets of IDs always produce
+// identical bytes regardless of how bm was built (e.g. insertion order or removed IDs).
+// Serialized bitmaps larger than CompressThreshold are compressed if Compress is true and that
+// makes them smaller.
+func Marshal(bm *roaring.Bitmap) ([]byte, error) {
+	canonical := roaring.BitmapOf(bm.ToArray()...)
+	canonical.RunOptimize()
+	data, err := canonical.ToBytes()
+	if err != nil || !Compress || len(data) <= CompressThreshold {
+		return data, err
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err = zw.Write(data); err != nil {
+		return nil, err
+	} else if err = zw.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() >= len(data) {
+		return data, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal deserializes data produced by Marshal into bm. Both compressed and uncompressed
+// data are accepted, regardless of Compress.
+func Unmarshal(bm *roaring.Bitmap, data []byte) error {
+	if !IsCompressed(data) {
+		return bm.UnmarshalBinary(data)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	_, err = bm.ReadFrom(zr)
+	return err
+}
+
+// IsCompressed returns true if data is a compressed bitmap.
+func IsCompressed(data []byte) bool {
+	return bytes.HasPrefix(data, gzipMagic)
+}
@@ -0,0 +1,94 @@
+package permsbitmap
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// largeBitmap returns a bitmap of n pseudo-random IDs spread like the repository IDs of a user
+// with access to a large number of repositories.
+func largeBitmap(n int) *roaring.Bitmap {
+	r := rand.New(rand.NewSource(1))
+	bm := roaring.NewBitmap()
+	for bm.GetCardinality() < uint64(n) {
+		bm.Add(uint32(r.Intn(10 * n)))
+	}
+	return bm
+}
+
+// withCompress sets Compress for the duration of a test.
+func withCompress(t testing.TB, compress bool) {
+	old := Compress
+	Compress = compress
+	t.Cleanup(func() { Compress = old })
+}
+
+func TestMarshalCompression(t *testing.T) {
+	small := roaring.BitmapOf(1, 2, 3)
+	large := largeBitmap(300000)
+
+	for _, compress := range []bool{false, true} {
+		withCompress(t, compress)
+		for name, bm := range map[string]*roaring.Bitmap{"small": small, "large": large} {
+			data, err := Marshal(bm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			uncompressed, err := bm.ToBytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantCompressed := compress && len(uncompressed) > CompressThreshold
+			if IsCompressed(data) != wantCompressed {
+				t.Fatalf("%s (compress=%v): want compressed %v", name, compress, wantCompressed)
+			}
+			if IsCompressed(data) && len(data) >= len(uncompressed) {
+				t.Fatalf("%s: compressed size %d is not smaller than %d", name, len(data), len(uncompressed))
+			}
+
+			// Both forms are readable regardless of Compress.
+			for form, data := range map[string][]byte{"stored": data, "uncompressed": uncompressed} {
+				for _, readCompress := range []bool{false, true} {
+					withCompress(t, readCompress)
+					have := roaring.NewBitmap()
+					if err = Unmarshal(have, data); err != nil {
+						t.Fatal(err)
+					}
+					if !reflect.DeepEqual(bm.ToArray(), have.ToArray()) {
+						t.Fatalf("%s %s (compress=%v): IDs differ", name, form, compress)
+					}
+				}
+				withCompress(t, compress)
+			}
+		}
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	withCompress(b, true)
+
+	bm := largeBitmap(300000)
+	uncompressed, err := bm.ToBytes()
+	if err != nil {
+		b.Fatal(err)
+	}
+	compressed, err := Marshal(bm)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{"uncompressed": uncompressed, "compressed": compressed} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportMetric(float64(len(data)), "stored-bytes")
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if err := Unmarshal(roaring.NewBitmap(), data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
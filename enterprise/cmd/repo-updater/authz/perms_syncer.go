@@ -3,6 +3,7 @@ package authz
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/RoaringBitmap/roaring"
@@ -178,6 +179,8 @@ func (s *PermsSyncer) syncUserPerms(ctx context.Context, userID int32) error {
 	}
 
 	var repoSpecs []api.ExternalRepoSpec
+	var providers []string
+	var fetchDuration time.Duration
 	for _, acct := range accts {
 		fetcher := s.fetchers()[acct.ServiceID]
 		if fetcher == nil {
@@ -185,10 +188,13 @@ func (s *PermsSyncer) syncUserPerms(ctx context.Context, userID int32) error {
 			continue
 		}
 
+		began := s.clock()
 		extIDs, err := fetcher.FetchUserPerms(ctx, acct)
 		if err != nil {
 			return errors.Wrap(err, "fetch user permissions")
 		}
+		fetchDuration += s.clock().Sub(began)
+		providers = append(providers, fetcher.ServiceID())
 
 		for i := range extIDs {
 			repoSpecs = append(repoSpecs, api.ExternalRepoSpec{
@@ -217,6 +223,11 @@ func (s *PermsSyncer) syncUserPerms(ctx context.Context, userID int32) error {
 		Perm:   authz.Read, // Note: We currently only support read for repository permissions.
 		Type:   authz.PermRepos,
 		IDs:    roaring.NewBitmap(),
+		Metadata: &authz.SyncMetadata{
+			Job:           "PermsSyncer.syncUserPerms",
+			Provider:      strings.Join(providers, ","),
+			FetchDuration: fetchDuration,
+		},
 	}
 	for i := range rs {
 		p.IDs.Add(uint32(rs[i].ID))
@@ -0,0 +1,65 @@
+// Package builder constructs search query parse trees programmatically, so that
+// callers rewriting queries (e.g. adding a repo filter) don't need to
+// concatenate and reparse query strings. Trees are rendered as queries with
+// search.ToQueryString.
+package builder
+
+import (
+	"github.com/sourcegraph/sourcegraph/internal/search"
+)
+
+// And returns the and-expression of children, as in "a and b". Children that
+// are and-expressions themselves are flattened into it, and a single child is
+// returned as is, like the parser does.
+func And(children ...search.Node) search.Node {
+	return operator(search.Operator{Kind: search.And}, children)
+}
+
+// Or returns the or-expression of children, as in "a or b". Children that are
+// or-expressions themselves are flattened into it, and a single child is
+// returned as is.
+func Or(children ...search.Node) search.Node {
+	return operator(search.Operator{Kind: search.Or}, children)
+}
+
+// Concat returns the ordered concatenation of search patterns, as in "a b".
+// Children that are concatenations themselves are flattened into it, and a
+// single child is returned as is.
+func Concat(children ...search.Node) search.Node {
+	return operator(search.Operator{Kind: search.Concat}, children)
+}
+
+// Not returns the negated group of child, as in "-(a b)".
+func Not(child search.Node) search.Node {
+	return search.Operator{Kind: search.Not, Operands: []search.Node{child}}
+}
+
+// Param returns a parameter with given field and value, as in "repo:foo" or
+// "-repo:foo" if negated. The value is used as it would be scanned by the
+// parser, so characters with a special meaning in queries, such as spaces and
+// parentheses, must be escaped or quoted. An empty field makes a search
+// pattern, which is never negated.
+func Param(field, value string, negated bool) search.Node {
+	return search.Parameter{Field: field, Value: value, Negated: negated && field != ""}
+}
+
+// Pattern returns the search pattern value, as in "foo".
+func Pattern(value string) search.Node {
+	return search.Parameter{Value: value}
+}
+
+// operator returns op with children as its operands, flattening children of
+// the same kind.
+func operator(op search.Operator, children []search.Node) search.Node {
+	if len(children) == 1 {
+		return children[0]
+	}
+	for _, child := range children {
+		if o, ok := child.(search.Operator); ok && o.Kind == op.Kind {
+			op.Operands = append(op.Operands, o.Operands...)
+			continue
+		}
+		op.Operands = append(op.Operands, child)
+	}
+	return op
+}
@@ -0,0 +1,88 @@
+package builder
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sourcegraph/sourcegraph/internal/search"
+)
+
+func TestBuilder(t *testing.T) {
+	cases := []struct {
+		Name       string
+		Node       search.Node
+		Equivalent string
+		Want       string
+	}{
+		{
+			Name:       "Filters and patterns",
+			Node:       And(Param("repo", "foo", false), Param("file", "bar", true), Concat(Pattern("a"), Pattern("b"))),
+			Equivalent: "repo:foo -file:bar a b",
+			Want:       "repo:foo and -file:bar and (a b)",
+		},
+		{
+			Name:       "Injected repo filter",
+			Node:       And(Param("repo", "^github\\.com/foo$", false), Or(Pattern("a"), And(Pattern("b"), Pattern("c")))),
+			Equivalent: `repo:^github\.com/foo$ (a or b and c)`,
+			Want:       `repo:^github\.com/foo$ and (a or (b and c))`,
+		},
+		{
+			Name:       "Nested operators are flattened",
+			Node:       Or(Or(Pattern("a"), Pattern("b")), Pattern("c")),
+			Equivalent: "a or b or c",
+			Want:       "a or b or c",
+		},
+		{
+			Name:       "Single child",
+			Node:       And(Param("lang", "go", false)),
+			Equivalent: "lang:go",
+			Want:       "lang:go",
+		},
+		{
+			Name:       "Negated group",
+			Node:       Or(Not(Concat(Pattern("a"), Pattern("b"))), Pattern("c")),
+			Equivalent: "-(a b) or c",
+			Want:       "-(a b) or c",
+		},
+		{
+			Name:       "Negated pattern is not negated",
+			Node:       Param("", "a", true),
+			Equivalent: "a",
+			Want:       "a",
+		},
+		{
+			Name:       "Pattern with a colon",
+			Node:       And(Param("repo", "foo", false), Pattern("fooo:bar")),
+			Equivalent: `repo:foo fooo\:bar`,
+			Want:       `repo:foo and fooo\:bar`,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			nodes, err := search.Parse(tt.Equivalent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(nodes, []search.Node{tt.Node}); diff != "" {
+				t.Fatal(diff)
+			}
+
+			got := search.ToQueryString([]search.Node{tt.Node})
+			if diff := cmp.Diff(tt.Want, got); diff != "" {
+				t.Error(diff)
+			}
+			if diff := cmp.Diff(nodes[0].String(), tt.Node.String()); diff != "" {
+				t.Error(diff)
+			}
+
+			// The rendered query parses into the built tree.
+			parsed, err := search.Parse(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff([]search.Node{tt.Node}, parsed); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package search
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// QueryEncodingVersion is the version of the encoding produced by EncodeQuery.
+// It changes whenever the encoding changes in a way that DecodeQuery of an
+// earlier version cannot read.
+const QueryEncodingVersion = 1
+
+// encodedQuery is the persisted form of a parse tree. Unlike the String form of
+// nodes, which is meant for debugging, every property of every node is retained,
+// and operators are identified by name rather than by their operatorKind value,
+// so that reordering the operatorKind constants does not change the encoding.
+type encodedQuery struct {
+	Version int           `json:"version"`
+	Nodes   []encodedNode `json:"nodes"`
+}
+
+// encodedNode holds exactly one of its fields.
+type encodedNode struct {
+	Parameter *encodedParameter `json:"parameter,omitempty"`
+	Operator  *encodedOperator  `json:"operator,omitempty"`
+	Constant  *bool             `json:"constant,omitempty"`
+}
+
+// encodedParameter is the persisted form of a Parameter. Revs and Segments are
+// pointers, so that a nil slice is distinct from an empty one.
+type encodedParameter struct {
+	Field         string        `json:"field,omitempty"`
+	Value         string        `json:"value"`
+	Negated       bool          `json:"negated,omitempty"`
+	CaseSensitive bool          `json:"caseSensitive,omitempty"`
+	Prefix        bool          `json:"prefix,omitempty"`
+	Quoted        bool          `json:"quoted,omitempty"`
+	Revs          *[]encodedRev `json:"revs,omitempty"`
+	Segments      *[]Segment    `json:"segments,omitempty"`
+}
+
+type encodedRev struct {
+	RevSpec        string `json:"revSpec,omitempty"`
+	RefGlob        string `json:"refGlob,omitempty"`
+	ExcludeRefGlob string `json:"excludeRefGlob,omitempty"`
+}
+
+type encodedOperator struct {
+	Kind     string        `json:"kind"`
+	Operands []encodedNode `json:"operands"`
+}
+
+var operatorKindNames = map[operatorKind]string{
+	Or:     "or",
+	And:    "and",
+	Concat: "concat",
+	Group:  "group",
+	Not:    "not",
+	Then:   "then",
+}
+
+// EncodeQuery returns the encoding of the parse tree nodes for persistence, as
+// in saved searches, which DecodeQuery decodes into nodes again. The encoding
+// is JSON that records its version (see QueryEncodingVersion) and every
+// property of the nodes, including negation, quoting and groups. Nodes are not
+// canonicalized, but equal nodes always have the same encoding, so that the
+// encoding of a canonical tree may be hashed or indexed.
+func EncodeQuery(nodes []Node) ([]byte, error) {
+	encoded, err := encodeNodes(nodes)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(encodedQuery{Version: QueryEncodingVersion, Nodes: encoded})
+}
+
+func encodeNodes(nodes []Node) ([]encodedNode, error) {
+	if nodes == nil {
+		return nil, nil
+	}
+	encoded := make([]encodedNode, 0, len(nodes))
+	for _, node := range nodes {
+		e, err := encodeNode(node)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, e)
+	}
+	return encoded, nil
+}
+
+func encodeNode(node Node) (encodedNode, error) {
+	switch n := node.(type) {
+	case Parameter:
+		p := &encodedParameter{
+			Field:         n.Field,
+			Value:         n.Value,
+			Negated:       n.Negated,
+			CaseSensitive: n.CaseSensitive,
+			Prefix:        n.Prefix,
+			Quoted:        n.Quoted,
+		}
+		if n.Revs != nil {
+			revs := make([]encodedRev, 0, len(n.Revs))
+			for _, rev := range n.Revs {
+				revs = append(revs, encodedRev(rev))
+			}
+			p.Revs = &revs
+		}
+		if n.Segments != nil {
+			segments := n.Segments
+			p.Segments = &segments
+		}
+		return encodedNode{Parameter: p}, nil
+	case Operator:
+		kind, ok := operatorKindNames[n.Kind]
+		if !ok {
+			return encodedNode{}, fmt.Errorf("unknown operator kind %d", n.Kind)
+		}
+		operands, err := encodeNodes(n.Operands)
+		if err != nil {
+			return encodedNode{}, err
+		}
+		return encodedNode{Operator: &encodedOperator{Kind: kind, Operands: operands}}, nil
+	case Constant:
+		value := n.Value
+		return encodedNode{Constant: &value}, nil
+	}
+	return encodedNode{}, fmt.Errorf("unknown node type %T", node)
+}
+
+// DecodeQuery returns the parse tree encoded by EncodeQuery. It returns an
+// error if data is not a valid encoding, or is of a version other than
+// QueryEncodingVersion.
+func DecodeQuery(data []byte) ([]Node, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var encoded encodedQuery
+	if err := dec.Decode(&encoded); err != nil {
+		return nil, fmt.Errorf("invalid query encoding: %v", err)
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("invalid query encoding: unexpected data after query")
+	}
+	if encoded.Version != QueryEncodingVersion {
+		return nil, fmt.Errorf("unsupported query encoding version %d", encoded.Version)
+	}
+	return decodeNodes(encoded.Nodes)
+}
+
+func decodeNodes(encoded []encodedNode) ([]Node, error) {
+	if encoded == nil {
+		return nil, nil
+	}
+	nodes := make([]Node, 0, len(encoded))
+	for _, e := range encoded {
+		node, err := decodeNode(e)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+func decodeNode(e encodedNode) (Node, error) {
+	switch {
+	case e.Parameter != nil && e.Operator == nil && e.Constant == nil:
+		p := e.Parameter
+		node := Parameter{
+			Field:         p.Field,
+			Value:         p.Value,
+			Negated:       p.Negated,
+			CaseSensitive: p.CaseSensitive,
+			Prefix:        p.Prefix,
+			Quoted:        p.Quoted,
+		}
+		if p.Revs != nil {
+			node.Revs = make([]RevisionSpecifier, 0, len(*p.Revs))
+			for _, rev := range *p.Revs {
+				node.Revs = append(node.Revs, RevisionSpecifier(rev))
+			}
+		}
+		if p.Segments != nil {
+			node.Segments = *p.Segments
+		}
+		return node, nil
+	case e.Operator != nil && e.Parameter == nil && e.Constant == nil:
+		for kind, name := range operatorKindNames {
+			if name == e.Operator.Kind {
+				operands, err := decodeNodes(e.Operator.Operands)
+				if err != nil {
+					return nil, err
+				}
+				return Operator{Kind: kind, Operands: operands}, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid query encoding: unknown operator kind %q", e.Operator.Kind)
+	case e.Constant != nil && e.Parameter == nil && e.Operator == nil:
+		return Constant{Value: *e.Constant}, nil
+	}
+	return nil, fmt.Errorf("invalid query encoding: a node must be exactly one of parameter, operator or constant")
+}
@@ -0,0 +1,192 @@
+package search
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sourcegraph/sourcegraph/internal/search/query"
+)
+
+func Test_EncodeQuery(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Input string
+		Parse func(in string) ([]Node, error) // Parse if nil.
+	}{
+		{Name: "Empty string", Input: ""},
+		{Name: "Single pattern", Input: "a"},
+		{Name: "Empty group", Input: "()"},
+		{Name: "Concat and and", Input: "repo:foo a b"},
+		{Name: "Nested operators", Input: "(a or b) and (c or (d and e))"},
+		{Name: "Negated fields", Input: "-repo:foo -file:(a or b) c"},
+		{Name: "Negated group", Input: "-(a b) c"},
+		{Name: "Empty field value", Input: "repo: a"},
+		{Name: "Escaped and quoted values", Input: `repo:foo\(bar "a b" \ c`},
+		{
+			Name:  "Faithful groups",
+			Input: "((a b)) or (c)",
+			Parse: func(in string) ([]Node, error) { return ParseWithGroupMode(in, GroupFaithful) },
+		},
+		{
+			Name:  "Unquoted values",
+			Input: `"a \"b\"\n" repo:"c d"`,
+			Parse: ParseWithQuoteEscapes,
+		},
+		{
+			Name:  "Constants",
+			Input: "true or (false and a)",
+			Parse: func(in string) ([]Node, error) {
+				return ParseWithConstants(in, map[string]bool{"true": true, "false": false})
+			},
+		},
+		{
+			Name:  "Placeholders",
+			Input: "repo:${ORG}/foo a",
+			Parse: ParseWithPlaceholders,
+		},
+		{
+			Name:  "Separator",
+			Input: "a ; b or c",
+			Parse: func(in string) ([]Node, error) { return ParseWithSeparator(in, ";") },
+		},
+		{
+			Name:  "Structural holes",
+			Input: "foo(:[x]) bar",
+			Parse: func(in string) ([]Node, error) { return ParseWithSearchType(in, query.SearchTypeStructural) },
+		},
+		{
+			Name:  "Revisions and case sensitivity",
+			Input: "repo:foo@a:*refs/heads/:*!refs/heads/x repo:bar@ case:yes a",
+			Parse: func(in string) ([]Node, error) {
+				plan, err := ParsePlan(in, nil)
+				if err != nil {
+					return nil, err
+				}
+				return plan.Nodes, nil
+			},
+		},
+		{
+			Name:  "Prefix matches",
+			Input: "repo:foo file:bar",
+			Parse: func(in string) ([]Node, error) {
+				nodes, err := Parse(in)
+				return SetPrefixMatches(nodes, []string{"repo"}), err
+			},
+		},
+		{
+			Name: "Empty revisions and segments",
+			Parse: func(string) ([]Node, error) {
+				return []Node{Parameter{Field: "repo", Value: "foo", Revs: []RevisionSpecifier{}, Segments: []Segment{}}}, nil
+			},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			parse := tt.Parse
+			if parse == nil {
+				parse = Parse
+			}
+			nodes, err := parse(tt.Input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := EncodeQuery(nodes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := DecodeQuery(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(nodes, result); diff != "" {
+				t.Fatal(diff)
+			}
+
+			// The encoding is stable.
+			again, err := EncodeQuery(result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(string(data), string(again)); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func Test_EncodeQueryFormat(t *testing.T) {
+	nodes, err := ParseWithQuoteEscapes(`-repo:foo ("a b" or true)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := EncodeQuery(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"version":1,"nodes":[{"operator":{"kind":"and","operands":[` +
+		`{"parameter":{"field":"repo","value":"foo","negated":true}},` +
+		`{"operator":{"kind":"or","operands":[{"parameter":{"value":"a b","quoted":true}},{"parameter":{"value":"true"}}]}}]}}]}`
+	if diff := cmp.Diff(want, string(data)); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func Test_DecodeQueryErrors(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Input     string
+		WantError string
+	}{
+		{
+			Name:      "Not JSON",
+			Input:     "repo:foo",
+			WantError: "invalid query encoding: invalid character 'r' looking for beginning of value",
+		},
+		{
+			Name:      "Missing version",
+			Input:     `{"nodes":[]}`,
+			WantError: "unsupported query encoding version 0",
+		},
+		{
+			Name:      "Unsupported version",
+			Input:     `{"version":2,"nodes":[]}`,
+			WantError: "unsupported query encoding version 2",
+		},
+		{
+			Name:      "Unknown field",
+			Input:     `{"version":1,"nodes":[{"parameter":{"value":"a","regexp":true}}]}`,
+			WantError: `invalid query encoding: json: unknown field "regexp"`,
+		},
+		{
+			Name:      "Unknown operator kind",
+			Input:     `{"version":1,"nodes":[{"operator":{"kind":"xor","operands":[]}}]}`,
+			WantError: `invalid query encoding: unknown operator kind "xor"`,
+		},
+		{
+			Name:      "Empty node",
+			Input:     `{"version":1,"nodes":[{}]}`,
+			WantError: "invalid query encoding: a node must be exactly one of parameter, operator or constant",
+		},
+		{
+			Name:      "Ambiguous node",
+			Input:     `{"version":1,"nodes":[{"parameter":{"value":"a"},"constant":true}]}`,
+			WantError: "invalid query encoding: a node must be exactly one of parameter, operator or constant",
+		},
+		{
+			Name:      "Trailing data",
+			Input:     `{"version":1,"nodes":[]} {}`,
+			WantError: "invalid query encoding: unexpected data after query",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			_, err := DecodeQuery([]byte(tt.Input))
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if diff := cmp.Diff(tt.WantError, err.Error()); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package search
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// EqualQueries returns true if the parse trees a and b are equal after
+// canonicalization, which groups operands of faithful groups (see
+// GroupFaithful) with their parent, simplifies the trees (see Simplify) and
+// orders operands of and- and or-expressions. For example, "repo:a repo:b" and
+// "repo:b repo:a" are equal, but "repo:a or repo:b" is not equal to either.
+// Concatenated patterns and negated groups retain their order. Parameters are
+// compared by all of their fields, including those that their String form does
+// not render, such as CaseSensitive.
+func EqualQueries(a, b []Node) bool {
+	return nodeKey(canonical(a)) == nodeKey(canonical(b))
+}
+
+// QueryDiff returns the differences between the canonicalized parse trees a
+// and b (see EqualQueries), or the empty string if they are equal. Each line
+// is the path of operand indices to a differing subtree, followed by the
+// subtree of a prefixed with "-" and the subtree of b prefixed with "+", as in
+// "/1: -repo:a +repo:c".
+func QueryDiff(a, b []Node) string {
+	var diffs []string
+	diffNodes("/", canonical(a), canonical(b), &diffs)
+	return strings.Join(diffs, "\n")
+}
+
+func diffNodes(path string, a, b Node, diffs *[]string) {
+	if nodeKey(a) == nodeKey(b) {
+		return
+	}
+	x, okA := a.(Operator)
+	y, okB := b.(Operator)
+	if !okA || !okB || x.Kind != y.Kind || len(x.Operands) != len(y.Operands) {
+		if nodeString(a) == nodeString(b) {
+			// The nodes differ in fields that are not rendered, so render all of them.
+			*diffs = append(*diffs, fmt.Sprintf("%s: -%s +%s", path, nodeKey(a), nodeKey(b)))
+			return
+		}
+		*diffs = append(*diffs, fmt.Sprintf("%s: -%s +%s", path, nodeString(a), nodeString(b)))
+		return
+	}
+	for i := range x.Operands {
+		diffNodes(fmt.Sprintf("%s%d/", path, i), x.Operands[i], y.Operands[i], diffs)
+	}
+}
+
+// canonical returns the canonical parse tree of nodes as a single node, or nil
+// if nodes is empty.
+func canonical(nodes []Node) Node {
+	nodes = Simplify(ungroup(nodes))
+	switch len(nodes) {
+	case 0:
+		return nil
+	case 1:
+		// An empty pattern, as in "()", is equal to an empty query.
+		if nodeKey(nodes[0]) == nodeKey(Parameter{}) {
+			return nil
+		}
+		return sortOperands(nodes[0])
+	}
+	return sortOperands(simplify(Operator{Kind: And, Operands: nodes}))
+}
+
+// nodeKey returns a string that is equal for two nodes if and only if the nodes
+// are structurally equal, unlike their String form, which omits fields such as
+// CaseSensitive.
+func nodeKey(node Node) string {
+	if node == nil {
+		return ""
+	}
+	return fmt.Sprintf("%#v", node)
+}
+
+func nodeString(node Node) string {
+	if node == nil {
+		return ""
+	}
+	return node.String()
+}
+
+// ungroup replaces every operator of kind Group with its operands, which are
+// and-ed if there are several.
+func ungroup(nodes []Node) []Node {
+	var result []Node
+	for _, node := range nodes {
+		operator, ok := node.(Operator)
+		if !ok {
+			result = append(result, node)
+			continue
+		}
+		operands := ungroup(operator.Operands)
+		if operator.Kind != Group {
+			result = append(result, Operator{Kind: operator.Kind, Operands: operands})
+			continue
+		}
+		if len(operands) == 1 {
+			result = append(result, operands[0])
+		} else if len(operands) > 1 {
+			result = append(result, Operator{Kind: And, Operands: operands})
+		}
+	}
+	return result
+}
+
+// sortOperands orders operands of and- and or-expressions by their string
+// representation, or by their key if the representations are equal, after
+// ordering their own operands.
+func sortOperands(node Node) Node {
+	operator, ok := node.(Operator)
+	if !ok {
+		return node
+	}
+	operands := make([]Node, 0, len(operator.Operands))
+	for _, operand := range operator.Operands {
+		operands = append(operands, sortOperands(operand))
+	}
+	if operator.Kind == And || operator.Kind == Or {
+		sort.SliceStable(operands, func(i, j int) bool {
+			x, y := operands[i].String(), operands[j].String()
+			if x == y {
+				return nodeKey(operands[i]) < nodeKey(operands[j])
+			}
+			return x < y
+		})
+	}
+	return Operator{Kind: operator.Kind, Operands: operands}
+}
@@ -0,0 +1,171 @@
+package search
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_EqualQueries(t *testing.T) {
+	cases := []struct {
+		Name     string
+		A        string
+		B        string
+		Want     bool
+		WantDiff string
+	}{
+		{
+			Name: "Identical",
+			A:    "repo:a b",
+			B:    "repo:a b",
+			Want: true,
+		},
+		{
+			Name: "Reordered filters",
+			A:    "repo:a repo:b",
+			B:    "repo:b repo:a",
+			Want: true,
+		},
+		{
+			Name: "Reordered or-expression",
+			A:    "a or (b and c)",
+			B:    "(c and b) or a",
+			Want: true,
+		},
+		{
+			Name: "Redundant operands",
+			A:    "a and (a or b) and c",
+			B:    "c and a",
+			Want: true,
+		},
+		{
+			Name: "Operator casing and parentheses",
+			A:    "(a) AND ((b))",
+			B:    "b and a",
+			Want: true,
+		},
+		{
+			Name: "Empty queries",
+			A:    "",
+			B:    "()",
+			Want: true,
+		},
+		{
+			Name:     "And is not or",
+			A:        "repo:a repo:b",
+			B:        "repo:a or repo:b",
+			WantDiff: "/: -(and repo:a repo:b) +(or repo:a repo:b)",
+		},
+		{
+			Name:     "Concatenation is ordered",
+			A:        "a b",
+			B:        "b a",
+			WantDiff: "/0/: -a +b\n/1/: -b +a",
+		},
+		{
+			Name:     "Negated filter",
+			A:        "repo:a x",
+			B:        "-repo:a x",
+			WantDiff: "/0/: -repo:a +-repo:a",
+		},
+		{
+			Name:     "Different nested operand",
+			A:        "x or (repo:a b)",
+			B:        "x or (repo:c b)",
+			WantDiff: "/0/1/: -repo:a +repo:c",
+		},
+		{
+			Name:     "Empty and nonempty",
+			A:        "",
+			B:        "a",
+			WantDiff: "/: - +a",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			a, err := Parse(tt.A)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := Parse(tt.B)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := EqualQueries(a, b); got != tt.Want {
+				t.Errorf("EqualQueries: want %t but got %t", tt.Want, got)
+			}
+			if diff := cmp.Diff(tt.WantDiff, QueryDiff(a, b)); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func Test_EqualQueriesParameterFields(t *testing.T) {
+	parsePlan := func(in string) []Node {
+		plan, err := ParsePlan(in, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return plan.Nodes
+	}
+	parsePrefix := func(in string) []Node {
+		nodes, err := Parse(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return SetPrefixMatches(nodes, DefaultPrefixFields)
+	}
+	literal := []Node{Parameter{Field: "repo", Value: "foo/*"}}
+
+	cases := []struct {
+		Name     string
+		A        []Node
+		B        []Node
+		WantDiff string
+	}{
+		{
+			Name: "Case sensitivity",
+			A:    parsePlan("case:yes Foo"),
+			B:    parsePlan("Foo"),
+			WantDiff: `/: -search.Parameter{Field:"", Value:"Foo", Negated:false, CaseSensitive:true, Prefix:false, Revs:[]search.RevisionSpecifier(nil), Quoted:false, Segments:[]search.Segment(nil)}` +
+				` +search.Parameter{Field:"", Value:"Foo", Negated:false, CaseSensitive:false, Prefix:false, Revs:[]search.RevisionSpecifier(nil), Quoted:false, Segments:[]search.Segment(nil)}`,
+		},
+		{
+			Name: "Prefix match and literal value",
+			A:    parsePrefix("repo:foo/*"),
+			B:    literal,
+			WantDiff: `/: -search.Parameter{Field:"repo", Value:"foo/", Negated:false, CaseSensitive:false, Prefix:true, Revs:[]search.RevisionSpecifier(nil), Quoted:false, Segments:[]search.Segment(nil)}` +
+				` +search.Parameter{Field:"repo", Value:"foo/*", Negated:false, CaseSensitive:false, Prefix:false, Revs:[]search.RevisionSpecifier(nil), Quoted:false, Segments:[]search.Segment(nil)}`,
+		},
+		{
+			Name: "Same prefix match",
+			A:    parsePrefix("repo:foo/* a"),
+			B:    parsePrefix("a repo:foo/*"),
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			if got, want := EqualQueries(tt.A, tt.B), tt.WantDiff == ""; got != want {
+				t.Errorf("EqualQueries: want %t but got %t", want, got)
+			}
+			if diff := cmp.Diff(tt.WantDiff, QueryDiff(tt.A, tt.B)); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func Test_EqualQueriesGroupMode(t *testing.T) {
+	a, err := ParseWithGroupMode("(a and b) and c", GroupFaithful)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Parse("c and b and a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !EqualQueries(a, b) {
+		t.Error(QueryDiff(a, b))
+	}
+}
@@ -0,0 +1,31 @@
+package search
+
+// FieldValues returns the values of all parameters with the given field in
+// nodes, descending into operators of any kind. Values of negated parameters
+// (e.g., foo in "-repo:foo") are returned separately in negated, as are values
+// of parameters inside a negated group (e.g., foo in "-(repo:foo)"), where a
+// double negation cancels out. Values are in the order of the parse tree, which
+// is the order of the input except that filters are ordered before a group with
+// search patterns they appear alongside.
+func FieldValues(nodes []Node, field string) (values, negated []string) {
+	var collect func(nodes []Node, inNot bool)
+	collect = func(nodes []Node, inNot bool) {
+		for _, node := range nodes {
+			switch v := node.(type) {
+			case Parameter:
+				if v.Field != field {
+					continue
+				}
+				if v.Negated != inNot {
+					negated = append(negated, v.Value)
+				} else {
+					values = append(values, v.Value)
+				}
+			case Operator:
+				collect(v.Operands, inNot != (v.Kind == Not))
+			}
+		}
+	}
+	collect(nodes, false)
+	return values, negated
+}
@@ -0,0 +1,73 @@
+package search
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_FieldValues(t *testing.T) {
+	type want struct {
+		Values  []string
+		Negated []string
+	}
+	cases := []struct {
+		Name  string
+		Input string
+		Want  want
+	}{
+		{
+			Name:  "No occurrences",
+			Input: "file:foo a",
+			Want:  want{},
+		},
+		{
+			Name:  "Multiple occurrences",
+			Input: "repo:foo a repo:bar b",
+			Want:  want{Values: []string{"foo", "bar"}},
+		},
+		{
+			Name:  "Negated occurrences",
+			Input: "repo:foo -repo:bar -repo:baz",
+			Want:  want{Values: []string{"foo"}, Negated: []string{"bar", "baz"}},
+		},
+		{
+			Name:  "Nested occurrences",
+			Input: "repo:a (repo:b or (file:c and -repo:d)) e f",
+			Want:  want{Values: []string{"a", "b"}, Negated: []string{"d"}},
+		},
+		{
+			Name:  "Occurrences in concatenated groups",
+			Input: "a (repo:b c) (repo:d e)",
+			Want:  want{Values: []string{"b", "d"}},
+		},
+		{
+			Name:  "Patterns are not fields",
+			Input: "repo a",
+			Want:  want{},
+		},
+		{
+			Name:  "Occurrences in negated groups",
+			Input: "-(repo:a b) -(-(repo:c d) e)",
+			Want:  want{Values: []string{"c"}, Negated: []string{"a"}},
+		},
+		{
+			Name:  "Negated occurrences in negated groups",
+			Input: "-(-repo:a b)",
+			Want:  want{Values: []string{"a"}},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			nodes, err := Parse(tt.Input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got want
+			got.Values, got.Negated = FieldValues(nodes, "repo")
+			if diff := cmp.Diff(tt.Want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package search
+
+import "fmt"
+
+// Diagnostic is a non-fatal warning about a query that is syntactically valid
+// but likely does not express what the user meant.
+type Diagnostic struct {
+	Message string
+	Node    Node // The node the diagnostic applies to.
+}
+
+// Lint returns diagnostics for parse tree nodes that are semantically dubious.
+// It never rejects a query. The following cases are reported:
+// (1) a filter inside a group that is concatenated with search patterns, as in "a b (repo:foo c d)".
+// (2) an empty group, as in "()".
+// (3) a filter that contradicts another filter in the same and-expression, as in "repo:foo -repo:foo".
+func Lint(nodes []Node) []Diagnostic {
+	var diagnostics []Diagnostic
+	for _, node := range nodes {
+		visit(node, func(node Node) {
+			diagnostics = append(diagnostics, lintNode(node)...)
+		})
+	}
+	diagnostics = append(diagnostics, lintContradictions(nodes)...)
+	return diagnostics
+}
+
+func lintNode(node Node) []Diagnostic {
+	switch v := node.(type) {
+	case Parameter:
+		if v.Field == "" && v.Value == "" {
+			return []Diagnostic{{Message: "empty group", Node: v}}
+		}
+	case Operator:
+		switch v.Kind {
+		case Concat:
+			return lintFiltersInConcat(v)
+		case And:
+			return lintContradictions(v.Operands)
+		}
+	}
+	return nil
+}
+
+// lintFiltersInConcat reports filters that appear in groups that are
+// concatenated with search patterns.
+func lintFiltersInConcat(operator Operator) []Diagnostic {
+	var diagnostics []Diagnostic
+	for _, operand := range operator.Operands {
+		if _, ok := operand.(Operator); !ok {
+			continue
+		}
+		visit(operand, func(node Node) {
+			if v, ok := node.(Parameter); ok && v.Field != "" {
+				diagnostics = append(diagnostics, Diagnostic{
+					Message: fmt.Sprintf("filter %s appears inside a sequence of search patterns", v),
+					Node:    v,
+				})
+			}
+		})
+	}
+	return diagnostics
+}
+
+// lintContradictions reports pairs of sibling filters that have the same field
+// and value but opposite negation.
+func lintContradictions(nodes []Node) []Diagnostic {
+	var diagnostics []Diagnostic
+	for i, left := range nodes {
+		l, ok := left.(Parameter)
+		if !ok || l.Field == "" {
+			continue
+		}
+		for _, right := range nodes[i+1:] {
+			r, ok := right.(Parameter)
+			if !ok || r.Field != l.Field || r.Value != l.Value || r.Negated == l.Negated {
+				continue
+			}
+			diagnostics = append(diagnostics, Diagnostic{
+				Message: fmt.Sprintf("filters %s and %s contradict each other", l, r),
+				Node:    r,
+			})
+		}
+	}
+	return diagnostics
+}
@@ -0,0 +1,66 @@
+package search
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_Lint(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Input string
+		Want  []string
+	}{
+		{
+			Name:  "No diagnostics",
+			Input: "repo:foo a b",
+			Want:  nil,
+		},
+		{
+			Name:  "Filter inside concatenated group",
+			Input: "a b (repo:foo c d)",
+			Want:  []string{"filter repo:foo appears inside a sequence of search patterns"},
+		},
+		{
+			Name:  "Filter inside group without concatenation",
+			Input: "repo:foo (c d)",
+			Want:  nil,
+		},
+		{
+			Name:  "Empty group",
+			Input: "()",
+			Want:  []string{"empty group"},
+		},
+		{
+			Name:  "Contradictory filters",
+			Input: "repo:foo -repo:foo",
+			Want:  []string{"filters repo:foo and -repo:foo contradict each other"},
+		},
+		{
+			Name:  "Negated filters with different values",
+			Input: "repo:foo -repo:bar",
+			Want:  nil,
+		},
+		{
+			Name:  "Contradictory filters in alternatives are fine",
+			Input: "repo:foo or -repo:foo",
+			Want:  nil,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			nodes, err := Parse(tt.Input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, d := range Lint(nodes) {
+				got = append(got, d.Message)
+			}
+			if diff := cmp.Diff(tt.Want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
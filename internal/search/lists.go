@@ -0,0 +1,114 @@
+package search
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ExpandLists returns a copy of the parse tree where the value of every
+// parameter whose field is in fields is interpreted as a comma-separated list of
+// values. An element prefixed with '-' excludes that value, like a negated
+// field does, and the remaining elements are alternatives, as in
+// "lang:go,-java,rust" => "(and (or lang:go lang:rust) -lang:java)". A negated
+// list excludes every element, as in "-lang:go,java" => "(and -lang:go
+// -lang:java)", and must not contain excluded elements. An escaped comma or an
+// escaped '-' at the start of an element, as in `lang:c\,d,\-e`, is part of the
+// value, without the backslash. Empty elements are ignored, and quoted values
+// (see ParseWithQuoteEscapes) are never split.
+func ExpandLists(nodes []Node, fields []string) ([]Node, error) {
+	var result []Node
+	for _, node := range nodes {
+		switch v := node.(type) {
+		case Parameter:
+			if v.Field == "" || !containsString(fields, v.Field) || v.Quoted || strings.HasPrefix(v.Value, `"`) {
+				result = append(result, v)
+				continue
+			}
+			expanded, err := expandList(v)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, expanded...)
+		case Operator:
+			operands, err := ExpandLists(v.Operands, fields)
+			if err != nil {
+				return nil, err
+			}
+			if v.Kind == And || v.Kind == Or {
+				// Flatten expanded lists of the same kind.
+				var flattened []Node
+				for _, operand := range operands {
+					if o, ok := operand.(Operator); ok && o.Kind == v.Kind {
+						flattened = append(flattened, o.Operands...)
+						continue
+					}
+					flattened = append(flattened, operand)
+				}
+				result = append(result, newOperator(flattened, v.Kind)...)
+				continue
+			}
+			result = append(result, Operator{Kind: v.Kind, Operands: operands})
+		default:
+			result = append(result, node)
+		}
+	}
+	return result, nil
+}
+
+func expandList(parameter Parameter) ([]Node, error) {
+	var included, excluded []Node
+	for _, element := range splitList(parameter.Value) {
+		if element.value == "" {
+			continue
+		}
+		if !element.excluded {
+			included = append(included, Parameter{Field: parameter.Field, Value: element.value, Negated: parameter.Negated})
+			continue
+		}
+		if parameter.Negated {
+			return nil, fmt.Errorf("unexpected excluded value %s in negated list for field %s", element.value, parameter.Field)
+		}
+		excluded = append(excluded, Parameter{Field: parameter.Field, Value: element.value, Negated: true})
+	}
+	if len(included) == 0 && len(excluded) == 0 {
+		// An empty value is not a list, see ParseWithEmptyValues.
+		return []Node{parameter}, nil
+	}
+	if parameter.Negated {
+		return newOperator(included, And), nil
+	}
+	if len(included) > 1 {
+		included = []Node{Operator{Kind: Or, Operands: included}}
+	}
+	return newOperator(append(included, excluded...), And), nil
+}
+
+type listElement struct {
+	value    string
+	excluded bool
+}
+
+// splitList splits value at unescaped commas. A '-' at the start of an element
+// marks it as excluded.
+func splitList(value string) []listElement {
+	var elements []listElement
+	var current strings.Builder
+	excluded := false
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '\\' && i+1 < len(value) && (value[i+1] == ',' || value[i+1] == '-' && current.Len() == 0):
+			current.WriteByte(value[i+1])
+			i++
+		case c == ',':
+			elements = append(elements, listElement{value: current.String(), excluded: excluded})
+			current.Reset()
+			excluded = false
+		case c == '-' && current.Len() == 0 && !excluded:
+			excluded = true
+		default:
+			current.WriteByte(c)
+		}
+	}
+	return append(elements, listElement{value: current.String(), excluded: excluded})
+}
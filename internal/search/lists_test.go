@@ -0,0 +1,116 @@
+package search
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_ExpandLists(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Input     string
+		Want      string
+		WantError string
+	}{
+		{
+			Name:  "Single value",
+			Input: "lang:go",
+			Want:  "lang:go",
+		},
+		{
+			Name:  "Alternatives",
+			Input: "lang:go,rust",
+			Want:  "(or lang:go lang:rust)",
+		},
+		{
+			Name:  "Included and excluded values",
+			Input: "lang:go,-java,rust",
+			Want:  "(and (or lang:go lang:rust) -lang:java)",
+		},
+		{
+			Name:  "Excluded values only",
+			Input: "lang:-java,-c",
+			Want:  "(and -lang:java -lang:c)",
+		},
+		{
+			Name:  "Negated list",
+			Input: "-lang:go,java",
+			Want:  "(and -lang:go -lang:java)",
+		},
+		{
+			Name:  "Escaped minus is literal",
+			Input: `lang:go,\-java`,
+			Want:  "(or lang:go lang:-java)",
+		},
+		{
+			Name:  "Minus inside an element is literal",
+			Input: "lang:objective-c",
+			Want:  "lang:objective-c",
+		},
+		{
+			Name:  "Escaped comma is literal",
+			Input: `lang:a\,b,c`,
+			Want:  "(or lang:a,b lang:c)",
+		},
+		{
+			Name:  "Empty elements are ignored",
+			Input: "lang:go,,rust,",
+			Want:  "(or lang:go lang:rust)",
+		},
+		{
+			Name:  "Empty value is retained",
+			Input: "lang: a",
+			Want:  "(and lang: a)",
+		},
+		{
+			Name:  "Quoted value is not split",
+			Input: `lang:"go,-java"`,
+			Want:  `lang:"go,-java"`,
+		},
+		{
+			Name:  "Other fields and patterns are not split",
+			Input: "repo:a,-b c,-d",
+			Want:  "(and repo:a,-b c,-d)",
+		},
+		{
+			Name:  "List in expression",
+			Input: "lang:go,-java and (a or b)",
+			Want:  "(and lang:go -lang:java (or a b))",
+		},
+		{
+			Name:      "Excluded value in negated list",
+			Input:     "-lang:go,-java",
+			WantError: "unexpected excluded value java in negated list for field lang",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			nodes, err := Parse(tt.Input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := ExpandLists(nodes, []string{"lang"})
+			if tt.WantError != "" {
+				if err == nil {
+					t.Fatalf("expected error %q but got nil", tt.WantError)
+				}
+				if diff := cmp.Diff(tt.WantError, err.Error()); diff != "" {
+					t.Fatal(diff)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resultStr []string
+			for _, node := range result {
+				resultStr = append(resultStr, node.String())
+			}
+			if diff := cmp.Diff(tt.Want, strings.Join(resultStr, " ")); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
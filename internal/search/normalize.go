@@ -0,0 +1,63 @@
+package search
+
+import (
+	"strings"
+
+	"github.com/sourcegraph/sourcegraph/internal/lazyregexp"
+)
+
+// Normalizer returns the canonical form of a parameter value.
+type Normalizer func(value string) string
+
+// DefaultNormalizers are the normalizers applied to the values of fields, keyed
+// by field.
+var DefaultNormalizers = map[string]Normalizer{
+	"repo": NormalizeRepoValue,
+}
+
+// Normalize returns a copy of the parse tree where the value of every parameter
+// whose field has a normalizer in normalizers is replaced by its canonical form.
+// Search patterns and fields without a normalizer are left untouched.
+func Normalize(nodes []Node, normalizers map[string]Normalizer) []Node {
+	var result []Node
+	for _, node := range nodes {
+		result = append(result, normalize(node, normalizers))
+	}
+	return result
+}
+
+func normalize(node Node, normalizers map[string]Normalizer) Node {
+	switch v := node.(type) {
+	case Parameter:
+		if f, ok := normalizers[v.Field]; ok && v.Field != "" {
+			v.Value = f(v.Value)
+		}
+		return v
+	case Operator:
+		return Operator{Kind: v.Kind, Operands: Normalize(v.Operands, normalizers)}
+	}
+	return node
+}
+
+var schemePattern = lazyregexp.New(`^[a-zA-Z][a-zA-Z0-9+.-]*://`)
+
+// NormalizeRepoValue strips a leading URL scheme and trailing slashes from a
+// repo value, so that "https://github.com/foo/bar/" becomes "github.com/foo/bar".
+// An escaped trailing slash, as in `foo\/`, is retained.
+func NormalizeRepoValue(value string) string {
+	value = schemePattern.ReplaceAllString(value, "")
+	for strings.HasSuffix(value, "/") && !isEscaped(value, len(value)-1) {
+		value = value[:len(value)-1]
+	}
+	return value
+}
+
+// isEscaped returns true if the character at index i of s is preceded by an odd
+// number of backslashes.
+func isEscaped(s string, i int) bool {
+	n := 0
+	for j := i - 1; j >= 0 && s[j] == '\\'; j-- {
+		n++
+	}
+	return n%2 == 1
+}
@@ -0,0 +1,66 @@
+package search
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_Normalize(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Input string
+		Want  string
+	}{
+		{
+			Name:  "Canonical repo value",
+			Input: "repo:github.com/foo/bar",
+			Want:  "repo:github.com/foo/bar",
+		},
+		{
+			Name:  "Scheme and trailing slash",
+			Input: "repo:https://github.com/foo/bar/",
+			Want:  "repo:github.com/foo/bar",
+		},
+		{
+			Name:  "Other scheme",
+			Input: "repo:git+ssh://github.com/foo/bar",
+			Want:  "repo:github.com/foo/bar",
+		},
+		{
+			Name:  "Multiple trailing slashes",
+			Input: "-repo:github.com/foo/bar//",
+			Want:  "-repo:github.com/foo/bar",
+		},
+		{
+			Name:  "Escaped trailing slash is preserved",
+			Input: `repo:github.com/foo/bar\/`,
+			Want:  `repo:github.com/foo/bar\/`,
+		},
+		{
+			Name:  "Repos in operators",
+			Input: "(repo:http://a/ or repo:b/) foo/",
+			Want:  "(and (or repo:a repo:b) foo/)",
+		},
+		{
+			Name:  "Other fields are untouched",
+			Input: "file:https://github.com/foo/ https://github.com/",
+			Want:  "(and file:https://github.com/foo/ https://github.com/)",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			nodes, err := Parse(tt.Input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			for _, node := range Normalize(nodes, DefaultNormalizers) {
+				got += node.String()
+			}
+			if diff := cmp.Diff(tt.Want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
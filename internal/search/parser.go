@@ -1,12 +1,14 @@
 package search
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"strings"
 
 	"github.com/sourcegraph/sourcegraph/internal/lazyregexp"
+	"github.com/sourcegraph/sourcegraph/internal/search/query"
 )
 
 /*
@@ -14,8 +16,9 @@ Parser implements a parser for the following grammar:
 
 OrTerm     → AndTerm { OR AndTerm }
 AndTerm    → Term { AND Term }
-Term       → (OrTerm) | Parameters
+Term       → (OrTerm) | -(OrTerm) | Parameters
 Parameters → Parameter { " " Parameter }
+Parameter  → Field:(OrTerm) | Field:Value { OrTerm } | Field:Value | Value
 */
 
 type Node interface {
@@ -26,12 +29,49 @@ type Node interface {
 // All terms that implement Node.
 func (Parameter) node() {}
 func (Operator) node()  {}
+func (Constant) node()  {}
 
 // Parameter is a leaf node of expressions.
 type Parameter struct {
 	Field   string `json:"field"`   // The repo part in repo:sourcegraph.
 	Value   string `json:"value"`   // The sourcegraph part in repo:sourcegraph.
 	Negated bool   `json:"negated"` // True if the - prefix exists, as in -repo:sourcegraph.
+
+	// CaseSensitive is true if a search pattern is matched case sensitively, as
+	// set by ParsePlan.
+	CaseSensitive bool `json:"caseSensitive,omitempty"`
+
+	// Prefix is true if the parameter matches any value starting with Value, as
+	// set by SetPrefixMatches.
+	Prefix bool `json:"prefix,omitempty"`
+
+	// Revs are the revisions of a repo field, as in repo:foo@a:b, which ParsePlan
+	// separates from Value. It is nil if no revisions are specified, and a single
+	// empty RevisionSpecifier refers to the default branch, as in repo:foo@.
+	Revs []RevisionSpecifier `json:"revs,omitempty"`
+
+	// Quoted is true if Value is the decoded contents of a double-quoted string,
+	// as set by ParseWithQuoteEscapes.
+	Quoted bool `json:"quoted,omitempty"`
+
+	// Segments are the literal text and placeholders of a field value with at
+	// least one placeholder, as in repo:${ORG}/foo, as set by
+	// ParseWithPlaceholders. It is nil if the value has no placeholders.
+	Segments []Segment `json:"segments,omitempty"`
+}
+
+// Segment is a part of a field value, which is either literal text or the name
+// of a placeholder to be substituted when the query is executed.
+type Segment struct {
+	Value       string `json:"value"`       // The literal text, or the name of the placeholder.
+	Placeholder bool   `json:"placeholder"` // True if Value is the name of a placeholder, as in ${ORG}.
+}
+
+// Constant is a leaf node that is always true, matching everything, or always
+// false, matching nothing. It is only produced by ParseWithConstants, and
+// Simplify removes it from expressions with other operands.
+type Constant struct {
+	Value bool `json:"value"`
 }
 
 type operatorKind int
@@ -40,6 +80,9 @@ const (
 	Or operatorKind = iota
 	And
 	Concat
+	Group // An explicit parenthesized group, only retained by GroupFaithful.
+	Not   // A negated group, as in "-(a b)", with a single operand.
+	Then  // A sequence of expressions, only produced by ParseWithSeparator.
 )
 
 // Operator is a nonterminal node of kind Kind with child nodes Operands.
@@ -48,16 +91,45 @@ type Operator struct {
 	Operands []Node
 }
 
+// String returns the form of the parameter as written, as in "-repo:foo@a". A
+// prefix match is rendered with its trailing '*', as in "repo:foo/*", so that it
+// is distinct from a parameter matching the value exactly.
 func (node Parameter) String() string {
+	value := node.Value
+	if node.Quoted {
+		value = quoteValue(value)
+	}
+	if node.Prefix {
+		value += "*"
+	}
 	if node.Field == "" {
-		return node.Value
+		return value
+	}
+	if node.Revs != nil {
+		revs := make([]string, 0, len(node.Revs))
+		for _, rev := range node.Revs {
+			revs = append(revs, rev.String())
+		}
+		value += "@" + strings.Join(revs, ":")
 	}
 	if node.Negated {
-		return fmt.Sprintf("-%s:%s", node.Field, node.Value)
+		return fmt.Sprintf("-%s:%s", node.Field, value)
 	}
-	return fmt.Sprintf("%s:%s", node.Field, node.Value)
+	return fmt.Sprintf("%s:%s", node.Field, value)
 }
 
+// String returns "(true)" or "(false)", so that a constant is distinct from a
+// search pattern "true" or "false".
+func (node Constant) String() string {
+	if node.Value {
+		return "(true)"
+	}
+	return "(false)"
+}
+
+// String returns the s-expression form of the operator, as in "(and a b)".
+// Operators are named in lowercase by their kind, so the form does not depend
+// on the casing of operator keywords in the input, as in "a AND b".
 func (node Operator) String() string {
 	var result []string
 	for _, child := range node.Operands {
@@ -71,6 +143,12 @@ func (node Operator) String() string {
 		kind = "and"
 	case Concat:
 		kind = "concat"
+	case Group:
+		kind = "group"
+	case Not:
+		kind = "not"
+	case Then:
+		kind = "then"
 	}
 
 	return fmt.Sprintf("(%s %s)", kind, strings.Join(result, " "))
@@ -84,6 +162,8 @@ const (
 	OR     keyword = "or"
 	LPAREN keyword = "("
 	RPAREN keyword = ")"
+	LBRACE keyword = "{"
+	RBRACE keyword = "}"
 )
 
 func isSpace(c byte) bool {
@@ -100,10 +180,124 @@ func skipSpace(buf []byte) int {
 	return len(buf)
 }
 
+// Limits bounds the size of input that Parse accepts. A zero value for a limit
+// means the input is not bounded by it.
+type Limits struct {
+	MaxLength int // Maximum length of the input in bytes.
+	MaxTokens int // Maximum number of parameters, operators and parentheses.
+}
+
+// DefaultLimits are the limits applied by Parse.
+var DefaultLimits = Limits{
+	MaxLength: 64 * 1024,
+	MaxTokens: 4096,
+}
+
+// LimitError is returned when input exceeds a limit.
+type LimitError struct {
+	Limit string // The kind of limit exceeded, "length" or "tokens".
+	Max   int    // The value of the limit.
+	Pos   int    // The position in the input where the limit was exceeded.
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("query exceeds maximum %s of %d at %d", e.Limit, e.Max, e.Pos)
+}
+
+// GroupMode controls how Parse treats explicit parenthesized groups.
+type GroupMode int
+
+const (
+	// GroupSemantic collapses groups into the surrounding expression, as in
+	// "(x())" => "x", which is what evaluation needs.
+	GroupSemantic GroupMode = iota
+	// GroupFaithful retains every non-empty group as an operator of kind Group,
+	// as in "(x())" => "(group x)", so that a query can be displayed the way the
+	// user grouped it. Empty groups are still removed.
+	GroupFaithful
+)
+
 type parser struct {
-	buf      []byte
-	pos      int
-	balanced int
+	buf       []byte
+	offsets   []int // The positions in the input of buf, see joinContinuations.
+	quotes    *quoteScanner
+	pos       int
+	balanced  int
+	tokens    int
+	maxTokens int
+	groups    GroupMode
+	blocks    int // The number of open brace blocks.
+
+	// literalBraces is the number of open braces outside blocks that are search
+	// patterns, whose closing braces are search patterns as well.
+	literalBraces int
+
+	// knownFields are the fields accepted by ParseStrict. All fields are
+	// accepted when it is nil.
+	knownFields []string
+
+	// topLevelFields are the fields rejected inside parentheses and brace
+	// blocks by ParseWithTopLevelFields.
+	topLevelFields []string
+
+	// emptyValues are the policies for fields with an empty value applied by
+	// ParseWithEmptyValues. Empty values are retained when it is nil.
+	emptyValues map[string]EmptyValuePolicy
+
+	// duplicates are the policies for fields that occur more than once applied
+	// by ParseWithDuplicatePolicies, and last holds the last occurrence of such
+	// fields.
+	duplicates map[string]DuplicatePolicy
+	last       map[string]Parameter
+
+	// combine are the policies for repeated fields in a conjunction applied by
+	// ParseWithCombinePolicies.
+	combine map[string]CombinePolicy
+
+	// constants maps search patterns to the value of the Constant they are
+	// parsed as by ParseWithConstants.
+	constants map[string]bool
+
+	// unquote is true if quoted values are decoded, see ParseWithQuoteEscapes.
+	unquote bool
+
+	// quotedFields is true if double-quoted field names are recognized, see
+	// ParseWithQuotedFields.
+	quotedFields bool
+
+	// placeholders is true if placeholders in field values are scanned into
+	// segments, see ParseWithPlaceholders.
+	placeholders bool
+
+	// searchType is the type of search patterns, see ParseWithSearchType.
+	searchType query.SearchType
+
+	// separator separates the expressions of a Then operator, see
+	// ParseWithSeparator. Expressions are never separated when it is empty.
+	separator keyword
+
+	// concat is the keyword of explicit Concat operators, see
+	// ParseWithConcatOperator. Concatenation is only implicit when it is empty.
+	concat keyword
+
+	// steps records the reductions applied while parsing, see ParseExplain.
+	// Reductions are not recorded when it is nil.
+	steps *[]ReductionStep
+
+	// recovering is true if syntax errors are recorded in hints instead of
+	// stopping the parse, see ParseWithRecovery.
+	recovering bool
+	hints      []Hint
+}
+
+// scanned records that a token was scanned at position start, and returns an
+// error if this exceeds the maximum number of tokens.
+func (p *parser) scanned(start int) error {
+	p.tokens++
+	if p.maxTokens > 0 && p.tokens > p.maxTokens {
+		return &LimitError{Limit: "tokens", Max: p.maxTokens, Pos: p.inputPos(start)}
+	}
+	return nil
 }
 
 func (p *parser) done() bool {
@@ -138,6 +332,17 @@ func (p *parser) expect(keyword keyword) bool {
 	return true
 }
 
+// matchBrace returns true if the input continues with brace as a block
+// delimiter. A delimiter must be followed by whitespace, a parenthesis or the
+// end of input, so that braces of regular expressions, as in a{2}, are not.
+func (p *parser) matchBrace(brace keyword) bool {
+	if !p.match(brace) {
+		return false
+	}
+	next := p.pos + len(string(brace))
+	return next == len(p.buf) || isSpace(p.buf[next]) || p.buf[next] == '(' || p.buf[next] == ')'
+}
+
 // skipSpaces advances the input and places the parser position at the next
 // non-space value.
 func (p *parser) skipSpaces() error {
@@ -152,7 +357,11 @@ func (p *parser) skipSpaces() error {
 	return nil
 }
 
-var fieldValuePattern = lazyregexp.New("(^-?[a-zA-Z0-9]+):(.*)")
+var fieldValuePattern = lazyregexp.New("(?s)(^-?[a-zA-Z0-9]+):(.*)")
+
+var quotedFieldValuePattern = lazyregexp.New(`(?s)(^-?"(?:[^"\\]|\\.)+"):(.*)`)
+
+var escapedFieldValuePattern = lazyregexp.New(`(?s)(^-?[a-zA-Z0-9]+)\\:(.*)`)
 
 // ScanParameter returns a leaf node value usable by _any_ kind of search (e.g.,
 // literal or regexp, or...) and always succeeds.
@@ -162,16 +371,33 @@ var fieldValuePattern = lazyregexp.New("(^-?[a-zA-Z0-9]+):(.*)")
 // (2) <string>
 //
 // When a parameter is of form (1), the <string> corresponds to Parameter.Value, field corresponds to Parameter.Field and Parameter.Negated is set if Field starts with '-'.
+// A '-' thus only negates as the very first character of a parameter that is immediately followed by a
+// valid field and a colon. Anywhere else, as in a-b, foo-:bar, foo:-bar or - alone, it is part of the
+// pattern or value, and search patterns are never negated. Parse negates a group of them instead, as
+// in -(a b).
 // When form (1) does not match, Value corresponds to <string> and Field is the empty string.
+// The colon of form (1) may be escaped, as in field\:<string>, to force the parameter to be of
+// form (2). In that case Value is field:<string>, without the backslash.
 //
 // The value parameter in the parse tree is only distinguished with respect to
 // the two forms above. There is no restriction on values that <string> may take
-// on. Notably, there is no interpretation of quoting or escaping, which may vary
+// on. Notably, there is no other interpretation of quoting or escaping, which may vary
 // depending on the search being performed. All validation with respect to such
 // properties, and how these should be interpretted, is thus context dependent
 // and handled appropriately within those contexts.
 func ScanParameter(parameter []byte) Parameter {
+	return scanParameter(parameter, false)
+}
+
+// scanParameter implements ScanParameter. If quotedFields is true, field may
+// also be a nonempty double-quoted string, as in "weird field":<string>, where :
+// is the colon right after the closing quote. Like quoted values, a quoted field
+// retains its quotes in Parameter.Field.
+func scanParameter(parameter []byte, quotedFields bool) Parameter {
 	result := fieldValuePattern.FindSubmatch(parameter)
+	if result == nil && quotedFields {
+		result = quotedFieldValuePattern.FindSubmatch(parameter)
+	}
 	if result != nil {
 		if result[1][0] == '-' {
 			return Parameter{
@@ -182,13 +408,201 @@ func ScanParameter(parameter []byte) Parameter {
 		}
 		return Parameter{Field: string(result[1]), Value: string(result[2])}
 	}
+	if result := escapedFieldValuePattern.FindSubmatch(parameter); result != nil {
+		return Parameter{Field: "", Value: string(result[1]) + ":" + string(result[2])}
+	}
 	return Parameter{Field: "", Value: string(parameter)}
 }
 
+// unquoteValue returns the contents of value if it is a single double-quoted
+// string, with the escape sequences \n, \t, \\ and \" decoded into a newline, a
+// tab, a backslash and a double quote. A backslash followed by any other
+// character is retained as is, so that `"a\.b"` is the value a\.b, which keeps
+// regular expressions intact. It returns false if value is not quoted.
+func unquoteValue(value string) (string, bool) {
+	if len(value) < 2 || value[0] != '"' || closingQuote([]byte(value[1:])) != len(value)-2 {
+		return "", false
+	}
+	var b strings.Builder
+	for i := 1; i < len(value)-1; i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		i++
+		switch value[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case '\\', '"':
+			b.WriteByte(value[i])
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String(), true
+}
+
+// quoteValue returns value as a double-quoted string that unquoteValue decodes
+// into value.
+func quoteValue(value string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// closingQuote returns the index of the first unescaped double quote in buf, or
+// -1 if there is none.
+func closingQuote(buf []byte) int {
+	for i := 0; i < len(buf); i++ {
+		switch buf[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// quoteScanner finds the closing quotes of the double quotes in buf. Unlike
+// calling closingQuote after every quote, which scans to the end of buf for
+// every unmatched quote, the time spent over all calls is linear in the length
+// of buf: once no closing quote is found after a quote, none is found after any
+// later quote either, because a later quote is escaped in the earlier scan, so
+// that scanning after it continues like the earlier scan, or it would have
+// ended the earlier scan.
+type quoteScanner struct {
+	buf       []byte
+	unmatched int // The position of the first quote without closing quote, or -1.
+}
+
+func newQuoteScanner(buf []byte) *quoteScanner {
+	return &quoteScanner{buf: buf, unmatched: -1}
+}
+
+// closingQuote returns the position of the closing quote of the double quote
+// at position open of buf, or -1 if there is none.
+func (s *quoteScanner) closingQuote(open int) int {
+	if s.unmatched >= 0 && open > s.unmatched {
+		return -1
+	}
+	end := closingQuote(s.buf[open+1:])
+	if end < 0 {
+		if s.unmatched < 0 || open < s.unmatched {
+			s.unmatched = open
+		}
+		return -1
+	}
+	return open + 1 + end
+}
+
+// joinContinuations removes line continuations from buf, which are backslashes
+// at the end of a line, so that the text before and after a continuation is
+// scanned as if it were on a single line (e.g., `repo:foo\` followed by a
+// newline and `bar` is "repo:foobar"). Continuations inside double-quoted
+// strings are retained. Other newlines are whitespace, like spaces.
+//
+// The offsets returned map every position of the result, and its end, to the
+// position in buf it was copied from, so that positions reported while parsing
+// the result refer to buf. They are nil if buf has no continuations, in which
+// case positions are the same.
+func joinContinuations(buf []byte) (result []byte, offsets []int) {
+	result = make([]byte, 0, len(buf))
+	// Offsets are only tracked from the first continuation, before which
+	// positions are the same.
+	skip := func() {
+		if offsets == nil {
+			offsets = make([]int, len(result), len(buf)+1)
+			for j := range offsets {
+				offsets[j] = j
+			}
+		}
+	}
+	add := func(from, to int) {
+		result = append(result, buf[from:to]...)
+		for j := from; offsets != nil && j < to; j++ {
+			offsets = append(offsets, j)
+		}
+	}
+	quotes := newQuoteScanner(buf)
+	for i := 0; i < len(buf); i++ {
+		switch {
+		case buf[i] == '"':
+			if end := quotes.closingQuote(i); end >= 0 {
+				add(i, end+1)
+				i = end
+				continue
+			}
+		case bytes.HasPrefix(buf[i:], []byte("\\\n")):
+			skip()
+			i++
+			continue
+		case bytes.HasPrefix(buf[i:], []byte("\\\r\n")):
+			skip()
+			i += 2
+			continue
+		}
+		add(i, i+1)
+	}
+	if offsets != nil {
+		offsets = append(offsets, len(buf))
+	}
+	return result, offsets
+}
+
+// inputPos returns the position in the input of the position pos in p.buf,
+// which differ after line continuations, see joinContinuations.
+func (p *parser) inputPos(pos int) int {
+	if p.offsets == nil || pos < 0 || pos >= len(p.offsets) {
+		return pos
+	}
+	return p.offsets[pos]
+}
+
 // ParseParameter returns valid leaf node values for AND/OR queries, taking into
-// account escape sequences for special syntax: whitespace and parentheses.
+// account escape sequences for special syntax: whitespace and parentheses. A
+// double-quoted string is scanned as part of the parameter in its entirety, so
+// that whitespace, parentheses and operator keywords inside quotes are never
+// interpreted. The quotes are retained in the value. A double quote without a
+// matching closing quote is treated like any other character.
+//
+// A parameter, including the value of a field, ends at the first parenthesis
+// that is neither escaped nor inside quotes, even without whitespace before it.
+// Thus "repo:foo(bar baz)" is the filter repo:foo followed by the group
+// "(bar baz)", and "repo:foo(bar" is an unbalanced expression. A parenthesis
+// that is part of a value must be escaped, as in "repo:foo\(bar", or quoted, as
+// in `repo:"foo(bar"`, and is retained as is in the value.
+//
+// With query.SearchTypeRegex, which Parse uses, a search pattern that starts
+// with the anchor ^ and ends with the anchor $ on the same line is scanned in
+// its entirety, so that "^func main$" is a single pattern rather than the
+// patterns ^func and main$, see anchoredEnd.
 func (p *parser) ParseParameter() Parameter {
 	start := p.pos
+	if p.searchType == query.SearchTypeRegex {
+		if end := anchoredEnd(p.buf[p.pos:]); end > 0 {
+			p.pos += end
+			return Parameter{Value: string(p.buf[start:p.pos])}
+		}
+	}
 	for {
 		if p.expect(`\ `) || p.expect(`\(`) || p.expect(`\)`) {
 			continue
@@ -202,9 +616,83 @@ func (p *parser) ParseParameter() Parameter {
 		if isSpace(p.buf[p.pos]) {
 			break
 		}
+		if p.buf[p.pos] == '"' {
+			if p.quotes == nil {
+				p.quotes = newQuoteScanner(p.buf)
+			}
+			if end := p.quotes.closingQuote(p.pos); end >= 0 {
+				p.pos = end + 1
+				continue
+			}
+		}
+		if p.searchType == query.SearchTypeStructural {
+			if end := holeEnd(p.buf[p.pos:]); end > 0 {
+				p.pos += end
+				continue
+			}
+		}
 		p.pos++
 	}
-	return ScanParameter(p.buf[start:p.pos])
+	parameter := scanParameter(p.buf[start:p.pos], p.quotedFields)
+	if p.searchType == query.SearchTypeStructural && parameter.Field != "" {
+		// The colon of a hole never separates a field, as in foo:[x].
+		colon := p.pos - len(parameter.Value) - 1
+		if holeEnd(p.buf[colon:p.pos]) > 0 {
+			return Parameter{Value: string(p.buf[start:p.pos])}
+		}
+	}
+	return parameter
+}
+
+// anchoredEnd returns the length of the regular expression at the start of buf
+// that starts with ^, contains spaces or tabs, and ends with a $ that is
+// followed by whitespace, a closing parenthesis or the end of buf, as in
+// "^func main$". It returns 0 if there is no such expression, in which case the
+// pattern is scanned as usual. Escaped characters, as in \$, never end the
+// expression, and operator keywords and fields inside it are part of it, as in
+// "^a or b$". Newlines, parentheses and double quotes are never part of it, so
+// an anchored expression containing any of these, as in "^func (s) main$", must
+// be quoted to be scanned as a single pattern.
+func anchoredEnd(buf []byte) int {
+	if len(buf) == 0 || buf[0] != '^' {
+		return 0
+	}
+	spaces := false
+	for i := 1; i < len(buf); i++ {
+		switch buf[i] {
+		case '\\':
+			i++
+		case ' ', '\t':
+			spaces = true
+		case '\n', '\r', '(', ')', '"':
+			return 0
+		case '$':
+			if i+1 == len(buf) || isSpace(buf[i+1]) || buf[i+1] == ')' {
+				if !spaces {
+					return 0
+				}
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
+
+// holeEnd returns the length of the structural search hole at the start of buf,
+// as in :[x] or :[[x]], or 0 if buf does not start with a closed hole.
+func holeEnd(buf []byte) int {
+	if bytes.HasPrefix(buf, []byte(":[[")) {
+		if end := bytes.Index(buf[3:], []byte("]]")); end >= 0 {
+			return end + 5
+		}
+		return 0
+	}
+	if bytes.HasPrefix(buf, []byte(":[")) {
+		if end := bytes.IndexByte(buf[2:], ']'); end >= 0 {
+			return end + 3
+		}
+	}
+	return 0
 }
 
 func visit(node Node, f func(node Node)) {
@@ -216,6 +704,8 @@ func visit(node Node, f func(node Node)) {
 		for _, n := range v.Operands {
 			visit(n, f)
 		}
+	case Constant:
+		f(v)
 	}
 }
 
@@ -238,14 +728,35 @@ func containsPattern(node Node) bool {
 // partitionParameters constructs a parse tree to distinguish terms where
 // ordering is insignificant (e.g., "repo:foo file:bar") versus terms where
 // ordering may be significant (e.g., search patterns like "foo bar"). Search
-// patterns are parameters whose field is the empty string.
+// patterns are parameters whose field is the empty string. Negated filters are
+// unordered like any other filter (e.g., "foo -lang:go bar" is
+// "(and -lang:go (concat foo bar))").
 //
 // The resulting tree defines an ordering relation on nodes in the following cases:
 // (1) When more than one search patterns exist at the same operator level, they
 // are concatenated in order.
 // (2) Any nonterminal node is concatenated (ordered in the tree) if its
-// descendents contain one or more search patterns.
+// descendents contain one or more search patterns. Such a node is kept as a
+// single element of the concatenation, even if it is not a pure sequence of
+// patterns (e.g., "a (b and c) d" is "(concat a (and b c) d)").
+//
+// Filters scope over the parenthesized groups they appear alongside. A group
+// containing only patterns inherits the filters of its enclosing level (e.g.,
+// "repo:foo (bar baz)" is "(and repo:foo (concat bar baz))"), and filters inside
+// a group intersect with the enclosing ones (e.g., "repo:foo (repo:bar baz)" is
+// "(and repo:foo repo:bar baz)").
 func partitionParameters(nodes []Node) []Node {
+	return partitionParametersWithSteps(nodes, nil)
+}
+
+// partitionParametersWithSteps is like partitionParameters, but appends the
+// reductions it applies to steps unless steps is nil.
+func partitionParametersWithSteps(nodes []Node, steps *[]ReductionStep) []Node {
+	var before string
+	if steps != nil {
+		before = nodesString(nodes)
+	}
+
 	var patterns, unorderedParams []Node
 	for _, n := range nodes {
 		switch v := n.(type) {
@@ -261,13 +772,34 @@ func partitionParameters(nodes []Node) []Node {
 			} else {
 				unorderedParams = append(unorderedParams, n)
 			}
+		case Constant:
+			unorderedParams = append(unorderedParams, n)
 		}
 	}
+	var result []Node
 	if len(patterns) > 1 {
-		orderedPatterns := newOperator(patterns, Concat)
-		return newOperator(append(unorderedParams, orderedPatterns...), And)
+		orderedPatterns := newOperatorWithSteps(patterns, Concat, steps)
+		result = newOperatorWithSteps(append(unorderedParams, orderedPatterns...), And, steps)
+	} else {
+		result = newOperatorWithSteps(append(unorderedParams, patterns...), And, steps)
+	}
+	if steps != nil && len(nodes) > 1 {
+		*steps = append(*steps, ReductionStep{
+			Name:   reductionPromote,
+			Before: before,
+			After:  nodesString(result),
+		})
 	}
-	return newOperator(append(unorderedParams, patterns...), And)
+	return result
+}
+
+// nodesString returns the s-expressions of nodes separated by spaces.
+func nodesString(nodes []Node) string {
+	result := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		result = append(result, node.String())
+	}
+	return strings.Join(result, " ")
 }
 
 // scanParameterList scans for consecutive leaf nodes.
@@ -281,39 +813,263 @@ loop:
 		if p.done() {
 			break loop
 		}
+		if p.matchBrace(RBRACE) {
+			if p.blocks > 0 {
+				// The caller parsing the block advances.
+				break loop
+			}
+			if p.literalBraces == 0 {
+				// A closing brace without a block to close, as in "repo:foo { a } }".
+				return nil, fmt.Errorf("unbalanced expression at %d", p.inputPos(p.pos))
+			}
+			// The closing brace of a literal one is a search pattern as well.
+			p.literalBraces--
+		} else if p.blocks == 0 && p.matchBrace(LBRACE) {
+			// A block only follows a filter, which parseBlock scans, so that this
+			// brace is a search pattern, as in "a { b }".
+			p.literalBraces++
+		}
+		if !p.matchOperator(AND) && !p.matchOperator(OR) && !p.matchSeparator() && !p.matchConcat() {
+			// Operators are counted by the caller that advances past them.
+			if err := p.scanned(p.pos); err != nil {
+				return nil, err
+			}
+		}
 		switch {
 		case p.expect(LPAREN):
 			p.balanced++
-			result, err := p.parseOr()
+			result, err := p.parseThen()
 			if err != nil {
 				return nil, err
 			}
+			if p.groups == GroupFaithful && !isEmptyGroup(result) {
+				result = []Node{Operator{Kind: Group, Operands: result}}
+			}
 			nodes = append(nodes, result...)
 		case p.expect(RPAREN):
 			p.balanced--
+			if p.recovering && p.balanced < 0 {
+				p.hints = append(p.hints, Hint{Kind: UnexpectedClosingParen, Pos: p.inputPos(p.pos - 1)})
+				p.balanced = 0
+			}
 			if len(nodes) == 0 {
 				// Return a non-nil node if we parsed "()".
 				nodes = []Node{Parameter{Value: ""}}
 			}
 			break loop
-		case p.match(AND), p.match(OR):
+		case p.matchOperator(AND), p.matchOperator(OR), p.matchSeparator(), p.matchConcat():
 			// Caller advances.
 			break loop
 		default:
+			start := p.pos
 			parameter := p.ParseParameter()
+			if p.knownFields != nil && parameter.Field != "" && !containsString(p.knownFields, parameter.Field) {
+				if suggestion := closestField(parameter.Field, p.knownFields); suggestion != "" {
+					return nil, fmt.Errorf("unknown field %s at %d, did you mean %s:?", parameter.Field, p.inputPos(start), suggestion)
+				}
+				return nil, fmt.Errorf("unknown field %s at %d", parameter.Field, p.inputPos(start))
+			}
+			if (p.balanced > 0 || p.blocks > 0) && containsString(p.topLevelFields, parameter.Field) {
+				return nil, fmt.Errorf("field %s must appear at the top level at %d", parameter.Field, p.inputPos(start))
+			}
+			if parameter.Field == "" && parameter.Value == "-" && p.match(LPAREN) {
+				if err := p.scanned(p.pos); err != nil {
+					return nil, err
+				}
+				p.expect(LPAREN)
+				p.balanced++
+				group, err := p.parseThen()
+				if err != nil {
+					return nil, err
+				}
+				if !isEmptyGroup(group) {
+					nodes = append(nodes, Operator{Kind: Not, Operands: group})
+				}
+				continue
+			}
+			if parameter.Field != "" && parameter.Value == "" && p.match(LPAREN) {
+				if err := p.scanned(p.pos); err != nil {
+					return nil, err
+				}
+				p.expect(LPAREN)
+				p.balanced++
+				group, err := p.parseThen()
+				if err != nil {
+					return nil, err
+				}
+				distributed, err := distributeField(group, parameter.Field, parameter.Negated)
+				if err != nil {
+					return nil, err
+				}
+				nodes = append(nodes, distributed...)
+				continue
+			}
+			if p.placeholders && parameter.Field != "" {
+				parameter.Segments = scanPlaceholders(parameter.Value)
+			}
+			if parameter.Field != "" && parameter.Value != "" {
+				block, ok, err := p.parseBlock()
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					nodes = append(nodes, newOperatorWithSteps(append([]Node{parameter}, block...), And, p.steps)...)
+					continue
+				}
+			}
+			if p.unquote {
+				if value, ok := unquoteValue(parameter.Value); ok {
+					parameter.Value = value
+					parameter.Quoted = true
+				}
+			}
+			if value, ok := p.constants[parameter.Value]; ok && parameter.Field == "" {
+				nodes = append(nodes, Constant{Value: value})
+				continue
+			}
+			if p.emptyValues != nil && parameter.Field != "" && parameter.Value == "" {
+				switch p.emptyValues[parameter.Field] {
+				case EmptyValuePresent:
+				case EmptyValueIgnore:
+					continue
+				default:
+					return nil, fmt.Errorf("empty value for field %s at %d", parameter.Field, p.inputPos(start))
+				}
+			}
+			if policy, ok := p.duplicates[parameter.Field]; ok && parameter.Field != "" {
+				if _, seen := p.last[parameter.Field]; seen && policy == DuplicateReject {
+					return nil, fmt.Errorf("duplicate field %s at %d", parameter.Field, p.inputPos(start))
+				}
+				p.last[parameter.Field] = parameter
+			}
 			nodes = append(nodes, parameter)
 		}
 	}
-	return partitionParameters(nodes), nil
+	return partitionParametersWithSteps(nodes, p.steps), nil
+}
+
+// isEmptyGroup returns true if nodes is the result of parsing a group without
+// any parameters, as in "()" or "(())".
+func isEmptyGroup(nodes []Node) bool {
+	if len(nodes) != 1 {
+		return false
+	}
+	param, ok := nodes[0].(Parameter)
+	return ok && param.Field == "" && param.Value == ""
 }
 
+// parseBlock parses a brace block following a filter, as in "repo:foo { bar baz }",
+// and returns false if there is none. The filter applies to the contents of the
+// block only, so that "a repo:foo { b }" is "(concat a (and repo:foo b))". A
+// block that is not closed, or that closes before a parenthesized group inside
+// it, is an unbalanced expression, and so is a closing brace without a block or
+// a literal opening brace to close, see parseParameterList.
+func (p *parser) parseBlock() ([]Node, bool, error) {
+	if err := p.skipSpaces(); err != nil {
+		return nil, false, err
+	}
+	if !p.matchBrace(LBRACE) {
+		return nil, false, nil
+	}
+	open := p.pos
+	if err := p.scanned(open); err != nil {
+		return nil, false, err
+	}
+	p.expect(LBRACE)
+	if err := p.skipSpaces(); err != nil {
+		return nil, false, err
+	}
+	if p.done() {
+		return nil, false, fmt.Errorf("unbalanced expression at %d", p.inputPos(open))
+	}
+
+	p.blocks++
+	balanced := p.balanced
+	nodes, err := p.parseThen()
+	if err != nil {
+		return nil, false, err
+	}
+	if err := p.skipSpaces(); err != nil {
+		return nil, false, err
+	}
+	if !p.matchBrace(RBRACE) {
+		return nil, false, fmt.Errorf("unbalanced expression at %d", p.inputPos(open))
+	}
+	if p.balanced != balanced {
+		return nil, false, fmt.Errorf("unbalanced expression at %d", p.inputPos(p.pos))
+	}
+	if err := p.scanned(p.pos); err != nil {
+		return nil, false, err
+	}
+	p.expect(RBRACE)
+	p.blocks--
+	return nodes, true, nil
+}
+
+// distributeField applies a field to every search pattern in a parenthesized
+// group, as in "repo:(a or b)" => "(or repo:a repo:b)". Patterns in a group are
+// implicitly and-ed once they become filters. When the field is negated, the
+// negation is distributed over the group according to De Morgan's laws, as in
+// "-repo:(a or b)" => "(and -repo:a -repo:b)".
+func distributeField(nodes []Node, field string, negated bool) ([]Node, error) {
+	var result []Node
+	for _, node := range nodes {
+		switch v := node.(type) {
+		case Parameter:
+			if v.Field != "" {
+				return nil, fmt.Errorf("unexpected field %s in group for field %s", v.Field, field)
+			}
+			result = append(result, Parameter{Field: field, Value: v.Value, Negated: negated})
+		case Constant:
+			result = append(result, Constant{Value: v.Value != negated})
+		case Operator:
+			if v.Kind == Not {
+				return nil, fmt.Errorf("unexpected negated group in group for field %s", field)
+			}
+			if v.Kind == Then {
+				return nil, fmt.Errorf("unexpected separator in group for field %s", field)
+			}
+			operands, err := distributeField(v.Operands, field, negated)
+			if err != nil {
+				return nil, err
+			}
+			kind := v.Kind
+			if kind == Group {
+				result = append(result, Operator{Kind: Group, Operands: operands})
+				continue
+			}
+			if kind == Concat {
+				kind = And
+			}
+			if negated {
+				if kind == And {
+					kind = Or
+				} else {
+					kind = And
+				}
+			}
+			result = append(result, newOperator(operands, kind)...)
+		}
+	}
+	return result, nil
+}
+
+// Names of the reductions applied by reduce and partitionParameters, as
+// recorded by ParseExplain.
+const (
+	reductionFlatten = "flatten" // An operand of the same kind is replaced by its operands.
+	reductionPrune   = "prune"   // An empty parameter is removed.
+	reductionPromote = "promote" // Filters are ordered before concatenated patterns.
+)
+
 // reduce takes lists of left and right nodes and reduces them if possible. For example,
 // (and a (b and c))       => (and a b c)
 // (((a and b) or c) or d) => (or (and a b) c d)
-func reduce(left, right []Node, kind operatorKind) ([]Node, bool) {
-	if param, ok := left[0].(Parameter); ok && param.Value == "" {
+// It returns the name of the reduction applied, or the empty string if none was.
+func reduce(left, right []Node, kind operatorKind) ([]Node, string) {
+	if param, ok := left[0].(Parameter); ok && param.Field == "" && param.Value == "" {
 		// Remove empty string parameter.
-		return right, true
+		return right, reductionPrune
 	}
 
 	switch term := right[0].(type) {
@@ -324,48 +1080,94 @@ func reduce(left, right []Node, kind operatorKind) ([]Node, bool) {
 			if len(right) > 1 {
 				left = append(left, right[1:]...)
 			}
-			return left, true
+			return left, reductionFlatten
 		}
 	case Parameter:
-		if term.Value == "" {
+		if term.Field == "" && term.Value == "" {
 			// Remove empty string parameter.
 			if len(right) > 1 {
-				return append(left, right[1:]...), true
+				return append(left, right[1:]...), reductionPrune
 			}
-			return left, true
+			return left, reductionPrune
 		}
 		if operator, ok := left[0].(Operator); ok && operator.Kind == kind {
 			// Reduce left node.
-			return append(operator.Operands, right...), true
+			return append(operator.Operands, right...), reductionFlatten
 
 		}
 	}
 	if len(right) > 1 {
 		// Reduce right list.
-		reduced, changed := reduce(append(left, right[0]), right[1:], kind)
-		if changed {
-			return reduced, true
+		reduced, reduction := reduce(append(left, right[0]), right[1:], kind)
+		if reduction != "" {
+			return reduced, reduction
 		}
 	}
-	return append(left, right...), false
+	return append(left, right...), ""
 }
 
 // newOperator constructs a new node of kind operatorKind with operands nodes,
 // reducing nodes as needed.
 func newOperator(nodes []Node, kind operatorKind) []Node {
+	return newOperatorWithSteps(nodes, kind, nil)
+}
+
+// newOperatorWithSteps is like newOperator, but appends the reductions it
+// applies to steps unless steps is nil.
+func newOperatorWithSteps(nodes []Node, kind operatorKind, steps *[]ReductionStep) []Node {
 	if len(nodes) == 0 {
 		return nil
 	} else if len(nodes) == 1 {
 		return nodes
 	}
 
-	reduced, changed := reduce([]Node{nodes[0]}, nodes[1:], kind)
-	if changed {
-		return newOperator(reduced, kind)
+	var before string
+	if steps != nil {
+		// Reducing may reuse the operands of nodes, so they are rendered first.
+		before = Operator{Kind: kind, Operands: nodes}.String()
+	}
+	reduced, reduction := reduce([]Node{nodes[0]}, nodes[1:], kind)
+	if reduction != "" {
+		if steps != nil {
+			*steps = append(*steps, ReductionStep{
+				Name:   reduction,
+				Before: before,
+				After:  Operator{Kind: kind, Operands: reduced}.String(),
+			})
+		}
+		return newOperatorWithSteps(reduced, kind, steps)
 	}
 	return []Node{Operator{Kind: kind, Operands: reduced}}
 }
 
+// expectOperand returns false if an operator is not followed by an operand,
+// which is the case at the end of input or a closing parenthesis, as in "(a or)".
+// Adjacent operators of any kind, as in "a and or b", are reported by the
+// caller when it finds no operand at the position of the second operator.
+func (p *parser) expectOperand() (bool, error) {
+	if err := p.skipSpaces(); err != nil {
+		return false, err
+	}
+	if p.done() || p.match(RPAREN) || (p.blocks > 0 && p.matchBrace(RBRACE)) {
+		return false, p.missingOperand()
+	}
+	return true, nil
+}
+
+// missingOperand returns an error for a missing operand at the current
+// position, or records a hint and returns nil when recovering.
+func (p *parser) missingOperand() error {
+	if p.recovering {
+		// Enclosing expressions may miss an operand at the same position, as in "repo:(".
+		hint := Hint{Kind: ExpectedOperand, Pos: p.inputPos(p.pos)}
+		if n := len(p.hints); n == 0 || p.hints[n-1] != hint {
+			p.hints = append(p.hints, hint)
+		}
+		return nil
+	}
+	return fmt.Errorf("expected operand at %d", p.inputPos(p.pos))
+}
+
 // parseAnd parses and-expressions.
 func (p *parser) parseAnd() ([]Node, error) {
 	left, err := p.parseParameterList()
@@ -373,16 +1175,29 @@ func (p *parser) parseAnd() ([]Node, error) {
 		return nil, err
 	}
 	if left == nil {
-		return nil, fmt.Errorf("expected operand at %d", p.pos)
+		if err := p.missingOperand(); err != nil {
+			return nil, err
+		}
+	}
+	start := p.pos
+	if !p.matchOperator(AND) {
+		return left, nil
+	}
+	p.expect(AND)
+	if err := p.scanned(start); err != nil {
+		return nil, err
 	}
-	if !p.expect(AND) {
+	if ok, err := p.expectOperand(); err != nil {
+		return nil, err
+	} else if !ok {
+		// Recovering from a dangling operator, which is dropped.
 		return left, nil
 	}
 	right, err := p.parseAnd()
 	if err != nil {
 		return nil, err
 	}
-	return newOperator(append(left, right...), And), nil
+	return newOperatorWithSteps(append(left, right...), And, p.steps), nil
 }
 
 // parseOr parses or-expressions. Or operators have lower precedence than And
@@ -392,31 +1207,726 @@ func (p *parser) parseOr() ([]Node, error) {
 	if err != nil {
 		return nil, err
 	}
-	if left == nil {
-		return nil, fmt.Errorf("expected operand at %d", p.pos)
+	// When recovering, parseAnd has already recorded the missing operand.
+	if left == nil && !p.recovering {
+		return nil, fmt.Errorf("expected operand at %d", p.inputPos(p.pos))
+	}
+	start := p.pos
+	if !p.matchOperator(OR) {
+		return left, nil
+	}
+	p.expect(OR)
+	if err := p.scanned(start); err != nil {
+		return nil, err
 	}
-	if !p.expect(OR) {
+	if ok, err := p.expectOperand(); err != nil {
+		return nil, err
+	} else if !ok {
+		// Recovering from a dangling operator, which is dropped.
 		return left, nil
 	}
 	right, err := p.parseOr()
 	if err != nil {
 		return nil, err
 	}
-	return newOperator(append(left, right...), Or), nil
+	return newOperatorWithSteps(append(left, right...), Or, p.steps), nil
+}
+
+// matchOperator returns true if the input continues with the keyword of an and
+// or or operator, which are only operators in regexp search, see
+// ParseWithSearchType.
+func (p *parser) matchOperator(keyword keyword) bool {
+	return p.searchType == query.SearchTypeRegex && p.match(keyword)
 }
 
-// Parse parses a raw input string into a parse tree comprising Nodes.
+// matchSeparator returns true if the input continues with the separator of Then
+// operators, which never matches when no separator is set.
+func (p *parser) matchSeparator() bool {
+	return p.separator != "" && p.match(p.separator)
+}
+
+// matchConcat returns true if the input continues with the keyword of explicit
+// Concat operators, which never matches when no keyword is set.
+func (p *parser) matchConcat() bool {
+	return p.concat != "" && p.match(p.concat)
+}
+
+// parseConcat parses expressions concatenated by the keyword of explicit Concat
+// operators, which have lower precedence than Or operators, therefore this
+// function calls parseOr.
+func (p *parser) parseConcat() ([]Node, error) {
+	operandStart := p.pos
+	left, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	start := p.pos
+	if !p.matchConcat() {
+		return left, nil
+	}
+	p.expect(p.concat)
+	if err := p.scanned(start); err != nil {
+		return nil, err
+	}
+	if ok, err := p.expectOperand(); err != nil {
+		return nil, err
+	} else if !ok {
+		// Recovering from a dangling operator, which is dropped.
+		return left, nil
+	}
+	rightStart := p.pos
+	right, err := p.parseConcat()
+	if err != nil {
+		return nil, err
+	}
+	// Operands are and-ed like the top level, so that each expression is a
+	// single operand, which must contain a pattern to be concatenated.
+	left = newOperatorWithSteps(left, And, p.steps)
+	right = newOperatorWithSteps(right, And, p.steps)
+	if len(left) > 0 && !containsPattern(left[0]) {
+		return nil, fmt.Errorf("expected pattern at %d", p.inputPos(skipSpace(p.buf[operandStart:])+operandStart))
+	}
+	if len(right) > 0 && !containsPattern(right[0]) {
+		return nil, fmt.Errorf("expected pattern at %d", p.inputPos(rightStart))
+	}
+	return newOperatorWithSteps(append(left, right...), Concat, p.steps), nil
+}
+
+// parseThen parses expressions separated by the separator of Then operators,
+// which have lower precedence than Concat operators, therefore this function
+// calls parseConcat.
+func (p *parser) parseThen() ([]Node, error) {
+	left, err := p.parseConcat()
+	if err != nil {
+		return nil, err
+	}
+	start := p.pos
+	if !p.matchSeparator() {
+		return left, nil
+	}
+	p.expect(p.separator)
+	if err := p.scanned(start); err != nil {
+		return nil, err
+	}
+	if ok, err := p.expectOperand(); err != nil {
+		return nil, err
+	} else if !ok {
+		// Recovering from a dangling operator, which is dropped.
+		return left, nil
+	}
+	right, err := p.parseThen()
+	if err != nil {
+		return nil, err
+	}
+	// Operands are and-ed like the top level, so that a sequence has one
+	// operand per expression.
+	left = newOperatorWithSteps(left, And, p.steps)
+	right = newOperatorWithSteps(right, And, p.steps)
+	return newOperatorWithSteps(append(left, right...), Then, p.steps), nil
+}
+
+// ParseWithConcatOperator is like Parse, but also parses expressions joined by
+// the keyword op into a Concat operator, which forces its operands to be
+// matched adjacently regardless of how Parse would combine them, as in
+// "repo:foo a + b" => "(concat (and repo:foo a) b)" with keyword "+", where
+// Parse combines "repo:foo a b" into "(and repo:foo (concat a b))". The
+// keyword has lower precedence than the or operator, as in "a or b + c" =>
+// "(concat (or a b) c)", and higher precedence than the separator of
+// ParseWithSeparator. Every operand must contain a search pattern. Like
+// operator keywords, the keyword is matched case insensitively at the start of
+// a parameter. Adjacent parameters are still concatenated implicitly, which
+// is all Parse does.
+func ParseWithConcatOperator(in, op string) ([]Node, error) {
+	return ParseWithOptions(in, ParseOptions{ConcatOperator: op})
+}
+
+// Parse parses a raw input string into a parse tree comprising Nodes. Empty or
+// whitespace-only input results in no nodes and no error. Input consisting of a
+// single pattern or filter results in a single Parameter node.
+//
+// Parse rejects input exceeding DefaultLimits with a *LimitError.
 func Parse(in string) ([]Node, error) {
-	if in == "" {
+	return ParseWithOptions(in, ParseOptions{})
+}
+
+// ParseWithLimits is like Parse, but rejects input exceeding limits instead of
+// DefaultLimits.
+func ParseWithLimits(in string, limits Limits) ([]Node, error) {
+	return ParseWithOptions(in, ParseOptions{Limits: &limits})
+}
+
+// ParseWithGroupMode is like Parse, but treats explicit parenthesized groups
+// according to mode. Parse uses GroupSemantic.
+func ParseWithGroupMode(in string, mode GroupMode) ([]Node, error) {
+	return ParseWithOptions(in, ParseOptions{GroupMode: mode})
+}
+
+// ParseStrict is like Parse, but rejects a parameter whose field is not in
+// knownFields with an error positioned at the start of the parameter, as in
+// "unknown field fooo at 0" for "fooo:bar". Fields are matched exactly and
+// without the - prefix of negated fields. Search patterns, including patterns
+// with an escaped colon like fooo\:bar, are always accepted.
+//
+// When an unknown field is a near miss of a known field, the error suggests the
+// known field, as in "unknown field rpeo at 0, did you mean repo:?" for
+// "rpeo:foo", see closestField.
+func ParseStrict(in string, knownFields []string) ([]Node, error) {
+	if knownFields == nil {
+		knownFields = []string{}
+	}
+	return ParseWithOptions(in, ParseOptions{KnownFields: knownFields})
+}
+
+// ParseOptions are the options of ParseWithOptions, which are those of the
+// other Parse functions. The zero value parses like Parse.
+type ParseOptions struct {
+	// Limits are the limits of ParseWithLimits. DefaultLimits apply when it is nil.
+	Limits *Limits
+
+	// GroupMode is the mode of ParseWithGroupMode.
+	GroupMode GroupMode
+
+	// KnownFields are the fields of ParseStrict. All fields are accepted when
+	// it is nil, and none when it is empty.
+	KnownFields []string
+
+	// TopLevelFields are the fields of ParseWithTopLevelFields.
+	TopLevelFields []string
+
+	// EmptyValues are the policies of ParseWithEmptyValues. Empty values are
+	// retained when it is nil.
+	EmptyValues map[string]EmptyValuePolicy
+
+	// Duplicates are the policies of ParseWithDuplicatePolicies.
+	Duplicates map[string]DuplicatePolicy
+
+	// Combine are the policies of ParseWithCombinePolicies.
+	Combine map[string]CombinePolicy
+
+	// Constants are the constants of ParseWithConstants.
+	Constants map[string]bool
+
+	// QuoteEscapes decodes quoted values like ParseWithQuoteEscapes.
+	QuoteEscapes bool
+
+	// QuotedFields recognizes quoted field names like ParseWithQuotedFields.
+	QuotedFields bool
+
+	// Placeholders scans placeholders in field values like ParseWithPlaceholders.
+	Placeholders bool
+
+	// SearchType is the search type of ParseWithSearchType.
+	SearchType query.SearchType
+
+	// Separator is the separator of ParseWithSeparator. Expressions are never
+	// separated when it is empty.
+	Separator string
+
+	// ConcatOperator is the keyword of ParseWithConcatOperator. Concatenation is
+	// only implicit when it is empty.
+	ConcatOperator string
+
+	// Steps, when non-nil, is set to the reductions returned by ParseExplain.
+	Steps *[]ReductionStep
+
+	// Hints, when non-nil, makes the parser recover from syntax errors like
+	// ParseWithRecovery, and is set to the hints it returns.
+	Hints *[]Hint
+}
+
+// ParseWithOptions is like Parse, but parses according to opts, so that the
+// options of the other Parse functions can be combined, as in limits with
+// a separator.
+func ParseWithOptions(in string, opts ParseOptions) ([]Node, error) {
+	limits := DefaultLimits
+	if opts.Limits != nil {
+		limits = *opts.Limits
+	}
+	var steps []ReductionStep
+	p := &parser{
+		maxTokens:      limits.MaxTokens,
+		groups:         opts.GroupMode,
+		knownFields:    opts.KnownFields,
+		topLevelFields: opts.TopLevelFields,
+		emptyValues:    opts.EmptyValues,
+		duplicates:     opts.Duplicates,
+		last:           map[string]Parameter{},
+		combine:        opts.Combine,
+		constants:      opts.Constants,
+		unquote:        opts.QuoteEscapes,
+		quotedFields:   opts.QuotedFields,
+		placeholders:   opts.Placeholders,
+		searchType:     opts.SearchType,
+		separator:      keyword(opts.Separator),
+		concat:         keyword(opts.ConcatOperator),
+		recovering:     opts.Hints != nil,
+	}
+	if opts.Steps != nil {
+		p.steps = &steps
+	}
+	nodes, err := parse(in, limits, p)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Steps != nil {
+		*opts.Steps = steps
+	}
+	if opts.Hints != nil {
+		*opts.Hints = p.hints
+	}
+	return nodes, nil
+}
+
+// DefaultTopLevelFields are the behavior fields used by callers of
+// ParseWithTopLevelFields that don't need their own. They change how the whole
+// query is evaluated, so nesting them has no meaning.
+var DefaultTopLevelFields = []string{"case", "patterntype", "count"}
+
+// maxSuggestionDistance is the maximum edit distance between an unknown field
+// and a known field suggested for it.
+const maxSuggestionDistance = 2
+
+// closestField returns the field in knownFields with the smallest edit distance
+// to field, or "" if there is none within maxSuggestionDistance. The distance
+// must also be less than the length of field, so that short fields, as in "x",
+// are not matched by any known field. Ties are resolved by the order of
+// knownFields.
+func closestField(field string, knownFields []string) string {
+	var closest string
+	best := maxSuggestionDistance + 1
+	for _, known := range knownFields {
+		if d := editDistance(field, known); d < best && d < len(field) {
+			closest, best = known, d
+		}
+	}
+	return closest
+}
+
+// editDistance returns the number of insertions, deletions, substitutions and
+// transpositions of adjacent bytes needed to turn a into b, so that the common
+// typo "rpeo" is at distance 1 of "repo".
+func editDistance(a, b string) int {
+	// d[i][j] is the distance between a[:i] and b[:j].
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = minInt(d[i-1][j]+1, minInt(d[i][j-1]+1, d[i-1][j-1]+cost))
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = minInt(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// ParseWithTopLevelFields is like Parse, but rejects a parameter whose field is
+// in fields when it appears inside parentheses or a brace block, as in
+// "(a case:yes)", with an error positioned at the start of the parameter. Such
+// fields are accepted anywhere at the top level, as in "case:yes (a or b)",
+// while other fields and search patterns are accepted anywhere.
+func ParseWithTopLevelFields(in string, fields []string) ([]Node, error) {
+	return ParseWithOptions(in, ParseOptions{TopLevelFields: fields})
+}
+
+// EmptyValuePolicy is the interpretation of a field with an empty value, as in
+// "file:".
+type EmptyValuePolicy int
+
+const (
+	// EmptyValueReject rejects an empty value with an error positioned at the
+	// start of the parameter.
+	EmptyValueReject EmptyValuePolicy = iota
+	// EmptyValueIgnore removes the parameter, so that it has no effect.
+	EmptyValueIgnore
+	// EmptyValuePresent retains the parameter with an empty value, meaning
+	// that the field is present with any value.
+	EmptyValuePresent
+)
+
+// DefaultEmptyValuePolicies are the policies for fields with an empty value
+// used by callers of ParseWithEmptyValues that don't need their own. Only
+// "file:" is accepted, matching results with any file.
+var DefaultEmptyValuePolicies = map[string]EmptyValuePolicy{
+	"file": EmptyValuePresent,
+}
+
+// ParseWithEmptyValues is like Parse, but applies policies to fields with an
+// empty value, as in "file:". Fields without a policy use EmptyValueReject.
+// Parse itself retains empty values and leaves their meaning to the caller.
+func ParseWithEmptyValues(in string, policies map[string]EmptyValuePolicy) ([]Node, error) {
+	if policies == nil {
+		policies = map[string]EmptyValuePolicy{}
+	}
+	return ParseWithOptions(in, ParseOptions{EmptyValues: policies})
+}
+
+// DuplicatePolicy is the interpretation of a field that occurs more than once,
+// as in "count:10 count:20".
+type DuplicatePolicy int
+
+const (
+	// DuplicateReject rejects every occurrence after the first with an error
+	// positioned at the start of the duplicate parameter.
+	DuplicateReject DuplicatePolicy = iota
+	// DuplicateLastWins removes every occurrence but the last one in the input.
+	DuplicateLastWins
+)
+
+// DefaultDuplicatePolicies are the policies for fields that occur more than
+// once used by callers of ParseWithDuplicatePolicies that don't need their own.
+// Behavior and output fields apply to the whole query, so a duplicate is
+// rejected instead of silently taking precedence.
+var DefaultDuplicatePolicies = map[string]DuplicatePolicy{
+	"case":        DuplicateReject,
+	"count":       DuplicateReject,
+	"patterntype": DuplicateReject,
+	"select":      DuplicateReject,
+}
+
+// ParseWithDuplicatePolicies is like Parse, but applies policies to fields
+// that occur more than once, whether negated or not. Fields without a policy
+// may occur any number of times, as may fields whose values are distributed
+// over a group, as in "count:(10 20)". With DuplicateLastWins, an earlier
+// occurrence equal to the last one is removed as well, so that exactly one
+// occurrence remains, and operators left without operands are removed like by
+// RemoveField. Parse itself retains every occurrence.
+func ParseWithDuplicatePolicies(in string, policies map[string]DuplicatePolicy) ([]Node, error) {
+	return ParseWithOptions(in, ParseOptions{Duplicates: policies})
+}
+
+// CombinePolicy is the interpretation of a field that occurs more than once in
+// a conjunction, as in "repo:a repo:b".
+type CombinePolicy int
+
+const (
+	// CombineAnd requires every occurrence to match, which is the default.
+	CombineAnd CombinePolicy = iota
+	// CombineOr requires any occurrence to match.
+	CombineOr
+)
+
+// DefaultCombinePolicies are the policies for repeated fields used by callers
+// of ParseWithCombinePolicies that don't need their own. A repository has a
+// single name, so repo fields combine as Or, while fields without a policy,
+// like lang, keep combining as And.
+var DefaultCombinePolicies = map[string]CombinePolicy{
+	"repo": CombineOr,
+}
+
+// ParseWithCombinePolicies is like Parse, but combines the occurrences of a
+// field with CombineOr among the operands of the same conjunction into an or
+// operator in place of the first occurrence, as in "repo:a lang:go repo:b x"
+// => "(and (or repo:a repo:b) lang:go x)". Negated occurrences are not
+// combined, since "-repo:a -repo:b" excludes both repositories, nor are
+// occurrences in different groups or operands of different operators. Parse
+// itself combines every field as And.
+func ParseWithCombinePolicies(in string, policies map[string]CombinePolicy) ([]Node, error) {
+	return ParseWithOptions(in, ParseOptions{Combine: policies})
+}
+
+// combineFields returns a copy of nodes, which are operands of a conjunction,
+// where the occurrences of each field with CombineOr in policies are combined
+// into an or operator, and does the same for every nested operator.
+func combineFields(nodes []Node, policies map[string]CombinePolicy) []Node {
+	var result []Node
+	first := make(map[string]int) // The index of the first occurrence of a field in result.
+	for _, node := range nodes {
+		switch v := node.(type) {
+		case Parameter:
+			if v.Field == "" || v.Negated || policies[v.Field] != CombineOr {
+				result = append(result, v)
+				continue
+			}
+			i, ok := first[v.Field]
+			if !ok {
+				first[v.Field] = len(result)
+				result = append(result, v)
+				continue
+			}
+			switch w := result[i].(type) {
+			case Parameter:
+				result[i] = Operator{Kind: Or, Operands: []Node{w, v}}
+			case Operator:
+				w.Operands = append(w.Operands, v)
+				result[i] = w
+			}
+		case Operator:
+			if v.Kind == And {
+				result = append(result, newOperator(combineFields(v.Operands, policies), And)...)
+				continue
+			}
+			operands := make([]Node, 0, len(v.Operands))
+			for _, operand := range v.Operands {
+				operands = append(operands, combineFields([]Node{operand}, policies)...)
+			}
+			result = append(result, Operator{Kind: v.Kind, Operands: operands})
+		default:
+			result = append(result, node)
+		}
+	}
+	return result
+}
+
+// DefaultConstants are the constants used by callers of ParseWithConstants
+// that don't need their own.
+var DefaultConstants = map[string]bool{
+	"true":  true,
+	"false": false,
+}
+
+// ParseWithConstants is like Parse, but parses a search pattern that is a key
+// of constants as a Constant with the corresponding value, as in "a and true".
+// Patterns are matched exactly, so that a quoted pattern, as in `"true"`, or a
+// field value, as in file:true, is never a constant. Parse itself parses "true"
+// and "false" as search patterns. Simplify applies the identities of constants.
+func ParseWithConstants(in string, constants map[string]bool) ([]Node, error) {
+	return ParseWithOptions(in, ParseOptions{Constants: constants})
+}
+
+// ParseWithQuoteEscapes is like Parse, but decodes a search pattern or field
+// value that is a double-quoted string, as in content:"line1\nline2", into its
+// contents without the quotes and sets Quoted. The escape sequences \n, \t, \\
+// and \" inside the quotes are decoded into a newline, a tab, a backslash and a
+// double quote. Any other backslash is retained with the character following
+// it, as in "a\.b" => a\.b, rather than rejected. Values that are only partly
+// quoted, as in a"b", are not decoded, and outside quotes only the escaping of
+// whitespace, parentheses and colons applies. Parse itself retains quotes and
+// escape sequences in values.
+func ParseWithQuoteEscapes(in string) ([]Node, error) {
+	return ParseWithOptions(in, ParseOptions{QuoteEscapes: true})
+}
+
+// ParseWithQuotedFields is like Parse, but also recognizes double-quoted field
+// names, as in "weird field":value, which retain their quotes in
+// Parameter.Field. By default such parameters are patterns, so that searching
+// for JSON keys, as in "version":"1.0", is unaffected.
+func ParseWithQuotedFields(in string) ([]Node, error) {
+	return ParseWithOptions(in, ParseOptions{QuotedFields: true})
+}
+
+// ParseWithPlaceholders is like Parse, but scans placeholders of the form
+// ${NAME} in field values into Parameter.Segments, so that they can be
+// substituted when the query is executed, as in "repo:${ORG}/foo" => segments
+// [${ORG} "/foo"]. A name consists of letters, digits and underscores and does
+// not start with a digit. An escaped dollar, as in repo:\${ORG}, is the
+// literal text "$" in segments, and a dollar that does not start a placeholder
+// is literal text as well. Values themselves are retained as written, and the
+// braces of a placeholder never end a parameter or a block. Placeholders in
+// search patterns are not recognized.
+func ParseWithPlaceholders(in string) ([]Node, error) {
+	return ParseWithOptions(in, ParseOptions{Placeholders: true})
+}
+
+// scanPlaceholders returns the segments of value, or nil if value contains no
+// placeholders.
+func scanPlaceholders(value string) []Segment {
+	var segments []Segment
+	var literal strings.Builder
+	found := false
+	for i := 0; i < len(value); i++ {
+		if strings.HasPrefix(value[i:], `\$`) {
+			literal.WriteByte('$')
+			i++
+			continue
+		}
+		if end := placeholderEnd(value[i:]); end > 0 {
+			if literal.Len() > 0 {
+				segments = append(segments, Segment{Value: literal.String()})
+				literal.Reset()
+			}
+			segments = append(segments, Segment{Value: value[i+2 : i+end-1], Placeholder: true})
+			found = true
+			i += end - 1
+			continue
+		}
+		literal.WriteByte(value[i])
+	}
+	if !found {
+		return nil
+	}
+	if literal.Len() > 0 {
+		segments = append(segments, Segment{Value: literal.String()})
+	}
+	return segments
+}
+
+// placeholderEnd returns the length of the placeholder at the start of s, as in
+// ${ORG}, or 0 if s does not start with a placeholder.
+func placeholderEnd(s string) int {
+	if !strings.HasPrefix(s, "${") {
+		return 0
+	}
+	for i := 2; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '}' && i > 2:
+			return i + 1
+		case c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z'):
+		case '0' <= c && c <= '9' && i > 2:
+		default:
+			return 0
+		}
+	}
+	return 0
+}
+
+// ParseWithSearchType is like Parse, but scans search patterns according to
+// searchType. With query.SearchTypeStructural, a hole of a structural template,
+// as in :[x], :[[x]] or :[ x], is scanned in its entirety, so that whitespace,
+// parentheses and operator keywords inside it are never interpreted, and a
+// parameter whose first colon starts a hole is a search pattern, as in
+// foo:[x], instead of a field foo with value [x].
+//
+// The keywords "and" and "or" are only operators with query.SearchTypeRegex,
+// which Parse uses. With other search types they are search patterns, so that
+// "a and b" => "(concat a and b)" instead of "(and a b)". Parentheses group
+// expressions regardless of the search type.
+func ParseWithSearchType(in string, searchType query.SearchType) ([]Node, error) {
+	return ParseWithOptions(in, ParseOptions{SearchType: searchType})
+}
+
+// ParseWithSeparator is like Parse, but also parses expressions separated by
+// separator into a Then operator, as in "a or b | c" => "(then (or a b) c)"
+// with separator "|", which experimental features may interpret as a sequence
+// of steps. The separator has lower precedence than the or operator and may be
+// used wherever an or operator may, including in parentheses. Like operator
+// keywords, it is matched case insensitively at the start of a parameter, so it
+// should not be the start of a search pattern. The operands of a Then operator
+// are never reordered or combined with those of other operators. Parse itself
+// has no separator.
+func ParseWithSeparator(in, separator string) ([]Node, error) {
+	return ParseWithOptions(in, ParseOptions{Separator: separator})
+}
+
+// ReductionStep is a reduction of the parse tree applied while parsing, as
+// recorded by ParseExplain.
+type ReductionStep struct {
+	// Name is the kind of reduction, which is one of "flatten" (an operand is
+	// replaced by its operands because it is of the same kind as its operator),
+	// "prune" (an empty parameter, as parsed from "()", is removed) and
+	// "promote" (parameters are partitioned into filters and concatenated
+	// patterns).
+	Name   string
+	Before string // The s-expression of the nodes before the reduction.
+	After  string // The s-expression of the nodes after the reduction.
+}
+
+// ParseExplain is like Parse, but also returns the reductions applied to the
+// parse tree in the order they were applied, which shows why a query parses
+// into a given tree. Parse itself records no reductions.
+func ParseExplain(in string) (nodes []Node, steps []ReductionStep, err error) {
+	nodes, err = ParseWithOptions(in, ParseOptions{Steps: &steps})
+	if err != nil {
+		return nil, nil, err
+	}
+	return nodes, steps, nil
+}
+
+// HintKind is the kind of a Hint.
+type HintKind int
+
+const (
+	ExpectedOperand        HintKind = iota // An operand is expected, as after "a and".
+	ExpectedClosingParen                   // A closing parenthesis is expected, as after "(a".
+	UnexpectedClosingParen                 // A closing parenthesis has no opening one, as in "a)".
+)
+
+func (k HintKind) String() string {
+	switch k {
+	case ExpectedOperand:
+		return "expected operand"
+	case ExpectedClosingParen:
+		return "expected closing parenthesis"
+	case UnexpectedClosingParen:
+		return "unexpected closing parenthesis"
+	}
+	return "unknown"
+}
+
+// Hint is a syntax error at position Pos of the input that ParseWithRecovery
+// recovered from.
+type Hint struct {
+	Kind HintKind
+	Pos  int
+}
+
+// ParseWithRecovery is like Parse, but does not stop at syntax errors, which is
+// useful to assist editing a partial query like "repo:foo and ". It returns the
+// best-effort parse tree of the input and a hint for every syntax error in the
+// order they were found. Operators without an operand are dropped, missing
+// closing parentheses are assumed at the end of input, and parsing continues
+// after a closing parenthesis without an opening one. Other errors, such as a
+// *LimitError, are still returned.
+func ParseWithRecovery(in string) ([]Node, []Hint, error) {
+	var hints []Hint
+	nodes, err := ParseWithOptions(in, ParseOptions{Hints: &hints})
+	if err != nil {
+		return nil, nil, err
+	}
+	return nodes, hints, nil
+}
+
+// parse parses in with parser p, whose input buffer is set by parse.
+func parse(in string, limits Limits, p *parser) ([]Node, error) {
+	if limits.MaxLength > 0 && len(in) > limits.MaxLength {
+		return nil, &LimitError{Limit: "length", Max: limits.MaxLength, Pos: limits.MaxLength}
+	}
+	buf, offsets := joinContinuations([]byte(in))
+	if strings.TrimSpace(string(buf)) == "" {
 		return nil, nil
 	}
-	parser := &parser{buf: []byte(in)}
-	nodes, err := parser.parseOr()
+	p.buf = buf
+	p.offsets = offsets
+	nodes, err := p.parseThen()
 	if err != nil {
 		return nil, err
 	}
-	if parser.balanced != 0 {
+	for p.recovering && !p.done() {
+		// Parsing stopped at a closing parenthesis without an opening one.
+		start := p.pos
+		more, err := p.parseThen()
+		if err != nil {
+			return nil, err
+		}
+		if p.pos == start {
+			break
+		}
+		nodes = partitionParametersWithSteps(append(nodes, more...), p.steps)
+	}
+	if p.recovering {
+		for ; p.balanced > 0; p.balanced-- {
+			p.hints = append(p.hints, Hint{Kind: ExpectedClosingParen, Pos: p.inputPos(len(p.buf))})
+		}
+	}
+	if p.balanced != 0 {
 		return nil, errors.New("unbalanced expression")
 	}
-	return newOperator(nodes, And), nil
+	nodes = newOperatorWithSteps(nodes, And, p.steps)
+	for field, last := range p.last {
+		if p.duplicates[field] == DuplicateLastWins {
+			nodes = keepLast(nodes, last)
+		}
+	}
+	if p.combine != nil {
+		nodes = combineFields(nodes, p.combine)
+	}
+	return nodes, nil
 }
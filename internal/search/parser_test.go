@@ -4,15 +4,18 @@ import (
 	"encoding/json"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/sourcegraph/sourcegraph/internal/search/query"
 )
 
 func Test_ScanParameter(t *testing.T) {
 	cases := []struct {
-		Name  string
-		Input string
-		Want  string
+		Name         string
+		Input        string
+		QuotedFields bool
+		Want         string
 	}{
 		{
 			Name:  "Normal field:value",
@@ -55,15 +58,137 @@ func Test_ScanParameter(t *testing.T) {
 			Input: `fie-ld:bar`,
 			Want:  `{"field":"","value":"fie-ld:bar","negated":false}`,
 		},
+		{
+			Name:  "Minus alone is a pattern",
+			Input: `-`,
+			Want:  `{"field":"","value":"-","negated":false}`,
+		},
+		{
+			Name:  "Minus prefix on pattern is not a negation",
+			Input: `-foo`,
+			Want:  `{"field":"","value":"-foo","negated":false}`,
+		},
+		{
+			Name:  "Minus inside pattern",
+			Input: `a-b`,
+			Want:  `{"field":"","value":"a-b","negated":false}`,
+		},
+		{
+			Name:  "Minus before colon is not a valid field",
+			Input: `foo-:bar`,
+			Want:  `{"field":"","value":"foo-:bar","negated":false}`,
+		},
+		{
+			Name:  "Minus prefix and minus in the middle is not a valid field",
+			Input: `-a-b:c`,
+			Want:  `{"field":"","value":"-a-b:c","negated":false}`,
+		},
+		{
+			Name:  "Minus prefix on value is part of the value",
+			Input: `foo:-bar`,
+			Want:  `{"field":"foo","value":"-bar","negated":false}`,
+		},
+		{
+			Name:  "Quoted field is a pattern by default",
+			Input: `"repo":foo`,
+			Want:  `{"field":"","value":"\"repo\":foo","negated":false}`,
+		},
+		{
+			Name:  "Quoted JSON key is a pattern by default",
+			Input: `"version":"1.0"`,
+			Want:  `{"field":"","value":"\"version\":\"1.0\"","negated":false}`,
+		},
+		{
+			Name:         "Quoted field",
+			Input:        `"repo":foo`,
+			QuotedFields: true,
+			Want:         `{"field":"\"repo\"","value":"foo","negated":false}`,
+		},
+		{
+			Name:         "Quoted field with space",
+			Input:        `"weird field":foo`,
+			QuotedFields: true,
+			Want:         `{"field":"\"weird field\"","value":"foo","negated":false}`,
+		},
+		{
+			Name:         "Quoted field matches colon after closing quote",
+			Input:        `"a:b":c:d`,
+			QuotedFields: true,
+			Want:         `{"field":"\"a:b\"","value":"c:d","negated":false}`,
+		},
+		{
+			Name:         "Negated quoted field",
+			Input:        `-"weird field":foo`,
+			QuotedFields: true,
+			Want:         `{"field":"\"weird field\"","value":"foo","negated":true}`,
+		},
+		{
+			Name:         "Quoted field with escaped quote",
+			Input:        `"a\"b":foo`,
+			QuotedFields: true,
+			Want:         `{"field":"\"a\\\"b\"","value":"foo","negated":false}`,
+		},
+		{
+			Name:         "Empty quoted field is a pattern",
+			Input:        `"":foo`,
+			QuotedFields: true,
+			Want:         `{"field":"","value":"\"\":foo","negated":false}`,
+		},
+		{
+			Name:         "Quoted string without colon after closing quote is a pattern",
+			Input:        `"a"b:foo`,
+			QuotedFields: true,
+			Want:         `{"field":"","value":"\"a\"b:foo","negated":false}`,
+		},
+		{
+			Name:  "Minus before quoted field is a pattern",
+			Input: `-"repo:foo"`,
+			Want:  `{"field":"","value":"-\"repo:foo\"","negated":false}`,
+		},
+		{
+			Name:  "Escaped colon in field position is a pattern",
+			Input: `foo\:bar`,
+			Want:  `{"field":"","value":"foo:bar","negated":false}`,
+		},
+		{
+			Name:  "Escaped colon with minus prefix is a pattern",
+			Input: `-foo\:bar`,
+			Want:  `{"field":"","value":"-foo:bar","negated":false}`,
+		},
+		{
+			Name:  "Escaped colon after unescaped colon is part of the value",
+			Input: `foo:bar\:baz`,
+			Want:  `{"field":"foo","value":"bar\\:baz","negated":false}`,
+		},
+		{
+			Name:  "Escaped colon outside field position is untouched",
+			Input: `fie-ld\:bar`,
+			Want:  `{"field":"","value":"fie-ld\\:bar","negated":false}`,
+		},
 		{
 			Name:  "No effect on escaped whitespace",
 			Input: `a\ pattern`,
 			Want:  `{"field":"","value":"a\\ pattern","negated":false}`,
 		},
+		{
+			Name:  "Quoted whitespace is part of the value",
+			Input: `content:"a pattern"`,
+			Want:  `{"field":"content","value":"\"a pattern\"","negated":false}`,
+		},
+		{
+			Name:  "Quoted parentheses are part of the value",
+			Input: `"(a)"`,
+			Want:  `{"field":"","value":"\"(a)\"","negated":false}`,
+		},
+		{
+			Name:  "Unterminated quote stops at whitespace",
+			Input: `"a pattern`,
+			Want:  `{"field":"","value":"\"a","negated":false}`,
+		},
 	}
 	for _, tt := range cases {
 		t.Run(tt.Name, func(t *testing.T) {
-			parser := &parser{buf: []byte(tt.Input)}
+			parser := &parser{buf: []byte(tt.Input), quotedFields: tt.QuotedFields}
 			result := parser.ParseParameter()
 			got, _ := json.Marshal(result)
 			if diff := cmp.Diff(tt.Want, string(got)); diff != "" {
@@ -84,11 +209,31 @@ func Test_Parse(t *testing.T) {
 			Input: "",
 			Want:  "",
 		},
+		{
+			Name:  "Whitespace only",
+			Input: " \t ",
+			Want:  "",
+		},
 		{
 			Name:  "Single",
 			Input: "a",
 			Want:  "a",
 		},
+		{
+			Name:  "Single surrounded by whitespace",
+			Input: " a ",
+			Want:  "a",
+		},
+		{
+			Name:  "Single filter",
+			Input: "repo:foo",
+			Want:  "repo:foo",
+		},
+		{
+			Name:  "Single negated filter",
+			Input: "-repo:foo",
+			Want:  "-repo:foo",
+		},
 		{
 			Name:  "Whitespace basic",
 			Input: "a b",
@@ -107,6 +252,42 @@ func Test_Parse(t *testing.T) {
 			Input: "aANDb",
 			Want:  "aANDb",
 		},
+		// Operator precedence: concatenation binds tighter than and, which binds tighter than or.
+		{
+			Name:  "Precedence of and over or on the left",
+			Input: "a and b or c",
+			Want:  "(or (and a b) c)",
+		},
+		{
+			Name:  "Precedence of and over or on the right",
+			Input: "a or b and c",
+			Want:  "(or a (and b c))",
+		},
+		{
+			Name:  "Associativity of or",
+			Input: "a or b or c",
+			Want:  "(or a b c)",
+		},
+		{
+			Name:  "Precedence of concatenation over and on the left",
+			Input: "a b and c",
+			Want:  "(and (concat a b) c)",
+		},
+		{
+			Name:  "Precedence of concatenation over and on the right",
+			Input: "a and b c",
+			Want:  "(and a (concat b c))",
+		},
+		{
+			Name:  "Precedence of concatenation over or on the left",
+			Input: "a b or c",
+			Want:  "(or (concat a b) c)",
+		},
+		{
+			Name:  "Precedence of concatenation over or on the right",
+			Input: "a or b c",
+			Want:  "(or a (concat b c))",
+		},
 		{
 			Name:  "Reduced complex query mixed caps",
 			Input: "a and b AND c or d and (e OR f) g h i or j",
@@ -144,6 +325,7 @@ func Test_Parse(t *testing.T) {
 		},
 		// Partition parameters and concatenated patterns.
 		{
+			Name:  "Operator in sequence of patterns is an element of the concat",
 			Input: "a (b and c) d",
 			Want:  "(concat a (and b c) d)",
 		},
@@ -159,6 +341,16 @@ func Test_Parse(t *testing.T) {
 			Input: "a b (repo:foo c d)",
 			Want:  "(concat a b (and repo:foo (concat c d)))",
 		},
+		{
+			Name:  "Negated filter in sequence of patterns is promoted",
+			Input: "foo -lang:go bar",
+			Want:  "(and -lang:go (concat foo bar))",
+		},
+		{
+			Name:  "Negated and positive filters in sequence of patterns are promoted",
+			Input: "foo lang:go -file:test bar",
+			Want:  "(and lang:go -file:test (concat foo bar))",
+		},
 		{
 			Input: "a repo:b repo:c (d repo:e repo:f)",
 			Want:  "(and repo:b repo:c (concat a (and repo:e repo:f d)))",
@@ -183,6 +375,339 @@ func Test_Parse(t *testing.T) {
 			Input: "a repo:b repo:c (d repo:e repo:f e)",
 			Want:  "(and repo:b repo:c (concat a (and repo:e repo:f (concat d e))))",
 		},
+		// Quoted operator keywords.
+		{
+			Name:  "Quoted and is a pattern",
+			Input: `a "and" b`,
+			Want:  `(concat a "and" b)`,
+		},
+		{
+			Name:  "Quoted or is a pattern",
+			Input: `"or"`,
+			Want:  `"or"`,
+		},
+		{
+			Name:  "Quoted operator keyword as field value",
+			Input: `content:"and"`,
+			Want:  `content:"and"`,
+		},
+		{
+			Name:  "Operator keyword inside quoted field value",
+			Input: `content:"a and b" or c`,
+			Want:  `(or content:"a and b" c)`,
+		},
+		{
+			Name:  "Parentheses and operators inside quotes",
+			Input: `"a or (b" and c`,
+			Want:  `(and "a or (b" c)`,
+		},
+		{
+			Name:  "Escaped quote inside quotes",
+			Input: `"a \" and b"`,
+			Want:  `"a \" and b"`,
+		},
+		{
+			Name:  "Unterminated quote does not hide operators",
+			Input: `"a and b`,
+			Want:  `(and "a b)`,
+		},
+		{
+			Name:  "Quoted field name is a pattern",
+			Input: `"repo":foo a`,
+			Want:  `(concat "repo":foo a)`,
+		},
+		{
+			Name:  "Quoted field name with space is a pattern",
+			Input: `a "weird field":"b c"`,
+			Want:  `(concat a "weird field":"b c")`,
+		},
+		{
+			Name:  "Quoted field name and operator keyword",
+			Input: `"repo":"and" or "and"`,
+			Want:  `(or "repo":"and" "and")`,
+		},
+		// Filter scoping over groups.
+		{
+			Name:  "Pattern-only group inherits outer filter",
+			Input: "repo:foo (bar baz)",
+			Want:  "(and repo:foo (concat bar baz))",
+		},
+		{
+			Name:  "Single pattern group inherits outer filter",
+			Input: "repo:foo (bar)",
+			Want:  "(and repo:foo bar)",
+		},
+		{
+			Name:  "Alternation group inherits outer filter",
+			Input: "repo:foo (bar or baz)",
+			Want:  "(and repo:foo (or bar baz))",
+		},
+		{
+			Name:  "Leading file filter scopes alternation group",
+			Input: "file:foo (a or b)",
+			Want:  "(and file:foo (or a b))",
+		},
+		{
+			Name:  "Trailing file filter scopes alternation group",
+			Input: "(a or b) file:foo",
+			Want:  "(and file:foo (or a b))",
+		},
+		{
+			Name:  "Negated file filter scopes alternation group",
+			Input: "-file:foo (a or b)",
+			Want:  "(and -file:foo (or a b))",
+		},
+		{
+			Name:  "Multiple filters scope alternation group",
+			Input: "file:foo repo:bar (a or b)",
+			Want:  "(and file:foo repo:bar (or a b))",
+		},
+		{
+			Name:  "File filter scopes alternation group concatenated with pattern",
+			Input: "file:foo (a or b) c",
+			Want:  "(and file:foo (concat (or a b) c))",
+		},
+		{
+			Name:  "File filter does not scope over top-level or",
+			Input: "file:foo (a or b) or c",
+			Want:  "(or (and file:foo (or a b)) c)",
+		},
+		{
+			Name:  "Inner filter intersects with outer filter",
+			Input: "repo:foo (repo:bar baz)",
+			Want:  "(and repo:foo repo:bar baz)",
+		},
+		{
+			Name:  "Nested inner filter intersects with outer filter",
+			Input: "repo:foo (repo:bar (baz))",
+			Want:  "(and repo:foo repo:bar baz)",
+		},
+		// Field distribution over groups.
+		{
+			Name:  "Field distributes over alternation",
+			Input: "repo:(a or b)",
+			Want:  "(or repo:a repo:b)",
+		},
+		{
+			Name:  "Field distributes over concatenation",
+			Input: "file:(x y)",
+			Want:  "(and file:x file:y)",
+		},
+		{
+			Name:  "Negated field distributes over alternation",
+			Input: "-repo:(a or b)",
+			Want:  "(and -repo:a -repo:b)",
+		},
+		{
+			Name:  "Negated field distributes over concatenation",
+			Input: "-file:(x y)",
+			Want:  "(or -file:x -file:y)",
+		},
+		{
+			Name:  "Negated field distributes over nested groups",
+			Input: "-file:(x (y or z))",
+			Want:  "(or -file:x (and -file:y -file:z))",
+		},
+		{
+			Name:  "Distributed field is scoped with other filters",
+			Input: "repo:foo -repo:(a or b) c",
+			Want:  "(and repo:foo -repo:a -repo:b c)",
+		},
+		{
+			Name:  "Field group containing fields",
+			Input: "repo:(a file:b)",
+			Want:  "unexpected field file in group for field repo",
+		},
+		// Minus.
+		{
+			Name:  "Minus separated from field by whitespace",
+			Input: "- repo:foo",
+			Want:  "(and repo:foo -)",
+		},
+		{
+			Name:  "Trailing minus",
+			Input: "a -",
+			Want:  "(concat a -)",
+		},
+		{
+			Name:  "Negated field in group",
+			Input: "a (-repo:foo)",
+			Want:  "(and -repo:foo a)",
+		},
+		// Operator casing.
+		{
+			Name:  "Uppercase and",
+			Input: "a AND b",
+			Want:  "(and a b)",
+		},
+		{
+			Name:  "Mixed case or",
+			Input: "a Or b",
+			Want:  "(or a b)",
+		},
+		{
+			Name:  "Mixed case operators in groups",
+			Input: "A aNd (b OR c)",
+			Want:  "(and A (or b c))",
+		},
+		{
+			Name:  "Uppercase operator in negated group",
+			Input: "-(a OR b)",
+			Want:  "(not (or a b))",
+		},
+		// Negated groups.
+		{
+			Name:  "Negated group of one pattern",
+			Input: "-(a)",
+			Want:  "(not a)",
+		},
+		{
+			Name:  "Negated concat",
+			Input: "-(a b)",
+			Want:  "(not (concat a b))",
+		},
+		{
+			Name:  "Negated or-expression",
+			Input: "-(a or b)",
+			Want:  "(not (or a b))",
+		},
+		{
+			Name:  "Nested negated groups",
+			Input: "-(a -(b c))",
+			Want:  "(not (concat a (not (concat b c))))",
+		},
+		{
+			Name:  "Negated group between patterns is not flattened",
+			Input: "x -(a b) y",
+			Want:  "(concat x (not (concat a b)) y)",
+		},
+		{
+			Name:  "Negated group alongside filter",
+			Input: "repo:foo -(a b)",
+			Want:  "(and repo:foo (not (concat a b)))",
+		},
+		{
+			Name:  "Negated empty group",
+			Input: "a -()",
+			Want:  "a",
+		},
+		{
+			Name:  "Minus separated from group is a pattern",
+			Input: "- (a)",
+			Want:  "(concat - a)",
+		},
+		{
+			Name:  "Negated group in field group",
+			Input: "repo:(a -(b))",
+			Want:  "unexpected negated group in group for field repo",
+		},
+		// Blocks.
+		{
+			Name:  "Block",
+			Input: "repo:foo { bar baz }",
+			Want:  "(and repo:foo (concat bar baz))",
+		},
+		{
+			Name:  "Block is scoped to its filter",
+			Input: "a repo:foo { b } c",
+			Want:  "(concat a (and repo:foo b) c)",
+		},
+		{
+			Name:  "Nested blocks",
+			Input: "repo:foo { file:bar { a } b }",
+			Want:  "(and repo:foo (concat (and file:bar a) b))",
+		},
+		{
+			Name:  "Group in block",
+			Input: "repo:foo { (a or b) c }",
+			Want:  "(and repo:foo (concat (or a b) c))",
+		},
+		{
+			Name:  "Block in group",
+			Input: "(repo:foo { a }) or b",
+			Want:  "(or (and repo:foo a) b)",
+		},
+		{
+			Name:  "Operators in block",
+			Input: "-repo:foo { a or b }",
+			Want:  "(and -repo:foo (or a b))",
+		},
+		{
+			Name:  "Braces of regular expressions are not blocks",
+			Input: "repo:foo a{2} {b}",
+			Want:  "(and repo:foo (concat a{2} {b}))",
+		},
+		{
+			Name:  "Brace after pattern is not a block",
+			Input: "a { b }",
+			Want:  "(concat a { b })",
+		},
+		{
+			Name:  "Nested braces after pattern are not blocks",
+			Input: "a { { b } }",
+			Want:  "(concat a { { b } })",
+		},
+		{
+			Name:  "Closing brace without block",
+			Input: "repo:foo { a } }",
+			Want:  "unbalanced expression at 15",
+		},
+		{
+			Name:  "Closing brace without opening brace",
+			Input: "a } b",
+			Want:  "unbalanced expression at 2",
+		},
+		{
+			Name:  "Closing brace after closed literal brace",
+			Input: "a { b } }",
+			Want:  "unbalanced expression at 8",
+		},
+		{
+			Name:  "Escaped closing brace is a pattern",
+			Input: `a \}`,
+			Want:  `(concat a \})`,
+		},
+		{
+			Name:  "Unclosed block",
+			Input: "repo:foo { a",
+			Want:  "unbalanced expression at 9",
+		},
+		{
+			Name:  "Unclosed block at end of input",
+			Input: "repo:foo {",
+			Want:  "unbalanced expression at 9",
+		},
+		{
+			Name:  "Block closed inside group",
+			Input: "repo:foo { (a } )",
+			Want:  "unbalanced expression at 14",
+		},
+		{
+			Name:  "Group closed inside block",
+			Input: "(repo:foo { a ) }",
+			Want:  "unbalanced expression at 16",
+		},
+		{
+			Name:  "Empty block",
+			Input: "repo:foo { }",
+			Want:  "expected operand at 11",
+		},
+		{
+			Name:  "Trailing operator in block",
+			Input: "repo:foo { a or }",
+			Want:  "expected operand at 16",
+		},
+		// Empty values.
+		{
+			Name:  "Empty value is retained",
+			Input: "file: a",
+			Want:  "(and file: a)",
+		},
+		{
+			Name:  "Empty value in or-expression",
+			Input: "repo: or a",
+			Want:  "(or repo: a)",
+		},
 		// Errors.
 		{
 			Name:  "Unbalanced",
@@ -204,6 +729,46 @@ func Test_Parse(t *testing.T) {
 			Input: "a and OR",
 			Want:  "expected operand at 6",
 		},
+		{
+			Name:  "Adjacent and operators",
+			Input: "a and and b",
+			Want:  "expected operand at 6",
+		},
+		{
+			Name:  "Adjacent and, or operators",
+			Input: "a and or b",
+			Want:  "expected operand at 6",
+		},
+		{
+			Name:  "Adjacent or, and operators",
+			Input: "a or and b",
+			Want:  "expected operand at 5",
+		},
+		{
+			Name:  "Leading and operator",
+			Input: "and a",
+			Want:  "expected operand at 0",
+		},
+		{
+			Name:  "Trailing and operator",
+			Input: "a and",
+			Want:  "expected operand at 5",
+		},
+		{
+			Name:  "Trailing operator in group",
+			Input: "(a or)",
+			Want:  "expected operand at 5",
+		},
+		{
+			Name:  "Trailing operator before closing parenthesis",
+			Input: "a and )",
+			Want:  "expected operand at 6",
+		},
+		{
+			Name:  "Leading operator in group",
+			Input: "a or (and b)",
+			Want:  "expected operand at 6",
+		},
 		{
 			Name:  "Illegal expression on the left",
 			Input: "or",
@@ -312,3 +877,1820 @@ func Test_Parse(t *testing.T) {
 		})
 	}
 }
+
+func Test_ParseSmallestInputs(t *testing.T) {
+	cases := []struct {
+		Input string
+		Want  []Node
+	}{
+		{Input: "", Want: nil},
+		{Input: "   ", Want: nil},
+		{Input: "a", Want: []Node{Parameter{Value: "a"}}},
+		{Input: "repo:foo", Want: []Node{Parameter{Field: "repo", Value: "foo"}}},
+		{Input: "-repo:foo", Want: []Node{Parameter{Field: "repo", Value: "foo", Negated: true}}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Input, func(t *testing.T) {
+			got, err := Parse(tt.Input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.Want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func Test_ParseWithLimits(t *testing.T) {
+	limits := Limits{MaxLength: 16, MaxTokens: 5}
+	cases := []struct {
+		Name  string
+		Input string
+		Want  string
+	}{
+		{
+			Name:  "At length limit",
+			Input: strings.Repeat("a", 16),
+			Want:  strings.Repeat("a", 16),
+		},
+		{
+			Name:  "Above length limit",
+			Input: strings.Repeat("a", 17),
+			Want:  "query exceeds maximum length of 16 at 16",
+		},
+		{
+			Name:  "At token limit",
+			Input: "(a) or b",
+			Want:  "(or a b)",
+		},
+		{
+			Name:  "Above token limit",
+			Input: "(a) or b c",
+			Want:  "query exceeds maximum tokens of 5 at 9",
+		},
+		{
+			Name:  "Above token limit with operators",
+			Input: "a or b or c or d",
+			Want:  "query exceeds maximum tokens of 5 at 12",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			result, err := ParseWithLimits(tt.Input, limits)
+			if err != nil {
+				if _, ok := err.(*LimitError); !ok {
+					t.Fatalf("want *LimitError but got %T", err)
+				}
+				if diff := cmp.Diff(tt.Want, err.Error()); diff != "" {
+					t.Fatal(diff)
+				}
+				return
+			}
+			var resultStr []string
+			for _, node := range result {
+				resultStr = append(resultStr, node.String())
+			}
+			if diff := cmp.Diff(tt.Want, strings.Join(resultStr, " ")); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+
+	t.Run("Default limits", func(t *testing.T) {
+		_, err := Parse(strings.Repeat("a ", DefaultLimits.MaxTokens+1))
+		if _, ok := err.(*LimitError); !ok {
+			t.Fatalf("want *LimitError but got %v", err)
+		}
+	})
+}
+
+func Test_ParseWithGroupMode(t *testing.T) {
+	cases := []struct {
+		Name         string
+		Input        string
+		WantSemantic string
+		WantFaithful string
+	}{
+		{
+			Name:         "Nested empty paren",
+			Input:        "(x())",
+			WantSemantic: "x",
+			WantFaithful: "(group x)",
+		},
+		{
+			Name:         "Empty paren",
+			Input:        "()",
+			WantSemantic: "",
+			WantFaithful: "",
+		},
+		{
+			Name:         "Ungrouped",
+			Input:        "a b",
+			WantSemantic: "(concat a b)",
+			WantFaithful: "(concat a b)",
+		},
+		{
+			Name:         "Grouped and-expression",
+			Input:        "(a and b) and c",
+			WantSemantic: "(and a b c)",
+			WantFaithful: "(and (group (and a b)) c)",
+		},
+		{
+			Name:         "Grouped patterns",
+			Input:        "repo:foo (a b) c",
+			WantSemantic: "(and repo:foo (concat a b c))",
+			WantFaithful: "(and repo:foo (concat (group (concat a b)) c))",
+		},
+		{
+			Name:         "Nested groups",
+			Input:        "((x))",
+			WantSemantic: "x",
+			WantFaithful: "(group (group x))",
+		},
+		{
+			Name:         "Group in negated field",
+			Input:        "-repo:((a) or b)",
+			WantSemantic: "(and -repo:a -repo:b)",
+			WantFaithful: "(and (group -repo:a) -repo:b)",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			for mode, want := range map[GroupMode]string{
+				GroupSemantic: tt.WantSemantic,
+				GroupFaithful: tt.WantFaithful,
+			} {
+				result, err := ParseWithGroupMode(tt.Input, mode)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var resultStr []string
+				for _, node := range result {
+					resultStr = append(resultStr, node.String())
+				}
+				if diff := cmp.Diff(want, strings.Join(resultStr, " ")); diff != "" {
+					t.Errorf("mode %d: %s", mode, diff)
+				}
+			}
+		})
+	}
+}
+
+func Test_ParseStrict(t *testing.T) {
+	knownFields := []string{"repo", "file"}
+	cases := []struct {
+		Name      string
+		Input     string
+		Want      string
+		WantError string
+	}{
+		{
+			Name:  "Known fields",
+			Input: "repo:foo -file:bar baz",
+			Want:  "(and repo:foo -file:bar baz)",
+		},
+		{
+			Name:  "Escaped colon is a pattern",
+			Input: `fooo\:bar`,
+			Want:  "fooo:bar",
+		},
+		{
+			Name:      "Unknown field",
+			Input:     "fooo:bar",
+			WantError: "unknown field fooo at 0",
+		},
+		{
+			Name:      "Unknown negated field",
+			Input:     "repo:foo -fooo:bar",
+			WantError: "unknown field fooo at 9",
+		},
+		{
+			Name:      "Unknown field in group",
+			Input:     "repo:foo (a or fooo:bar)",
+			WantError: "unknown field fooo at 15",
+		},
+		{
+			Name:      "Unknown field distributed over group",
+			Input:     "fooo:(a b)",
+			WantError: "unknown field fooo at 0",
+		},
+		{
+			Name:      "Fields are case sensitive",
+			Input:     "Repo:foo",
+			WantError: "unknown field Repo at 0, did you mean repo:?",
+		},
+		{
+			Name:      "Transposed letters",
+			Input:     "rpeo:foo",
+			WantError: "unknown field rpeo at 0, did you mean repo:?",
+		},
+		{
+			Name:      "Missing letter",
+			Input:     "a fil:bar",
+			WantError: "unknown field fil at 2, did you mean file:?",
+		},
+		{
+			Name:      "Extra letters",
+			Input:     "-filess:bar",
+			WantError: "unknown field filess at 0, did you mean file:?",
+		},
+		{
+			Name:      "Too far from known fields",
+			Input:     "reeeeepo:foo",
+			WantError: "unknown field reeeeepo at 0",
+		},
+		{
+			Name:      "Short field",
+			Input:     "r:foo",
+			WantError: "unknown field r at 0",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			result, err := ParseStrict(tt.Input, knownFields)
+			if tt.WantError != "" {
+				if err == nil {
+					t.Fatalf("expected error %q but got nil", tt.WantError)
+				}
+				if diff := cmp.Diff(tt.WantError, err.Error()); diff != "" {
+					t.Fatal(diff)
+				}
+				// The lenient parser accepts the same input.
+				if _, err := Parse(tt.Input); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resultStr []string
+			for _, node := range result {
+				resultStr = append(resultStr, node.String())
+			}
+			if diff := cmp.Diff(tt.Want, strings.Join(resultStr, " ")); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func Test_ParseWithTopLevelFields(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Input     string
+		Want      string
+		WantError string
+	}{
+		{
+			Name:  "Behavior fields at the top level",
+			Input: "case:yes (a or b) count:10",
+			Want:  "(and case:yes count:10 (or a b))",
+		},
+		{
+			Name:  "Negated behavior field at the top level",
+			Input: "-patterntype:regexp a",
+			Want:  "(and -patterntype:regexp a)",
+		},
+		{
+			Name:  "Other fields in a group",
+			Input: "case:yes (repo:foo or file:bar)",
+			Want:  "(and case:yes (or repo:foo file:bar))",
+		},
+		{
+			Name:      "Behavior field in a group",
+			Input:     "a (b case:yes)",
+			WantError: "field case must appear at the top level at 5",
+		},
+		{
+			Name:      "Behavior field in an or-expression in a group",
+			Input:     "(a or patterntype:regexp)",
+			WantError: "field patterntype must appear at the top level at 6",
+		},
+		{
+			Name:      "Behavior field in a nested group",
+			Input:     "((count:10))",
+			WantError: "field count must appear at the top level at 2",
+		},
+		{
+			Name:      "Behavior field in a negated group",
+			Input:     "-(a case:yes)",
+			WantError: "field case must appear at the top level at 4",
+		},
+		{
+			Name:  "Behavior field distributed over a group",
+			Input: "case:(yes) a",
+			Want:  "(and case:yes a)",
+		},
+		{
+			Name:      "Behavior field in a block",
+			Input:     "repo:foo { a count:10 }",
+			WantError: "field count must appear at the top level at 13",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			result, err := ParseWithTopLevelFields(tt.Input, DefaultTopLevelFields)
+			if tt.WantError != "" {
+				if err == nil {
+					t.Fatalf("expected error %q but got nil", tt.WantError)
+				}
+				if diff := cmp.Diff(tt.WantError, err.Error()); diff != "" {
+					t.Fatal(diff)
+				}
+				// The lenient parser accepts the same input.
+				if _, err := Parse(tt.Input); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resultStr []string
+			for _, node := range result {
+				resultStr = append(resultStr, node.String())
+			}
+			if diff := cmp.Diff(tt.Want, strings.Join(resultStr, " ")); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func Test_ParseWithDuplicatePolicies(t *testing.T) {
+	policies := map[string]DuplicatePolicy{
+		"case":        DuplicateReject,
+		"patterntype": DuplicateReject,
+		"count":       DuplicateLastWins,
+	}
+	cases := []struct {
+		Name      string
+		Input     string
+		Want      string
+		WantError string
+	}{
+		{
+			Name:  "Single occurrences",
+			Input: "case:yes count:10 patterntype:regexp a",
+			Want:  "(and case:yes count:10 patterntype:regexp a)",
+		},
+		{
+			Name:      "Duplicate case",
+			Input:     "case:yes a case:no",
+			WantError: "duplicate field case at 11",
+		},
+		{
+			Name:      "Duplicate negated patterntype",
+			Input:     "patterntype:regexp -patterntype:literal",
+			WantError: "duplicate field patterntype at 19",
+		},
+		{
+			Name:      "Duplicate with equal value",
+			Input:     "case:yes case:yes",
+			WantError: "duplicate field case at 9",
+		},
+		{
+			Name:  "Last count wins",
+			Input: "count:10 a count:20",
+			Want:  "(and count:20 a)",
+		},
+		{
+			Name:  "Last count wins over equal earlier value",
+			Input: "count:20 count:10 count:20",
+			Want:  "count:20",
+		},
+		{
+			Name:  "Last count wins in a group",
+			Input: "(count:10 a) or count:20",
+			Want:  "(or a count:20)",
+		},
+		{
+			Name:  "Fields without a policy",
+			Input: "repo:foo repo:bar",
+			Want:  "(and repo:foo repo:bar)",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			result, err := ParseWithDuplicatePolicies(tt.Input, policies)
+			if tt.WantError != "" {
+				if err == nil {
+					t.Fatalf("expected error %q but got nil", tt.WantError)
+				}
+				if diff := cmp.Diff(tt.WantError, err.Error()); diff != "" {
+					t.Fatal(diff)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resultStr []string
+			for _, node := range result {
+				resultStr = append(resultStr, node.String())
+			}
+			if diff := cmp.Diff(tt.Want, strings.Join(resultStr, " ")); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func Test_ParseWithCombinePolicies(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Input string
+		Want  string
+	}{
+		{
+			Name:  "Repo combines as or",
+			Input: "repo:a repo:b",
+			Want:  "(or repo:a repo:b)",
+		},
+		{
+			Name:  "Repo combines as or in place of the first occurrence",
+			Input: "repo:a lang:go repo:b repo:c x",
+			Want:  "(and (or repo:a repo:b repo:c) lang:go x)",
+		},
+		{
+			Name:  "Lang combines as and by default",
+			Input: "lang:go lang:rust x",
+			Want:  "(and lang:go lang:rust x)",
+		},
+		{
+			Name:  "Single occurrence",
+			Input: "repo:a x",
+			Want:  "(and repo:a x)",
+		},
+		{
+			Name:  "Negated occurrences combine as and",
+			Input: "-repo:a -repo:b repo:c",
+			Want:  "(and -repo:a -repo:b repo:c)",
+		},
+		{
+			Name:  "Explicit and operator",
+			Input: "repo:a and repo:b and x",
+			Want:  "(and (or repo:a repo:b) x)",
+		},
+		{
+			Name:  "Occurrences in a nested conjunction",
+			Input: "(repo:a repo:b x) or (repo:c y)",
+			Want:  "(or (and (or repo:a repo:b) x) (and repo:c y))",
+		},
+		{
+			Name:  "Occurrences in different groups",
+			Input: "(repo:a x) (repo:b y)",
+			Want:  "(concat (and repo:a x) (and repo:b y))",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			result, err := ParseWithCombinePolicies(tt.Input, DefaultCombinePolicies)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resultStr []string
+			for _, node := range result {
+				resultStr = append(resultStr, node.String())
+			}
+			if diff := cmp.Diff(tt.Want, strings.Join(resultStr, " ")); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func Test_ParseWithEmptyValues(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Input     string
+		Policies  map[string]EmptyValuePolicy
+		Want      string
+		WantError string
+	}{
+		{
+			Name:     "File may be empty",
+			Input:    "file: a",
+			Policies: DefaultEmptyValuePolicies,
+			Want:     "(and file: a)",
+		},
+		{
+			Name:     "Negated file may be empty",
+			Input:    "-file: a",
+			Policies: DefaultEmptyValuePolicies,
+			Want:     "(and -file: a)",
+		},
+		{
+			Name:      "Empty repo",
+			Input:     "a repo:",
+			Policies:  DefaultEmptyValuePolicies,
+			WantError: "empty value for field repo at 2",
+		},
+		{
+			Name:      "Empty negated repo",
+			Input:     "-repo:",
+			Policies:  DefaultEmptyValuePolicies,
+			WantError: "empty value for field repo at 0",
+		},
+		{
+			Name:     "Nonempty repo",
+			Input:    "repo:foo",
+			Policies: DefaultEmptyValuePolicies,
+			Want:     "repo:foo",
+		},
+		{
+			Name:     "Ignored field",
+			Input:    "lang: a b",
+			Policies: map[string]EmptyValuePolicy{"lang": EmptyValueIgnore},
+			Want:     "(concat a b)",
+		},
+		{
+			Name:     "Field distributed over group is not empty",
+			Input:    "repo:(a b)",
+			Policies: map[string]EmptyValuePolicy{},
+			Want:     "(and repo:a repo:b)",
+		},
+		{
+			Name:      "Nil policies reject",
+			Input:     "file:",
+			WantError: "empty value for field file at 0",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			result, err := ParseWithEmptyValues(tt.Input, tt.Policies)
+			if tt.WantError != "" {
+				if err == nil {
+					t.Fatalf("expected error %q but got nil", tt.WantError)
+				}
+				if diff := cmp.Diff(tt.WantError, err.Error()); diff != "" {
+					t.Fatal(diff)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resultStr []string
+			for _, node := range result {
+				resultStr = append(resultStr, node.String())
+			}
+			if diff := cmp.Diff(tt.Want, strings.Join(resultStr, " ")); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func Test_ParseWithConstants(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Input     string
+		Constants map[string]bool
+		Want      string
+	}{
+		{
+			Name:      "True",
+			Input:     "true",
+			Constants: DefaultConstants,
+			Want:      "(true)",
+		},
+		{
+			Name:      "Constant with filter",
+			Input:     "repo:foo and false",
+			Constants: DefaultConstants,
+			Want:      "(and repo:foo (false))",
+		},
+		{
+			Name:      "Constants are not concatenated with patterns",
+			Input:     "a true b",
+			Constants: DefaultConstants,
+			Want:      "(and (true) (concat a b))",
+		},
+		{
+			Name:      "Negated constant",
+			Input:     "-(false)",
+			Constants: DefaultConstants,
+			Want:      "(not (false))",
+		},
+		{
+			Name:      "Quoted pattern",
+			Input:     `"true"`,
+			Constants: DefaultConstants,
+			Want:      `"true"`,
+		},
+		{
+			Name:      "Field value",
+			Input:     "file:true",
+			Constants: DefaultConstants,
+			Want:      "file:true",
+		},
+		{
+			Name:      "Constants are matched exactly",
+			Input:     "TRUE",
+			Constants: DefaultConstants,
+			Want:      "TRUE",
+		},
+		{
+			Name:      "Field distributed over constant",
+			Input:     "-repo:(a or true)",
+			Constants: DefaultConstants,
+			Want:      "(and -repo:a (false))",
+		},
+		{
+			Name:      "Custom constants",
+			Input:     "* or none",
+			Constants: map[string]bool{"*": true, "none": false},
+			Want:      "(or (true) (false))",
+		},
+		{
+			Name:  "Patterns without constants",
+			Input: "true or false",
+			Want:  "(or true false)",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			result, err := ParseWithConstants(tt.Input, tt.Constants)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resultStr []string
+			for _, node := range result {
+				resultStr = append(resultStr, node.String())
+			}
+			if diff := cmp.Diff(tt.Want, strings.Join(resultStr, " ")); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+
+	// Parse keeps true and false as search patterns.
+	result, err := Parse("true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]Node{Parameter{Value: "true"}}, result); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func Test_ParseWithQuoteEscapes(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Input string
+		Want  []Node
+	}{
+		{
+			Name:  "Newline",
+			Input: `content:"line1\nline2"`,
+			Want:  []Node{Parameter{Field: "content", Value: "line1\nline2", Quoted: true}},
+		},
+		{
+			Name:  "Tab",
+			Input: `"a\tb"`,
+			Want:  []Node{Parameter{Value: "a\tb", Quoted: true}},
+		},
+		{
+			Name:  "Backslash",
+			Input: `"a\\nb"`,
+			Want:  []Node{Parameter{Value: `a\nb`, Quoted: true}},
+		},
+		{
+			Name:  "Double quote",
+			Input: `"a \" and b"`,
+			Want:  []Node{Parameter{Value: `a " and b`, Quoted: true}},
+		},
+		{
+			Name:  "Unknown escape is retained",
+			Input: `"a\.b\z"`,
+			Want:  []Node{Parameter{Value: `a\.b\z`, Quoted: true}},
+		},
+		{
+			Name:  "Empty quotes",
+			Input: `file:""`,
+			Want:  []Node{Parameter{Field: "file", Quoted: true}},
+		},
+		{
+			Name:  "Negated field",
+			Input: `-content:"a\tb"`,
+			Want:  []Node{Parameter{Field: "content", Value: "a\tb", Negated: true, Quoted: true}},
+		},
+		{
+			Name:  "Escapes outside quotes are not decoded",
+			Input: `a\nb`,
+			Want:  []Node{Parameter{Value: `a\nb`}},
+		},
+		{
+			Name:  "Partly quoted value",
+			Input: `content:a"b\n"`,
+			Want:  []Node{Parameter{Field: "content", Value: `a"b\n"`}},
+		},
+		{
+			Name:  "Unterminated quote",
+			Input: `"a\nb`,
+			Want:  []Node{Parameter{Value: `"a\nb`}},
+		},
+		{
+			Name:  "Quoted field name is a pattern",
+			Input: `"repo":"a\tb"`,
+			Want:  []Node{Parameter{Value: `"repo":"a\tb"`}},
+		},
+		{
+			Name:  "Quoted pattern is distinct from unquoted pattern",
+			Input: `"a" and a`,
+			Want: []Node{Operator{Kind: And, Operands: []Node{
+				Parameter{Value: "a", Quoted: true},
+				Parameter{Value: "a"},
+			}}},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			result, err := ParseWithQuoteEscapes(tt.Input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.Want, result); diff != "" {
+				t.Fatal(diff)
+			}
+
+			// The string form of a parameter parses back into the same parameter.
+			if _, ok := result[0].(Parameter); ok {
+				again, err := ParseWithQuoteEscapes(result[0].String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(result, again); diff != "" {
+					t.Error(diff)
+				}
+			}
+		})
+	}
+}
+
+func Test_ParseWithQuotedFields(t *testing.T) {
+	cases := []struct {
+		Name         string
+		Input        string
+		QuotedFields bool
+		Want         []Node
+	}{
+		{
+			Name:  "JSON key is a pattern by default",
+			Input: `"version":"1.0"`,
+			Want:  []Node{Parameter{Value: `"version":"1.0"`}},
+		},
+		{
+			Name:  "Quoted field is a pattern by default",
+			Input: `"weird field":foo`,
+			Want:  []Node{Parameter{Value: `"weird field":foo`}},
+		},
+		{
+			Name:         "Quoted field",
+			Input:        `"weird field":foo`,
+			QuotedFields: true,
+			Want:         []Node{Parameter{Field: `"weird field"`, Value: "foo"}},
+		},
+		{
+			Name:         "Negated quoted field and pattern",
+			Input:        `-"weird field":foo a`,
+			QuotedFields: true,
+			Want: []Node{Operator{Kind: And, Operands: []Node{
+				Parameter{Field: `"weird field"`, Value: "foo", Negated: true},
+				Parameter{Value: "a"},
+			}}},
+		},
+		{
+			Name:         "Unquoted field",
+			Input:        `repo:foo`,
+			QuotedFields: true,
+			Want:         []Node{Parameter{Field: "repo", Value: "foo"}},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			parse := Parse
+			if tt.QuotedFields {
+				parse = ParseWithQuotedFields
+			}
+			result, err := parse(tt.Input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.Want, result); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func Test_ParseWithPlaceholders(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Input string
+		Want  []Node
+	}{
+		{
+			Name:  "Placeholder with literal text",
+			Input: "repo:${ORG}/foo",
+			Want: []Node{Parameter{Field: "repo", Value: "${ORG}/foo", Segments: []Segment{
+				{Value: "ORG", Placeholder: true},
+				{Value: "/foo"},
+			}}},
+		},
+		{
+			Name:  "Placeholders between literal text",
+			Input: "repo:^github.com/${ORG}/${REPO_1}$",
+			Want: []Node{Parameter{Field: "repo", Value: "^github.com/${ORG}/${REPO_1}$", Segments: []Segment{
+				{Value: "^github.com/"},
+				{Value: "ORG", Placeholder: true},
+				{Value: "/"},
+				{Value: "REPO_1", Placeholder: true},
+				{Value: "$"},
+			}}},
+		},
+		{
+			Name:  "Adjacent placeholders",
+			Input: "file:${A}${B}",
+			Want: []Node{Parameter{Field: "file", Value: "${A}${B}", Segments: []Segment{
+				{Value: "A", Placeholder: true},
+				{Value: "B", Placeholder: true},
+			}}},
+		},
+		{
+			Name:  "Escaped dollar",
+			Input: `repo:\${ORG}/foo`,
+			Want:  []Node{Parameter{Field: "repo", Value: `\${ORG}/foo`}},
+		},
+		{
+			Name:  "Escaped dollar with a placeholder",
+			Input: `repo:\${ORG}/${ORG}`,
+			Want: []Node{Parameter{Field: "repo", Value: `\${ORG}/${ORG}`, Segments: []Segment{
+				{Value: "${ORG}/"},
+				{Value: "ORG", Placeholder: true},
+			}}},
+		},
+		{
+			Name:  "Invalid placeholders are literal text",
+			Input: "repo:${} file:${1A} lang:${A-B} case:${A",
+			Want: []Node{Operator{Kind: And, Operands: []Node{
+				Parameter{Field: "repo", Value: "${}"},
+				Parameter{Field: "file", Value: "${1A}"},
+				Parameter{Field: "lang", Value: "${A-B}"},
+				Parameter{Field: "case", Value: "${A"},
+			}}},
+		},
+		{
+			Name:  "Placeholders with other parameters",
+			Input: "(repo:${ORG}/a or -file:${DIR}) foo",
+			Want: []Node{Operator{Kind: And, Operands: []Node{
+				Operator{Kind: Or, Operands: []Node{
+					Parameter{Field: "repo", Value: "${ORG}/a", Segments: []Segment{
+						{Value: "ORG", Placeholder: true},
+						{Value: "/a"},
+					}},
+					Parameter{Field: "file", Value: "${DIR}", Negated: true, Segments: []Segment{
+						{Value: "DIR", Placeholder: true},
+					}},
+				}},
+				Parameter{Value: "foo"},
+			}}},
+		},
+		{
+			Name:  "Placeholders in a block",
+			Input: "repo:${ORG}/a { file:${DIR} }",
+			Want: []Node{Operator{Kind: And, Operands: []Node{
+				Parameter{Field: "repo", Value: "${ORG}/a", Segments: []Segment{
+					{Value: "ORG", Placeholder: true},
+					{Value: "/a"},
+				}},
+				Parameter{Field: "file", Value: "${DIR}", Segments: []Segment{
+					{Value: "DIR", Placeholder: true},
+				}},
+			}}},
+		},
+		{
+			Name:  "Placeholders in search patterns are not recognized",
+			Input: "${ORG}",
+			Want:  []Node{Parameter{Value: "${ORG}"}},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			result, err := ParseWithPlaceholders(tt.Input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.Want, result); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+
+	// Parse itself does not scan placeholders.
+	result, err := Parse("repo:${ORG}/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]Node{Parameter{Field: "repo", Value: "${ORG}/foo"}}, result); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func Test_ParseWithRecovery(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Input     string
+		Want      string
+		WantHints []Hint
+	}{
+		{
+			Name:  "Valid input",
+			Input: "repo:foo a or b",
+			Want:  "(or (and repo:foo a) b)",
+		},
+		{
+			Name:      "Trailing and operator",
+			Input:     "repo:foo and ",
+			Want:      "repo:foo",
+			WantHints: []Hint{{Kind: ExpectedOperand, Pos: 13}},
+		},
+		{
+			Name:      "Trailing or operator",
+			Input:     "a or",
+			Want:      "a",
+			WantHints: []Hint{{Kind: ExpectedOperand, Pos: 4}},
+		},
+		{
+			Name:      "Leading operator",
+			Input:     "or a",
+			Want:      "a",
+			WantHints: []Hint{{Kind: ExpectedOperand, Pos: 0}},
+		},
+		{
+			Name:      "Adjacent operators",
+			Input:     "a and or b",
+			Want:      "(or a b)",
+			WantHints: []Hint{{Kind: ExpectedOperand, Pos: 6}},
+		},
+		{
+			Name:      "Unclosed group",
+			Input:     "repo:foo (a or b",
+			Want:      "(and repo:foo (or a b))",
+			WantHints: []Hint{{Kind: ExpectedClosingParen, Pos: 16}},
+		},
+		{
+			Name:  "Unclosed group with trailing operator",
+			Input: "((a or",
+			Want:  "a",
+			WantHints: []Hint{
+				{Kind: ExpectedOperand, Pos: 6},
+				{Kind: ExpectedClosingParen, Pos: 6},
+				{Kind: ExpectedClosingParen, Pos: 6},
+			},
+		},
+		{
+			Name:      "Unclosed field group",
+			Input:     "repo:(",
+			Want:      "",
+			WantHints: []Hint{{Kind: ExpectedOperand, Pos: 6}, {Kind: ExpectedClosingParen, Pos: 6}},
+		},
+		{
+			Name:      "Trailing operator in group",
+			Input:     "(a and) b",
+			Want:      "(concat a b)",
+			WantHints: []Hint{{Kind: ExpectedOperand, Pos: 6}},
+		},
+		{
+			Name:      "Unexpected closing paren",
+			Input:     "a) b",
+			Want:      "(concat a b)",
+			WantHints: []Hint{{Kind: UnexpectedClosingParen, Pos: 1}},
+		},
+		{
+			Name:  "Trailing operator before unexpected closing paren",
+			Input: "a and ) repo:foo",
+			Want:  "(and repo:foo a)",
+			WantHints: []Hint{
+				{Kind: ExpectedOperand, Pos: 6},
+				{Kind: UnexpectedClosingParen, Pos: 6},
+			},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			result, hints, err := ParseWithRecovery(tt.Input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resultStr []string
+			for _, node := range result {
+				resultStr = append(resultStr, node.String())
+			}
+			if diff := cmp.Diff(tt.Want, strings.Join(resultStr, " ")); diff != "" {
+				t.Error(diff)
+			}
+			if diff := cmp.Diff(tt.WantHints, hints); diff != "" {
+				t.Error(diff)
+			}
+
+			// Parse is strict about the same input.
+			if _, err := Parse(tt.Input); (err != nil) != (len(tt.WantHints) > 0) {
+				t.Errorf("Parse: unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func Test_ParseMultiline(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Input string
+		Want  string // The single-line equivalent of Input.
+	}{
+		{
+			Name:  "Newlines separate patterns",
+			Input: "a\nb\r\nc",
+			Want:  "a b c",
+		},
+		{
+			Name:  "Newlines separate operators and filters",
+			Input: "repo:foo\n  a\nor\n  b",
+			Want:  "repo:foo a or b",
+		},
+		{
+			Name:  "Continuation joins tokens",
+			Input: "repo:foo\\\nbar baz",
+			Want:  "repo:foobar baz",
+		},
+		{
+			Name:  "Continuation with carriage return",
+			Input: "a\\\r\nb",
+			Want:  "ab",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			got, err := Parse(tt.Input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := Parse(tt.Want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func Test_ParseMultilineQuoted(t *testing.T) {
+	// Newlines and continuations inside quotes are part of the value.
+	input := "content:\"a\nb\\\nc\""
+	got, err := Parse(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Node{Parameter{Field: "content", Value: "\"a\nb\\\nc\""}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func Test_QuoteScanner(t *testing.T) {
+	// The scanner agrees with closingQuote after every quote of every string of
+	// quotes, backslashes and other characters up to a length.
+	alphabet := []byte{'"', '\\', 'a'}
+	var check func(buf []byte)
+	check = func(buf []byte) {
+		s := newQuoteScanner(buf)
+		for i, c := range buf {
+			if c != '"' {
+				continue
+			}
+			want := closingQuote(buf[i+1:])
+			if want >= 0 {
+				want += i + 1
+			}
+			if got := s.closingQuote(i); got != want {
+				t.Fatalf("closing quote of %d in %q: want %d but got %d", i, buf, want, got)
+			}
+		}
+		if len(buf) < 8 {
+			for _, c := range alphabet {
+				check(append(buf[:len(buf):len(buf)], c))
+			}
+		}
+	}
+	check(nil)
+}
+
+func Test_ParseUnmatchedQuotes(t *testing.T) {
+	// Scanning quotes without closing quote takes linear time, which is well
+	// within the deadline, unlike quadratic time, which is far beyond it.
+	limits := Limits{MaxLength: 256 * 1024, MaxTokens: DefaultLimits.MaxTokens}
+	for _, input := range []string{
+		strings.Repeat(`"\`, limits.MaxLength/2),
+		strings.Repeat(`a\"`, limits.MaxLength/3),
+	} {
+		done := make(chan error, 1)
+		go func() {
+			_, err := ParseWithLimits(input, limits)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("parsing %d bytes of unmatched quotes timed out", len(input))
+		}
+	}
+}
+
+func BenchmarkParseUnmatchedQuotes(b *testing.B) {
+	input := strings.Repeat(`"\`, DefaultLimits.MaxLength/2)
+	for i := 0; i < b.N; i++ {
+		if _, err := Parse(input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Test_ParseContinuationErrorPositions(t *testing.T) {
+	// Positions in errors refer to the input, not to the input with continuations removed.
+	cases := []struct {
+		Name      string
+		Input     string
+		WantError string
+	}{
+		{
+			Name:      "Expected operand after several continuations",
+			Input:     "a\\\nb\\\nc\\\nd or",
+			WantError: "expected operand at 13",
+		},
+		{
+			Name:      "Carriage returns and groups",
+			Input:     "a\\\r\nb\\\n(c) or)",
+			WantError: "expected operand at 13",
+		},
+		{
+			Name:      "Continuation inside quotes is retained",
+			Input:     "\"a\\\nb\" or",
+			WantError: "expected operand at 9",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			_, err := Parse(tt.Input)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if diff := cmp.Diff(tt.WantError, err.Error()); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func Test_ParseWithSearchType(t *testing.T) {
+	cases := []struct {
+		Name       string
+		Input      string
+		SearchType query.SearchType
+		Want       []Node
+	}{
+		{
+			Name:       "Hole after a word is not a field",
+			Input:      "foo:[x]",
+			SearchType: query.SearchTypeStructural,
+			Want:       []Node{Parameter{Value: "foo:[x]"}},
+		},
+		{
+			Name:       "Field-like hole in regexp search",
+			Input:      "foo:[x]",
+			SearchType: query.SearchTypeRegex,
+			Want:       []Node{Parameter{Field: "foo", Value: "[x]"}},
+		},
+		{
+			Name:       "Hole alone",
+			Input:      ":[x]",
+			SearchType: query.SearchTypeStructural,
+			Want:       []Node{Parameter{Value: ":[x]"}},
+		},
+		{
+			Name:       "Alphanumeric hole",
+			Input:      "a:[[x]].b",
+			SearchType: query.SearchTypeStructural,
+			Want:       []Node{Parameter{Value: "a:[[x]].b"}},
+		},
+		{
+			Name:       "Whitespace and parentheses in a hole",
+			Input:      "f:[ x] g:[y~(a|b)]",
+			SearchType: query.SearchTypeStructural,
+			Want: []Node{Operator{Kind: Concat, Operands: []Node{
+				Parameter{Value: "f:[ x]"},
+				Parameter{Value: "g:[y~(a|b)]"},
+			}}},
+		},
+		{
+			Name:       "Operator keywords in a hole",
+			Input:      "if :[c and d] {}",
+			SearchType: query.SearchTypeStructural,
+			Want: []Node{Operator{Kind: Concat, Operands: []Node{
+				Parameter{Value: "if"},
+				Parameter{Value: ":[c and d]"},
+				Parameter{Value: "{}"},
+			}}},
+		},
+		{
+			Name:       "Filters alongside a template",
+			Input:      "repo:foo -file:bar.go strings.Split(:[x], :[y])",
+			SearchType: query.SearchTypeStructural,
+			Want: []Node{Operator{Kind: And, Operands: []Node{
+				Parameter{Field: "repo", Value: "foo"},
+				Parameter{Field: "file", Value: "bar.go", Negated: true},
+				Operator{Kind: Concat, Operands: []Node{
+					Parameter{Value: "strings.Split"},
+					Parameter{Value: ":[x],"},
+					Parameter{Value: ":[y]"},
+				}},
+			}}},
+		},
+		{
+			Name:       "Hole in a field value",
+			Input:      "content:a:[x]",
+			SearchType: query.SearchTypeStructural,
+			Want:       []Node{Parameter{Field: "content", Value: "a:[x]"}},
+		},
+		{
+			Name:       "Unclosed hole",
+			Input:      "foo:[x",
+			SearchType: query.SearchTypeStructural,
+			Want:       []Node{Parameter{Field: "foo", Value: "[x"}},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			result, err := ParseWithSearchType(tt.Input, tt.SearchType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.Want, result); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func Test_ParseAnchoredPatterns(t *testing.T) {
+	concat := func(values ...string) []Node {
+		operands := make([]Node, 0, len(values))
+		for _, v := range values {
+			operands = append(operands, Parameter{Value: v})
+		}
+		return []Node{Operator{Kind: Concat, Operands: operands}}
+	}
+	cases := []struct {
+		Name       string
+		Input      string
+		SearchType query.SearchType
+		Want       []Node
+	}{
+		{
+			Name:  "Anchored pattern without spaces",
+			Input: "^func$",
+			Want:  []Node{Parameter{Value: "^func$"}},
+		},
+		{
+			Name:  "Anchored pattern with spaces",
+			Input: "^func main$ foo",
+			Want:  concat("^func main$", "foo"),
+		},
+		{
+			Name:  "Start anchor only",
+			Input: "^func main",
+			Want:  concat("^func", "main"),
+		},
+		{
+			Name:  "End anchor only",
+			Input: "func main$",
+			Want:  concat("func", "main$"),
+		},
+		{
+			Name:  "Escaped end anchor",
+			Input: `^func main\$ foo$`,
+			Want:  []Node{Parameter{Value: `^func main\$ foo$`}},
+		},
+		{
+			Name:  "Dollar inside the pattern",
+			Input: "^a$b c$",
+			Want:  []Node{Parameter{Value: "^a$b c$"}},
+		},
+		{
+			Name:  "Tabs and repeated spaces",
+			Input: "^func\t main  x$",
+			Want:  []Node{Parameter{Value: "^func\t main  x$"}},
+		},
+		{
+			Name:  "Anchored pattern with fields",
+			Input: "repo:foo ^func main$ file:bar",
+			Want: []Node{Operator{Kind: And, Operands: []Node{
+				Parameter{Field: "repo", Value: "foo"},
+				Parameter{Field: "file", Value: "bar"},
+				Parameter{Value: "^func main$"},
+			}}},
+		},
+		{
+			Name:  "Operator keyword inside the pattern",
+			Input: "^a or b$",
+			Want:  []Node{Parameter{Value: "^a or b$"}},
+		},
+		{
+			Name:  "Anchored pattern in a group",
+			Input: "(^func main$) or foo",
+			Want: []Node{Operator{Kind: Or, Operands: []Node{
+				Parameter{Value: "^func main$"},
+				Parameter{Value: "foo"},
+			}}},
+		},
+		{
+			Name:  "Parentheses in the pattern",
+			Input: "^func (s) main$",
+			Want:  concat("^func", "s", "main$"),
+		},
+		{
+			Name:  "Quoted pattern with parentheses",
+			Input: `"^func (s) main$"`,
+			Want:  []Node{Parameter{Value: `"^func (s) main$"`}},
+		},
+		{
+			Name:  "Newline in the pattern",
+			Input: "^func\nmain$",
+			Want:  concat("^func", "main$"),
+		},
+		{
+			Name:       "Literal search",
+			Input:      "^func main$",
+			SearchType: query.SearchTypeLiteral,
+			Want:       concat("^func", "main$"),
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			result, err := ParseWithSearchType(tt.Input, tt.SearchType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.Want, result); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func Test_ParseFieldValueParens(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Input     string
+		Want      string
+		WantError string
+	}{
+		{
+			Name:  "Group right after a field value",
+			Input: "repo:foo(bar baz)",
+			Want:  "(and repo:foo (concat bar baz))",
+		},
+		{
+			Name:  "Group right after a field value and before a pattern",
+			Input: "repo:foo(bar) baz",
+			Want:  "(and repo:foo (concat bar baz))",
+		},
+		{
+			Name:  "Escaped opening paren in a field value",
+			Input: `repo:foo\(bar`,
+			Want:  `repo:foo\(bar`,
+		},
+		{
+			Name:  "Escaped parens in a field value",
+			Input: `repo:foo\(bar\) baz`,
+			Want:  `(and repo:foo\(bar\) baz)`,
+		},
+		{
+			Name:  "Quoted paren in a field value",
+			Input: `repo:"foo(bar"`,
+			Want:  `repo:"foo(bar"`,
+		},
+		{
+			Name:      "Unclosed group after a field value",
+			Input:     "repo:foo(bar",
+			WantError: "unbalanced expression",
+		},
+		{
+			Name:      "Closing paren after a field value",
+			Input:     "repo:foo)bar",
+			WantError: "unbalanced expression",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			result, err := Parse(tt.Input)
+			if err != nil {
+				if diff := cmp.Diff(tt.WantError, err.Error()); diff != "" {
+					t.Fatal(diff)
+				}
+				return
+			}
+			var resultStr []string
+			for _, node := range result {
+				resultStr = append(resultStr, node.String())
+			}
+			if diff := cmp.Diff(tt.Want, strings.Join(resultStr, " ")); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func Test_ParseWithSeparator(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Input     string
+		Want      string
+		WantError string
+	}{
+		{
+			Name:  "Sequence",
+			Input: "a | b",
+			Want:  "(then a b)",
+		},
+		{
+			Name:  "Sequences are flattened",
+			Input: "a | b | (c | d)",
+			Want:  "(then a b c d)",
+		},
+		{
+			Name:  "Lower precedence than or",
+			Input: "a or b | c and d",
+			Want:  "(then (or a b) (and c d))",
+		},
+		{
+			Name:  "Parameters of an expression",
+			Input: "repo:foo a b | file:bar",
+			Want:  "(then (and repo:foo (concat a b)) file:bar)",
+		},
+		{
+			Name:  "Sequence in a group",
+			Input: "a and (b | c)",
+			Want:  "(and a (then b c))",
+		},
+		{
+			Name:  "Separator inside a pattern",
+			Input: "a|b",
+			Want:  "a|b",
+		},
+		{
+			Name:      "Missing operand",
+			Input:     "a |",
+			WantError: "expected operand at 3",
+		},
+		{
+			Name:      "Sequence in a group for a field",
+			Input:     "repo:(a | b)",
+			WantError: "unexpected separator in group for field repo",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			result, err := ParseWithSeparator(tt.Input, "|")
+			if tt.WantError != "" {
+				if err == nil {
+					t.Fatalf("expected error %q but got nil", tt.WantError)
+				}
+				if diff := cmp.Diff(tt.WantError, err.Error()); diff != "" {
+					t.Fatal(diff)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resultStr []string
+			for _, node := range result {
+				resultStr = append(resultStr, node.String())
+			}
+			if diff := cmp.Diff(tt.Want, strings.Join(resultStr, " ")); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func Test_ParseWithConcatOperator(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Input     string
+		Want      string
+		WantError string
+	}{
+		{
+			Name:  "Explicit concat",
+			Input: "a + b",
+			Want:  "(concat a b)",
+		},
+		{
+			Name:  "Implicit concat is retained",
+			Input: "a b + c",
+			Want:  "(concat a b c)",
+		},
+		{
+			Name:  "Filters stay in their operand",
+			Input: "repo:foo a + b",
+			Want:  "(concat (and repo:foo a) b)",
+		},
+		{
+			Name:  "Filters are promoted without explicit concat",
+			Input: "repo:foo a b",
+			Want:  "(and repo:foo (concat a b))",
+		},
+		{
+			Name:  "Lower precedence than or",
+			Input: "a or b + c",
+			Want:  "(concat (or a b) c)",
+		},
+		{
+			Name:  "Or binds adjacent patterns without explicit concat",
+			Input: "a or b c",
+			Want:  "(or a (concat b c))",
+		},
+		{
+			Name:  "Across groups",
+			Input: "(a and b) + (c or d)",
+			Want:  "(concat (and a b) (or c d))",
+		},
+		{
+			Name:  "Concat in a group",
+			Input: "x or (a + b)",
+			Want:  "(or x (concat a b))",
+		},
+		{
+			Name:  "Keyword inside a pattern",
+			Input: "a+b",
+			Want:  "a+b",
+		},
+		{
+			Name:      "Missing operand",
+			Input:     "a +",
+			WantError: "expected operand at 3",
+		},
+		{
+			Name:      "Left operand without pattern",
+			Input:     " repo:foo + a",
+			WantError: "expected pattern at 1",
+		},
+		{
+			Name:      "Right operand without pattern",
+			Input:     "a + repo:foo",
+			WantError: "expected pattern at 4",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			result, err := ParseWithConcatOperator(tt.Input, "+")
+			if tt.WantError != "" {
+				if err == nil {
+					t.Fatalf("expected error %q but got nil", tt.WantError)
+				}
+				if diff := cmp.Diff(tt.WantError, err.Error()); diff != "" {
+					t.Fatal(diff)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resultStr []string
+			for _, node := range result {
+				resultStr = append(resultStr, node.String())
+			}
+			if diff := cmp.Diff(tt.Want, strings.Join(resultStr, " ")); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func Test_ParseWithSearchTypeOperators(t *testing.T) {
+	cases := []struct {
+		Input      string
+		Regex      string
+		Literal    string
+		Structural string
+	}{
+		{
+			Input:      "a and b",
+			Regex:      "(and a b)",
+			Literal:    "(concat a and b)",
+			Structural: "(concat a and b)",
+		},
+		{
+			Input:      "a OR b",
+			Regex:      "(or a b)",
+			Literal:    "(concat a OR b)",
+			Structural: "(concat a OR b)",
+		},
+		{
+			Input:      "repo:foo (x or y) and z",
+			Regex:      "(and repo:foo (or x y) z)",
+			Literal:    "(and repo:foo (concat x or y and z))",
+			Structural: "(and repo:foo (concat x or y and z))",
+		},
+		{
+			Input:      "if :[c] or :[d]",
+			Regex:      "(or (concat if :[c]) :[d])",
+			Literal:    "(concat if :[c] or :[d])",
+			Structural: "(concat if :[c] or :[d])",
+		},
+	}
+	for _, tt := range cases {
+		for _, searchType := range []struct {
+			Name string
+			Type query.SearchType
+			Want string
+		}{
+			{"regex", query.SearchTypeRegex, tt.Regex},
+			{"literal", query.SearchTypeLiteral, tt.Literal},
+			{"structural", query.SearchTypeStructural, tt.Structural},
+		} {
+			t.Run(searchType.Name+"/"+tt.Input, func(t *testing.T) {
+				result, err := ParseWithSearchType(tt.Input, searchType.Type)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var resultStr []string
+				for _, node := range result {
+					resultStr = append(resultStr, node.String())
+				}
+				if diff := cmp.Diff(searchType.Want, strings.Join(resultStr, " ")); diff != "" {
+					t.Error(diff)
+				}
+			})
+		}
+	}
+}
+
+func Test_ParseExplain(t *testing.T) {
+	input := "a (b c) repo:foo and (d and ())"
+	nodes, steps, err := ParseExplain(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ReductionStep{
+		{Name: "promote", Before: "b c", After: "(concat b c)"},
+		{Name: "flatten", Before: "(concat a (concat b c))", After: "(concat a b c)"},
+		{Name: "promote", Before: "a (concat b c) repo:foo", After: "(and repo:foo (concat a b c))"},
+		{Name: "prune", Before: "(and d )", After: "(and d)"},
+		{Name: "flatten", Before: "(and (and repo:foo (concat a b c)) d)", After: "(and repo:foo (concat a b c) d)"},
+	}
+	if diff := cmp.Diff(want, steps); diff != "" {
+		t.Error(diff)
+	}
+
+	// The parse tree is the one returned by Parse.
+	parsed, err := Parse(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(parsed, nodes); diff != "" {
+		t.Error(diff)
+	}
+
+	// A query without reductions has no steps.
+	_, steps, err = ParseExplain("repo:foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 0 {
+		t.Errorf("want no steps but got %v", steps)
+	}
+}
+
+func Test_ParseWithOptions(t *testing.T) {
+	limits := Limits{MaxLength: 32}
+	cases := []struct {
+		Name      string
+		Input     string
+		Options   ParseOptions
+		Want      string
+		WantError string
+	}{
+		{
+			Name:    "Zero options parse like Parse",
+			Input:   "repo:foo a or b",
+			Options: ParseOptions{},
+			Want:    "(or (and repo:foo a) b)",
+		},
+		{
+			Name:  "Known fields with quote escapes",
+			Input: `repo:"a b" content:"x\ty"`,
+			Options: ParseOptions{
+				KnownFields:  []string{"repo", "content"},
+				QuoteEscapes: true,
+			},
+			Want: `(and repo:"a b" content:"x\ty")`,
+		},
+		{
+			Name:  "Unknown field with quote escapes",
+			Input: `repo:"a b" rpeo:foo`,
+			Options: ParseOptions{
+				KnownFields:  []string{"repo"},
+				QuoteEscapes: true,
+			},
+			WantError: "unknown field rpeo at 11, did you mean repo:?",
+		},
+		{
+			Name:  "Separator with concat operator",
+			Input: "a + b | c",
+			Options: ParseOptions{
+				Separator:      "|",
+				ConcatOperator: "+",
+			},
+			Want: "(then (concat a b) c)",
+		},
+		{
+			Name:  "Combine with duplicates",
+			Input: "repo:a count:1 repo:b x count:2",
+			Options: ParseOptions{
+				Duplicates: map[string]DuplicatePolicy{"count": DuplicateLastWins},
+				Combine:    DefaultCombinePolicies,
+			},
+			Want: "(and (or repo:a repo:b) count:2 x)",
+		},
+		{
+			Name:  "Empty values in structural search",
+			Input: "file: foo(:[x] and y)",
+			Options: ParseOptions{
+				EmptyValues: DefaultEmptyValuePolicies,
+				SearchType:  query.SearchTypeStructural,
+			},
+			Want: "(and file: (concat foo :[x] and y))",
+		},
+		{
+			Name:  "Limits with constants",
+			Input: strings.Repeat("true ", 7),
+			Options: ParseOptions{
+				Limits:    &limits,
+				Constants: DefaultConstants,
+			},
+			WantError: "query exceeds maximum length of 32 at 32",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			result, err := ParseWithOptions(tt.Input, tt.Options)
+			if tt.WantError != "" {
+				if err == nil {
+					t.Fatalf("expected error %q but got nil", tt.WantError)
+				}
+				if diff := cmp.Diff(tt.WantError, err.Error()); diff != "" {
+					t.Fatal(diff)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var resultStr []string
+			for _, node := range result {
+				resultStr = append(resultStr, node.String())
+			}
+			if diff := cmp.Diff(tt.Want, strings.Join(resultStr, " ")); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+
+	t.Run("Hints with reductions", func(t *testing.T) {
+		var hints []Hint
+		var steps []ReductionStep
+		result, err := ParseWithOptions("(a b", ParseOptions{Hints: &hints, Steps: &steps})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff("(concat a b)", result[0].String()); diff != "" {
+			t.Error(diff)
+		}
+		if diff := cmp.Diff([]Hint{{Kind: ExpectedClosingParen, Pos: 4}}, hints); diff != "" {
+			t.Error(diff)
+		}
+		if len(steps) == 0 {
+			t.Error("want steps but got none")
+		}
+	})
+}
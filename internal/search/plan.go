@@ -0,0 +1,238 @@
+package search
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// OutputField describes a field that shapes the results of a query instead of
+// filtering them, as in "select:repo".
+type OutputField struct {
+	Values []string // The values the field may take on. Any value is valid if nil.
+	Max    int      // The maximum number of occurrences of the field. Zero means unbounded.
+}
+
+// DefaultOutputFields are the output fields recognized by ParsePlan, keyed by field.
+var DefaultOutputFields = map[string]OutputField{
+	"select": {
+		Values: []string{"repo", "file", "content", "symbol", "commit"},
+		Max:    1,
+	},
+}
+
+// CaseSensitivity is the value of the "case" field, which controls whether
+// search patterns are matched case sensitively.
+type CaseSensitivity int
+
+const (
+	CaseNo   CaseSensitivity = iota // "case:no", the default.
+	CaseYes                         // "case:yes".
+	CaseAuto                        // "case:auto", case sensitive only for patterns containing an upper case letter.
+)
+
+var caseSensitivities = map[string]CaseSensitivity{
+	"no":   CaseNo,
+	"yes":  CaseYes,
+	"auto": CaseAuto,
+}
+
+// caseField is the behavior field that sets the CaseSensitivity of a plan. It
+// is recognized by ParsePlan regardless of the output fields passed to it.
+var caseField = OutputField{Values: []string{"yes", "no", "auto"}, Max: 1}
+
+// revField is the behavior field that sets the revisions of a plan, as in
+// "repo:foo rev:a:b", which is equivalent to "repo:foo@a:b". Like caseField, it
+// is recognized by ParsePlan regardless of the output fields passed to it.
+var revField = OutputField{Max: 1}
+
+// Plan is a parsed query where output fields and behavior fields are separated
+// from the parse tree of patterns and filters.
+type Plan struct {
+	Nodes   []Node              // The parse tree without output and behavior fields.
+	Outputs []Parameter         // The output fields in the order they appear in the query.
+	Case    CaseSensitivity     // The value of the case field.
+	Revs    []RevisionSpecifier // The revisions of the rev field, nil if absent.
+}
+
+// ParsePlan parses a raw input string like Parse, and removes parameters whose
+// field is in outputFields or is one of the behavior fields "case" and "rev"
+// from the parse tree.
+// Output and behavior fields are transforms and not predicates, so they may
+// neither be negated nor appear in an or-expression, and their values and
+// number of occurrences are validated. In particular, the case field may
+// appear at most once. The resulting case sensitivity is set on the plan and
+// on every search pattern in the parse tree. The revisions of repo fields, as
+// in "repo:foo@a:b", are separated from their values into Parameter.Revs (see
+// ParseRepositoryRevisions), and may neither be negated nor combined with the
+// rev field, whose revisions are set on the plan.
+func ParsePlan(in string, outputFields map[string]OutputField) (*Plan, error) {
+	nodes, err := Parse(in)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]OutputField{"case": caseField, "rev": revField}
+	for name, field := range outputFields {
+		if name != "case" && name != "rev" {
+			fields[name] = field
+		}
+	}
+
+	var extracted []Parameter
+	nodes, err = extractOutputs(nodes, fields, false, false, &extracted)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{}
+	counts := make(map[string]int)
+	for _, parameter := range extracted {
+		field := fields[parameter.Field]
+		if field.Values != nil && !containsString(field.Values, parameter.Value) {
+			return nil, fmt.Errorf("invalid value %s for field %s", parameter.Value, parameter.Field)
+		}
+		counts[parameter.Field]++
+		if field.Max > 0 && counts[parameter.Field] > field.Max {
+			return nil, fmt.Errorf("field %s may appear at most %d times", parameter.Field, field.Max)
+		}
+
+		switch parameter.Field {
+		case "case":
+			plan.Case = caseSensitivities[parameter.Value]
+		case "rev":
+			plan.Revs = parseRevs(parameter.Value)
+		default:
+			plan.Outputs = append(plan.Outputs, parameter)
+		}
+	}
+
+	var hasRevs bool
+	nodes, err = setRepoRevisions(nodes, false, &hasRevs)
+	if err != nil {
+		return nil, err
+	}
+	if hasRevs && plan.Revs != nil {
+		return nil, fmt.Errorf("field rev cannot be combined with revisions in field repo")
+	}
+
+	plan.Nodes = setCaseSensitivity(nodes, plan.Case)
+	return plan, nil
+}
+
+// Filters returns the filters of the parse tree of the plan, which are the
+// parameters with a field other than output and behavior fields, in the order
+// of a depth-first traversal of the tree. The order only depends on the query,
+// as in "repo:b file:a" => [repo:b file:a], so that filters serialized in this
+// order are the same for every parse of the same query. Filters in negated
+// groups are included as they appear in the group, without Negated set.
+func (p *Plan) Filters() []Parameter {
+	var filters []Parameter
+	for _, node := range p.Nodes {
+		visit(node, func(node Node) {
+			if v, ok := node.(Parameter); ok && v.Field != "" {
+				filters = append(filters, v)
+			}
+		})
+	}
+	return filters
+}
+
+// setRepoRevisions returns a copy of the parse tree where the revisions of
+// every repo field are separated from its value, and sets hasRevs if any field
+// has revisions. Parameters inside a negated group are considered negated.
+func setRepoRevisions(nodes []Node, inNot bool, hasRevs *bool) ([]Node, error) {
+	var result []Node
+	for _, node := range nodes {
+		switch v := node.(type) {
+		case Parameter:
+			if v.Field == "repo" && strings.Contains(v.Value, "@") {
+				if v.Negated || inNot {
+					return nil, fmt.Errorf("negated field repo cannot have revisions")
+				}
+				repo, revs := ParseRepositoryRevisions(v.Value)
+				v.Value = string(repo)
+				v.Revs = revs
+				*hasRevs = true
+			}
+			result = append(result, v)
+		case Operator:
+			operands, err := setRepoRevisions(v.Operands, inNot || v.Kind == Not, hasRevs)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, Operator{Kind: v.Kind, Operands: operands})
+		default:
+			result = append(result, node)
+		}
+	}
+	return result, nil
+}
+
+// setCaseSensitivity returns a copy of the parse tree where CaseSensitive is
+// set on every search pattern according to c.
+func setCaseSensitivity(nodes []Node, c CaseSensitivity) []Node {
+	var result []Node
+	for _, node := range nodes {
+		switch v := node.(type) {
+		case Parameter:
+			if v.Field == "" {
+				v.CaseSensitive = c == CaseYes || (c == CaseAuto && strings.IndexFunc(v.Value, unicode.IsUpper) >= 0)
+			}
+			result = append(result, v)
+		case Operator:
+			result = append(result, Operator{Kind: v.Kind, Operands: setCaseSensitivity(v.Operands, c)})
+		default:
+			result = append(result, node)
+		}
+	}
+	return result
+}
+
+// extractOutputs removes parameters whose field is in outputFields from nodes,
+// appends them to outputs, and reduces the remaining nodes. Parameters inside a
+// negated group are considered negated.
+func extractOutputs(nodes []Node, outputFields map[string]OutputField, inOr, inNot bool, outputs *[]Parameter) ([]Node, error) {
+	var result []Node
+	for _, node := range nodes {
+		switch v := node.(type) {
+		case Parameter:
+			if _, ok := outputFields[v.Field]; !ok || v.Field == "" {
+				result = append(result, v)
+				continue
+			}
+			if v.Negated || inNot {
+				return nil, fmt.Errorf("output field %s cannot be negated", v.Field)
+			}
+			if inOr {
+				return nil, fmt.Errorf("output field %s cannot appear in an or-expression", v.Field)
+			}
+			*outputs = append(*outputs, v)
+		case Operator:
+			operands, err := extractOutputs(v.Operands, outputFields, inOr || v.Kind == Or, inNot || v.Kind == Not, outputs)
+			if err != nil {
+				return nil, err
+			}
+			if v.Kind == Not || v.Kind == Group {
+				// A single operand must keep its negation or group.
+				if len(operands) > 0 {
+					result = append(result, Operator{Kind: v.Kind, Operands: operands})
+				}
+				continue
+			}
+			result = append(result, newOperator(operands, v.Kind)...)
+		default:
+			result = append(result, node)
+		}
+	}
+	return result, nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,398 @@
+package search
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_ParsePlan(t *testing.T) {
+	type want struct {
+		Nodes   string
+		Outputs []Parameter
+	}
+	cases := []struct {
+		Name      string
+		Input     string
+		Want      want
+		WantError string
+	}{
+		{
+			Name:  "No output fields",
+			Input: "repo:foo a b",
+			Want:  want{Nodes: "(and repo:foo (concat a b))"},
+		},
+		{
+			Name:  "Valid select",
+			Input: "repo:foo select:repo a b",
+			Want: want{
+				Nodes:   "(and repo:foo (concat a b))",
+				Outputs: []Parameter{{Field: "select", Value: "repo"}},
+			},
+		},
+		{
+			Name:  "Select alone",
+			Input: "select:file",
+			Want: want{
+				Outputs: []Parameter{{Field: "select", Value: "file"}},
+			},
+		},
+		{
+			Name:  "Select in group is extracted",
+			Input: "(select:repo a) and b",
+			Want: want{
+				Nodes:   "(and a b)",
+				Outputs: []Parameter{{Field: "select", Value: "repo"}},
+			},
+		},
+		{
+			Name:      "Invalid select value",
+			Input:     "select:bogus a",
+			WantError: "invalid value bogus for field select",
+		},
+		{
+			Name:      "Duplicate select",
+			Input:     "select:repo select:file a",
+			WantError: "field select may appear at most 1 times",
+		},
+		{
+			Name:      "Negated select",
+			Input:     "-select:repo a",
+			WantError: "output field select cannot be negated",
+		},
+		{
+			Name:      "Select in negated group",
+			Input:     "-(select:repo a)",
+			WantError: "output field select cannot be negated",
+		},
+		{
+			Name:  "Negated group is retained",
+			Input: "select:repo -(a)",
+			Want: want{
+				Nodes:   "(not a)",
+				Outputs: []Parameter{{Field: "select", Value: "repo"}},
+			},
+		},
+		{
+			Name:      "Select in or-expression",
+			Input:     "select:repo or a",
+			WantError: "output field select cannot appear in an or-expression",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			plan, err := ParsePlan(tt.Input, DefaultOutputFields)
+			if tt.WantError != "" {
+				if err == nil {
+					t.Fatalf("expected error %q but got nil", tt.WantError)
+				}
+				if diff := cmp.Diff(tt.WantError, err.Error()); diff != "" {
+					t.Fatal(diff)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got want
+			for _, node := range plan.Nodes {
+				got.Nodes += node.String()
+			}
+			got.Outputs = plan.Outputs
+			if diff := cmp.Diff(tt.Want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func Test_ParsePlanConfigurableOutputFields(t *testing.T) {
+	outputFields := map[string]OutputField{
+		"select": {Values: []string{"repo", "file"}, Max: 2},
+	}
+	plan, err := ParsePlan("select:repo select:file a", outputFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Parameter{{Field: "select", Value: "repo"}, {Field: "select", Value: "file"}}
+	if diff := cmp.Diff(want, plan.Outputs); diff != "" {
+		t.Error(diff)
+	}
+
+	// Without configuration, select is a regular filter.
+	plan, err = ParsePlan("select:bogus a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("(and select:bogus a)", plan.Nodes[0].String()); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func Test_ParsePlanCase(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Input     string
+		WantCase  CaseSensitivity
+		WantNodes []Node
+		WantError string
+	}{
+		{
+			Name:      "Default",
+			Input:     "Foo",
+			WantCase:  CaseNo,
+			WantNodes: []Node{Parameter{Value: "Foo"}},
+		},
+		{
+			Name:      "No",
+			Input:     "case:no Foo",
+			WantCase:  CaseNo,
+			WantNodes: []Node{Parameter{Value: "Foo"}},
+		},
+		{
+			Name:     "Yes",
+			Input:    "repo:Bar case:yes foo Foo",
+			WantCase: CaseYes,
+			WantNodes: []Node{Operator{Kind: And, Operands: []Node{
+				Parameter{Field: "repo", Value: "Bar"},
+				Operator{Kind: Concat, Operands: []Node{
+					Parameter{Value: "foo", CaseSensitive: true},
+					Parameter{Value: "Foo", CaseSensitive: true},
+				}},
+			}}},
+		},
+		{
+			Name:     "Auto",
+			Input:    "case:auto (foo or Foo)",
+			WantCase: CaseAuto,
+			WantNodes: []Node{Operator{Kind: Or, Operands: []Node{
+				Parameter{Value: "foo"},
+				Parameter{Value: "Foo", CaseSensitive: true},
+			}}},
+		},
+		{
+			Name:      "Invalid value",
+			Input:     "case:maybe foo",
+			WantError: "invalid value maybe for field case",
+		},
+		{
+			Name:      "Duplicate",
+			Input:     "case:yes case:no foo",
+			WantError: "field case may appear at most 1 times",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			plan, err := ParsePlan(tt.Input, DefaultOutputFields)
+			if tt.WantError != "" {
+				if err == nil {
+					t.Fatalf("expected error %q but got nil", tt.WantError)
+				}
+				if diff := cmp.Diff(tt.WantError, err.Error()); diff != "" {
+					t.Fatal(diff)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.WantCase, plan.Case); diff != "" {
+				t.Error(diff)
+			}
+			if diff := cmp.Diff(tt.WantNodes, plan.Nodes); diff != "" {
+				t.Error(diff)
+			}
+			if len(plan.Outputs) != 0 {
+				t.Errorf("expected no outputs but got %v", plan.Outputs)
+			}
+		})
+	}
+}
+
+func Test_ParsePlanRevisions(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Input     string
+		WantNodes []Node
+		WantRevs  []RevisionSpecifier
+		WantError string
+	}{
+		{
+			Name:      "No revision",
+			Input:     "repo:foo",
+			WantNodes: []Node{Parameter{Field: "repo", Value: "foo"}},
+		},
+		{
+			Name:  "Single revision",
+			Input: "repo:foo@a",
+			WantNodes: []Node{Parameter{Field: "repo", Value: "foo", Revs: []RevisionSpecifier{
+				{RevSpec: "a"},
+			}}},
+		},
+		{
+			Name:  "Multiple revisions",
+			Input: "repo:foo@a:*refs/heads/:*!refs/heads/b",
+			WantNodes: []Node{Parameter{Field: "repo", Value: "foo", Revs: []RevisionSpecifier{
+				{RevSpec: "a"},
+				{RefGlob: "refs/heads/"},
+				{ExcludeRefGlob: "refs/heads/b"},
+			}}},
+		},
+		{
+			Name:  "Empty revision is the default branch",
+			Input: "repo:foo@",
+			WantNodes: []Node{Parameter{Field: "repo", Value: "foo", Revs: []RevisionSpecifier{
+				{RevSpec: ""},
+			}}},
+		},
+		{
+			Name:  "Empty elements are ignored",
+			Input: "repo:foo@a::b",
+			WantNodes: []Node{Parameter{Field: "repo", Value: "foo", Revs: []RevisionSpecifier{
+				{RevSpec: "a"},
+				{RevSpec: "b"},
+			}}},
+		},
+		{
+			Name:  "Revisions of several repos",
+			Input: "repo:foo@a or repo:bar",
+			WantNodes: []Node{Operator{Kind: Or, Operands: []Node{
+				Parameter{Field: "repo", Value: "foo", Revs: []RevisionSpecifier{{RevSpec: "a"}}},
+				Parameter{Field: "repo", Value: "bar"},
+			}}},
+		},
+		{
+			Name:      "Rev field",
+			Input:     "repo:foo rev:a:b",
+			WantNodes: []Node{Parameter{Field: "repo", Value: "foo"}},
+			WantRevs:  []RevisionSpecifier{{RevSpec: "a"}, {RevSpec: "b"}},
+		},
+		{
+			Name:      "Empty rev field is the default branch",
+			Input:     "repo:foo rev:",
+			WantNodes: []Node{Parameter{Field: "repo", Value: "foo"}},
+			WantRevs:  []RevisionSpecifier{{RevSpec: ""}},
+		},
+		{
+			Name:      "Other fields keep the at sign",
+			Input:     "file:foo@a",
+			WantNodes: []Node{Parameter{Field: "file", Value: "foo@a"}},
+		},
+		{
+			Name:      "Rev field and revisions in repo",
+			Input:     "repo:foo@a rev:b",
+			WantError: "field rev cannot be combined with revisions in field repo",
+		},
+		{
+			Name:      "Negated repo with revisions",
+			Input:     "-repo:foo@a",
+			WantError: "negated field repo cannot have revisions",
+		},
+		{
+			Name:      "Repo with revisions in negated group",
+			Input:     "-(repo:foo@a b)",
+			WantError: "negated field repo cannot have revisions",
+		},
+		{
+			Name:      "Duplicate rev field",
+			Input:     "rev:a rev:b",
+			WantError: "field rev may appear at most 1 times",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			plan, err := ParsePlan(tt.Input, DefaultOutputFields)
+			if tt.WantError != "" {
+				if err == nil {
+					t.Fatalf("expected error %q but got nil", tt.WantError)
+				}
+				if diff := cmp.Diff(tt.WantError, err.Error()); diff != "" {
+					t.Fatal(diff)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.WantNodes, plan.Nodes); diff != "" {
+				t.Error(diff)
+			}
+			if diff := cmp.Diff(tt.WantRevs, plan.Revs); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func Test_PlanFilters(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Input string
+		Want  []Parameter
+	}{
+		{
+			Name:  "No filters",
+			Input: "a b",
+		},
+		{
+			Name:  "Source order",
+			Input: "repo:b file:a lang:c x",
+			Want: []Parameter{
+				{Field: "repo", Value: "b"},
+				{Field: "file", Value: "a"},
+				{Field: "lang", Value: "c"},
+			},
+		},
+		{
+			Name:  "Patterns between filters",
+			Input: "x file:a y repo:b",
+			Want: []Parameter{
+				{Field: "file", Value: "a"},
+				{Field: "repo", Value: "b"},
+			},
+		},
+		{
+			Name:  "Output and behavior fields are excluded",
+			Input: "case:yes repo:b select:repo rev:c file:a",
+			Want: []Parameter{
+				{Field: "repo", Value: "b"},
+				{Field: "file", Value: "a"},
+			},
+		},
+		{
+			Name:  "Nested filters",
+			Input: "(repo:b or (file:a -lang:c)) -(repo:d)",
+			Want: []Parameter{
+				{Field: "repo", Value: "b"},
+				{Field: "file", Value: "a"},
+				{Field: "lang", Value: "c", Negated: true},
+				{Field: "repo", Value: "d"},
+			},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			// The same query always yields the same order.
+			for i := 0; i < 10; i++ {
+				plan, err := ParsePlan(tt.Input, DefaultOutputFields)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(tt.Want, plan.Filters()); diff != "" {
+					t.Fatal(diff)
+				}
+			}
+		})
+	}
+}
+
+func Test_ParameterStringRevisions(t *testing.T) {
+	plan, err := ParsePlan("repo:foo@a:*b repo:foo@ repo:foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Revisions distinguish otherwise equal parameters.
+	if diff := cmp.Diff("(and repo:foo@a:*b repo:foo@ repo:foo)", plan.Nodes[0].String()); diff != "" {
+		t.Error(diff)
+	}
+}
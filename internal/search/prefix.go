@@ -0,0 +1,33 @@
+package search
+
+import "strings"
+
+// DefaultPrefixFields are the fields whose values may be prefix matches, see
+// SetPrefixMatches.
+var DefaultPrefixFields = []string{"repo"}
+
+// SetPrefixMatches returns a copy of the parse tree where every parameter whose
+// field is in fields and whose value ends with an unescaped '*' is a prefix
+// match of the value before the '*', as in "repo:github.com/myorg/*" =>
+// Parameter{Field: "repo", Value: "github.com/myorg/", Prefix: true}. The '*' is
+// not interpreted anywhere else in the value, and an escaped trailing '*', as in
+// `repo:foo\*`, is left untouched, as is a quoted value (see
+// ParseWithQuoteEscapes).
+func SetPrefixMatches(nodes []Node, fields []string) []Node {
+	var result []Node
+	for _, node := range nodes {
+		switch v := node.(type) {
+		case Parameter:
+			if v.Field != "" && !v.Quoted && containsString(fields, v.Field) && strings.HasSuffix(v.Value, "*") && !isEscaped(v.Value, len(v.Value)-1) {
+				v.Value = v.Value[:len(v.Value)-1]
+				v.Prefix = true
+			}
+			result = append(result, v)
+		case Operator:
+			result = append(result, Operator{Kind: v.Kind, Operands: SetPrefixMatches(v.Operands, fields)})
+		default:
+			result = append(result, node)
+		}
+	}
+	return result
+}
@@ -0,0 +1,76 @@
+package search
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_SetPrefixMatches(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Input string
+		Want  []Node
+	}{
+		{
+			Name:  "Prefix",
+			Input: "repo:github.com/myorg/*",
+			Want:  []Node{Parameter{Field: "repo", Value: "github.com/myorg/", Prefix: true}},
+		},
+		{
+			Name:  "Negated prefix",
+			Input: "-repo:github.com/myorg/*",
+			Want:  []Node{Parameter{Field: "repo", Value: "github.com/myorg/", Negated: true, Prefix: true}},
+		},
+		{
+			Name:  "Star alone matches any value",
+			Input: "repo:*",
+			Want:  []Node{Parameter{Field: "repo", Value: "", Prefix: true}},
+		},
+		{
+			Name:  "Escaped star is literal",
+			Input: `repo:github.com/myorg\*`,
+			Want:  []Node{Parameter{Field: "repo", Value: `github.com/myorg\*`}},
+		},
+		{
+			Name:  "Escaped backslash before star",
+			Input: `repo:foo\\*`,
+			Want:  []Node{Parameter{Field: "repo", Value: `foo\\`, Prefix: true}},
+		},
+		{
+			Name:  "Mid-value star is not interpreted",
+			Input: "repo:github.com/*/foo",
+			Want:  []Node{Parameter{Field: "repo", Value: "github.com/*/foo"}},
+		},
+		{
+			Name:  "Other fields and patterns are untouched",
+			Input: "file:foo* bar*",
+			Want: []Node{Operator{Kind: And, Operands: []Node{
+				Parameter{Field: "file", Value: "foo*"},
+				Parameter{Value: "bar*"},
+			}}},
+		},
+		{
+			Name:  "Prefix in expression",
+			Input: "(repo:a/* or repo:b) c",
+			Want: []Node{Operator{Kind: And, Operands: []Node{
+				Operator{Kind: Or, Operands: []Node{
+					Parameter{Field: "repo", Value: "a/", Prefix: true},
+					Parameter{Field: "repo", Value: "b"},
+				}},
+				Parameter{Value: "c"},
+			}}},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			nodes, err := Parse(tt.Input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.Want, SetPrefixMatches(nodes, DefaultPrefixFields)); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
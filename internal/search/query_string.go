@@ -0,0 +1,69 @@
+package search
+
+import (
+	"strings"
+)
+
+// ToQueryString returns the query syntax of the parse tree, which Parse parses
+// back into an equal parse tree if the tree could have been produced by Parse.
+// This is unlike String, which returns the s-expression form of a node. Values
+// are rendered as they appear in Parameter.Value, except that a search pattern
+// that would otherwise be scanned as a field has its colon escaped, as in
+// `fooo\:bar`, and values with Quoted, Prefix or Revs set are rendered as they
+// were written, as in "a\tb", repo:foo* and repo:foo@a. Operands that are
+// operators themselves are parenthesized, as in "a and (b or c)". Top-level
+// nodes are separated by spaces.
+func ToQueryString(nodes []Node) string {
+	var result []string
+	for _, node := range nodes {
+		result = append(result, toQueryString(node))
+	}
+	return strings.Join(result, " ")
+}
+
+func toQueryString(node Node) string {
+	switch v := node.(type) {
+	case Parameter:
+		return parameterQueryString(v)
+	case Constant:
+		if v.Value {
+			return "true"
+		}
+		return "false"
+	case Operator:
+		switch v.Kind {
+		case Not:
+			return "-(" + ToQueryString(v.Operands) + ")"
+		case Group:
+			return "(" + ToQueryString(v.Operands) + ")"
+		}
+		separator := " "
+		switch v.Kind {
+		case And:
+			separator = " and "
+		case Or:
+			separator = " or "
+		}
+		operands := make([]string, 0, len(v.Operands))
+		for _, operand := range v.Operands {
+			s := toQueryString(operand)
+			if o, ok := operand.(Operator); ok && o.Kind != Not && o.Kind != Group {
+				s = "(" + s + ")"
+			}
+			operands = append(operands, s)
+		}
+		return strings.Join(operands, separator)
+	}
+	return node.String()
+}
+
+func parameterQueryString(p Parameter) string {
+	if p.Field == "" && p.Value == "" && !p.Quoted {
+		return "()"
+	}
+	if p.Field == "" && !p.Quoted && fieldValuePattern.MatchString(p.Value) {
+		i := strings.Index(p.Value, ":")
+		p.Value = p.Value[:i] + `\:` + p.Value[i+1:]
+	}
+	return p.String()
+}
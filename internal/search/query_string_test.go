@@ -0,0 +1,131 @@
+package search
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_ToQueryString(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Input string
+		Want  string
+	}{
+		{
+			Name:  "Pattern",
+			Input: "a",
+			Want:  "a",
+		},
+		{
+			Name:  "Filters and patterns",
+			Input: "repo:foo -file:bar a b",
+			Want:  "repo:foo and -file:bar and (a b)",
+		},
+		{
+			Name:  "Precedence",
+			Input: "a or b and c",
+			Want:  "a or (b and c)",
+		},
+		{
+			Name:  "Or in and",
+			Input: "(a or b) and c",
+			Want:  "(a or b) and c",
+		},
+		{
+			Name:  "Negated group",
+			Input: "-(a b) or c",
+			Want:  "-(a b) or c",
+		},
+		{
+			Name:  "Distributed field",
+			Input: "repo:(a or b)",
+			Want:  "repo:a or repo:b",
+		},
+		{
+			Name:  "Escaped colon",
+			Input: `fooo\:bar`,
+			Want:  `fooo\:bar`,
+		},
+		{
+			Name:  "Quoted values",
+			Input: `content:"a b" "or"`,
+			Want:  `content:"a b" and "or"`,
+		},
+		{
+			Name:  "Escaped characters",
+			Input: `a\ b\(`,
+			Want:  `a\ b\(`,
+		},
+		{
+			Name:  "Quoted field name",
+			Input: `"repo":foo`,
+			Want:  `"repo":foo`,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			nodes, err := Parse(tt.Input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ToQueryString(nodes)
+			if diff := cmp.Diff(tt.Want, got); diff != "" {
+				t.Fatal(diff)
+			}
+			again, err := Parse(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(nodes, again); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func Test_ToQueryStringAttributes(t *testing.T) {
+	cases := []struct {
+		Name string
+		Node Node
+		Want string
+	}{
+		{
+			Name: "Prefix",
+			Node: Parameter{Field: "repo", Value: "foo/", Prefix: true},
+			Want: "repo:foo/*",
+		},
+		{
+			Name: "Revisions",
+			Node: Parameter{Field: "repo", Value: "foo", Revs: []RevisionSpecifier{{RevSpec: "a"}, {RefGlob: "refs/*"}}},
+			Want: "repo:foo@a:*refs/*",
+		},
+		{
+			Name: "Quoted",
+			Node: Parameter{Field: "content", Value: "a\tb", Quoted: true},
+			Want: `content:"a\tb"`,
+		},
+		{
+			Name: "Pattern that looks like a field",
+			Node: Parameter{Value: "-a:b"},
+			Want: `-a\:b`,
+		},
+		{
+			Name: "Constant",
+			Node: Operator{Kind: And, Operands: []Node{Parameter{Value: "a"}, Constant{Value: true}}},
+			Want: "a and true",
+		},
+		{
+			Name: "Group",
+			Node: Operator{Kind: Group, Operands: []Node{Operator{Kind: Or, Operands: []Node{Parameter{Value: "a"}, Parameter{Value: "b"}}}}},
+			Want: "(a or b)",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.Want, ToQueryString([]Node{tt.Node})); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
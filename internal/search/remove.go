@@ -0,0 +1,57 @@
+package search
+
+// RemoveField returns a copy of the parse tree without any parameter whose
+// field is field, whether negated or not, as in "repo:foo a" => "a". Operators
+// left without operands are removed as well, as in "a (repo:foo or repo:bar)"
+// => "a", and operators left with a single operand are replaced by it, except
+// for Not and Group, which keep their operand. Remaining operands of an operator
+// are reduced like those produced by Parse, so that "(and a (or b repo:foo))" =>
+// "(and a b)". The input tree is not modified.
+func RemoveField(nodes []Node, field string) []Node {
+	return removeParameters(nodes, func(p Parameter) bool {
+		return p.Field == field
+	})
+}
+
+// keepLast returns a copy of the parse tree where last is the only parameter
+// with its field. The first parameter equal to last in the tree is kept.
+func keepLast(nodes []Node, last Parameter) []Node {
+	kept := false
+	return removeParameters(nodes, func(p Parameter) bool {
+		if p.Field != last.Field {
+			return false
+		}
+		if !kept && p.Value == last.Value && p.Negated == last.Negated && p.Quoted == last.Quoted {
+			kept = true
+			return false
+		}
+		return true
+	})
+}
+
+// removeParameters implements RemoveField for parameters matching remove.
+func removeParameters(nodes []Node, remove func(Parameter) bool) []Node {
+	var result []Node
+	for _, node := range nodes {
+		switch v := node.(type) {
+		case Parameter:
+			if !remove(v) {
+				result = append(result, v)
+			}
+		case Operator:
+			operands := removeParameters(v.Operands, remove)
+			if len(operands) == 0 {
+				continue
+			}
+			switch v.Kind {
+			case Not, Group:
+				result = append(result, Operator{Kind: v.Kind, Operands: operands})
+			default:
+				result = append(result, newOperator(operands, v.Kind)...)
+			}
+		default:
+			result = append(result, node)
+		}
+	}
+	return result
+}
@@ -0,0 +1,97 @@
+package search
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_RemoveField(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Input string
+		Mode  GroupMode
+		Want  string
+	}{
+		{
+			Name:  "Field absent",
+			Input: "file:foo a",
+			Want:  "(and file:foo a)",
+		},
+		{
+			Name:  "Multiple occurrences",
+			Input: "repo:foo a -repo:bar file:baz repo:qux",
+			Want:  "(and file:baz a)",
+		},
+		{
+			Name:  "Only the field",
+			Input: "repo:foo repo:bar",
+			Want:  "",
+		},
+		{
+			Name:  "Nested",
+			Input: "a and (b or (repo:foo and c))",
+			Want:  "(and a (or b c))",
+		},
+		{
+			Name:  "Remaining operands are reduced",
+			Input: "a and (b or repo:foo)",
+			Want:  "(and a b)",
+		},
+		{
+			Name:  "Sole operand of a group",
+			Input: "a (repo:foo)",
+			Want:  "a",
+		},
+		{
+			Name:  "Sole operands of an or-expression",
+			Input: "a (repo:foo or repo:bar)",
+			Want:  "a",
+		},
+		{
+			Name:  "Sole operand of a negated group",
+			Input: "a -(repo:foo)",
+			Want:  "a",
+		},
+		{
+			Name:  "Negated group keeps its operand",
+			Input: "a -(repo:foo b)",
+			Want:  "(concat a (not b))",
+		},
+		{
+			Name:  "Faithful group keeps its operand",
+			Input: "a (repo:foo or b)",
+			Mode:  GroupFaithful,
+			Want:  "(concat a (group b))",
+		},
+		{
+			Name:  "Sole operand of a faithful group",
+			Input: "a (repo:foo)",
+			Mode:  GroupFaithful,
+			Want:  "a",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			nodes, err := ParseWithGroupMode(tt.Input, tt.Mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			toString := func(nodes []Node) string {
+				var s string
+				for _, node := range nodes {
+					s += node.String()
+				}
+				return s
+			}
+			before := toString(nodes)
+			if diff := cmp.Diff(tt.Want, toString(RemoveField(nodes, "repo"))); diff != "" {
+				t.Error(diff)
+			}
+			// The input is not modified.
+			if diff := cmp.Diff(before, toString(nodes)); diff != "" {
+				t.Errorf("input modified: %s", diff)
+			}
+		})
+	}
+}
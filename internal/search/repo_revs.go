@@ -118,8 +118,15 @@ func ParseRepositoryRevisions(repoAndOptionalRev string) (api.RepoName, []Revisi
 	}
 
 	repo := api.RepoName(repoAndOptionalRev[:i])
+	return repo, parseRevs(repoAndOptionalRev[i+1:])
+}
+
+// parseRevs parses a ':'-separated list of revspecs and/or ref globs, as in the
+// revs of repo@revs. Empty elements are ignored, and an empty list refers to the
+// default branch.
+func parseRevs(spec string) []RevisionSpecifier {
 	var revs []RevisionSpecifier
-	for _, part := range strings.Split(repoAndOptionalRev[i+1:], ":") {
+	for _, part := range strings.Split(spec, ":") {
 		if part == "" {
 			continue
 		}
@@ -128,7 +135,7 @@ func ParseRepositoryRevisions(repoAndOptionalRev string) (api.RepoName, []Revisi
 	if len(revs) == 0 {
 		revs = []RevisionSpecifier{{RevSpec: ""}} // default branch
 	}
-	return repo, revs
+	return revs
 }
 
 func parseRev(spec string) RevisionSpecifier {
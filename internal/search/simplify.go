@@ -0,0 +1,128 @@
+package search
+
+// Simplify returns an equivalent parse tree where the following boolean
+// algebra identities are applied to and- and or-expressions:
+// (1) flattening, as in "(and a (and b c))" => "(and a b c)".
+// (2) idempotence, as in "(and a a)" => "a" and "(or a a)" => "a".
+// (3) absorption, as in "(and a (or a b))" => "a" and "(or a (and a b))" => "a".
+// (4) identity and annihilation of constants (see ParseWithConstants), as in
+// "(and a (true))" => "a", "(or a (false))" => "a", "(and a (false))" =>
+// "(false)" and "(or a (true))" => "(true)".
+//
+// Concatenated patterns are ordered and not boolean operands, so their
+// operands are simplified but never removed, reordered or flattened. Likewise,
+// the operand of a negated group is simplified but the negation is retained,
+// unless the operand is a constant, as in "(not (true))" => "(false)". The
+// operands of a sequence (see ParseWithSeparator) are also ordered.
+// Operands are considered equal if they have the same string representation.
+func Simplify(nodes []Node) []Node {
+	var result []Node
+	for _, node := range nodes {
+		result = append(result, simplify(node))
+	}
+	return result
+}
+
+func simplify(node Node) Node {
+	operator, ok := node.(Operator)
+	if !ok {
+		return node
+	}
+
+	var operands []Node
+	for _, operand := range operator.Operands {
+		operand = simplify(operand)
+		if v, ok := operand.(Operator); ok && v.Kind == operator.Kind && (v.Kind == And || v.Kind == Or) {
+			operands = append(operands, v.Operands...)
+			continue
+		}
+		operands = append(operands, operand)
+	}
+	if operator.Kind == Not && len(operands) == 1 {
+		if c, ok := operands[0].(Constant); ok {
+			return Constant{Value: !c.Value}
+		}
+	}
+	if operator.Kind == Concat || operator.Kind == Not || operator.Kind == Then {
+		return Operator{Kind: operator.Kind, Operands: operands}
+	}
+
+	operands, c, ok := foldConstants(operands, operator.Kind)
+	if ok {
+		return c
+	}
+	operands = absorb(dedupe(operands), operator.Kind)
+	if len(operands) == 1 {
+		return operands[0]
+	}
+	return Operator{Kind: operator.Kind, Operands: operands}
+}
+
+// foldConstants removes constants that are the identity of operators of kind
+// kind from nodes, which is true for and-expressions and false for
+// or-expressions. It returns the constant that the operator reduces to and true
+// if nodes contain the complement of the identity, or if nothing else remains.
+func foldConstants(nodes []Node, kind operatorKind) ([]Node, Constant, bool) {
+	identity := kind == And
+	var result []Node
+	for _, node := range nodes {
+		c, ok := node.(Constant)
+		if !ok {
+			result = append(result, node)
+			continue
+		}
+		if c.Value != identity {
+			return nil, c, true
+		}
+	}
+	if len(result) == 0 {
+		return nil, Constant{Value: identity}, true
+	}
+	return result, Constant{}, false
+}
+
+// dedupe removes operands that are structurally equal to a preceding operand.
+func dedupe(nodes []Node) []Node {
+	seen := make(map[string]bool)
+	var result []Node
+	for _, node := range nodes {
+		if seen[nodeKey(node)] {
+			continue
+		}
+		seen[nodeKey(node)] = true
+		result = append(result, node)
+	}
+	return result
+}
+
+// absorb removes operands of the dual operator kind that contain an operand
+// equal to one of nodes, which are the operands of an operator of kind kind.
+func absorb(nodes []Node, kind operatorKind) []Node {
+	dual := And
+	if kind == And {
+		dual = Or
+	}
+
+	siblings := make(map[string]bool)
+	for _, node := range nodes {
+		siblings[nodeKey(node)] = true
+	}
+
+	var result []Node
+	for _, node := range nodes {
+		if v, ok := node.(Operator); ok && v.Kind == dual && containsAny(v.Operands, siblings) {
+			continue
+		}
+		result = append(result, node)
+	}
+	return result
+}
+
+func containsAny(nodes []Node, set map[string]bool) bool {
+	for _, node := range nodes {
+		if set[nodeKey(node)] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package search
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_Simplify(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Input string
+		Want  string
+	}{
+		{
+			Name:  "Idempotent and",
+			Input: "a and a",
+			Want:  "a",
+		},
+		{
+			Name:  "Idempotent or",
+			Input: "a or b or a",
+			Want:  "(or a b)",
+		},
+		{
+			Name:  "Absorption over or",
+			Input: "a and (a or b)",
+			Want:  "a",
+		},
+		{
+			Name:  "Absorption over and",
+			Input: "a or (a and b)",
+			Want:  "a",
+		},
+		{
+			Name:  "Flattening after simplification",
+			Input: "(a or a) and (b and c)",
+			Want:  "(and a b c)",
+		},
+		{
+			Name:  "No absorption without shared operand",
+			Input: "a and (b or c)",
+			Want:  "(and a (or b c))",
+		},
+		{
+			Name:  "Concatenated patterns are preserved",
+			Input: "a a",
+			Want:  "(concat a a)",
+		},
+		{
+			Name:  "Idempotent concatenated patterns",
+			Input: "(a b) and (a b)",
+			Want:  "(concat a b)",
+		},
+		{
+			Name:  "Negated filters are distinct",
+			Input: "repo:foo and -repo:foo",
+			Want:  "(and repo:foo -repo:foo)",
+		},
+		{
+			Name:  "Negation is retained",
+			Input: "-(a or a)",
+			Want:  "(not a)",
+		},
+		{
+			Name:  "Nested negations are not flattened",
+			Input: "-(-(a))",
+			Want:  "(not (not a))",
+		},
+		{
+			Name:  "And with true",
+			Input: "a and true",
+			Want:  "a",
+		},
+		{
+			Name:  "Or with false",
+			Input: "a or false",
+			Want:  "a",
+		},
+		{
+			Name:  "And with false",
+			Input: "a and b and false",
+			Want:  "(false)",
+		},
+		{
+			Name:  "Or with true",
+			Input: "a or true",
+			Want:  "(true)",
+		},
+		{
+			Name:  "Only identities",
+			Input: "true and true",
+			Want:  "(true)",
+		},
+		{
+			Name:  "Nested constants",
+			Input: "a or (b and false)",
+			Want:  "a",
+		},
+		{
+			Name:  "Negated constant",
+			Input: "a and -(false)",
+			Want:  "a",
+		},
+		{
+			Name:  "Constants alongside patterns",
+			Input: "a true b",
+			Want:  "(concat a b)",
+		},
+		{
+			Name:  "Constant in negated group",
+			Input: "-(a and false)",
+			Want:  "(true)",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			nodes, err := ParseWithConstants(tt.Input, DefaultConstants)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			for _, node := range Simplify(nodes) {
+				got += node.String()
+			}
+			if diff := cmp.Diff(tt.Want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func Test_SimplifyFlattensNestedOperators(t *testing.T) {
+	input := []Node{
+		Operator{
+			Kind: Or,
+			Operands: []Node{
+				Parameter{Value: "a"},
+				Operator{
+					Kind: Or,
+					Operands: []Node{
+						Parameter{Value: "b"},
+						Operator{Kind: Or, Operands: []Node{Parameter{Value: "c"}, Parameter{Value: "a"}}},
+					},
+				},
+			},
+		},
+	}
+	want := "(or a b c)"
+	got := Simplify(input)[0].String()
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func Test_SimplifyPrefixMatches(t *testing.T) {
+	// A prefix match is not equal to a match of its value.
+	nodes, err := Parse("repo:foo/* or repo:foo/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "(or repo:foo/* repo:foo/)"
+	got := Simplify(SetPrefixMatches(nodes, DefaultPrefixFields))[0].String()
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func Test_SimplifyPlainPatterns(t *testing.T) {
+	// Without constants, true and false are search patterns like any other.
+	nodes, err := Parse("a and true or false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "(or (and a true) false)"
+	got := Simplify(nodes)[0].String()
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func Test_SimplifyRetainsSequences(t *testing.T) {
+	nodes, err := ParseWithSeparator("a | a | (b or b)", "|")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	for _, node := range Simplify(nodes) {
+		got += node.String()
+	}
+	if diff := cmp.Diff("(then a a b)", got); diff != "" {
+		t.Error(diff)
+	}
+}
@@ -0,0 +1,82 @@
+package search
+
+// TokenKind is the kind of a token produced by Tokenize.
+type TokenKind int
+
+const (
+	TokenWhitespace TokenKind = iota
+	TokenParen                // A parenthesis, or a brace delimiting a block.
+	TokenOperator
+	TokenField // The field part of a parameter, including any - prefix and the colon, as in "-repo:".
+	TokenValue // The value part of a parameter, or a search pattern.
+)
+
+func (k TokenKind) String() string {
+	switch k {
+	case TokenWhitespace:
+		return "whitespace"
+	case TokenParen:
+		return "paren"
+	case TokenOperator:
+		return "operator"
+	case TokenField:
+		return "field"
+	case TokenValue:
+		return "value"
+	}
+	return "unknown"
+}
+
+// Token is a lexical unit of a query.
+type Token struct {
+	Kind  TokenKind
+	Value string
+	Start int // Byte offset of the first character of the token in the input.
+	End   int // Byte offset just past the last character of the token in the input.
+}
+
+// Tokenize returns the tokens of input in order, for example to highlight
+// syntax while a query is being typed. It uses the same scanner as Parse, but
+// does not parse, so it accepts partial or invalid input: the concatenation of
+// all token values is always the input.
+func Tokenize(in string) []Token {
+	p := &parser{buf: []byte(in)}
+	var tokens []Token
+	emit := func(kind TokenKind, start, end int) {
+		tokens = append(tokens, Token{Kind: kind, Value: in[start:end], Start: start, End: end})
+	}
+	for !p.done() {
+		start := p.pos
+		switch {
+		case isSpace(p.buf[p.pos]):
+			p.pos += skipSpace(p.buf[p.pos:])
+			emit(TokenWhitespace, start, p.pos)
+		case p.expect(LPAREN), p.expect(RPAREN):
+			emit(TokenParen, start, p.pos)
+		case p.matchBrace(LBRACE), p.matchBrace(RBRACE):
+			p.pos++
+			emit(TokenParen, start, p.pos)
+		case p.expect(AND), p.expect(OR):
+			emit(TokenOperator, start, p.pos)
+		default:
+			parameter := p.ParseParameter()
+			if p.pos == start {
+				// Never get stuck on input the scanner does not consume.
+				p.pos++
+			}
+			if parameter.Field == "" {
+				emit(TokenValue, start, p.pos)
+				break
+			}
+			fieldEnd := start + len(parameter.Field) + 1
+			if parameter.Negated {
+				fieldEnd++
+			}
+			emit(TokenField, start, fieldEnd)
+			if fieldEnd < p.pos {
+				emit(TokenValue, fieldEnd, p.pos)
+			}
+		}
+	}
+	return tokens
+}
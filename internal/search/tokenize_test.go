@@ -0,0 +1,83 @@
+package search
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_Tokenize(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Input string
+		Want  string
+	}{
+		{
+			Name:  "Empty",
+			Input: "",
+			Want:  "",
+		},
+		{
+			Name:  "Pattern",
+			Input: "foo",
+			Want:  "value(foo)@0",
+		},
+		{
+			Name:  "Field and value",
+			Input: "repo:foo",
+			Want:  "field(repo:)@0 value(foo)@5",
+		},
+		{
+			Name:  "Negated field without value",
+			Input: "-file:",
+			Want:  "field(-file:)@0",
+		},
+		{
+			Name:  "Mixed token stream",
+			Input: "(a or repo:b) and  c",
+			Want:  "paren(()@0 value(a)@1 whitespace( )@2 operator(or)@3 whitespace( )@5 field(repo:)@6 value(b)@11 paren())@12 whitespace( )@13 operator(and)@14 whitespace(  )@17 value(c)@19",
+		},
+		{
+			Name:  "Quoted value",
+			Input: `content:"a and b"`,
+			Want:  `field(content:)@0 value("a and b")@8`,
+		},
+		{
+			Name:  "Partial input",
+			Input: "(a or",
+			Want:  "paren(()@0 value(a)@1 whitespace( )@2 operator(or)@3",
+		},
+		{
+			Name:  "Block",
+			Input: "repo:a { b{2} }",
+			Want:  "field(repo:)@0 value(a)@5 whitespace( )@6 paren({)@7 whitespace( )@8 value(b{2})@9 whitespace( )@13 paren(})@14",
+		},
+		{
+			Name:  "Invalid input",
+			Input: "or ) (",
+			Want:  "operator(or)@0 whitespace( )@2 paren())@3 whitespace( )@4 paren(()@5",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			tokens := Tokenize(tt.Input)
+			var got []string
+			var concat strings.Builder
+			for _, token := range tokens {
+				got = append(got, fmt.Sprintf("%s(%s)@%d", token.Kind, token.Value, token.Start))
+				if token.Value != tt.Input[token.Start:token.End] {
+					t.Errorf("token %v does not match its range", token)
+				}
+				concat.WriteString(token.Value)
+			}
+			if diff := cmp.Diff(tt.Want, strings.Join(got, " ")); diff != "" {
+				t.Error(diff)
+			}
+			if concat.String() != tt.Input {
+				t.Errorf("tokens %q do not cover input %q", concat.String(), tt.Input)
+			}
+		})
+	}
+}
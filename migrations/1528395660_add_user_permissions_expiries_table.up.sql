@@ -0,0 +1,18 @@
+BEGIN;
+
+-- Records the time at which a single grant of a user permission expires.
+-- Object IDs in "user_permissions" without a row in this table never expire.
+CREATE TABLE IF NOT EXISTS user_permissions_expiries (
+    user_id integer NOT NULL,
+    permission text NOT NULL,
+    object_type text NOT NULL,
+    object_id integer NOT NULL,
+    expired_at timestamp with time zone NOT NULL,
+    CONSTRAINT user_permissions_expiries_perm_object_unique
+        UNIQUE (user_id, permission, object_type, object_id)
+);
+
+CREATE INDEX IF NOT EXISTS user_permissions_expiries_expired_at_idx
+    ON user_permissions_expiries (expired_at);
+
+COMMIT;
@@ -0,0 +1,15 @@
+BEGIN;
+
+-- Records which users are granted access to a repository by each provider.
+-- The "user_ids" of "repo_permissions" is the union across all providers.
+CREATE TABLE IF NOT EXISTS repo_permissions_providers (
+    repo_id integer NOT NULL,
+    permission text NOT NULL,
+    provider text NOT NULL,
+    user_ids bytea NOT NULL,
+    updated_at timestamp with time zone NOT NULL,
+    CONSTRAINT repo_permissions_providers_perm_provider_unique
+        UNIQUE (repo_id, permission, provider)
+);
+
+COMMIT;
@@ -0,0 +1,16 @@
+BEGIN;
+
+-- Records changes of "repo_permissions" for auditing, when enabled.
+CREATE TABLE IF NOT EXISTS repo_permissions_changes (
+    id SERIAL PRIMARY KEY,
+    repo_id integer NOT NULL,
+    permission text NOT NULL,
+    added_user_ids bytea NOT NULL,
+    removed_user_ids bytea NOT NULL,
+    changed_at timestamp with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS repo_permissions_changes_repo_perm_changed_at
+    ON repo_permissions_changes (repo_id, permission, changed_at);
+
+COMMIT;
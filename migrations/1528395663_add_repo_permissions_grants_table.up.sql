@@ -0,0 +1,13 @@
+BEGIN;
+
+-- Records the time at which a user was added to "repo_permissions" by SetRepoPermissions.
+CREATE TABLE IF NOT EXISTS repo_permissions_grants (
+    repo_id integer NOT NULL,
+    permission text NOT NULL,
+    user_id integer NOT NULL,
+    added_at timestamp with time zone NOT NULL,
+    CONSTRAINT repo_permissions_grants_perm_user_unique
+        UNIQUE (repo_id, permission, user_id)
+);
+
+COMMIT;
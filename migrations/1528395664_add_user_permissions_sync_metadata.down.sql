@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE user_permissions DROP COLUMN IF EXISTS sync_metadata;
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+-- Describes the sync that last wrote a row of "user_permissions", NULL if unknown.
+ALTER TABLE user_permissions ADD COLUMN IF NOT EXISTS sync_metadata jsonb;
+
+COMMIT;
@@ -0,0 +1,5 @@
+BEGIN;
+
+DROP INDEX IF EXISTS user_permissions_expiries_object_perm_idx;
+
+COMMIT;
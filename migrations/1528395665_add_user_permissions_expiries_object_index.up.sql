@@ -0,0 +1,8 @@
+BEGIN;
+
+-- Serves lookups of the expiries of a single repository and permission, e.g. by
+-- LoadRepoPermissions, which the unique constraint leading with user_id can't serve.
+CREATE INDEX IF NOT EXISTS user_permissions_expiries_object_perm_idx
+    ON user_permissions_expiries (object_id, permission, object_type);
+
+COMMIT;
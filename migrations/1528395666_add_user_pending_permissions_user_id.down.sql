@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP INDEX IF EXISTS user_pending_permissions_user_id_idx;
+ALTER TABLE user_pending_permissions DROP COLUMN IF EXISTS user_id;
+
+COMMIT;
@@ -0,0 +1,10 @@
+BEGIN;
+
+-- The ID of the user that a bind ID is already known to belong to, if any, so
+-- that the pending permissions can be granted without looking up the bind ID.
+ALTER TABLE user_pending_permissions ADD COLUMN IF NOT EXISTS user_id integer;
+
+CREATE INDEX IF NOT EXISTS user_pending_permissions_user_id_idx
+    ON user_pending_permissions (user_id) WHERE user_id IS NOT NULL;
+
+COMMIT;
@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE repo_permissions DROP COLUMN IF EXISTS sequence;
+
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+
+-- The sequence key of the last write applied by SetRepoPermissionsWithSequence,
+-- so that an out-of-order retry of an older write can be ignored.
+ALTER TABLE repo_permissions ADD COLUMN IF NOT EXISTS sequence bigint;
+
+COMMIT;
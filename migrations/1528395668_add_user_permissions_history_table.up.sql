@@ -0,0 +1,17 @@
+BEGIN;
+
+-- Records the object IDs of "user_permissions" before every change for auditing,
+-- when enabled.
+CREATE TABLE IF NOT EXISTS user_permissions_history (
+    id SERIAL PRIMARY KEY,
+    user_id integer NOT NULL,
+    permission text NOT NULL,
+    object_type text NOT NULL,
+    object_ids bytea NOT NULL,
+    recorded_at timestamp with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS user_permissions_history_user_perm_recorded_at
+    ON user_permissions_history (user_id, permission, object_type, recorded_at);
+
+COMMIT;
@@ -86,6 +86,24 @@
 // 1528395658_perms_table_provider_nullable.up.sql (894B)
 // 1528395659_user_pending_perms_table_add_service_type_and_id.down.sql (499B)
 // 1528395659_user_pending_perms_table_add_service_type_and_id.up.sql (1.289kB)
+// 1528395660_add_user_permissions_expiries_table.down.sql (65B)
+// 1528395660_add_user_permissions_expiries_table.up.sql (637B)
+// 1528395661_add_repo_permissions_providers_table.down.sql (66B)
+// 1528395661_add_repo_permissions_providers_table.up.sql (504B)
+// 1528395662_add_repo_permissions_changes_table.down.sql (64B)
+// 1528395662_add_repo_permissions_changes_table.up.sql (492B)
+// 1528395663_add_repo_permissions_grants_table.down.sql (63B)
+// 1528395663_add_repo_permissions_grants_table.up.sql (404B)
+// 1528395664_add_user_permissions_sync_metadata.down.sql (83B)
+// 1528395664_add_user_permissions_sync_metadata.up.sql (176B)
+// 1528395665_add_user_permissions_expiries_object_index.down.sql (81B)
+// 1528395665_add_user_permissions_expiries_object_index.up.sql (324B)
+// 1528395666_add_user_pending_permissions_user_id.down.sql (144B)
+// 1528395666_add_user_pending_permissions_user_id.up.sql (388B)
+// 1528395667_add_repo_permissions_sequence.down.sql (78B)
+// 1528395667_add_repo_permissions_sequence.up.sql (236B)
+// 1528395668_add_user_permissions_history_table.down.sql (64B)
+// 1528395668_add_user_permissions_history_table.up.sql (528B)
 
 package migrations
 
@@ -1874,6 +1892,366 @@ func _1528395659_user_pending_perms_table_add_service_type_and_idUpSql() (*asset
 	return a, nil
 }
 
+var __1528395660_add_user_permissions_expiries_tableDownSql = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x00\x41\x00\xbe\xff\x42\x45\x47\x49\x4e\x3b\x0a\x0a\x44\x52\x4f\x50\x20\x54\x41\x42\x4c\x45\x20\x49\x46\x20\x45\x58\x49\x53\x54\x53\x20\x75\x73\x65\x72\x5f\x70\x65\x72\x6d\x69\x73\x73\x69\x6f\x6e\x73\x5f\x65\x78\x70\x69\x72\x69\x65\x73\x3b\x0a\x0a\x43\x4f\x4d\x4d\x49\x54\x3b\x0a\x03\x00\x47\xa7\xcb\xf1\x41\x00\x00\x00")
+
+func _1528395660_add_user_permissions_expiries_tableDownSqlBytes() ([]byte, error) {
+	return bindataRead(
+		__1528395660_add_user_permissions_expiries_tableDownSql,
+		"1528395660_add_user_permissions_expiries_table.down.sql",
+	)
+}
+
+func _1528395660_add_user_permissions_expiries_tableDownSql() (*asset, error) {
+	bytes, err := _1528395660_add_user_permissions_expiries_tableDownSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "1528395660_add_user_permissions_expiries_table.down.sql", size: 0, mode: os.FileMode(0), modTime: time.Unix(0, 0)}
+	a := &asset{bytes: bytes, info: info, digest: [32]uint8{0x32, 0xc2, 0x41, 0x67, 0x74, 0xe7, 0xf0, 0x28, 0x55, 0x95, 0xa8, 0x9c, 0xa9, 0xc5, 0xd5, 0x6e, 0x70, 0x9a, 0x6, 0x3b, 0x98, 0xe2, 0x3d, 0xc6, 0x95, 0x3f, 0xd3, 0x74, 0x97, 0x25, 0xf4, 0xca}}
+	return a, nil
+}
+
+var __1528395660_add_user_permissions_expiries_tableUpSql = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x8c\x51\x4d\x8b\xe2\x40\x10\xbd\xe7\x57\x3c\x3c\x29\xa8\x7f\xc0\x93\x1f\xd9\xa5\x41\x3b\xac\x46\xf0\x16\x5a\x53\x6b\x6a\xd1\xee\x6c\x77\x65\x74\xe6\xd7\x0f\xe9\xd1\xc9\x20\x38\x0c\xf4\xa5\x78\x1f\x55\xef\xf5\x2c\xfd\xad\xf4\x24\x49\x46\x23\xac\xe9\xe0\x7c\x19\x20\x15\x41\xf8\x4c\x30\x82\x4b\xc5\x87\x0a\x06\x81\xed\xf1\x44\x38\x7a\x63\x05\xee\x2f\x0c\x9a\x40\x1e\x35\xf9\x33\x87\xc0\xce\x82\xae\x35\x7b\x0a\xe3\xd6\x29\xdb\xff\xa3\x83\x40\x2d\x02\xd8\xa2\xd7\x52\x8b\x8e\x1a\x7a\xb8\xb0\x54\xae\x11\x18\x78\x77\x69\x39\x52\x71\x80\x98\xfd\x89\x60\xe9\x85\xfc\xcd\x6e\x9c\xcc\xd7\xe9\x34\x4f\x91\x4f\x67\xcb\x14\xea\x17\x74\x96\x23\xdd\xa9\x4d\xbe\xc1\xa3\x6d\x11\x35\x4c\x01\xfd\x04\xc0\x07\xce\x25\xd8\x0a\x1d\xc9\x47\xa9\xde\x2e\x97\xc3\x88\x76\x42\x08\x5d\xe5\x01\x75\x31\x41\x21\xaf\x35\x7d\x03\x3f\x35\x8f\x97\x50\x59\x18\x89\x4d\x06\x31\xe7\x3a\x86\x8e\x23\xde\x9c\xa5\x07\xc5\x3c\xd3\x9b\x7c\x3d\x55\x3a\x7f\x9e\x2b\x76\x58\xdc\x76\x37\x96\xff\x37\x14\xb5\xed\xdb\x6a\xf5\x67\x9b\xa2\x7f\x0b\x3d\xfc\xf2\x35\xc3\xfb\xb9\x6d\x9a\xcf\x81\xcb\x41\x32\x98\x24\xf7\x82\x95\x5e\xa4\xbb\x9f\x16\x5c\x74\xf9\x0a\x2e\xaf\xf1\x88\x4c\x3f\xe7\xa3\xdf\x09\xe2\xce\x6c\xb5\x52\xf9\x24\x79\x1f\x00\x01\x39\xa9\x70\x7d\x02\x00\x00")
+
+func _1528395660_add_user_permissions_expiries_tableUpSqlBytes() ([]byte, error) {
+	return bindataRead(
+		__1528395660_add_user_permissions_expiries_tableUpSql,
+		"1528395660_add_user_permissions_expiries_table.up.sql",
+	)
+}
+
+func _1528395660_add_user_permissions_expiries_tableUpSql() (*asset, error) {
+	bytes, err := _1528395660_add_user_permissions_expiries_tableUpSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "1528395660_add_user_permissions_expiries_table.up.sql", size: 0, mode: os.FileMode(0), modTime: time.Unix(0, 0)}
+	a := &asset{bytes: bytes, info: info, digest: [32]uint8{0xa2, 0xec, 0xf6, 0x52, 0x1a, 0xd0, 0x79, 0x8e, 0x95, 0x46, 0xec, 0x17, 0x6a, 0x6c, 0xc7, 0xcf, 0xf0, 0x63, 0x94, 0x54, 0xc1, 0xf8, 0xff, 0x7e, 0xc3, 0x4c, 0x55, 0x40, 0x63, 0x47, 0xb2, 0x34}}
+	return a, nil
+}
+
+var __1528395661_add_repo_permissions_providers_tableDownSql = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x00\x42\x00\xbd\xff\x42\x45\x47\x49\x4e\x3b\x0a\x0a\x44\x52\x4f\x50\x20\x54\x41\x42\x4c\x45\x20\x49\x46\x20\x45\x58\x49\x53\x54\x53\x20\x72\x65\x70\x6f\x5f\x70\x65\x72\x6d\x69\x73\x73\x69\x6f\x6e\x73\x5f\x70\x72\x6f\x76\x69\x64\x65\x72\x73\x3b\x0a\x0a\x43\x4f\x4d\x4d\x49\x54\x3b\x0a\x03\x00\x1c\xac\x10\x3f\x42\x00\x00\x00")
+
+func _1528395661_add_repo_permissions_providers_tableDownSqlBytes() ([]byte, error) {
+	return bindataRead(
+		__1528395661_add_repo_permissions_providers_tableDownSql,
+		"1528395661_add_repo_permissions_providers_table.down.sql",
+	)
+}
+
+func _1528395661_add_repo_permissions_providers_tableDownSql() (*asset, error) {
+	bytes, err := _1528395661_add_repo_permissions_providers_tableDownSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "1528395661_add_repo_permissions_providers_table.down.sql", size: 0, mode: os.FileMode(0), modTime: time.Unix(0, 0)}
+	a := &asset{bytes: bytes, info: info, digest: [32]uint8{0x4c, 0x1c, 0x45, 0x70, 0xd7, 0x61, 0x1c, 0xdd, 0xc4, 0x1c, 0x23, 0x85, 0xb1, 0x1b, 0xb6, 0xc7, 0x6f, 0xbe, 0x36, 0x18, 0x6f, 0x94, 0x12, 0xd7, 0x85, 0x3e, 0x70, 0xbd, 0xe7, 0x58, 0x32, 0x13}}
+	return a, nil
+}
+
+var __1528395661_add_repo_permissions_providers_tableUpSql = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x7c\x90\x51\x6b\xc2\x30\x14\x85\xdf\xf3\x2b\x0e\x7d\x52\x50\xff\x80\x4f\x2a\xdd\x28\x68\x65\x1a\x61\x6f\x25\x36\x77\x36\xa0\x49\x97\x7b\x3b\xe7\x7e\xfd\x68\xe7\x2a\x94\x31\xc8\xcb\xe1\xe4\xfb\xe0\xdc\x65\xfa\x9c\xe5\x73\xa5\xa6\x53\xec\xa8\x0c\xd1\x32\xae\x95\x2b\x2b\x34\x4c\x91\x61\x22\xe1\x14\x8d\x17\xb2\x30\x65\x49\xcc\x90\x00\x83\x48\x75\x60\x27\x21\xde\x70\xbc\x81\x4c\x59\xa1\x8e\xe1\xc3\x59\x8a\xb3\xd6\xa5\x2b\x42\xd2\x2a\x0a\x67\x39\x41\x78\x43\xd2\x22\x45\x4d\xf1\xe2\x98\x5d\xf0\x9c\xc0\x31\xa4\x22\x34\xde\x05\x0f\x53\xc6\xc0\x0c\x73\x3e\xf7\x26\x9e\xa9\xd5\x2e\x5d\xe8\x14\x7a\xb1\x5c\xa7\xc8\x9e\x90\x6f\x35\xd2\xd7\x6c\xaf\xf7\x18\xfa\x8a\x1e\xc3\x48\x01\xf8\xf9\xe0\x2c\x9c\x17\x3a\x51\xec\xd8\xfc\xb0\x5e\x4f\xba\xf6\x41\x42\xe8\x53\x86\xed\xdd\xf5\x57\xf7\x3b\x0b\xc7\x9b\x90\x19\x96\xb5\x35\x42\xb6\x30\x02\x71\x17\x62\x31\x97\x1a\x57\x27\x55\x17\xf1\x15\x3c\x0d\x88\xd5\x36\xdf\xeb\xdd\x22\xcb\xf5\x3f\x93\xba\xc3\xf5\xb1\x68\xbc\x7b\x6f\xa8\xc3\xdb\x77\xc8\xb3\x97\x43\x8a\xd1\x7d\xf1\x04\x0f\xc7\xa4\x9f\x32\x56\xe3\xb9\x52\xab\xed\x66\x93\xe9\xb9\xfa\x1e\x00\x94\x8b\x22\xb9\xf8\x01\x00\x00")
+
+func _1528395661_add_repo_permissions_providers_tableUpSqlBytes() ([]byte, error) {
+	return bindataRead(
+		__1528395661_add_repo_permissions_providers_tableUpSql,
+		"1528395661_add_repo_permissions_providers_table.up.sql",
+	)
+}
+
+func _1528395661_add_repo_permissions_providers_tableUpSql() (*asset, error) {
+	bytes, err := _1528395661_add_repo_permissions_providers_tableUpSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "1528395661_add_repo_permissions_providers_table.up.sql", size: 0, mode: os.FileMode(0), modTime: time.Unix(0, 0)}
+	a := &asset{bytes: bytes, info: info, digest: [32]uint8{0xbd, 0x9e, 0xd8, 0x41, 0xed, 0x84, 0xc5, 0x6f, 0xc, 0x13, 0x14, 0x8f, 0x5c, 0xd4, 0x12, 0xdc, 0x32, 0xd6, 0xa1, 0xbe, 0x8c, 0x30, 0x34, 0x9a, 0x86, 0xb1, 0xa, 0xf1, 0x69, 0xdb, 0x28, 0x61}}
+	return a, nil
+}
+
+var __1528395662_add_repo_permissions_changes_tableDownSql = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x00\x40\x00\xbf\xff\x42\x45\x47\x49\x4e\x3b\x0a\x0a\x44\x52\x4f\x50\x20\x54\x41\x42\x4c\x45\x20\x49\x46\x20\x45\x58\x49\x53\x54\x53\x20\x72\x65\x70\x6f\x5f\x70\x65\x72\x6d\x69\x73\x73\x69\x6f\x6e\x73\x5f\x63\x68\x61\x6e\x67\x65\x73\x3b\x0a\x0a\x43\x4f\x4d\x4d\x49\x54\x3b\x0a\x03\x00\xd9\x87\xf9\x89\x40\x00\x00\x00")
+
+func _1528395662_add_repo_permissions_changes_tableDownSqlBytes() ([]byte, error) {
+	return bindataRead(
+		__1528395662_add_repo_permissions_changes_tableDownSql,
+		"1528395662_add_repo_permissions_changes_table.down.sql",
+	)
+}
+
+func _1528395662_add_repo_permissions_changes_tableDownSql() (*asset, error) {
+	bytes, err := _1528395662_add_repo_permissions_changes_tableDownSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "1528395662_add_repo_permissions_changes_table.down.sql", size: 0, mode: os.FileMode(0), modTime: time.Unix(0, 0)}
+	a := &asset{bytes: bytes, info: info, digest: [32]uint8{0x2d, 0x42, 0xbd, 0x25, 0xc9, 0xbf, 0xcd, 0x4c, 0xfb, 0x5, 0x7, 0x62, 0x20, 0x59, 0xbe, 0xa1, 0x44, 0xc0, 0xd8, 0x90, 0x3, 0xc0, 0x3d, 0x6e, 0x24, 0xe9, 0x1a, 0x1c, 0x7b, 0xfa, 0xf, 0x7a}}
+	return a, nil
+}
+
+var __1528395662_add_repo_permissions_changes_tableUpSql = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x8c\x90\xcd\x4e\xeb\x30\x10\x85\xf7\x7e\x8a\xa3\xae\xee\x95\x52\x5e\xa0\xab\x14\x0c\xb2\x48\x53\x94\x04\xa9\x5d\x59\x6e\x3d\x4d\x2c\x11\x3b\xb2\x5d\x0a\x3c\x3d\xc2\xfd\xa1\xca\x02\x58\xda\x67\xe6\xcc\xa7\x6f\xce\x1f\x44\x39\x63\x6c\x3a\x45\x45\x5b\xe7\x75\xc0\xb6\x53\xb6\xa5\x00\xb7\xc3\xc4\xd3\xe0\xe4\x40\xbe\x37\x21\x18\x67\xc3\x04\x3b\xe7\xa1\xf6\xda\x44\x63\xdb\x0c\x87\x8e\x2c\xc8\xaa\xcd\x0b\xe9\x1b\x76\x5b\xf1\xbc\xe1\x68\xf2\x79\xc1\x21\xee\x51\x2e\x1b\xf0\x95\xa8\x9b\x1a\xe3\x22\x79\xbe\xf2\x8f\x01\x80\xd1\xa8\x79\x25\xf2\x02\x4f\x95\x58\xe4\xd5\x1a\x8f\x7c\x9d\xa5\x28\x6d\x1a\x0d\x63\x23\xb5\xe4\x53\x69\xf9\x5c\x14\xc7\xf4\xbb\x12\x91\xde\xe2\x28\x55\x5a\x93\x96\xfb\x40\x5e\x1a\x1d\xb0\x79\x8f\xa4\x46\x23\x9e\x7a\xf7\xfa\xdb\xd0\x11\x56\x4b\x15\x11\x4d\x4f\x21\xaa\x7e\xc0\xc1\xc4\x2e\x3d\xf1\xe1\x2c\x5d\x36\xd8\xff\x19\x3b\x9b\x10\xe5\x1d\x5f\xfd\xd1\x84\xbc\x04\xa7\x9f\xaf\x73\x09\x71\x59\xfe\xa0\xef\xa4\x27\xbb\x32\x91\x5d\xf1\x26\x98\xe5\x62\x21\x9a\x19\xfb\x1c\x00\x6e\xc3\xba\xc9\xec\x01\x00\x00")
+
+func _1528395662_add_repo_permissions_changes_tableUpSqlBytes() ([]byte, error) {
+	return bindataRead(
+		__1528395662_add_repo_permissions_changes_tableUpSql,
+		"1528395662_add_repo_permissions_changes_table.up.sql",
+	)
+}
+
+func _1528395662_add_repo_permissions_changes_tableUpSql() (*asset, error) {
+	bytes, err := _1528395662_add_repo_permissions_changes_tableUpSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "1528395662_add_repo_permissions_changes_table.up.sql", size: 0, mode: os.FileMode(0), modTime: time.Unix(0, 0)}
+	a := &asset{bytes: bytes, info: info, digest: [32]uint8{0xc6, 0xdf, 0x1, 0xf2, 0x82, 0x51, 0xb1, 0xfa, 0x6c, 0x38, 0x87, 0xd0, 0x3b, 0xb0, 0x1c, 0x29, 0x8a, 0xe5, 0xf7, 0x12, 0x27, 0x9b, 0xd, 0x3d, 0x86, 0x22, 0x82, 0x43, 0xca, 0xbc, 0xdc, 0xcf}}
+	return a, nil
+}
+
+var __1528395663_add_repo_permissions_grants_tableDownSql = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x00\x3f\x00\xc0\xff\x42\x45\x47\x49\x4e\x3b\x0a\x0a\x44\x52\x4f\x50\x20\x54\x41\x42\x4c\x45\x20\x49\x46\x20\x45\x58\x49\x53\x54\x53\x20\x72\x65\x70\x6f\x5f\x70\x65\x72\x6d\x69\x73\x73\x69\x6f\x6e\x73\x5f\x67\x72\x61\x6e\x74\x73\x3b\x0a\x0a\x43\x4f\x4d\x4d\x49\x54\x3b\x0a\x03\x00\xf3\xbb\x95\xd1\x3f\x00\x00\x00")
+
+func _1528395663_add_repo_permissions_grants_tableDownSqlBytes() ([]byte, error) {
+	return bindataRead(
+		__1528395663_add_repo_permissions_grants_tableDownSql,
+		"1528395663_add_repo_permissions_grants_table.down.sql",
+	)
+}
+
+func _1528395663_add_repo_permissions_grants_tableDownSql() (*asset, error) {
+	bytes, err := _1528395663_add_repo_permissions_grants_tableDownSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "1528395663_add_repo_permissions_grants_table.down.sql", size: 0, mode: os.FileMode(0), modTime: time.Unix(0, 0)}
+	a := &asset{bytes: bytes, info: info, digest: [32]uint8{0xeb, 0xd1, 0x5d, 0xcd, 0x50, 0x93, 0x87, 0x19, 0xc6, 0x57, 0x9a, 0x98, 0x82, 0x1c, 0x8d, 0x34, 0x27, 0x19, 0x28, 0xfa, 0x99, 0xa3, 0x20, 0x6e, 0xe4, 0x11, 0xde, 0x1, 0xad, 0xf4, 0x2e, 0x1e}}
+	return a, nil
+}
+
+var __1528395663_add_repo_permissions_grants_tableUpSql = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x74\x8f\xc1\x6a\xeb\x30\x10\x45\xf7\xfa\x8a\x4b\x56\x09\x24\xef\x07\xb2\x4a\x8c\x5e\x11\x38\x72\x6b\xcb\xd0\x9d\x51\xe3\x21\xd6\xc2\x96\x2b\x8d\x71\xdb\xaf\x2f\x51\x5b\x0c\x86\x80\x36\xd2\xd5\x99\xb9\xe7\x2c\x9f\x94\x3e\x0a\x71\x38\xa0\xa4\xab\x0f\x6d\x04\x77\x04\x76\x3d\xc1\x32\xe6\xce\x5d\x3b\x58\x4c\x91\x02\x66\x1b\x61\xdb\x96\x5a\xb0\xc7\x26\xd0\xe8\x9b\x91\x42\xef\x62\x74\x7e\x88\x1b\xbc\x7d\xa2\x22\x2e\x69\xf4\xcf\xcb\xf3\x3f\x91\x95\xf2\x64\x24\xcc\xe9\x9c\x4b\xa8\xff\xd0\x85\x81\x7c\x55\x95\xa9\xb0\x9e\xd1\xdc\x82\x1d\x38\x62\x2b\x00\xfc\xa4\xae\x85\x1b\x98\x6e\x14\x12\xa8\xeb\x3c\xdf\xa7\x74\xc1\xc0\xf4\xc1\xab\xf4\x5e\xf8\x31\x9b\x2c\x1a\xcb\xc9\x33\xb2\xed\x47\xcc\x8e\xbb\x74\xc5\x97\x1f\x68\xf5\x3f\x2b\x74\x65\xca\x93\xd2\xe6\x51\xe5\x64\xd1\xa4\xad\xd3\xe0\xde\x27\x4a\xdc\xfd\xd4\x5a\xbd\xd4\x12\xdb\x5f\x9b\x3d\x16\x78\xff\x57\x73\x27\x76\x47\x21\xb2\xe2\x72\x51\xe6\x28\xbe\x07\x00\xd2\x40\x54\x07\x94\x01\x00\x00")
+
+func _1528395663_add_repo_permissions_grants_tableUpSqlBytes() ([]byte, error) {
+	return bindataRead(
+		__1528395663_add_repo_permissions_grants_tableUpSql,
+		"1528395663_add_repo_permissions_grants_table.up.sql",
+	)
+}
+
+func _1528395663_add_repo_permissions_grants_tableUpSql() (*asset, error) {
+	bytes, err := _1528395663_add_repo_permissions_grants_tableUpSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "1528395663_add_repo_permissions_grants_table.up.sql", size: 0, mode: os.FileMode(0), modTime: time.Unix(0, 0)}
+	a := &asset{bytes: bytes, info: info, digest: [32]uint8{0x74, 0xee, 0x65, 0x99, 0x34, 0xca, 0x84, 0xf, 0xb8, 0x7, 0xfd, 0x54, 0xb9, 0xa7, 0x7e, 0x67, 0x57, 0x68, 0xd3, 0xd9, 0x4b, 0x6f, 0x51, 0xed, 0xcb, 0xf2, 0x90, 0x45, 0x45, 0xf9, 0x2a, 0xee}}
+	return a, nil
+}
+
+var __1528395664_add_user_permissions_sync_metadataDownSql = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x00\x53\x00\xac\xff\x42\x45\x47\x49\x4e\x3b\x0a\x0a\x41\x4c\x54\x45\x52\x20\x54\x41\x42\x4c\x45\x20\x75\x73\x65\x72\x5f\x70\x65\x72\x6d\x69\x73\x73\x69\x6f\x6e\x73\x20\x44\x52\x4f\x50\x20\x43\x4f\x4c\x55\x4d\x4e\x20\x49\x46\x20\x45\x58\x49\x53\x54\x53\x20\x73\x79\x6e\x63\x5f\x6d\x65\x74\x61\x64\x61\x74\x61\x3b\x0a\x0a\x43\x4f\x4d\x4d\x49\x54\x3b\x0a\x03\x00\xf5\x4a\x94\x81\x53\x00\x00\x00")
+
+func _1528395664_add_user_permissions_sync_metadataDownSqlBytes() ([]byte, error) {
+	return bindataRead(
+		__1528395664_add_user_permissions_sync_metadataDownSql,
+		"1528395664_add_user_permissions_sync_metadata.down.sql",
+	)
+}
+
+func _1528395664_add_user_permissions_sync_metadataDownSql() (*asset, error) {
+	bytes, err := _1528395664_add_user_permissions_sync_metadataDownSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "1528395664_add_user_permissions_sync_metadata.down.sql", size: 0, mode: os.FileMode(0), modTime: time.Unix(0, 0)}
+	a := &asset{bytes: bytes, info: info, digest: [32]uint8{0xef, 0x7c, 0x63, 0x9e, 0xb1, 0x7d, 0x57, 0x2b, 0x3f, 0x9d, 0x8d, 0x36, 0x46, 0x3a, 0xc6, 0x21, 0x1d, 0xa6, 0x8, 0xce, 0xbd, 0x54, 0x9f, 0xeb, 0xa0, 0x48, 0x62, 0x94, 0xe9, 0x97, 0xea, 0x18}}
+	return a, nil
+}
+
+var __1528395664_add_user_permissions_sync_metadataUpSql = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x5c\xcd\xbd\xaa\x83\x30\x1c\x07\xd0\x3d\x4f\xf1\xc3\xf9\x7a\x5f\xc0\xc9\x8f\xb4\x04\x62\x84\x1a\xa1\x9b\x44\x1b\x31\x6d\x4d\x4a\xfe\x11\xe9\xdb\x17\x3a\x76\x3f\x70\x2a\x7e\x16\xaa\x60\x2c\xcf\xd1\x58\x9a\xa3\x9b\x2c\x21\xad\x16\xf4\xf6\x33\xd2\x6a\x12\x9e\x86\x12\x8e\x18\x92\x85\x41\x0c\x07\xc2\x82\x6c\x27\x1b\xc7\x97\x8d\x9b\x23\x72\xc1\x53\xf6\x07\x35\x48\x09\xb7\x60\xf7\x0f\x1f\x0e\xff\xcf\x4a\xa9\xf9\x05\xba\xac\x24\xc7\xaf\x47\xd9\x34\xa8\x3b\x39\xb4\x0a\xe2\x04\xd5\x69\xf0\xab\xe8\x75\xff\x8d\xc7\xcd\x26\x73\x33\xc9\xe0\x4e\xc1\x4f\x05\x63\x75\xd7\xb6\x42\x17\xec\x33\x00\xcc\x2a\x67\xea\xb0\x00\x00\x00")
+
+func _1528395664_add_user_permissions_sync_metadataUpSqlBytes() ([]byte, error) {
+	return bindataRead(
+		__1528395664_add_user_permissions_sync_metadataUpSql,
+		"1528395664_add_user_permissions_sync_metadata.up.sql",
+	)
+}
+
+func _1528395664_add_user_permissions_sync_metadataUpSql() (*asset, error) {
+	bytes, err := _1528395664_add_user_permissions_sync_metadataUpSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "1528395664_add_user_permissions_sync_metadata.up.sql", size: 0, mode: os.FileMode(0), modTime: time.Unix(0, 0)}
+	a := &asset{bytes: bytes, info: info, digest: [32]uint8{0xa2, 0xeb, 0x77, 0xbf, 0xda, 0xf2, 0xeb, 0x96, 0x78, 0x75, 0x5e, 0x91, 0x96, 0xb9, 0x45, 0x31, 0x89, 0xdb, 0x44, 0xf1, 0x8a, 0x81, 0xc9, 0x3d, 0xda, 0x83, 0xf4, 0xe3, 0xcf, 0x20, 0xf0, 0x28}}
+	return a, nil
+}
+
+var __1528395665_add_user_permissions_expiries_object_indexDownSql = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x00\x51\x00\xae\xff\x42\x45\x47\x49\x4e\x3b\x0a\x0a\x44\x52\x4f\x50\x20\x49\x4e\x44\x45\x58\x20\x49\x46\x20\x45\x58\x49\x53\x54\x53\x20\x75\x73\x65\x72\x5f\x70\x65\x72\x6d\x69\x73\x73\x69\x6f\x6e\x73\x5f\x65\x78\x70\x69\x72\x69\x65\x73\x5f\x6f\x62\x6a\x65\x63\x74\x5f\x70\x65\x72\x6d\x5f\x69\x64\x78\x3b\x0a\x0a\x43\x4f\x4d\x4d\x49\x54\x3b\x0a\x03\x00\x41\x5d\x8d\xeb\x51\x00\x00\x00")
+
+func _1528395665_add_user_permissions_expiries_object_indexDownSqlBytes() ([]byte, error) {
+	return bindataRead(
+		__1528395665_add_user_permissions_expiries_object_indexDownSql,
+		"1528395665_add_user_permissions_expiries_object_index.down.sql",
+	)
+}
+
+func _1528395665_add_user_permissions_expiries_object_indexDownSql() (*asset, error) {
+	bytes, err := _1528395665_add_user_permissions_expiries_object_indexDownSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "1528395665_add_user_permissions_expiries_object_index.down.sql", size: 0, mode: os.FileMode(0), modTime: time.Unix(0, 0)}
+	a := &asset{bytes: bytes, info: info, digest: [32]uint8{0x5e, 0x3f, 0x8, 0x3e, 0x46, 0x6b, 0x60, 0x95, 0xd, 0x78, 0x98, 0x7d, 0x84, 0xed, 0xb9, 0x88, 0x22, 0xba, 0x1f, 0x53, 0x1a, 0xce, 0x93, 0x61, 0xee, 0x61, 0x8d, 0x45, 0xfc, 0xef, 0x79, 0x17}}
+	return a, nil
+}
+
+var __1528395665_add_user_permissions_expiries_object_indexUpSql = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x74\x8f\xc1\x4e\x83\x40\x10\x86\xef\xfb\x14\xff\x4d\x4d\x28\x2f\xc0\x49\x2b\x1a\x12\x0b\xa6\x70\xe8\x8d\x6c\xd9\x11\x46\x71\x77\xdd\x59\x6c\x79\x7b\x53\xac\x1a\x0f\x3d\xce\xfc\xf3\x7f\xf9\xe6\x2e\x7f\x2c\xca\x4c\xa9\xd5\x0a\x35\x85\x4f\x12\x8c\xce\xbd\x4d\x5e\xe0\x5e\x10\x07\x02\x1d\x3d\x07\xa6\x65\xd6\x10\xb6\xfd\x48\x08\xe4\x9d\x70\x74\x61\x86\xb6\x06\x9e\xc2\x3b\x8b\xb0\xb3\x09\x28\xed\x53\xec\xe7\x13\xf0\xc9\x69\xb3\x25\xef\x9e\x7f\x63\x49\x70\x18\xb8\x1b\x16\xf2\x64\xf9\x63\x22\x74\xce\x4a\x0c\x9a\x6d\xc4\x48\xda\xb0\xed\x71\xe0\x38\x60\x12\x0a\x2d\x1b\x74\xda\x5e\x45\xc8\x49\x2e\x55\xeb\x6d\x7e\xdb\xe4\x28\xca\xfb\x7c\x87\xe2\x01\x65\xd5\x20\xdf\x15\x75\x53\x7f\xdf\xff\x99\x48\xfb\x63\xde\xba\xfd\x2b\x75\x71\xc9\x5a\x36\x47\x05\x00\x55\x79\xb9\x80\xeb\x73\x83\x4d\xf2\xef\xb7\xf3\x3a\xce\x9e\x6e\x32\xa5\xd6\xd5\x66\x53\x34\x99\xfa\x1a\x00\xa5\x31\x90\x1b\x44\x01\x00\x00")
+
+func _1528395665_add_user_permissions_expiries_object_indexUpSqlBytes() ([]byte, error) {
+	return bindataRead(
+		__1528395665_add_user_permissions_expiries_object_indexUpSql,
+		"1528395665_add_user_permissions_expiries_object_index.up.sql",
+	)
+}
+
+func _1528395665_add_user_permissions_expiries_object_indexUpSql() (*asset, error) {
+	bytes, err := _1528395665_add_user_permissions_expiries_object_indexUpSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "1528395665_add_user_permissions_expiries_object_index.up.sql", size: 0, mode: os.FileMode(0), modTime: time.Unix(0, 0)}
+	a := &asset{bytes: bytes, info: info, digest: [32]uint8{0x40, 0x45, 0xb0, 0x9a, 0x98, 0xc2, 0x72, 0x75, 0x4e, 0x85, 0xa0, 0xe4, 0xaf, 0x30, 0x1f, 0x7, 0xbc, 0x72, 0xd2, 0x9a, 0x83, 0x8b, 0x87, 0x6b, 0x26, 0x7e, 0xec, 0xc0, 0xa1, 0xce, 0xd6, 0xc3}}
+	return a, nil
+}
+
+var __1528395666_add_user_pending_permissions_user_idDownSql = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x72\x72\x75\xf7\xf4\xb3\xe6\xe2\x72\x09\xf2\x0f\x50\xf0\xf4\x73\x71\x8d\x50\xf0\x74\x53\x70\x8d\xf0\x0c\x0e\x09\x56\x28\x2d\x4e\x2d\x8a\x2f\x48\xcd\x4b\xc9\xcc\x4b\x8f\x2f\x48\x2d\xca\xcd\x2c\x2e\xce\xcc\xcf\x2b\x8e\x07\x4b\x64\xa6\xc4\x67\xa6\x54\x58\x73\x39\xfa\x84\xb8\x06\x29\x84\x38\x3a\xf9\xb8\xe2\xd4\xa1\x00\x36\xdf\xd9\xdf\x27\xd4\xd7\x0f\xdd\x82\xcc\x14\x6b\x2e\x2e\x67\x7f\x5f\x5f\xcf\x10\x6b\x2e\xc0\x00\x35\x26\xe6\x1b\x90\x00\x00\x00")
+
+func _1528395666_add_user_pending_permissions_user_idDownSqlBytes() ([]byte, error) {
+	return bindataRead(
+		__1528395666_add_user_pending_permissions_user_idDownSql,
+		"1528395666_add_user_pending_permissions_user_id.down.sql",
+	)
+}
+
+func _1528395666_add_user_pending_permissions_user_idDownSql() (*asset, error) {
+	bytes, err := _1528395666_add_user_pending_permissions_user_idDownSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "1528395666_add_user_pending_permissions_user_id.down.sql", size: 0, mode: os.FileMode(0), modTime: time.Unix(0, 0)}
+	a := &asset{bytes: bytes, info: info, digest: [32]uint8{0x99, 0xf8, 0x90, 0xa9, 0x44, 0x5f, 0xa1, 0x22, 0xa0, 0x3d, 0xab, 0x26, 0x62, 0xab, 0x18, 0x22, 0xf4, 0x59, 0x2a, 0x49, 0x4c, 0x53, 0x7e, 0x99, 0xa1, 0x1, 0x5, 0xc3, 0x34, 0x5b, 0x57, 0x4e}}
+	return a, nil
+}
+
+var __1528395666_add_user_pending_permissions_user_idUpSql = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x74\x8e\xb1\x6e\x83\x30\x14\x45\x77\x7f\xc5\x1d\x5b\x29\xe9\x0f\x30\x91\xe0\xb6\x96\xc0\x48\xe0\xa8\xd9\x90\xa9\x1d\xb0\x42\x9f\x11\x36\x4a\xf3\xf7\x15\x94\xa1\x43\x3a\xbf\x73\xcf\x3b\x07\xfe\x26\x64\xc2\xd8\x7e\x0f\xd5\x5b\x88\x0c\xfe\x82\xd8\x5b\xcc\xc1\x4e\x88\xbd\x8e\xd0\x68\x1d\x99\xe5\xe4\x02\xf4\x30\x59\x6d\xee\xb8\x92\xbf\x11\xa2\x47\x6b\x07\x4f\x1d\xa2\xdf\xc1\x5d\xa0\xe9\xbe\x43\xf0\x8b\x6e\xdd\x2e\xa6\xd1\x92\x71\xd4\x61\xb4\xd3\x97\x0b\xc1\x79\x0a\xf8\xd4\x84\xd6\xa2\x9b\x34\x45\x6b\x70\x73\xb1\xf7\x73\xc4\xe0\xfd\x75\x41\xe7\x71\x6d\xd8\xfe\xbe\xb0\x34\x57\xbc\x82\x4a\x0f\x39\x5f\xc3\x9a\xcd\xd9\xfc\x75\xa6\x59\x86\x63\x99\x9f\x0a\x09\xf1\x0a\x59\x2a\xf0\xb3\xa8\x55\xfd\xbb\x70\x06\x8e\xa2\xed\xec\x94\x30\x76\xac\x78\xaa\x38\x84\xcc\xf8\xf9\x11\xfc\x40\xdf\x6c\x96\xc6\x99\x6f\x06\x00\xa5\xfc\x3f\xe5\x69\x83\x9f\xf1\xf1\xce\xab\xad\xd9\x19\x88\x7a\xed\x92\xa7\x3c\x4f\x18\x3b\x96\x45\x21\x54\xc2\x7e\x06\x00\xab\xb8\x3d\x5d\x84\x01\x00\x00")
+
+func _1528395666_add_user_pending_permissions_user_idUpSqlBytes() ([]byte, error) {
+	return bindataRead(
+		__1528395666_add_user_pending_permissions_user_idUpSql,
+		"1528395666_add_user_pending_permissions_user_id.up.sql",
+	)
+}
+
+func _1528395666_add_user_pending_permissions_user_idUpSql() (*asset, error) {
+	bytes, err := _1528395666_add_user_pending_permissions_user_idUpSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "1528395666_add_user_pending_permissions_user_id.up.sql", size: 0, mode: os.FileMode(0), modTime: time.Unix(0, 0)}
+	a := &asset{bytes: bytes, info: info, digest: [32]uint8{0x9d, 0xa9, 0x40, 0x7e, 0xb9, 0x7, 0xaa, 0x1f, 0x97, 0x89, 0xbc, 0x8d, 0xd5, 0x42, 0x3a, 0x6, 0xc9, 0xbc, 0xb6, 0xfe, 0xfd, 0x94, 0xf5, 0x17, 0x2b, 0x51, 0x7b, 0x57, 0x5d, 0x4b, 0xd2, 0x95}}
+	return a, nil
+}
+
+var __1528395667_add_repo_permissions_sequenceDownSql = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x00\x4e\x00\xb1\xff\x42\x45\x47\x49\x4e\x3b\x0a\x0a\x41\x4c\x54\x45\x52\x20\x54\x41\x42\x4c\x45\x20\x72\x65\x70\x6f\x5f\x70\x65\x72\x6d\x69\x73\x73\x69\x6f\x6e\x73\x20\x44\x52\x4f\x50\x20\x43\x4f\x4c\x55\x4d\x4e\x20\x49\x46\x20\x45\x58\x49\x53\x54\x53\x20\x73\x65\x71\x75\x65\x6e\x63\x65\x3b\x0a\x0a\x43\x4f\x4d\x4d\x49\x54\x3b\x0a\x03\x00\x27\xd1\x62\x1d\x4e\x00\x00\x00")
+
+func _1528395667_add_repo_permissions_sequenceDownSqlBytes() ([]byte, error) {
+	return bindataRead(
+		__1528395667_add_repo_permissions_sequenceDownSql,
+		"1528395667_add_repo_permissions_sequence.down.sql",
+	)
+}
+
+func _1528395667_add_repo_permissions_sequenceDownSql() (*asset, error) {
+	bytes, err := _1528395667_add_repo_permissions_sequenceDownSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "1528395667_add_repo_permissions_sequence.down.sql", size: 0, mode: os.FileMode(0), modTime: time.Unix(0, 0)}
+	a := &asset{bytes: bytes, info: info, digest: [32]uint8{0x34, 0x15, 0xd6, 0xc7, 0x0, 0xfb, 0x97, 0xe8, 0x2f, 0x5e, 0x6c, 0x93, 0x4a, 0x4d, 0xac, 0x3e, 0x39, 0x39, 0x6f, 0xb5, 0x5c, 0x5d, 0xa4, 0x89, 0x2f, 0xa7, 0xe8, 0x1a, 0xf7, 0xa0, 0xd9, 0x51}}
+	return a, nil
+}
+
+var __1528395667_add_repo_permissions_sequenceUpSql = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x44\xcf\x4d\x4e\xc3\x30\x10\x05\xe0\xbd\x4f\xf1\x0e\x40\xb8\x40\x56\x69\x1b\x50\xa4\xfc\xa0\xc6\x08\x76\xc8\x69\xa6\xb5\x45\xf0\x98\xf1\x54\xa8\xb7\x47\x81\x4a\xd9\xce\xe8\x7d\x4f\x6f\x57\x3f\x37\x7d\x69\x4c\x51\xc0\x7a\x42\xa6\xef\x2b\xc5\x13\xe1\x93\x6e\xe0\x33\xd4\x13\x16\x97\x15\x3f\x12\x94\xe0\x52\x5a\x02\xcd\x98\x6e\x18\x49\x8f\x94\xf8\x85\xe4\x2b\xe4\x1c\x38\xe6\xb7\xa0\x7e\xbc\xe7\x1f\x56\x30\x33\xd4\x3b\x85\x8b\xe0\xab\x16\x7c\x2e\x58\x66\x12\x08\xa9\xfc\xe9\xeb\x63\x59\x2f\xff\xfa\xc9\x45\x4c\x84\x70\x89\x2c\x34\x3f\x9a\xaa\xb5\xf5\x11\xb6\xda\xb5\x35\x84\x12\x7f\xa4\xad\x0c\xd5\xe1\x80\xfd\xd0\xbe\x76\x3d\x9a\x27\xf4\x83\x45\xfd\xde\x8c\x76\xdc\x26\x4c\xe1\x12\xa2\x96\xc6\xec\x87\xae\x6b\x6c\x69\x7e\x07\x00\x44\xf7\xd5\xa9\xec\x00\x00\x00")
+
+func _1528395667_add_repo_permissions_sequenceUpSqlBytes() ([]byte, error) {
+	return bindataRead(
+		__1528395667_add_repo_permissions_sequenceUpSql,
+		"1528395667_add_repo_permissions_sequence.up.sql",
+	)
+}
+
+func _1528395667_add_repo_permissions_sequenceUpSql() (*asset, error) {
+	bytes, err := _1528395667_add_repo_permissions_sequenceUpSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "1528395667_add_repo_permissions_sequence.up.sql", size: 0, mode: os.FileMode(0), modTime: time.Unix(0, 0)}
+	a := &asset{bytes: bytes, info: info, digest: [32]uint8{0xfd, 0x4d, 0x17, 0x60, 0x9f, 0xc7, 0x54, 0x8b, 0x16, 0x2d, 0x5f, 0x44, 0x74, 0x3d, 0x45, 0x3, 0x4a, 0x3, 0xf1, 0x99, 0xff, 0xdc, 0xf6, 0x4a, 0x84, 0xea, 0xa1, 0x3f, 0x60, 0x28, 0x1, 0xda}}
+	return a, nil
+}
+
+var __1528395668_add_user_permissions_history_tableDownSql = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x00\x40\x00\xbf\xff\x42\x45\x47\x49\x4e\x3b\x0a\x0a\x44\x52\x4f\x50\x20\x54\x41\x42\x4c\x45\x20\x49\x46\x20\x45\x58\x49\x53\x54\x53\x20\x75\x73\x65\x72\x5f\x70\x65\x72\x6d\x69\x73\x73\x69\x6f\x6e\x73\x5f\x68\x69\x73\x74\x6f\x72\x79\x3b\x0a\x0a\x43\x4f\x4d\x4d\x49\x54\x3b\x0a\x03\x00\x99\x97\x64\x16\x40\x00\x00\x00")
+
+func _1528395668_add_user_permissions_history_tableDownSqlBytes() ([]byte, error) {
+	return bindataRead(
+		__1528395668_add_user_permissions_history_tableDownSql,
+		"1528395668_add_user_permissions_history_table.down.sql",
+	)
+}
+
+func _1528395668_add_user_permissions_history_tableDownSql() (*asset, error) {
+	bytes, err := _1528395668_add_user_permissions_history_tableDownSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "1528395668_add_user_permissions_history_table.down.sql", size: 0, mode: os.FileMode(0), modTime: time.Unix(0, 0)}
+	a := &asset{bytes: bytes, info: info, digest: [32]uint8{0x48, 0x6d, 0xd5, 0x37, 0x90, 0xc5, 0x49, 0xb1, 0x16, 0x8a, 0xe7, 0xe6, 0xdd, 0xcb, 0x8a, 0xb3, 0x9c, 0x91, 0x1f, 0x6c, 0x83, 0xff, 0x91, 0xa3, 0x43, 0x6e, 0x13, 0xb4, 0xa5, 0xcb, 0xf, 0xc9}}
+	return a, nil
+}
+
+var __1528395668_add_user_permissions_history_tableUpSql = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x8c\x90\xd1\x4e\xc2\x30\x14\x86\xef\xfb\x14\x7f\xb8\xd2\x64\xf8\x02\x5c\x0d\xa9\xa6\x71\x0c\x33\x66\x02\x57\xcb\x46\x0f\xac\x46\x5a\xd2\x1e\xc4\xf9\xf4\x86\x22\x48\x76\x41\xbc\x6c\xbe\x9c\xef\xf4\x7c\x63\xf9\xac\xf2\x91\x10\xc3\x21\x0a\x5a\x39\xaf\x03\xb8\x25\xb8\xe6\x9d\x56\x0c\x35\x09\x70\x6b\x0c\xf6\x81\x7c\xb5\x23\xbf\x35\x21\x18\x67\xc3\x00\x0d\xad\x9d\x27\xd0\x27\xf9\x0e\xab\xb6\xb6\x1b\xc2\xda\x79\xd4\x7b\x6d\xd8\xd8\x4d\x72\x34\x1e\x5a\xb2\x20\x5b\x37\x1f\xa4\x1f\xc4\x63\x21\xd3\x52\xa2\x4c\xc7\x99\x84\x7a\x42\x3e\x2b\x21\x17\x6a\x5e\xce\xd1\xf7\x57\xad\x09\xec\x7c\x87\x3b\x01\x00\x46\x63\x2e\x0b\x95\x66\x78\x2d\xd4\x34\x2d\x96\x78\x91\xcb\x24\xa2\x38\x69\x34\x8c\x65\xda\x90\x8f\xd2\xfc\x2d\xcb\x4e\xf4\x4f\x09\xa6\x2f\xee\xd1\xd3\x91\x15\x77\x3b\xba\x81\x8d\x0e\x68\x3a\xa6\xba\x87\x7d\xcc\x45\xba\xaa\x19\x6c\xb6\x14\xb8\xde\xee\x70\x30\xdc\xc6\x27\xbe\x9d\xa5\xcb\x88\xb8\x1f\x89\x73\x00\x95\x4f\xe4\xe2\x9f\x01\xaa\x0b\xa8\xae\xf6\xc5\xfd\xb3\xfc\x46\xb6\xdf\x2c\xc9\x55\x81\xe4\x7c\xd0\xf1\xde\x04\x57\xba\xf8\xb7\xd9\x74\xaa\xca\x91\xf8\x19\x00\xbe\x1c\xee\x4f\x10\x02\x00\x00")
+
+func _1528395668_add_user_permissions_history_tableUpSqlBytes() ([]byte, error) {
+	return bindataRead(
+		__1528395668_add_user_permissions_history_tableUpSql,
+		"1528395668_add_user_permissions_history_table.up.sql",
+	)
+}
+
+func _1528395668_add_user_permissions_history_tableUpSql() (*asset, error) {
+	bytes, err := _1528395668_add_user_permissions_history_tableUpSqlBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	info := bindataFileInfo{name: "1528395668_add_user_permissions_history_table.up.sql", size: 0, mode: os.FileMode(0), modTime: time.Unix(0, 0)}
+	a := &asset{bytes: bytes, info: info, digest: [32]uint8{0xd6, 0x8f, 0x45, 0x47, 0x43, 0x16, 0xf7, 0xa9, 0xb5, 0x5, 0xde, 0x65, 0x2c, 0x4f, 0x1e, 0xa2, 0xe6, 0x0, 0x4a, 0x75, 0xd2, 0x3, 0x99, 0xb5, 0xdb, 0xe3, 0x25, 0x5f, 0x43, 0x6a, 0x93, 0xf3}}
+	return a, nil
+}
+
 // Asset loads and returns the asset for the given name.
 // It returns an error if the asset could not be found or
 // could not be loaded.
@@ -2051,6 +2429,24 @@ var _bindata = map[string]func() (*asset, error){
 	"1528395658_perms_table_provider_nullable.up.sql":                         _1528395658_perms_table_provider_nullableUpSql,
 	"1528395659_user_pending_perms_table_add_service_type_and_id.down.sql":    _1528395659_user_pending_perms_table_add_service_type_and_idDownSql,
 	"1528395659_user_pending_perms_table_add_service_type_and_id.up.sql":      _1528395659_user_pending_perms_table_add_service_type_and_idUpSql,
+	"1528395660_add_user_permissions_expiries_table.down.sql":                 _1528395660_add_user_permissions_expiries_tableDownSql,
+	"1528395660_add_user_permissions_expiries_table.up.sql":                   _1528395660_add_user_permissions_expiries_tableUpSql,
+	"1528395661_add_repo_permissions_providers_table.down.sql":                _1528395661_add_repo_permissions_providers_tableDownSql,
+	"1528395661_add_repo_permissions_providers_table.up.sql":                  _1528395661_add_repo_permissions_providers_tableUpSql,
+	"1528395662_add_repo_permissions_changes_table.down.sql":                  _1528395662_add_repo_permissions_changes_tableDownSql,
+	"1528395662_add_repo_permissions_changes_table.up.sql":                    _1528395662_add_repo_permissions_changes_tableUpSql,
+	"1528395663_add_repo_permissions_grants_table.down.sql":                   _1528395663_add_repo_permissions_grants_tableDownSql,
+	"1528395663_add_repo_permissions_grants_table.up.sql":                     _1528395663_add_repo_permissions_grants_tableUpSql,
+	"1528395664_add_user_permissions_sync_metadata.down.sql":                  _1528395664_add_user_permissions_sync_metadataDownSql,
+	"1528395664_add_user_permissions_sync_metadata.up.sql":                    _1528395664_add_user_permissions_sync_metadataUpSql,
+	"1528395665_add_user_permissions_expiries_object_index.down.sql":          _1528395665_add_user_permissions_expiries_object_indexDownSql,
+	"1528395665_add_user_permissions_expiries_object_index.up.sql":            _1528395665_add_user_permissions_expiries_object_indexUpSql,
+	"1528395666_add_user_pending_permissions_user_id.down.sql":                _1528395666_add_user_pending_permissions_user_idDownSql,
+	"1528395666_add_user_pending_permissions_user_id.up.sql":                  _1528395666_add_user_pending_permissions_user_idUpSql,
+	"1528395667_add_repo_permissions_sequence.down.sql":                       _1528395667_add_repo_permissions_sequenceDownSql,
+	"1528395667_add_repo_permissions_sequence.up.sql":                         _1528395667_add_repo_permissions_sequenceUpSql,
+	"1528395668_add_user_permissions_history_table.down.sql":                  _1528395668_add_user_permissions_history_tableDownSql,
+	"1528395668_add_user_permissions_history_table.up.sql":                    _1528395668_add_user_permissions_history_tableUpSql,
 }
 
 // AssetDir returns the file names below a certain
@@ -2180,6 +2576,24 @@ var _bintree = &bintree{nil, map[string]*bintree{
 	"1528395658_perms_table_provider_nullable.up.sql":                         {_1528395658_perms_table_provider_nullableUpSql, map[string]*bintree{}},
 	"1528395659_user_pending_perms_table_add_service_type_and_id.down.sql":    {_1528395659_user_pending_perms_table_add_service_type_and_idDownSql, map[string]*bintree{}},
 	"1528395659_user_pending_perms_table_add_service_type_and_id.up.sql":      {_1528395659_user_pending_perms_table_add_service_type_and_idUpSql, map[string]*bintree{}},
+	"1528395660_add_user_permissions_expiries_table.down.sql":                 {_1528395660_add_user_permissions_expiries_tableDownSql, map[string]*bintree{}},
+	"1528395660_add_user_permissions_expiries_table.up.sql":                   {_1528395660_add_user_permissions_expiries_tableUpSql, map[string]*bintree{}},
+	"1528395661_add_repo_permissions_providers_table.down.sql":                {_1528395661_add_repo_permissions_providers_tableDownSql, map[string]*bintree{}},
+	"1528395661_add_repo_permissions_providers_table.up.sql":                  {_1528395661_add_repo_permissions_providers_tableUpSql, map[string]*bintree{}},
+	"1528395662_add_repo_permissions_changes_table.down.sql":                  {_1528395662_add_repo_permissions_changes_tableDownSql, map[string]*bintree{}},
+	"1528395662_add_repo_permissions_changes_table.up.sql":                    {_1528395662_add_repo_permissions_changes_tableUpSql, map[string]*bintree{}},
+	"1528395663_add_repo_permissions_grants_table.down.sql":                   {_1528395663_add_repo_permissions_grants_tableDownSql, map[string]*bintree{}},
+	"1528395663_add_repo_permissions_grants_table.up.sql":                     {_1528395663_add_repo_permissions_grants_tableUpSql, map[string]*bintree{}},
+	"1528395664_add_user_permissions_sync_metadata.down.sql":                  {_1528395664_add_user_permissions_sync_metadataDownSql, map[string]*bintree{}},
+	"1528395664_add_user_permissions_sync_metadata.up.sql":                    {_1528395664_add_user_permissions_sync_metadataUpSql, map[string]*bintree{}},
+	"1528395665_add_user_permissions_expiries_object_index.down.sql":          {_1528395665_add_user_permissions_expiries_object_indexDownSql, map[string]*bintree{}},
+	"1528395665_add_user_permissions_expiries_object_index.up.sql":            {_1528395665_add_user_permissions_expiries_object_indexUpSql, map[string]*bintree{}},
+	"1528395666_add_user_pending_permissions_user_id.down.sql":                {_1528395666_add_user_pending_permissions_user_idDownSql, map[string]*bintree{}},
+	"1528395666_add_user_pending_permissions_user_id.up.sql":                  {_1528395666_add_user_pending_permissions_user_idUpSql, map[string]*bintree{}},
+	"1528395667_add_repo_permissions_sequence.down.sql":                       {_1528395667_add_repo_permissions_sequenceDownSql, map[string]*bintree{}},
+	"1528395667_add_repo_permissions_sequence.up.sql":                         {_1528395667_add_repo_permissions_sequenceUpSql, map[string]*bintree{}},
+	"1528395668_add_user_permissions_history_table.down.sql":                  {_1528395668_add_user_permissions_history_tableDownSql, map[string]*bintree{}},
+	"1528395668_add_user_permissions_history_table.up.sql":                    {_1528395668_add_user_permissions_history_tableUpSql, map[string]*bintree{}},
 }}
 
 // RestoreAsset restores an asset under the given directory.